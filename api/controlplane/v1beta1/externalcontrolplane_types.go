@@ -2,10 +2,18 @@ package v1beta1
 
 import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 )
 
 // ExternalControlPlaneSpec defines the desired state of ExternalControlPlane.
 type ExternalControlPlaneSpec struct {
+	// Version is the Kubernetes version the cluster is expected to run. It is
+	// set by the topology controller for clusters with a managed topology.
+	// The version of an external cluster cannot be changed by CAPE; a
+	// difference with the version of the control plane is reported in the
+	// VersionMatched condition.
+	// +optional
+	Version string `json:"version,omitempty"`
 }
 
 // ExternalControlPlaneStatus defines the observed state of ExternalControlPlane.
@@ -15,6 +23,39 @@ type ExternalControlPlaneStatus struct {
 	// +optional
 	Version *string `json:"version,omitempty"`
 
+	// Replicas is the number of control plane nodes of the cluster.
+	// +optional
+	Replicas int32 `json:"replicas"`
+
+	// ReadyReplicas is the number of ready control plane nodes of the cluster.
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas"`
+
+	// Selector is the label selector of the control plane Machines, in string
+	// form, for the scale subresource.
+	// +optional
+	Selector string `json:"selector,omitempty"`
+
+	// ProviderManaged is true if the control plane is hidden from the nodes of
+	// the cluster, as with managed offerings like EKS, GKE and AKS.
+	// +optional
+	ProviderManaged bool `json:"providerManaged,omitempty"`
+
+	// Certificates are the serving certificate chain of the API server and
+	// the CA certificates in the kubeconfig, as of the last probe.
+	// +optional
+	Certificates []CertificateStatus `json:"certificates,omitempty"`
+
+	// LastCertificateCheckTime is the time of the last probe of the
+	// certificates.
+	// +optional
+	LastCertificateCheckTime *metav1.Time `json:"lastCertificateCheckTime,omitempty"`
+
+	// UpgradeReadiness is the report of the last check of the usage of APIs
+	// that are removed in the next minor Kubernetes version.
+	// +optional
+	UpgradeReadiness *UpgradeReadiness `json:"upgradeReadiness,omitempty"`
+
 	// Initialized denotes whether or not the control plane has the
 	// uploaded external-config configmap.
 	// +optional
@@ -39,6 +80,121 @@ type ExternalControlPlaneStatus struct {
 	// ObservedGeneration is the latest generation observed by the controller.
 	// +optional
 	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions defines current service state of the ExternalControlPlane.
+	// +optional
+	Conditions clusterv1.Conditions `json:"conditions,omitempty"`
+}
+
+const (
+	// CertificateSourceAPIServer is the source of the serving certificate
+	// chain of the API server.
+	CertificateSourceAPIServer = "APIServer"
+
+	// CertificateSourceKubeconfig is the source of the CA certificates in the
+	// kubeconfig of the cluster.
+	CertificateSourceKubeconfig = "Kubeconfig"
+)
+
+// CertificateStatus describes a certificate of the control plane.
+type CertificateStatus struct {
+	// Source is APIServer for the serving certificate chain of the API
+	// server, or Kubeconfig for the CA certificates in the kubeconfig.
+	Source string `json:"source"`
+
+	// Subject is the subject of the certificate.
+	Subject string `json:"subject"`
+
+	// Issuer is the issuer of the certificate.
+	// +optional
+	Issuer string `json:"issuer,omitempty"`
+
+	// NotAfter is the time at which the certificate expires.
+	NotAfter metav1.Time `json:"notAfter"`
+}
+
+// UpgradeReadiness reports whether the cluster uses APIs that are removed in
+// the next minor Kubernetes version.
+type UpgradeReadiness struct {
+	// Version is the version of the API server at the check.
+	Version string `json:"version"`
+
+	// TargetVersion is the next minor version of the API server, e.g. 1.25
+	// for v1.24.3.
+	TargetVersion string `json:"targetVersion"`
+
+	// Ready is true if no API that is removed in the target version was
+	// requested, and no object was written through one.
+	Ready bool `json:"ready"`
+
+	// DeprecatedAPIRequests are the deprecated APIs that were requested since
+	// the API server started, as reported by its
+	// apiserver_requested_deprecated_apis metric.
+	// +optional
+	DeprecatedAPIRequests []DeprecatedAPIRequest `json:"deprecatedAPIRequests,omitempty"`
+
+	// RemovedAPIObjects are the objects that were written through an API
+	// that is removed in the target version.
+	// +optional
+	RemovedAPIObjects []RemovedAPIObjects `json:"removedAPIObjects,omitempty"`
+
+	// Message explains which parts of the check failed, if any.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// LastCheckTime is the time of the check.
+	LastCheckTime metav1.Time `json:"lastCheckTime"`
+}
+
+// DeprecatedAPIRequest is a deprecated API that was requested.
+type DeprecatedAPIRequest struct {
+	// +optional
+	Group    string `json:"group,omitempty"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+
+	// +optional
+	Subresource string `json:"subresource,omitempty"`
+
+	// RemovedRelease is the Kubernetes version that removes the API, e.g.
+	// 1.25. It is empty if no removal is planned.
+	// +optional
+	RemovedRelease string `json:"removedRelease,omitempty"`
+}
+
+// RemovedAPIObjects are the objects of a resource that were written through
+// an API that is removed in the target version.
+type RemovedAPIObjects struct {
+	// +optional
+	Group    string `json:"group,omitempty"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+
+	// RemovedRelease is the Kubernetes version that removes the API.
+	RemovedRelease string `json:"removedRelease"`
+
+	// Replacement is the API version to migrate the objects to, e.g.
+	// networking.k8s.io/v1. It is empty if the resource is removed
+	// altogether.
+	// +optional
+	Replacement string `json:"replacement,omitempty"`
+
+	// Count is the number of objects.
+	Count int32 `json:"count"`
+
+	// Objects are the first objects, as <namespace>/<name> or <name>.
+	// +optional
+	Objects []string `json:"objects,omitempty"`
+}
+
+// GetConditions returns the set of conditions for this object.
+func (in *ExternalControlPlane) GetConditions() clusterv1.Conditions {
+	return in.Status.Conditions
+}
+
+// SetConditions sets the conditions on this object.
+func (in *ExternalControlPlane) SetConditions(conditions clusterv1.Conditions) {
+	in.Status.Conditions = conditions
 }
 
 // +kubebuilder:object:root=true
@@ -49,6 +205,9 @@ type ExternalControlPlaneStatus struct {
 // +kubebuilder:printcolumn:name="Cluster",type="string",JSONPath=".metadata.labels['cluster\\.x-k8s\\.io/cluster-name']",description="Cluster"
 // +kubebuilder:printcolumn:name="Initialized",type=boolean,JSONPath=".status.initialized",description="This denotes whether or not the control plane has the uploaded external-config configmap"
 // +kubebuilder:printcolumn:name="Available",type=boolean,JSONPath=".status.ready",description="ExternalControlPlane API Server is ready to receive requests"
+// +kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=".status.replicas",description="Number of control plane nodes"
+// +kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=".status.readyReplicas",description="Number of ready control plane nodes"
+// +kubebuilder:printcolumn:name="Provider-Managed",type=boolean,JSONPath=".status.providerManaged",description="The control plane is managed by the provider and not visible as nodes"
 // +kubebuilder:printcolumn:name="Version",type=string,JSONPath=".status.version",description="Kubernetes version associated with this control plane"
 
 // ExternalControlPlane is the Schema for the ExternalControlPlane API.
@@ -0,0 +1,54 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+)
+
+// ExternalControlPlaneTemplateSpec defines the desired state of ExternalControlPlaneTemplate.
+type ExternalControlPlaneTemplateSpec struct {
+	Template ExternalControlPlaneTemplateResource `json:"template"`
+}
+
+// ExternalControlPlaneTemplateResource describes the data needed to create an
+// ExternalControlPlane from a template.
+type ExternalControlPlaneTemplateResource struct {
+	// Standard object's metadata.
+	// +optional
+	ObjectMeta clusterv1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Spec is the spec of the ExternalControlPlanes created from the template.
+	// +optional
+	Spec ExternalControlPlaneTemplateResourceSpec `json:"spec,omitempty"`
+}
+
+// ExternalControlPlaneTemplateResourceSpec is the ExternalControlPlaneSpec
+// without the Version, which is set from the topology of the Cluster.
+type ExternalControlPlaneTemplateResourceSpec struct {
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=externalcontrolplanetemplates,scope=Namespaced,categories=cluster-api
+// +kubebuilder:storageversion
+
+// ExternalControlPlaneTemplate is the Schema for the ExternalControlPlaneTemplate API.
+// It is the control plane template of a ClusterClass for imported clusters.
+type ExternalControlPlaneTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ExternalControlPlaneTemplateSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ExternalControlPlaneTemplateList contains a list of ExternalControlPlaneTemplate.
+type ExternalControlPlaneTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ExternalControlPlaneTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ExternalControlPlaneTemplate{}, &ExternalControlPlaneTemplateList{})
+}
@@ -7,8 +7,40 @@ package v1beta1
 
 import (
 	runtime "k8s.io/apimachinery/pkg/runtime"
+	apiv1beta1 "sigs.k8s.io/cluster-api/api/v1beta1"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CertificateStatus) DeepCopyInto(out *CertificateStatus) {
+	*out = *in
+	in.NotAfter.DeepCopyInto(&out.NotAfter)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CertificateStatus.
+func (in *CertificateStatus) DeepCopy() *CertificateStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CertificateStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeprecatedAPIRequest) DeepCopyInto(out *DeprecatedAPIRequest) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeprecatedAPIRequest.
+func (in *DeprecatedAPIRequest) DeepCopy() *DeprecatedAPIRequest {
+	if in == nil {
+		return nil
+	}
+	out := new(DeprecatedAPIRequest)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ExternalControlPlane) DeepCopyInto(out *ExternalControlPlane) {
 	*out = *in
@@ -91,11 +123,34 @@ func (in *ExternalControlPlaneStatus) DeepCopyInto(out *ExternalControlPlaneStat
 		*out = new(string)
 		**out = **in
 	}
+	if in.Certificates != nil {
+		in, out := &in.Certificates, &out.Certificates
+		*out = make([]CertificateStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LastCertificateCheckTime != nil {
+		in, out := &in.LastCertificateCheckTime, &out.LastCertificateCheckTime
+		*out = (*in).DeepCopy()
+	}
+	if in.UpgradeReadiness != nil {
+		in, out := &in.UpgradeReadiness, &out.UpgradeReadiness
+		*out = new(UpgradeReadiness)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.FailureMessage != nil {
 		in, out := &in.FailureMessage, &out.FailureMessage
 		*out = new(string)
 		**out = **in
 	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make(apiv1beta1.Conditions, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalControlPlaneStatus.
@@ -107,3 +162,157 @@ func (in *ExternalControlPlaneStatus) DeepCopy() *ExternalControlPlaneStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalControlPlaneTemplate) DeepCopyInto(out *ExternalControlPlaneTemplate) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalControlPlaneTemplate.
+func (in *ExternalControlPlaneTemplate) DeepCopy() *ExternalControlPlaneTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalControlPlaneTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ExternalControlPlaneTemplate) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalControlPlaneTemplateList) DeepCopyInto(out *ExternalControlPlaneTemplateList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ExternalControlPlaneTemplate, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalControlPlaneTemplateList.
+func (in *ExternalControlPlaneTemplateList) DeepCopy() *ExternalControlPlaneTemplateList {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalControlPlaneTemplateList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ExternalControlPlaneTemplateList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalControlPlaneTemplateResource) DeepCopyInto(out *ExternalControlPlaneTemplateResource) {
+	*out = *in
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalControlPlaneTemplateResource.
+func (in *ExternalControlPlaneTemplateResource) DeepCopy() *ExternalControlPlaneTemplateResource {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalControlPlaneTemplateResource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalControlPlaneTemplateResourceSpec) DeepCopyInto(out *ExternalControlPlaneTemplateResourceSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalControlPlaneTemplateResourceSpec.
+func (in *ExternalControlPlaneTemplateResourceSpec) DeepCopy() *ExternalControlPlaneTemplateResourceSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalControlPlaneTemplateResourceSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalControlPlaneTemplateSpec) DeepCopyInto(out *ExternalControlPlaneTemplateSpec) {
+	*out = *in
+	in.Template.DeepCopyInto(&out.Template)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalControlPlaneTemplateSpec.
+func (in *ExternalControlPlaneTemplateSpec) DeepCopy() *ExternalControlPlaneTemplateSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalControlPlaneTemplateSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RemovedAPIObjects) DeepCopyInto(out *RemovedAPIObjects) {
+	*out = *in
+	if in.Objects != nil {
+		in, out := &in.Objects, &out.Objects
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RemovedAPIObjects.
+func (in *RemovedAPIObjects) DeepCopy() *RemovedAPIObjects {
+	if in == nil {
+		return nil
+	}
+	out := new(RemovedAPIObjects)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpgradeReadiness) DeepCopyInto(out *UpgradeReadiness) {
+	*out = *in
+	if in.DeprecatedAPIRequests != nil {
+		in, out := &in.DeprecatedAPIRequests, &out.DeprecatedAPIRequests
+		*out = make([]DeprecatedAPIRequest, len(*in))
+		copy(*out, *in)
+	}
+	if in.RemovedAPIObjects != nil {
+		in, out := &in.RemovedAPIObjects, &out.RemovedAPIObjects
+		*out = make([]RemovedAPIObjects, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.LastCheckTime.DeepCopyInto(&out.LastCheckTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpgradeReadiness.
+func (in *UpgradeReadiness) DeepCopy() *UpgradeReadiness {
+	if in == nil {
+		return nil
+	}
+	out := new(UpgradeReadiness)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package v1beta1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 )
@@ -24,10 +25,105 @@ import (
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+const (
+	// KubeconfigProjectionAnnotation is an alternative to
+	// Spec.KubeconfigProjection.Namespaces. It contains a comma-separated list of
+	// namespaces to project the kubeconfig of the cluster into.
+	KubeconfigProjectionAnnotation = "externalcluster.infrastructure.cluster.x-k8s.io/kubeconfig-projection"
+
+	// AdoptedByAnnotation is set on the objects in an external cluster that
+	// were adopted by a ClusterResourceSet, to the <namespace>/<name> of the
+	// ClusterResourceSet. See Spec.AdoptExistingResources.
+	AdoptedByAnnotation = "externalcluster.infrastructure.cluster.x-k8s.io/adopted-by"
+)
+
 // ExternalClusterSpec defines the desired state of ExternalCluster
 type ExternalClusterSpec struct {
 	// +optional
 	ControlPlaneEndpoint clusterv1.APIEndpoint `json:"controlPlaneEndpoint"`
+
+	// KubeconfigProjection configures copies of the kubeconfig of this cluster
+	// in other namespaces, for example for use by Flux Kustomizations and
+	// HelmReleases.
+	// +optional
+	KubeconfigProjection *KubeconfigProjection `json:"kubeconfigProjection,omitempty"`
+
+	// Tunnel routes all requests to the cluster through the reverse tunnel
+	// opened by `cape agent` running in the cluster, for clusters whose API
+	// server cannot be reached from the management cluster. The agent
+	// authenticates with the token in the <cluster-name>-tunnel-token Secret.
+	// +optional
+	Tunnel bool `json:"tunnel,omitempty"`
+
+	// Proxy routes all requests to the cluster through an HTTP, HTTPS or
+	// SOCKS5 proxy, for clusters that are only reachable through an egress
+	// proxy. With Tunnel, the proxy is reached through the tunnel.
+	// +optional
+	Proxy *ProxySpec `json:"proxy,omitempty"`
+
+	// MachinePools groups the nodes of the cluster into read-only
+	// MachinePools by node pool, instead of creating a Machine for every node.
+	// +optional
+	MachinePools *MachinePoolsSpec `json:"machinePools,omitempty"`
+
+	// NodeLabelAllowlist are the node labels that are mirrored into the status
+	// of the ExternalMachines. An entry ending with * matches all labels with
+	// that prefix. Defaults to DefaultNodeLabelAllowlist.
+	// +optional
+	NodeLabelAllowlist []string `json:"nodeLabelAllowlist,omitempty"`
+
+	// AdoptExistingResources adopts the objects of the ClusterResourceSets
+	// matching the cluster that already exist in the cluster, for brownfield
+	// clusters that already run some of the addons. The existing objects are
+	// left unchanged and annotated with the ClusterResourceSet that adopted
+	// them. Resources whose objects all exist are recorded as applied in the
+	// ClusterResourceSetBinding of the cluster, so that the
+	// ClusterResourceSet does not apply them.
+	// +optional
+	AdoptExistingResources bool `json:"adoptExistingResources,omitempty"`
+}
+
+// ProxySpec configures the proxy of an external cluster.
+type ProxySpec struct {
+	// URL of the proxy, e.g. http://proxy.example.com:3128 or
+	// socks5://proxy.example.com:1080. The port defaults to 80 for http, 443
+	// for https and 1080 for socks5.
+	// +kubebuilder:validation:Pattern=`^(http|https|socks5)://`
+	URL string `json:"url"`
+
+	// CredentialsSecretRef references a Secret in the namespace of the
+	// ExternalCluster with the username and password keys to authenticate to
+	// the proxy with. The optional ca.crt key holds the CA to verify an HTTPS
+	// proxy with, instead of the system CAs.
+	// +optional
+	CredentialsSecretRef *corev1.LocalObjectReference `json:"credentialsSecretRef,omitempty"`
+}
+
+// MachinePoolsSpec configures how nodes are grouped into MachinePools.
+type MachinePoolsSpec struct {
+	// NodePoolLabels are the node labels whose value identifies the node pool
+	// of a node. The first label that is set on a node is used. Defaults to
+	// the node pool labels of EKS, GKE and AKS. Nodes without any of the
+	// labels are still synced as individual Machines.
+	// +optional
+	NodePoolLabels []string `json:"nodePoolLabels,omitempty"`
+}
+
+// KubeconfigProjection defines where copies of the kubeconfig of the cluster
+// should be created. The copies contain a sanitized kubeconfig with only the
+// current context and inlined credentials, under the keys "value" and
+// "value.yaml".
+type KubeconfigProjection struct {
+	// Namespaces to copy the kubeconfig into.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// SecretName is the name of the Secret created in each of the namespaces.
+	// Defaults to <cluster-name>-kubeconfig. Existing Secrets that are not
+	// projections of this cluster, such as the original kubeconfig Secret, are
+	// never overwritten.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
 }
 
 // ExternalClusterStatus defines the observed state of ExternalCluster
@@ -49,9 +145,79 @@ type ExternalClusterStatus struct {
 	// Conditions defines current service state of the NodeletControlPlane.
 	// +optional
 	Conditions clusterv1.Conditions `json:"conditions,omitempty"`
+
+	// Inventory contains a summary of what is running on the cluster.
+	// +optional
+	Inventory *ClusterInventory `json:"inventory,omitempty"`
+
+	// VersionSkew lists the nodes whose kubelet version violates the
+	// Kubernetes version skew policy with the API server.
+	// +optional
+	VersionSkew []NodeVersionSkew `json:"versionSkew,omitempty"`
 	// TODO FailureDomains
 }
 
+const (
+	// KubeletNewerThanAPIServer is the reason of a node whose kubelet is newer
+	// than the API server.
+	KubeletNewerThanAPIServer = "KubeletNewerThanAPIServer"
+
+	// KubeletTooOld is the reason of a node whose kubelet is more minor
+	// versions older than the API server than the skew policy allows.
+	KubeletTooOld = "KubeletTooOld"
+)
+
+// NodeVersionSkew is a node whose kubelet version violates the version skew
+// policy.
+type NodeVersionSkew struct {
+	// Node is the name of the node.
+	Node string `json:"node"`
+
+	// KubeletVersion is the version of the kubelet of the node.
+	KubeletVersion string `json:"kubeletVersion"`
+
+	// APIServerVersion is the version of the API server.
+	APIServerVersion string `json:"apiServerVersion"`
+
+	// Reason is KubeletNewerThanAPIServer or KubeletTooOld.
+	Reason string `json:"reason"`
+}
+
+// ClusterInventory is a bounded summary of the software and resources of an
+// external cluster.
+type ClusterInventory struct {
+	// Distribution is the detected Kubernetes distribution, such as EKS, GKE,
+	// AKS, k3s, RKE, RKE2 or PMK. It is Unknown if it could not be detected.
+	Distribution string `json:"distribution"`
+
+	// CNI is the detected container network plugin.
+	// +optional
+	CNI string `json:"cni,omitempty"`
+
+	// CSIDrivers lists the names of the CSI drivers installed in the cluster.
+	// +optional
+	CSIDrivers []string `json:"csiDrivers,omitempty"`
+
+	// CRDGroups lists the API groups served by the cluster that are not part
+	// of Kubernetes itself.
+	// +optional
+	CRDGroups []string `json:"crdGroups,omitempty"`
+
+	// NodeCount is the number of nodes in the cluster.
+	NodeCount int32 `json:"nodeCount"`
+
+	// NamespaceCount is the number of namespaces in the cluster.
+	NamespaceCount int32 `json:"namespaceCount"`
+
+	// Allocatable is the total allocatable CPU and memory of all nodes.
+	// +optional
+	Allocatable corev1.ResourceList `json:"allocatable,omitempty"`
+
+	// LastUpdated is the time at which the inventory was collected.
+	// +optional
+	LastUpdated *metav1.Time `json:"lastUpdated,omitempty"`
+}
+
 // GetConditions returns the set of conditions for this object.
 func (in *ExternalCluster) GetConditions() clusterv1.Conditions {
 	return in.Status.Conditions
@@ -67,6 +233,7 @@ func (in *ExternalCluster) SetConditions(conditions clusterv1.Conditions) {
 // +kubebuilder:printcolumn:name="Cluster",type="string",JSONPath=".metadata.labels.cluster\\.x-k8s\\.io/cluster-name",description="Cluster to which this ExternalCluster belongs"
 // +kubebuilder:printcolumn:name="Endpoint",type="string",JSONPath=".spec.controlPlaneEndpoint",description="API Endpoint"
 // +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.ready",description="Cluster infrastructure is ready for External instances"
+// +kubebuilder:printcolumn:name="Distribution",type="string",JSONPath=".status.inventory.distribution",description="Detected Kubernetes distribution"
 
 // ExternalCluster is the Schema for the externalclusters API
 type ExternalCluster struct {
@@ -0,0 +1,161 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+)
+
+// ExternalClusterDriftCheckSpec defines the desired state of ExternalClusterDriftCheck
+type ExternalClusterDriftCheckSpec struct {
+	// ClusterSelector selects the imported Clusters in the namespace of the
+	// ExternalClusterDriftCheck to check. An empty selector selects all of
+	// them.
+	// +optional
+	ClusterSelector metav1.LabelSelector `json:"clusterSelector,omitempty"`
+
+	// Objects are the objects to check in each cluster.
+	// +kubebuilder:validation:MinItems=1
+	Objects []DriftCheckObject `json:"objects"`
+
+	// Interval is the interval at which the clusters are checked.
+	// +kubebuilder:default="5m"
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+
+	// Reapply restores the desired state of drifted objects, and recreates
+	// the missing objects that are given as a manifest.
+	// +optional
+	Reapply bool `json:"reapply,omitempty"`
+}
+
+// DriftCheckObject is an object to check, given either by reference or as a
+// manifest.
+type DriftCheckObject struct {
+	// Ref references an object in the cluster. Its desired state is its
+	// state at the first check, which is stored in the
+	// <name>-drift-baselines ConfigMap next to the ExternalClusterDriftCheck.
+	// Remove the entry of the object from the ConfigMap to accept its current
+	// state.
+	// +optional
+	Ref *DriftCheckObjectReference `json:"ref,omitempty"`
+
+	// Manifest is the desired state of the object as YAML or JSON. Only the
+	// fields set in the manifest are compared, so that defaults and the
+	// status of the object do not count as drift.
+	// +optional
+	Manifest string `json:"manifest,omitempty"`
+}
+
+// DriftCheckObjectReference identifies an object in an external cluster.
+type DriftCheckObjectReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// Namespace of the object. Defaults to default for namespaced objects.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	Name string `json:"name"`
+}
+
+// ExternalClusterDriftCheckStatus defines the observed state of ExternalClusterDriftCheck
+type ExternalClusterDriftCheckStatus struct {
+	// LastCheckTime is the time of the last check.
+	// +optional
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+
+	// Clusters is the result of the last check for each selected cluster.
+	// +optional
+	Clusters []DriftCheckClusterStatus `json:"clusters,omitempty"`
+
+	// Conditions defines current service state of the ExternalClusterDriftCheck.
+	// +optional
+	Conditions clusterv1.Conditions `json:"conditions,omitempty"`
+}
+
+// DriftCheckClusterStatus is the result of the check of a single cluster.
+type DriftCheckClusterStatus struct {
+	// Name of the Cluster.
+	Name string `json:"name"`
+
+	// DriftedObjects are the objects that differ from their desired state.
+	// +optional
+	DriftedObjects []DriftedObject `json:"driftedObjects,omitempty"`
+
+	// Message explains why the cluster could not be checked.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// DriftedObject is an object that differs from its desired state.
+type DriftedObject struct {
+	DriftCheckObjectReference `json:",inline"`
+
+	// Missing is true if the object does not exist in the cluster.
+	// +optional
+	Missing bool `json:"missing,omitempty"`
+
+	// Fields are the paths of the drifted fields, e.g.
+	// .spec.template.spec.containers[0].image.
+	// +optional
+	Fields []string `json:"fields,omitempty"`
+
+	// Reapplied is true if the desired state of the object was restored.
+	// +optional
+	Reapplied bool `json:"reapplied,omitempty"`
+}
+
+// GetConditions returns the set of conditions for this object.
+func (in *ExternalClusterDriftCheck) GetConditions() clusterv1.Conditions {
+	return in.Status.Conditions
+}
+
+// SetConditions sets the conditions on this object.
+func (in *ExternalClusterDriftCheck) SetConditions(conditions clusterv1.Conditions) {
+	in.Status.Conditions = conditions
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type=='Ready')].status",description="Whether the last check succeeded"
+// +kubebuilder:printcolumn:name="In Sync",type="string",JSONPath=".status.conditions[?(@.type=='ObjectsInSync')].status",description="Whether no object drifted"
+// +kubebuilder:printcolumn:name="Last Check",type="date",JSONPath=".status.lastCheckTime",description="Time of the last check"
+
+// ExternalClusterDriftCheck periodically compares objects in imported clusters
+// with their desired state.
+type ExternalClusterDriftCheck struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ExternalClusterDriftCheckSpec   `json:"spec,omitempty"`
+	Status ExternalClusterDriftCheckStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ExternalClusterDriftCheckList contains a list of ExternalClusterDriftCheck
+type ExternalClusterDriftCheckList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ExternalClusterDriftCheck `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ExternalClusterDriftCheck{}, &ExternalClusterDriftCheckList{})
+}
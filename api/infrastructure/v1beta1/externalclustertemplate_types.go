@@ -0,0 +1,66 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+)
+
+// ExternalClusterTemplateSpec defines the desired state of ExternalClusterTemplate
+type ExternalClusterTemplateSpec struct {
+	Template ExternalClusterTemplateResource `json:"template"`
+}
+
+// ExternalClusterTemplateResource describes the data needed to create an
+// ExternalCluster from a template.
+type ExternalClusterTemplateResource struct {
+	// Standard object's metadata.
+	// +optional
+	ObjectMeta clusterv1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Spec is the spec of the ExternalClusters created from the template. The
+	// ControlPlaneEndpoint can be left empty; it is then taken from the
+	// kubeconfig of the cluster.
+	Spec ExternalClusterSpec `json:"spec"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=externalclustertemplates,scope=Namespaced,categories=cluster-api
+// +kubebuilder:storageversion
+
+// ExternalClusterTemplate is the Schema for the externalclustertemplates API.
+// It is the infrastructure template of a ClusterClass for imported clusters.
+type ExternalClusterTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ExternalClusterTemplateSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ExternalClusterTemplateList contains a list of ExternalClusterTemplate
+type ExternalClusterTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ExternalClusterTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ExternalClusterTemplate{}, &ExternalClusterTemplateList{})
+}
@@ -22,6 +22,16 @@ import (
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 )
 
+// DefaultNodeLabelAllowlist are the node labels that are mirrored into the
+// ExternalMachines if the ExternalCluster does not configure an allowlist.
+var DefaultNodeLabelAllowlist = []string{
+	"kubernetes.io/arch",
+	"kubernetes.io/os",
+	"node.kubernetes.io/instance-type",
+	"topology.kubernetes.io/region",
+	"topology.kubernetes.io/zone",
+}
+
 // ExternalMachineSpec defines the desired state of ExternalMachine
 type ExternalMachineSpec struct {
 	// ProviderID is the unique identifier as specified by the cloud provider.
@@ -40,6 +50,49 @@ type ExternalMachineStatus struct {
 
 	// Addresses contains the IP and/or DNS addresses of the CoxEdge instances.
 	Addresses []corev1.NodeAddress `json:"addresses,omitempty"`
+
+	// NodeLabels are the labels of the node that match the node label
+	// allowlist of the ExternalCluster.
+	// +optional
+	NodeLabels map[string]string `json:"nodeLabels,omitempty"`
+
+	// Taints are the taints of the node.
+	// +optional
+	Taints []corev1.Taint `json:"taints,omitempty"`
+
+	// Capacity is the total amount of resources of the node.
+	// +optional
+	Capacity corev1.ResourceList `json:"capacity,omitempty"`
+
+	// Allocatable is the amount of resources of the node that is available
+	// for scheduling.
+	// +optional
+	Allocatable corev1.ResourceList `json:"allocatable,omitempty"`
+
+	// NodeInfo describes the operating system and runtime of the node.
+	// +optional
+	NodeInfo *NodeInfo `json:"nodeInfo,omitempty"`
+}
+
+// NodeInfo is the subset of the system info of a node that describes its
+// hardware and software.
+type NodeInfo struct {
+	// OSImage is the OS image reported by the node, such as "Ubuntu 20.04.4 LTS".
+	// +optional
+	OSImage string `json:"osImage,omitempty"`
+
+	// ContainerRuntimeVersion is the container runtime reported by the node,
+	// such as "containerd://1.5.9".
+	// +optional
+	ContainerRuntimeVersion string `json:"containerRuntimeVersion,omitempty"`
+
+	// Architecture is the CPU architecture of the node, such as "amd64".
+	// +optional
+	Architecture string `json:"architecture,omitempty"`
+
+	// KernelVersion is the kernel version reported by the node.
+	// +optional
+	KernelVersion string `json:"kernelVersion,omitempty"`
 }
 
 // GetConditions returns the set of conditions for this object.
@@ -56,6 +109,8 @@ func (in *ExternalMachine) SetConditions(conditions clusterv1.Conditions) {
 // +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="Machine",type="string",JSONPath=".metadata.labels.cluster\\.x-k8s\\.io/cluster-name",description="Machine to which this ExternalMachine belongs"
 // +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.ready",description="Machine infrastructure is ready for External instances"
+// +kubebuilder:printcolumn:name="Arch",type="string",JSONPath=".status.nodeInfo.architecture",description="CPU architecture of the node"
+// +kubebuilder:printcolumn:name="OS Image",type="string",JSONPath=".status.nodeInfo.osImage",description="OS image of the node",priority=1
 
 // ExternalMachine is the Schema for the externalclusters API
 type ExternalMachine struct {
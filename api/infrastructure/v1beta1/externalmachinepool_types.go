@@ -0,0 +1,105 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+)
+
+const (
+	// NodePoolLabel is set on the MachinePools and ExternalMachinePools of an
+	// external cluster to the name of the node pool they represent.
+	NodePoolLabel = "externalcluster.infrastructure.cluster.x-k8s.io/node-pool"
+)
+
+// DefaultNodePoolLabels are the node labels of managed Kubernetes offerings
+// that identify the node pool of a node.
+var DefaultNodePoolLabels = []string{
+	"eks.amazonaws.com/nodegroup",
+	"cloud.google.com/gke-nodepool",
+	"kubernetes.azure.com/agentpool",
+	"agentpool",
+}
+
+// ExternalMachinePoolSpec defines the desired state of ExternalMachinePool
+type ExternalMachinePoolSpec struct {
+	// NodePool is the name of the node pool in the external cluster.
+	NodePool string `json:"nodePool"`
+
+	// ProviderIDList are the provider IDs of the nodes in the pool.
+	// +optional
+	ProviderIDList []string `json:"providerIDList,omitempty"`
+}
+
+// ExternalMachinePoolStatus defines the observed state of ExternalMachinePool
+type ExternalMachinePoolStatus struct {
+	// +optional
+	Ready bool `json:"ready"`
+
+	// Replicas is the number of nodes in the pool.
+	// +optional
+	Replicas int32 `json:"replicas"`
+
+	// ReadyReplicas is the number of ready nodes in the pool.
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas"`
+
+	// Conditions defines current service state of the ExternalMachinePool.
+	// +optional
+	Conditions clusterv1.Conditions `json:"conditions,omitempty"`
+}
+
+// GetConditions returns the set of conditions for this object.
+func (in *ExternalMachinePool) GetConditions() clusterv1.Conditions {
+	return in.Status.Conditions
+}
+
+// SetConditions sets the conditions on this object.
+func (in *ExternalMachinePool) SetConditions(conditions clusterv1.Conditions) {
+	in.Status.Conditions = conditions
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Cluster",type="string",JSONPath=".metadata.labels.cluster\\.x-k8s\\.io/cluster-name",description="Cluster to which this ExternalMachinePool belongs"
+// +kubebuilder:printcolumn:name="Node Pool",type="string",JSONPath=".spec.nodePool",description="Node pool in the external cluster"
+// +kubebuilder:printcolumn:name="Replicas",type="integer",JSONPath=".status.replicas",description="Number of nodes"
+// +kubebuilder:printcolumn:name="Ready",type="integer",JSONPath=".status.readyReplicas",description="Number of ready nodes"
+
+// ExternalMachinePool is a read-only view of a node pool of an external
+// cluster. It is the infrastructure of a MachinePool.
+type ExternalMachinePool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ExternalMachinePoolSpec   `json:"spec,omitempty"`
+	Status ExternalMachinePoolStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ExternalMachinePoolList contains a list of ExternalMachinePool
+type ExternalMachinePoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ExternalMachinePool `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ExternalMachinePool{}, &ExternalMachinePoolList{})
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+)
+
+const (
+	// QbertSourceLabel, QbertClusterUUIDLabel and QbertProjectIDLabel are set
+	// on the Clusters imported by a QbertSource.
+	QbertSourceLabel      = "externalcluster.infrastructure.cluster.x-k8s.io/qbert-source"
+	QbertClusterUUIDLabel = "externalcluster.infrastructure.cluster.x-k8s.io/qbert-cluster-uuid"
+	QbertProjectIDLabel   = "externalcluster.infrastructure.cluster.x-k8s.io/qbert-project-id"
+
+	// QbertDeletedAnnotation is set on imported Clusters that no longer exist
+	// in Qbert. It holds the time at which the deletion was noticed. The
+	// Clusters are not deleted automatically.
+	QbertDeletedAnnotation = "externalcluster.infrastructure.cluster.x-k8s.io/qbert-deleted"
+
+	// QbertTokenExpiryAnnotation is set on the kubeconfig Secrets of the
+	// Clusters imported with token authentication. It holds the expiry of the
+	// Keystone token in the kubeconfig, in RFC 3339 format.
+	QbertTokenExpiryAnnotation = "externalcluster.infrastructure.cluster.x-k8s.io/qbert-token-expiry"
+
+	QbertClusterImported = "Imported"
+	QbertClusterSkipped  = "Skipped"
+	QbertClusterFailed   = "Failed"
+	QbertClusterDeleted  = "Deleted"
+)
+
+// QbertSourceSpec defines the desired state of QbertSource
+type QbertSourceSpec struct {
+	// FQDN is the URL of the PMK deployment unit, e.g.
+	// https://example.platform9.net.
+	FQDN string `json:"fqdn"`
+
+	// Project is the Keystone project to import the clusters of.
+	// +kubebuilder:default=service
+	// +optional
+	Project string `json:"project,omitempty"`
+
+	// Region selects the Qbert endpoint from the Keystone service catalog.
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// CredentialsSecretRef references a Secret in the namespace of the
+	// QbertSource with either the keys username and password, or the key
+	// token.
+	CredentialsSecretRef corev1.LocalObjectReference `json:"credentialsSecretRef"`
+
+	// SyncInterval is the interval at which the clusters are synced.
+	// +kubebuilder:default="10m"
+	// +optional
+	SyncInterval *metav1.Duration `json:"syncInterval,omitempty"`
+
+	// ClusterClass imports the clusters with a managed topology of this
+	// ClusterClass instead of with their own ExternalCluster and
+	// ExternalControlPlane. The version of the topology is the version of
+	// the cluster at the time of the import.
+	// +optional
+	ClusterClass string `json:"clusterClass,omitempty"`
+
+	// Proxy is set on the ExternalClusters of the imported clusters, see
+	// ExternalClusterSpec. It also applies to the requests that the import
+	// makes to the clusters, but not to the requests to the deployment unit.
+	// It cannot be combined with ClusterClass, whose ExternalClusterTemplate
+	// sets the proxy instead.
+	// +optional
+	Proxy *ProxySpec `json:"proxy,omitempty"`
+}
+
+// QbertSourceStatus defines the observed state of QbertSource
+type QbertSourceStatus struct {
+	// LastSyncTime is the time of the last successful sync.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Clusters is the result of the last sync for each Qbert cluster.
+	// +optional
+	Clusters []QbertClusterStatus `json:"clusters,omitempty"`
+
+	// Conditions defines current service state of the QbertSource.
+	// +optional
+	Conditions clusterv1.Conditions `json:"conditions,omitempty"`
+}
+
+// QbertClusterStatus is the sync state of a single Qbert cluster.
+type QbertClusterStatus struct {
+	// Name of the cluster in Qbert and of the imported Cluster.
+	Name string `json:"name"`
+
+	// UUID of the cluster in Qbert.
+	UUID string `json:"uuid"`
+
+	// State is Imported, Skipped (no kubeconfig available yet), Failed or
+	// Deleted.
+	State string `json:"state"`
+
+	// Message explains why the cluster was skipped or could not be imported.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// GetConditions returns the set of conditions for this object.
+func (in *QbertSource) GetConditions() clusterv1.Conditions {
+	return in.Status.Conditions
+}
+
+// SetConditions sets the conditions on this object.
+func (in *QbertSource) SetConditions(conditions clusterv1.Conditions) {
+	in.Status.Conditions = conditions
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="FQDN",type="string",JSONPath=".spec.fqdn",description="PMK deployment unit"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type=='Ready')].status",description="Whether the last sync succeeded"
+// +kubebuilder:printcolumn:name="Last Sync",type="date",JSONPath=".status.lastSyncTime",description="Time of the last successful sync"
+
+// QbertSource periodically imports the clusters of a PMK deployment unit.
+type QbertSource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   QbertSourceSpec   `json:"spec,omitempty"`
+	Status QbertSourceStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// QbertSourceList contains a list of QbertSource
+type QbertSourceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []QbertSource `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&QbertSource{}, &QbertSourceList{})
+}
@@ -0,0 +1,342 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	addonsv1 "sigs.k8s.io/cluster-api/exp/addons/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	utilyaml "sigs.k8s.io/cluster-api/util/yaml"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	ClusterResourceSetsAdoptedCondition    clusterv1.ConditionType = "ClusterResourceSetsAdopted"
+	ClusterResourceSetAdoptionFailedReason                         = "ClusterResourceSetAdoptionFailed"
+)
+
+// +kubebuilder:rbac:groups=addons.cluster.x-k8s.io,resources=clusterresourcesets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=addons.cluster.x-k8s.io,resources=clusterresourcesetbindings,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+
+// appliedResource is a resource of a ClusterResourceSet whose objects all
+// exist in the external cluster.
+type appliedResource struct {
+	clusterResourceSet *addonsv1.ClusterResourceSet
+	resource           addonsv1.ResourceRef
+	hash               string
+}
+
+// reconcileClusterResourceSetAdoption adopts the existing objects of the
+// ClusterResourceSets of the cluster if Spec.AdoptExistingResources is set.
+// Failures are reported in the ClusterResourceSetsAdopted condition, but do
+// not fail the reconcile.
+func (r *ExternalClusterReconciler) reconcileClusterResourceSetAdoption(ctx context.Context, clusterScope *scope.ExternalClusterScope, clusterConfig *rest.Config) {
+	externalCluster := clusterScope.ExternalCluster
+	if !externalCluster.Spec.AdoptExistingResources {
+		conditions.Delete(externalCluster, ClusterResourceSetsAdoptedCondition)
+		return
+	}
+	adopted, err := r.adoptClusterResourceSets(ctx, clusterScope, clusterConfig)
+	if err != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "Failed to adopt the existing resources of the ClusterResourceSets")
+		conditions.MarkFalse(externalCluster, ClusterResourceSetsAdoptedCondition, ClusterResourceSetAdoptionFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
+		return
+	}
+	if adopted > 0 {
+		r.Recorder.Eventf(externalCluster, corev1.EventTypeNormal, "ResourcesAdopted", "Adopted %d existing object(s) of ClusterResourceSets", adopted)
+	}
+	conditions.MarkTrue(externalCluster, ClusterResourceSetsAdoptedCondition)
+}
+
+// adoptClusterResourceSets annotates the objects of the ClusterResourceSets
+// matching the cluster that already exist in the cluster, and records the
+// resources whose objects all exist as applied in the
+// ClusterResourceSetBinding. It returns the number of adopted objects.
+func (r *ExternalClusterReconciler) adoptClusterResourceSets(ctx context.Context, clusterScope *scope.ExternalClusterScope, clusterConfig *rest.Config) (int, error) {
+	cluster := clusterScope.Cluster
+	clusterResourceSets, err := r.matchingClusterResourceSets(ctx, cluster)
+	if err != nil || len(clusterResourceSets) == 0 {
+		return 0, err
+	}
+	binding := &addonsv1.ClusterResourceSetBinding{}
+	err = r.Client.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: cluster.Name}, binding)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return 0, errors.Wrap(err, "failed to get the ClusterResourceSetBinding")
+	}
+
+	remoteClient, err := client.New(clusterConfig, client.Options{})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create a client for the cluster")
+	}
+	adopted := 0
+	var applied []appliedResource
+	for _, clusterResourceSet := range clusterResourceSets {
+		resourceSetBinding := binding.GetOrCreateBinding(clusterResourceSet)
+		for _, resource := range clusterResourceSet.Spec.Resources {
+			if resourceSetBinding.IsApplied(resource) {
+				continue
+			}
+			data, err := r.clusterResourceSetData(ctx, cluster.Namespace, resource)
+			if apierrors.IsNotFound(err) {
+				// The ClusterResourceSet reports missing resources.
+				continue
+			}
+			if err != nil {
+				return adopted, err
+			}
+			objs, err := decodeClusterResourceSetData(data)
+			if err != nil {
+				return adopted, errors.Wrapf(err, "failed to decode %s %s", resource.Kind, resource.Name)
+			}
+			n, allExist, err := adoptObjects(ctx, remoteClient, clusterResourceSet, objs)
+			adopted += n
+			if err != nil {
+				return adopted, errors.Wrapf(err, "failed to adopt the objects of %s %s", resource.Kind, resource.Name)
+			}
+			if allExist {
+				applied = append(applied, appliedResource{clusterResourceSet: clusterResourceSet, resource: resource, hash: computeResourceHash(data)})
+			}
+		}
+	}
+	if len(applied) == 0 {
+		return adopted, nil
+	}
+	return adopted, r.markResourcesApplied(ctx, cluster, applied)
+}
+
+// matchingClusterResourceSets returns the ClusterResourceSets in the
+// namespace of the Cluster whose selector matches the Cluster. An empty
+// selector matches no Clusters, like in the ClusterResourceSet controller.
+func (r *ExternalClusterReconciler) matchingClusterResourceSets(ctx context.Context, cluster *clusterv1.Cluster) ([]*addonsv1.ClusterResourceSet, error) {
+	clusterResourceSetList := &addonsv1.ClusterResourceSetList{}
+	if err := r.Client.List(ctx, clusterResourceSetList, client.InNamespace(cluster.Namespace)); err != nil {
+		return nil, errors.Wrap(err, "failed to list ClusterResourceSets")
+	}
+	var clusterResourceSets []*addonsv1.ClusterResourceSet
+	for i := range clusterResourceSetList.Items {
+		clusterResourceSet := &clusterResourceSetList.Items[i]
+		if !clusterResourceSet.DeletionTimestamp.IsZero() {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(&clusterResourceSet.Spec.ClusterSelector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid cluster selector of ClusterResourceSet %s", clusterResourceSet.Name)
+		}
+		if selector.Empty() || !selector.Matches(labels.Set(cluster.Labels)) {
+			continue
+		}
+		clusterResourceSets = append(clusterResourceSets, clusterResourceSet)
+	}
+	return clusterResourceSets, nil
+}
+
+// clusterResourceSetData returns the values of a resource of a
+// ClusterResourceSet, sorted by key.
+func (r *ExternalClusterReconciler) clusterResourceSetData(ctx context.Context, namespace string, resource addonsv1.ResourceRef) ([][]byte, error) {
+	key := client.ObjectKey{Namespace: namespace, Name: resource.Name}
+	values := map[string][]byte{}
+	switch addonsv1.ClusterResourceSetResourceKind(resource.Kind) {
+	case addonsv1.ConfigMapClusterResourceSetResourceKind:
+		configMap := &corev1.ConfigMap{}
+		if err := r.Client.Get(ctx, key, configMap); err != nil {
+			return nil, err
+		}
+		for k, v := range configMap.Data {
+			values[k] = []byte(v)
+		}
+	case addonsv1.SecretClusterResourceSetResourceKind:
+		secret := &corev1.Secret{}
+		if err := r.Client.Get(ctx, key, secret); err != nil {
+			return nil, err
+		}
+		if secret.Type != addonsv1.ClusterResourceSetSecretType {
+			return nil, errors.Errorf("secret %s has type %q instead of %q", secret.Name, secret.Type, addonsv1.ClusterResourceSetSecretType)
+		}
+		values = secret.Data
+	default:
+		return nil, errors.Errorf("unsupported resource kind %q", resource.Kind)
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	data := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		data = append(data, values[k])
+	}
+	return data, nil
+}
+
+// decodeClusterResourceSetData decodes the objects in the values of a
+// resource, which are either YAML or JSON documents or JSON lists.
+func decodeClusterResourceSetData(data [][]byte) ([]unstructured.Unstructured, error) {
+	var objs []unstructured.Unstructured
+	for _, value := range data {
+		if bytes.HasPrefix(bytes.TrimSpace(value), []byte("[")) {
+			var list []map[string]interface{}
+			if err := json.Unmarshal(value, &list); err != nil {
+				return nil, err
+			}
+			for _, obj := range list {
+				objs = append(objs, unstructured.Unstructured{Object: obj})
+			}
+			continue
+		}
+		decoded, err := utilyaml.ToUnstructured(value)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, decoded...)
+	}
+	return objs, nil
+}
+
+// adoptObjects annotates the objects that exist in the external cluster with
+// the ClusterResourceSet, without changing them otherwise. It returns the
+// number of newly adopted objects and whether all objects exist.
+func adoptObjects(ctx context.Context, remoteClient client.Client, clusterResourceSet *addonsv1.ClusterResourceSet, objs []unstructured.Unstructured) (int, bool, error) {
+	adoptedBy := fmt.Sprintf("%s/%s", clusterResourceSet.Namespace, clusterResourceSet.Name)
+	adopted := 0
+	allExist := true
+	for i := range objs {
+		existing := &unstructured.Unstructured{}
+		existing.SetGroupVersionKind(objs[i].GroupVersionKind())
+		err := remoteClient.Get(ctx, client.ObjectKeyFromObject(&objs[i]), existing)
+		if apierrors.IsNotFound(err) {
+			allExist = false
+			continue
+		}
+		if err != nil {
+			return adopted, false, err
+		}
+		if _, ok := existing.GetAnnotations()[externalv1.AdoptedByAnnotation]; ok {
+			continue
+		}
+		patchBase := client.MergeFrom(existing.DeepCopy())
+		annotations := existing.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[externalv1.AdoptedByAnnotation] = adoptedBy
+		existing.SetAnnotations(annotations)
+		if err := remoteClient.Patch(ctx, existing, patchBase); err != nil {
+			return adopted, false, err
+		}
+		adopted++
+	}
+	return adopted, allExist, nil
+}
+
+// markResourcesApplied records the resources as applied in the
+// ClusterResourceSetBinding of the Cluster, which is created like the
+// ClusterResourceSet controller does if it does not exist yet.
+func (r *ExternalClusterReconciler) markResourcesApplied(ctx context.Context, cluster *clusterv1.Cluster, applied []appliedResource) error {
+	binding := &addonsv1.ClusterResourceSetBinding{}
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: cluster.Name}, binding)
+	if apierrors.IsNotFound(err) {
+		binding = &addonsv1.ClusterResourceSetBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      cluster.Name,
+				Namespace: cluster.Namespace,
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: clusterv1.GroupVersion.String(),
+						Kind:       "Cluster",
+						Name:       cluster.Name,
+						UID:        cluster.UID,
+					},
+					*metav1.NewControllerRef(applied[0].clusterResourceSet, addonsv1.GroupVersion.WithKind("ClusterResourceSet")),
+				},
+			},
+			Spec: addonsv1.ClusterResourceSetBindingSpec{Bindings: []*addonsv1.ResourceSetBinding{}},
+		}
+		if err := r.Client.Create(ctx, binding); err != nil {
+			return errors.Wrap(err, "failed to create the ClusterResourceSetBinding")
+		}
+	} else if err != nil {
+		return errors.Wrap(err, "failed to get the ClusterResourceSetBinding")
+	}
+
+	patchHelper, err := patch.NewHelper(binding, r.Client)
+	if err != nil {
+		return err
+	}
+	now := metav1.Now()
+	for _, a := range applied {
+		ownerRef := metav1.OwnerReference{
+			APIVersion: addonsv1.GroupVersion.String(),
+			Kind:       "ClusterResourceSet",
+			Name:       a.clusterResourceSet.Name,
+			UID:        a.clusterResourceSet.UID,
+		}
+		if !util.HasOwnerRef(binding.OwnerReferences, ownerRef) {
+			binding.OwnerReferences = append(binding.OwnerReferences, ownerRef)
+		}
+		binding.GetOrCreateBinding(a.clusterResourceSet).SetBinding(addonsv1.ResourceBinding{
+			ResourceRef:     a.resource,
+			Hash:            a.hash,
+			Applied:         true,
+			LastAppliedTime: &now,
+		})
+	}
+	if err := patchHelper.Patch(ctx, binding); err != nil {
+		return errors.Wrap(err, "failed to patch the ClusterResourceSetBinding")
+	}
+	return nil
+}
+
+// computeResourceHash computes the hash of the values of a resource like the
+// ClusterResourceSet controller does.
+func computeResourceHash(data [][]byte) string {
+	hash := sha256.New()
+	for _, value := range data {
+		_, _ = hash.Write(value)
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil))
+}
+
+// clusterResourceSetToExternalClusters maps a ClusterResourceSet to the
+// ExternalClusters of the Clusters it selects.
+func (r *ExternalClusterReconciler) clusterResourceSetToExternalClusters(o client.Object) []ctrl.Request {
+	clusterResourceSet, ok := o.(*addonsv1.ClusterResourceSet)
+	if !ok {
+		return nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(&clusterResourceSet.Spec.ClusterSelector)
+	if err != nil || selector.Empty() {
+		return nil
+	}
+	clusters := &clusterv1.ClusterList{}
+	if err := r.Client.List(context.TODO(), clusters, client.InNamespace(clusterResourceSet.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil
+	}
+	var requests []ctrl.Request
+	for _, cluster := range clusters.Items {
+		infraRef := cluster.Spec.InfrastructureRef
+		if infraRef == nil || infraRef.Kind != "ExternalCluster" {
+			continue
+		}
+		requests = append(requests, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: cluster.Namespace, Name: infraRef.Name}})
+	}
+	return requests
+}
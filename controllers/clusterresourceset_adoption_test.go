@@ -0,0 +1,249 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	addonsv1 "sigs.k8s.io/cluster-api/exp/addons/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newClusterResourceSetTest(g *WithT, objects ...client.Object) *ExternalClusterReconciler {
+	scheme := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	g.Expect(clusterv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(addonsv1.AddToScheme(scheme)).To(Succeed())
+	return &ExternalClusterReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		Scheme: scheme,
+	}
+}
+
+func clusterResourceSet(namespace, name string, selector metav1.LabelSelector, resources ...addonsv1.ResourceRef) *addonsv1.ClusterResourceSet {
+	return &addonsv1.ClusterResourceSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID("uid-" + name)},
+		Spec: addonsv1.ClusterResourceSetSpec{
+			ClusterSelector: selector,
+			Resources:       resources,
+		},
+	}
+}
+
+func TestMatchingClusterResourceSets(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	cni := metav1.LabelSelector{MatchLabels: map[string]string{"cni": "calico"}}
+	deleting := clusterResourceSet("default", "deleting", cni)
+	deleting.DeletionTimestamp = &metav1.Time{Time: metav1.Now().Time}
+	deleting.Finalizers = []string{addonsv1.ClusterResourceSetFinalizer}
+	r := newClusterResourceSetTest(g,
+		clusterResourceSet("default", "calico", cni),
+		clusterResourceSet("default", "calico-expression", metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "cni", Operator: metav1.LabelSelectorOpIn, Values: []string{"calico", "cilium"}},
+		}}),
+		clusterResourceSet("default", "cilium", metav1.LabelSelector{MatchLabels: map[string]string{"cni": "cilium"}}),
+		clusterResourceSet("default", "empty-selector", metav1.LabelSelector{}),
+		clusterResourceSet("other", "calico", cni),
+		deleting,
+	)
+	cluster := &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "workload", Labels: map[string]string{"cni": "calico"}}}
+
+	clusterResourceSets, err := r.matchingClusterResourceSets(ctx, cluster)
+	g.Expect(err).NotTo(HaveOccurred())
+	var names []string
+	for _, clusterResourceSet := range clusterResourceSets {
+		names = append(names, clusterResourceSet.Namespace+"/"+clusterResourceSet.Name)
+	}
+	g.Expect(names).To(ConsistOf("default/calico", "default/calico-expression"))
+
+	// A Cluster without labels is only selected by an empty selector, which
+	// selects no Clusters.
+	clusterResourceSets, err = r.matchingClusterResourceSets(ctx, &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unlabeled"}})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(clusterResourceSets).To(BeEmpty())
+
+	invalid := clusterResourceSet("invalid", "broken", metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+		{Key: "cni", Operator: "Like", Values: []string{"calico"}},
+	}})
+	r = newClusterResourceSetTest(g, invalid)
+	_, err = r.matchingClusterResourceSets(ctx, &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "invalid", Name: "workload"}})
+	g.Expect(err).To(MatchError(ContainSubstring("invalid cluster selector of ClusterResourceSet broken")))
+}
+
+func TestDecodeClusterResourceSetData(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []string
+		wantNames []string
+		wantErr   bool
+	}{
+		{
+			name: "yaml documents",
+			data: []string{`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: first
+  namespace: default
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: second
+`},
+			wantNames: []string{"ConfigMap default/first", "Namespace second"},
+		},
+		{
+			name:      "json object",
+			data:      []string{`{"apiVersion":"v1","kind":"ServiceAccount","metadata":{"name":"first","namespace":"kube-system"}}`},
+			wantNames: []string{"ServiceAccount kube-system/first"},
+		},
+		{
+			name: "json list",
+			data: []string{`
+[
+  {"apiVersion": "v1", "kind": "ServiceAccount", "metadata": {"name": "first", "namespace": "kube-system"}},
+  {"apiVersion": "rbac.authorization.k8s.io/v1", "kind": "ClusterRole", "metadata": {"name": "second"}}
+]`},
+			wantNames: []string{"ServiceAccount kube-system/first", "ClusterRole second"},
+		},
+		{
+			name: "values of all keys",
+			data: []string{
+				`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"first","namespace":"default"}}`,
+				`[{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"second","namespace":"default"}}]`,
+			},
+			wantNames: []string{"ConfigMap default/first", "ConfigMap default/second"},
+		},
+		{
+			name:    "invalid json list",
+			data:    []string{`[{"apiVersion": "v1",`},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			var data [][]byte
+			for _, value := range tt.data {
+				data = append(data, []byte(value))
+			}
+			objs, err := decodeClusterResourceSetData(data)
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			var names []string
+			for _, obj := range objs {
+				name := obj.GetKind() + " " + obj.GetName()
+				if obj.GetNamespace() != "" {
+					name = obj.GetKind() + " " + obj.GetNamespace() + "/" + obj.GetName()
+				}
+				names = append(names, name)
+			}
+			g.Expect(names).To(Equal(tt.wantNames))
+		})
+	}
+}
+
+// TestClusterResourceSetHash checks that the hash of a resource is the hash
+// that the ClusterResourceSet controller records: the sha256 of the values,
+// sorted by key, with the values of Secrets decoded.
+func TestClusterResourceSetHash(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	r := newClusterResourceSetTest(g,
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "addons"},
+			Data:       map[string]string{"b": "second", "a": "first"},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "addons"},
+			Type:       addonsv1.ClusterResourceSetSecretType,
+			Data:       map[string][]byte{"b": []byte("second"), "a": []byte("first")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "opaque"},
+			Data:       map[string][]byte{"a": []byte("first")},
+		},
+	)
+	// printf firstsecond | sha256sum
+	const want = "sha256:da83f63e1a473003712c18f5afc5a79044221943d1083c7c5a7ac7236d85e8d2"
+
+	data, err := r.clusterResourceSetData(ctx, "default", addonsv1.ResourceRef{Kind: "ConfigMap", Name: "addons"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(computeResourceHash(data)).To(Equal(want))
+	data, err = r.clusterResourceSetData(ctx, "default", addonsv1.ResourceRef{Kind: "Secret", Name: "addons"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(computeResourceHash(data)).To(Equal(want))
+
+	_, err = r.clusterResourceSetData(ctx, "default", addonsv1.ResourceRef{Kind: "Secret", Name: "opaque"})
+	g.Expect(err).To(MatchError(ContainSubstring(`has type "" instead of "addons.cluster.x-k8s.io/resource-set"`)))
+}
+
+func TestMarkResourcesApplied(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	cluster := &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "workload", UID: "uid-workload"}}
+	cni := clusterResourceSet("default", "cni", metav1.LabelSelector{}, addonsv1.ResourceRef{Kind: "ConfigMap", Name: "calico"})
+	csi := clusterResourceSet("default", "csi", metav1.LabelSelector{}, addonsv1.ResourceRef{Kind: "Secret", Name: "csi"})
+	r := newClusterResourceSetTest(g, cluster, cni, csi)
+	bindingKey := client.ObjectKey{Namespace: "default", Name: "workload"}
+
+	// The binding is created like the ClusterResourceSet controller does.
+	g.Expect(r.markResourcesApplied(ctx, cluster, []appliedResource{
+		{clusterResourceSet: cni, resource: cni.Spec.Resources[0], hash: "sha256:cni"},
+	})).To(Succeed())
+	binding := &addonsv1.ClusterResourceSetBinding{}
+	g.Expect(r.Get(ctx, bindingKey, binding)).To(Succeed())
+	g.Expect(binding.OwnerReferences).To(HaveLen(2))
+	g.Expect(binding.OwnerReferences[0].Kind).To(Equal("Cluster"))
+	g.Expect(binding.OwnerReferences[0].UID).To(Equal(cluster.UID))
+	g.Expect(binding.OwnerReferences[1].Kind).To(Equal("ClusterResourceSet"))
+	g.Expect(binding.OwnerReferences[1].Name).To(Equal("cni"))
+	g.Expect(binding.OwnerReferences[1].Controller).To(Equal(pointer.Bool(true)))
+	g.Expect(binding.Spec.Bindings).To(HaveLen(1))
+	g.Expect(binding.Spec.Bindings[0].ClusterResourceSetName).To(Equal("cni"))
+	g.Expect(binding.Spec.Bindings[0].Resources).To(HaveLen(1))
+	g.Expect(binding.Spec.Bindings[0].Resources[0].Applied).To(BeTrue())
+	g.Expect(binding.Spec.Bindings[0].Resources[0].Hash).To(Equal("sha256:cni"))
+	g.Expect(binding.Spec.Bindings[0].Resources[0].LastAppliedTime).NotTo(BeNil())
+	g.Expect(binding.GetOrCreateBinding(cni).IsApplied(cni.Spec.Resources[0])).To(BeTrue())
+
+	// An existing binding keeps its bindings, and gains the owner reference
+	// of the other ClusterResourceSet.
+	g.Expect(r.markResourcesApplied(ctx, cluster, []appliedResource{
+		{clusterResourceSet: csi, resource: csi.Spec.Resources[0], hash: "sha256:csi"},
+	})).To(Succeed())
+	binding = &addonsv1.ClusterResourceSetBinding{}
+	g.Expect(r.Get(ctx, bindingKey, binding)).To(Succeed())
+	g.Expect(binding.OwnerReferences).To(HaveLen(3))
+	g.Expect(binding.OwnerReferences[2].Name).To(Equal("csi"))
+	g.Expect(binding.OwnerReferences[2].Controller).To(BeNil())
+	g.Expect(binding.Spec.Bindings).To(HaveLen(2))
+	g.Expect(binding.GetOrCreateBinding(cni).IsApplied(cni.Spec.Resources[0])).To(BeTrue())
+	g.Expect(binding.GetOrCreateBinding(csi).IsApplied(csi.Spec.Resources[0])).To(BeTrue())
+
+	// Marking a resource again updates its hash without duplicating it.
+	g.Expect(r.markResourcesApplied(ctx, cluster, []appliedResource{
+		{clusterResourceSet: cni, resource: cni.Spec.Resources[0], hash: "sha256:cni-v2"},
+	})).To(Succeed())
+	binding = &addonsv1.ClusterResourceSetBinding{}
+	g.Expect(r.Get(ctx, bindingKey, binding)).To(Succeed())
+	g.Expect(binding.OwnerReferences).To(HaveLen(3))
+	resources := binding.GetOrCreateBinding(cni).Resources
+	g.Expect(resources).To(HaveLen(1))
+	g.Expect(resources[0].Hash).To(Equal("sha256:cni-v2"))
+}
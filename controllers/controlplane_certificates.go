@@ -0,0 +1,211 @@
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/metrics"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/remote"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// CertificatesValidCondition is false if a certificate of the control
+	// plane expires within the CertificateExpiryWarning threshold of the
+	// ExternalControlPlaneReconciler. Its severity is Error within the
+	// CertificateExpiryCritical threshold.
+	CertificatesValidCondition   clusterv1.ConditionType = "CertificatesValid"
+	CertificateExpiringReason                            = "CertificateExpiring"
+	CertificateProbeFailedReason                         = "CertificateProbeFailed"
+
+	DefaultCertificateExpiryWarning  = 30 * 24 * time.Hour
+	DefaultCertificateExpiryCritical = 7 * 24 * time.Hour
+
+	// certificateCheckInterval is the interval at which the certificates are
+	// probed.
+	certificateCheckInterval = time.Hour
+	certificateProbeTimeout  = 10 * time.Second
+)
+
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+
+// reconcileCertificates probes the serving certificate chain of the API server
+// and the CA certificates in the kubeconfig, and reports their expiry in the
+// status of the ExternalControlPlane. Failures are reported in the
+// CertificatesValid condition, but do not fail the reconcile.
+func (r *ExternalControlPlaneReconciler) reconcileCertificates(ctx context.Context, clusterScope *scope.ControlPlaneScope, externalCluster *externalinfrav1.ExternalCluster) {
+	log := ctrl.LoggerFrom(ctx)
+	externalControlPlane := clusterScope.ExternalControlPlane
+	clusterKey := types.NamespacedName{Namespace: clusterScope.Namespace(), Name: clusterScope.Name()}
+
+	certificates, err := r.probeCertificates(ctx, clusterKey, externalCluster)
+	if err != nil {
+		log.Error(err, "Failed to probe the certificates of the control plane")
+		conditions.Set(externalControlPlane, &clusterv1.Condition{
+			Type:     CertificatesValidCondition,
+			Status:   corev1.ConditionUnknown,
+			Severity: clusterv1.ConditionSeverityInfo,
+			Reason:   CertificateProbeFailedReason,
+			Message:  err.Error(),
+		})
+		return
+	}
+	now := metav1.Now()
+	externalControlPlane.Status.LastCertificateCheckTime = &now
+	externalControlPlane.Status.Certificates = certificates
+
+	warning, critical := r.CertificateExpiryWarning, r.CertificateExpiryCritical
+	if warning <= 0 {
+		warning = DefaultCertificateExpiryWarning
+	}
+	if critical <= 0 {
+		critical = DefaultCertificateExpiryCritical
+	}
+	var first *externalcontrolplanev1.CertificateStatus
+	firstBySource := map[string]time.Time{}
+	for i := range certificates {
+		certificate := &certificates[i]
+		if first == nil || certificate.NotAfter.Before(&first.NotAfter) {
+			first = certificate
+		}
+		if notAfter, ok := firstBySource[certificate.Source]; !ok || certificate.NotAfter.Time.Before(notAfter) {
+			firstBySource[certificate.Source] = certificate.NotAfter.Time
+		}
+	}
+	metrics.SetCertificateExpiry(clusterKey, firstBySource)
+
+	if first == nil || time.Until(first.NotAfter.Time) > warning {
+		conditions.MarkTrue(externalControlPlane, CertificatesValidCondition)
+		return
+	}
+	severity := clusterv1.ConditionSeverityWarning
+	if time.Until(first.NotAfter.Time) <= critical {
+		severity = clusterv1.ConditionSeverityError
+	}
+	message := expiryMessage(first)
+	if previous := conditions.Get(externalControlPlane, CertificatesValidCondition); previous == nil || previous.Status != corev1.ConditionFalse || previous.Severity != severity {
+		r.Recorder.Event(externalControlPlane, corev1.EventTypeWarning, CertificateExpiringReason, message)
+	}
+	conditions.Set(externalControlPlane, &clusterv1.Condition{
+		Type:     CertificatesValidCondition,
+		Status:   corev1.ConditionFalse,
+		Severity: severity,
+		Reason:   CertificateExpiringReason,
+		Message:  message,
+	})
+}
+
+// probeCertificates returns the serving certificate chain of the API server
+// in the kubeconfig of the cluster, followed by the CA certificates in the
+// kubeconfig.
+func (r *ExternalControlPlaneReconciler) probeCertificates(ctx context.Context, clusterKey types.NamespacedName, externalCluster *externalinfrav1.ExternalCluster) ([]externalcontrolplanev1.CertificateStatus, error) {
+	// The probe dials the API server itself, so the config is built without
+	// the transport cache, which would move the Dial of the tunnel or the
+	// egress proxy and the CA of the kubeconfig into the cached transport.
+	clusterConfig, err := remote.Config(ctx, r.Client, clusterKey, externalCluster, remote.Options{Tunnel: r.Tunnel})
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := servingCertificates(ctx, clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	var certificates []externalcontrolplanev1.CertificateStatus
+	for _, cert := range chain {
+		certificates = append(certificates, certificateStatus(externalcontrolplanev1.CertificateSourceAPIServer, cert))
+	}
+
+	caData := clusterConfig.TLSClientConfig.CAData
+	if len(caData) == 0 && clusterConfig.TLSClientConfig.CAFile != "" {
+		// Kubeconfig Secrets embed their CA, but tolerate a kubeconfig that
+		// references a file that the controller can read.
+		if caData, err = os.ReadFile(clusterConfig.TLSClientConfig.CAFile); err != nil {
+			return nil, errors.Wrap(err, "failed to read the CA of the kubeconfig")
+		}
+	}
+	for block, remaining := pem.Decode(caData); block != nil; block, remaining = pem.Decode(remaining) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid CA certificate in kubeconfig")
+		}
+		certificates = append(certificates, certificateStatus(externalcontrolplanev1.CertificateSourceKubeconfig, cert))
+	}
+	return certificates, nil
+}
+
+// servingCertificates connects to the API server and returns the certificate
+// chain it serves. The chain is not verified here: it is only inspected, and
+// the clients of the cluster verify it as usual.
+func servingCertificates(ctx context.Context, clusterConfig *rest.Config) ([]*x509.Certificate, error) {
+	serverURL, err := url.Parse(clusterConfig.Host)
+	if err != nil || serverURL.Host == "" {
+		return nil, errors.Errorf("invalid server %q in kubeconfig", clusterConfig.Host)
+	}
+	if serverURL.Scheme != "https" {
+		return nil, nil
+	}
+	address := serverURL.Host
+	if serverURL.Port() == "" {
+		address = net.JoinHostPort(serverURL.Hostname(), "443")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, certificateProbeTimeout)
+	defer cancel()
+	dial := clusterConfig.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", address)
+	}
+	defer conn.Close()
+	serverName := clusterConfig.TLSClientConfig.ServerName
+	if serverName == "" {
+		serverName = serverURL.Hostname()
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true, //nolint:gosec // the certificates are only inspected
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, errors.Wrapf(err, "TLS handshake with %s failed", address)
+	}
+	return tlsConn.ConnectionState().PeerCertificates, nil
+}
+
+func certificateStatus(source string, cert *x509.Certificate) externalcontrolplanev1.CertificateStatus {
+	return externalcontrolplanev1.CertificateStatus{
+		Source:   source,
+		Subject:  cert.Subject.String(),
+		Issuer:   cert.Issuer.String(),
+		NotAfter: metav1.NewTime(cert.NotAfter),
+	}
+}
+
+func expiryMessage(certificate *externalcontrolplanev1.CertificateStatus) string {
+	verb := "expires"
+	if certificate.NotAfter.Time.Before(time.Now()) {
+		verb = "expired"
+	}
+	return fmt.Sprintf("%s certificate %q %s at %s", certificate.Source, certificate.Subject, verb, certificate.NotAfter.UTC().Format(time.RFC3339))
+}
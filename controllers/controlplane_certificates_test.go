@@ -0,0 +1,385 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/metrics"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/remote"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/secret"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newCertificate returns a certificate for 127.0.0.1 that expires at
+// notAfter, signed by parent, or a self-signed CA if parent is nil.
+func newCertificate(g *WithT, commonName string, notAfter time.Time, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	g.Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	issuer, signer := template, interface{}(key)
+	var chain [][]byte
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		issuer, signer = parent.Leaf, parent.PrivateKey
+		chain = parent.Certificate
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	g.Expect(err).NotTo(HaveOccurred())
+	leaf, err := x509.ParseCertificate(der)
+	g.Expect(err).NotTo(HaveOccurred())
+	return tls.Certificate{Certificate: append([][]byte{der}, chain...), PrivateKey: key, Leaf: leaf}
+}
+
+// newTLSServer starts an API server that serves the certificate, and records
+// the server names requested by its clients. The probes close the connection
+// after the handshake, so the errors of the server are not logged.
+func newTLSServer(certificate tls.Certificate) (*httptest.Server, *[]string) {
+	var serverNames []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames = append(serverNames, hello.ServerName)
+			return nil, nil
+		},
+	}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	return server, &serverNames
+}
+
+func TestServingCertificates(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	ca := newCertificate(g, "kubernetes-ca", notAfter.Add(time.Hour), nil)
+	serving := newCertificate(g, "kube-apiserver", notAfter, &ca)
+	server, serverNames := newTLSServer(serving)
+	defer server.Close()
+
+	chain, err := servingCertificates(ctx, &rest.Config{Host: server.URL})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(chain).To(HaveLen(2))
+	g.Expect(chain[0].Subject.CommonName).To(Equal("kube-apiserver"))
+	g.Expect(chain[0].NotAfter).To(BeTemporally("==", notAfter))
+	g.Expect(chain[1].Subject.CommonName).To(Equal("kubernetes-ca"))
+
+	// The server name of the kubeconfig is sent, and a dialer replaces the
+	// address, like the tunnel does.
+	config := &rest.Config{
+		Host:            "https://kubernetes.invalid",
+		TLSClientConfig: rest.TLSClientConfig{ServerName: "api.example.com"},
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			g.Expect(address).To(Equal("kubernetes.invalid:443"))
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}
+	chain, err = servingCertificates(ctx, config)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(chain).To(HaveLen(2))
+	g.Expect(*serverNames).To(Equal([]string{"", "api.example.com"}))
+
+	// Plain HTTP has no certificates.
+	chain, err = servingCertificates(ctx, &rest.Config{Host: "http://127.0.0.1:8080"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(chain).To(BeEmpty())
+
+	_, err = servingCertificates(ctx, &rest.Config{Host: "127.0.0.1"})
+	g.Expect(err).To(MatchError(ContainSubstring("invalid server")))
+
+	server.Close()
+	_, err = servingCertificates(ctx, &rest.Config{Host: server.URL})
+	g.Expect(err).To(MatchError(ContainSubstring("failed to connect")))
+}
+
+func TestReconcileCertificates(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		name     string
+		validity time.Duration
+		warning  time.Duration
+		critical time.Duration
+
+		wantStatus   corev1.ConditionStatus
+		wantSeverity clusterv1.ConditionSeverity
+		wantMessage  string
+	}{
+		{
+			name:       "valid",
+			validity:   60 * day,
+			wantStatus: corev1.ConditionTrue,
+		},
+		{
+			name:         "within the warning threshold",
+			validity:     20 * day,
+			wantStatus:   corev1.ConditionFalse,
+			wantSeverity: clusterv1.ConditionSeverityWarning,
+			wantMessage:  `APIServer certificate "CN=kube-apiserver" expires at`,
+		},
+		{
+			name:         "within the critical threshold",
+			validity:     3 * day,
+			wantStatus:   corev1.ConditionFalse,
+			wantSeverity: clusterv1.ConditionSeverityError,
+			wantMessage:  `APIServer certificate "CN=kube-apiserver" expires at`,
+		},
+		{
+			name:         "expired",
+			validity:     -time.Hour,
+			wantStatus:   corev1.ConditionFalse,
+			wantSeverity: clusterv1.ConditionSeverityError,
+			wantMessage:  `APIServer certificate "CN=kube-apiserver" expired at`,
+		},
+		{
+			name:         "custom warning threshold",
+			validity:     60 * day,
+			warning:      90 * day,
+			wantStatus:   corev1.ConditionFalse,
+			wantSeverity: clusterv1.ConditionSeverityWarning,
+		},
+		{
+			name:         "custom critical threshold",
+			validity:     20 * day,
+			critical:     21 * day,
+			wantStatus:   corev1.ConditionFalse,
+			wantSeverity: clusterv1.ConditionSeverityError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.Background()
+
+			ca := newCertificate(g, "kubernetes-ca", time.Now().Add(365*day), nil)
+			server, _ := newTLSServer(newCertificate(g, "kube-apiserver", time.Now().Add(tt.validity), &ca))
+			defer server.Close()
+
+			clusterKey := types.NamespacedName{Namespace: "default", Name: strings.ReplaceAll(tt.name, " ", "-")}
+			recorder := record.NewFakeRecorder(10)
+			r := &ExternalControlPlaneReconciler{
+				Client:                    fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(kubeconfigSecret(clusterKey, server.URL)).Build(),
+				Recorder:                  recorder,
+				CertificateExpiryWarning:  tt.warning,
+				CertificateExpiryCritical: tt.critical,
+			}
+			clusterScope := &scope.ControlPlaneScope{
+				Cluster:              &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: clusterKey.Namespace, Name: clusterKey.Name}},
+				ExternalControlPlane: &externalcontrolplanev1.ExternalControlPlane{},
+			}
+			externalControlPlane := clusterScope.ExternalControlPlane
+			defer metrics.DeleteCertificateExpiry(clusterKey)
+
+			// A stale series of a source that has no certificates anymore is
+			// removed.
+			metrics.SetCertificateExpiry(clusterKey, map[string]time.Time{externalcontrolplanev1.CertificateSourceKubeconfig: time.Now()})
+
+			r.reconcileCertificates(ctx, clusterScope, &externalinfrav1.ExternalCluster{})
+			g.Expect(externalControlPlane.Status.LastCertificateCheckTime).NotTo(BeNil())
+			g.Expect(externalControlPlane.Status.Certificates).To(HaveLen(2))
+			condition := conditions.Get(externalControlPlane, CertificatesValidCondition)
+			g.Expect(condition).NotTo(BeNil())
+			g.Expect(condition.Status).To(Equal(tt.wantStatus))
+			g.Expect(condition.Severity).To(Equal(tt.wantSeverity))
+			g.Expect(condition.Message).To(HavePrefix(tt.wantMessage))
+
+			expiry := testutil.ToFloat64(metrics.ClusterCertificateExpiry.WithLabelValues(clusterKey.Namespace, clusterKey.Name, externalcontrolplanev1.CertificateSourceAPIServer))
+			g.Expect(expiry).To(BeNumerically("~", tt.validity.Seconds(), 60))
+			g.Expect(metrics.ClusterCertificateExpiry.DeleteLabelValues(clusterKey.Namespace, clusterKey.Name, externalcontrolplanev1.CertificateSourceKubeconfig)).To(BeFalse())
+
+			// An event is only recorded when the severity rises.
+			if tt.wantStatus == corev1.ConditionFalse {
+				g.Expect(recorder.Events).To(Receive(HavePrefix("Warning CertificateExpiring ")))
+			}
+			r.reconcileCertificates(ctx, clusterScope, &externalinfrav1.ExternalCluster{})
+			g.Expect(recorder.Events).NotTo(Receive())
+		})
+	}
+}
+
+func TestReconcileCertificatesKubeconfigCA(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	ca := newCertificate(g, "kubernetes-ca", time.Now().Add(365*24*time.Hour), nil)
+	server, _ := newTLSServer(newCertificate(g, "kube-apiserver", time.Now().Add(60*24*time.Hour), &ca))
+	defer server.Close()
+
+	// The CA in the kubeconfig expires first.
+	kubeconfigCA := newCertificate(g, "previous-ca", time.Now().Add(5*24*time.Hour), nil)
+	clusterKey := types.NamespacedName{Namespace: "default", Name: "kubeconfig-ca"}
+	kubeconfig := kubeconfigSecret(clusterKey, server.URL)
+	config, err := clientcmd.Load(kubeconfig.Data[secret.KubeconfigDataName])
+	g.Expect(err).NotTo(HaveOccurred())
+	config.Clusters[clusterKey.Name].CertificateAuthorityData = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kubeconfigCA.Leaf.Raw})
+	kubeconfig.Data[secret.KubeconfigDataName], err = clientcmd.Write(*config)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	r := &ExternalControlPlaneReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(kubeconfig).Build(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+	clusterScope := &scope.ControlPlaneScope{
+		Cluster:              &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: clusterKey.Namespace, Name: clusterKey.Name}},
+		ExternalControlPlane: &externalcontrolplanev1.ExternalControlPlane{},
+	}
+	defer metrics.DeleteCertificateExpiry(clusterKey)
+
+	r.reconcileCertificates(ctx, clusterScope, &externalinfrav1.ExternalCluster{})
+	certificates := clusterScope.ExternalControlPlane.Status.Certificates
+	g.Expect(certificates).To(HaveLen(3))
+	g.Expect(certificates[2].Source).To(Equal(externalcontrolplanev1.CertificateSourceKubeconfig))
+	condition := conditions.Get(clusterScope.ExternalControlPlane, CertificatesValidCondition)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Severity).To(Equal(clusterv1.ConditionSeverityError))
+	g.Expect(condition.Message).To(HavePrefix(`Kubeconfig certificate "CN=previous-ca"`))
+	expiry := testutil.ToFloat64(metrics.ClusterCertificateExpiry.WithLabelValues(clusterKey.Namespace, clusterKey.Name, externalcontrolplanev1.CertificateSourceKubeconfig))
+	g.Expect(expiry).To(BeNumerically("~", (5 * 24 * time.Hour).Seconds(), 60))
+
+	// A failed probe keeps the last certificates.
+	server.Close()
+	r.reconcileCertificates(ctx, clusterScope, &externalinfrav1.ExternalCluster{})
+	g.Expect(clusterScope.ExternalControlPlane.Status.Certificates).To(Equal(certificates))
+	g.Expect(conditions.GetReason(clusterScope.ExternalControlPlane, CertificatesValidCondition)).To(Equal(CertificateProbeFailedReason))
+}
+
+// newConnectProxy starts an egress proxy stand-in that tunnels CONNECT
+// requests for target to address, and counts the tunnels it opened.
+func newConnectProxy(target, address string) (*httptest.Server, *int32) {
+	var connects int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Host != target {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		upstream, err := net.Dial("tcp", address)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		atomic.AddInt32(&connects, 1)
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go func() { _, _ = io.Copy(upstream, conn) }()
+		_, _ = io.Copy(conn, upstream)
+	})), &connects
+}
+
+func TestReconcileCertificatesThroughProxy(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	ca := newCertificate(g, "kubernetes-ca", time.Now().Add(365*24*time.Hour), nil)
+	server, _ := newTLSServer(newCertificate(g, "kube-apiserver", time.Now().Add(60*24*time.Hour), &ca))
+	defer server.Close()
+	// The API server can only be reached through the proxy.
+	proxy, connects := newConnectProxy("kube-apiserver.invalid:443", server.Listener.Addr().String())
+	defer proxy.Close()
+
+	clusterKey := types.NamespacedName{Namespace: "default", Name: "egress"}
+	kubeconfig := kubeconfigSecret(clusterKey, "https://kube-apiserver.invalid")
+	config, err := clientcmd.Load(kubeconfig.Data[secret.KubeconfigDataName])
+	g.Expect(err).NotTo(HaveOccurred())
+	config.Clusters[clusterKey.Name].CertificateAuthorityData = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Leaf.Raw})
+	kubeconfig.Data[secret.KubeconfigDataName], err = clientcmd.Write(*config)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// The transport cache of the other checks does not affect the probe.
+	r := &ExternalControlPlaneReconciler{
+		Client:     fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(kubeconfig).Build(),
+		Recorder:   record.NewFakeRecorder(10),
+		Transports: remote.NewTransports(),
+	}
+	clusterScope := &scope.ControlPlaneScope{
+		Cluster:              &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: clusterKey.Namespace, Name: clusterKey.Name}},
+		ExternalControlPlane: &externalcontrolplanev1.ExternalControlPlane{},
+	}
+	externalCluster := &externalinfrav1.ExternalCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: clusterKey.Namespace, Name: clusterKey.Name},
+		Spec:       externalinfrav1.ExternalClusterSpec{Proxy: &externalinfrav1.ProxySpec{URL: proxy.URL}},
+	}
+	defer metrics.DeleteCertificateExpiry(clusterKey)
+
+	_, err = r.clusterConfig(ctx, clusterKey, externalCluster)
+	g.Expect(err).NotTo(HaveOccurred())
+	r.reconcileCertificates(ctx, clusterScope, externalCluster)
+	g.Expect(atomic.LoadInt32(connects)).To(BeEquivalentTo(1))
+	g.Expect(conditions.GetReason(clusterScope.ExternalControlPlane, CertificatesValidCondition)).NotTo(Equal(CertificateProbeFailedReason))
+	certificates := clusterScope.ExternalControlPlane.Status.Certificates
+	g.Expect(certificates).To(HaveLen(3))
+	g.Expect(certificates[0].Subject).To(Equal("CN=kube-apiserver"))
+	g.Expect(certificates[2].Source).To(Equal(externalcontrolplanev1.CertificateSourceKubeconfig))
+	g.Expect(certificates[2].Subject).To(Equal("CN=kubernetes-ca"))
+}
+
+func TestDeleteControlPlaneMetrics(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	g.Expect(clusterv1.AddToScheme(scheme)).To(Succeed())
+	cluster := &clusterv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deleted-control-plane"},
+		Spec: clusterv1.ClusterSpec{
+			ControlPlaneRef: &corev1.ObjectReference{Kind: "ExternalControlPlane", Name: "control-plane"},
+		},
+	}
+	clusterKey := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
+	r := &ExternalControlPlaneReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(cluster).Build()}
+
+	metrics.SetCertificateExpiry(clusterKey, map[string]time.Time{externalcontrolplanev1.CertificateSourceAPIServer: time.Now()})
+	g.Expect(r.deleteControlPlaneMetrics(ctx, types.NamespacedName{Namespace: "default", Name: "other"})).To(Succeed())
+	g.Expect(testutil.ToFloat64(metrics.ClusterCertificateExpiry.WithLabelValues(clusterKey.Namespace, clusterKey.Name, externalcontrolplanev1.CertificateSourceAPIServer))).NotTo(BeZero())
+
+	g.Expect(r.deleteControlPlaneMetrics(ctx, types.NamespacedName{Namespace: "default", Name: "control-plane"})).To(Succeed())
+	g.Expect(metrics.ClusterCertificateExpiry.DeleteLabelValues(clusterKey.Namespace, clusterKey.Name, externalcontrolplanev1.CertificateSourceAPIServer)).To(BeFalse())
+}
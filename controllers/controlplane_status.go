@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/inventory"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// VersionMatchedCondition reports whether the external cluster runs the
+	// Kubernetes version in the spec of its ExternalControlPlane, which is set
+	// by the topology controller for clusters with a managed topology.
+	VersionMatchedCondition clusterv1.ConditionType = "VersionMatched"
+	VersionMismatchReason                           = "VersionMismatch"
+)
+
+// +kubebuilder:rbac:groups=controlplane.cluster.x-k8s.io,resources=externalcontrolplanes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=controlplane.cluster.x-k8s.io,resources=externalcontrolplanes/status,verbs=get;update;patch
+
+// reconcileControlPlaneStatus reports the control plane nodes of the external
+// cluster in the status of its ExternalControlPlane. If no node runs the
+// control plane, the control plane is managed by the provider and its version
+// is the version of the API server. Versions are reported without the
+// distribution suffix (e.g. v1.23.5 for v1.23.5-eks-1234), so that they can be
+// compared with the version of a managed topology. The ExternalControlPlane
+// reconciler patches the same status concurrently, so only the fields and the
+// condition owned by this function are patched.
+func (r *ExternalClusterReconciler) reconcileControlPlaneStatus(ctx context.Context, clusterScope *scope.ExternalClusterScope, nodes []corev1.Node, apiServerVersion string) error {
+	controlPlaneRef := clusterScope.Cluster.Spec.ControlPlaneRef
+	if controlPlaneRef == nil || controlPlaneRef.Kind != "ExternalControlPlane" {
+		return nil
+	}
+	externalControlPlane := &externalcontrolplanev1.ExternalControlPlane{}
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: clusterScope.Namespace(), Name: controlPlaneRef.Name}, externalControlPlane)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to get the external control plane")
+	}
+
+	patchHelper, err := patch.NewHelper(externalControlPlane, r.Client)
+	if err != nil {
+		return errors.Wrap(err, "failed to init patch helper")
+	}
+	status := &externalControlPlane.Status
+	status.Replicas, status.ReadyReplicas, status.Version = 0, 0, nil
+	var minVersion *version.Version
+	for i := range nodes {
+		if !inventory.IsControlPlaneNode(&nodes[i]) {
+			continue
+		}
+		status.Replicas++
+		if isNodeReady(&nodes[i]) {
+			status.ReadyReplicas++
+		}
+		if v, err := version.ParseGeneric(nodes[i].Status.NodeInfo.KubeletVersion); err == nil && (minVersion == nil || v.LessThan(minVersion)) {
+			minVersion = v
+		}
+	}
+	status.ProviderManaged = status.Replicas == 0
+	if status.ProviderManaged {
+		if v, err := version.ParseGeneric(apiServerVersion); err == nil {
+			minVersion = v
+		}
+	}
+	if minVersion != nil {
+		status.Version = pointer.String(kubernetesVersion(minVersion))
+	}
+	reconcileVersionMatched(externalControlPlane)
+	status.Selector = labels.SelectorFromSet(labels.Set{
+		clusterv1.ClusterLabelName:             clusterScope.Name(),
+		clusterv1.MachineControlPlaneLabelName: "",
+	}).String()
+	err = patchHelper.Patch(ctx, externalControlPlane, patch.WithOwnedConditions{Conditions: []clusterv1.ConditionType{VersionMatchedCondition}})
+	if err != nil {
+		return errors.Wrap(err, "failed to patch the external control plane status")
+	}
+	return nil
+}
+
+// reconcileVersionMatched compares the version in the spec of the
+// ExternalControlPlane, if any, with the version of the cluster.
+func reconcileVersionMatched(externalControlPlane *externalcontrolplanev1.ExternalControlPlane) {
+	specVersion := externalControlPlane.Spec.Version
+	if specVersion == "" {
+		conditions.Delete(externalControlPlane, VersionMatchedCondition)
+		return
+	}
+	statusVersion := pointer.StringDeref(externalControlPlane.Status.Version, "")
+	desired, err := version.ParseGeneric(specVersion)
+	if err != nil {
+		conditions.MarkFalse(externalControlPlane, VersionMatchedCondition, VersionMismatchReason, clusterv1.ConditionSeverityWarning,
+			"Invalid version %q: %v", specVersion, err)
+		return
+	}
+	if statusVersion == "" {
+		conditions.MarkUnknown(externalControlPlane, VersionMatchedCondition, VersionMismatchReason, "The version of the cluster is not known yet")
+		return
+	}
+	if kubernetesVersion(desired) != statusVersion {
+		conditions.MarkFalse(externalControlPlane, VersionMatchedCondition, VersionMismatchReason, clusterv1.ConditionSeverityWarning,
+			"The cluster runs Kubernetes %s instead of %s; external clusters have to be upgraded outside of Cluster API", statusVersion, specVersion)
+		return
+	}
+	conditions.MarkTrue(externalControlPlane, VersionMatchedCondition)
+}
+
+// kubernetesVersion formats a version as v<major>.<minor>.<patch>.
+func kubernetesVersion(v *version.Version) string {
+	return fmt.Sprintf("v%d.%d.%d", v.Major(), v.Minor(), v.Patch())
+}
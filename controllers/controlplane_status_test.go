@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// controlPlaneNode returns a node of the control plane if controlPlane is
+// set, and a worker node otherwise.
+func controlPlaneNode(name, kubeletVersion string, controlPlane, ready bool) corev1.Node {
+	node := corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{}},
+		Status:     corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{KubeletVersion: kubeletVersion}},
+	}
+	if controlPlane {
+		node.Labels["node-role.kubernetes.io/control-plane"] = ""
+	}
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}}
+	return node
+}
+
+// concurrentConditionClient sets a condition on the ExternalControlPlane
+// right after it is read, like the ExternalControlPlane reconciler could.
+type concurrentConditionClient struct {
+	client.Client
+	done bool
+}
+
+func (c *concurrentConditionClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if err := c.Client.Get(ctx, key, obj); err != nil || c.done {
+		return err
+	}
+	c.done = true
+	latest := &externalcontrolplanev1.ExternalControlPlane{}
+	if err := c.Client.Get(ctx, key, latest); err != nil {
+		return err
+	}
+	conditions.MarkTrue(latest, clusterv1.ReadyCondition)
+	return c.Client.Status().Update(ctx, latest)
+}
+
+func TestReconcileControlPlaneStatus(t *testing.T) {
+	tests := []struct {
+		name             string
+		nodes            []corev1.Node
+		apiServerVersion string
+		specVersion      string
+
+		wantReplicas        int32
+		wantReadyReplicas   int32
+		wantProviderManaged bool
+		wantVersion         *string
+		wantVersionMatched  corev1.ConditionStatus
+	}{
+		{
+			// The lowest version of the control plane nodes is reported,
+			// without the distribution suffix.
+			name: "control plane nodes",
+			nodes: []corev1.Node{
+				controlPlaneNode("control-plane-1", "v1.23.5+k3s1", true, true),
+				controlPlaneNode("control-plane-2", "v1.22.9+k3s1", true, false),
+				controlPlaneNode("worker-1", "v1.21.2", false, true),
+			},
+			apiServerVersion:  "v1.23.5+k3s1",
+			wantReplicas:      2,
+			wantReadyReplicas: 1,
+			wantVersion:       pointer.String("v1.22.9"),
+		},
+		{
+			// Without control plane nodes, the control plane is managed by the
+			// provider and runs the version of the API server.
+			name: "provider managed",
+			nodes: []corev1.Node{
+				controlPlaneNode("worker-1", "v1.22.6-eks-7d68063", false, true),
+			},
+			apiServerVersion:    "v1.23.5-eks-1234",
+			wantProviderManaged: true,
+			wantVersion:         pointer.String("v1.23.5"),
+		},
+		{
+			name:                "unknown version",
+			apiServerVersion:    "unknown",
+			wantProviderManaged: true,
+		},
+		{
+			name:                "version matched",
+			apiServerVersion:    "v1.23.5-gke.1500",
+			specVersion:         "v1.23.5",
+			wantProviderManaged: true,
+			wantVersion:         pointer.String("v1.23.5"),
+			wantVersionMatched:  corev1.ConditionTrue,
+		},
+		{
+			name:                "version mismatch",
+			apiServerVersion:    "v1.22.9-gke.1500",
+			specVersion:         "v1.23.5",
+			wantProviderManaged: true,
+			wantVersion:         pointer.String("v1.22.9"),
+			wantVersionMatched:  corev1.ConditionFalse,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.Background()
+			scheme := runtime.NewScheme()
+			g.Expect(clusterv1.AddToScheme(scheme)).To(Succeed())
+			g.Expect(externalcontrolplanev1.AddToScheme(scheme)).To(Succeed())
+			externalControlPlane := &externalcontrolplanev1.ExternalControlPlane{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "prod-control-plane"},
+				Spec:       externalcontrolplanev1.ExternalControlPlaneSpec{Version: tt.specVersion},
+			}
+			c := &concurrentConditionClient{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(externalControlPlane).Build()}
+			r := &ExternalClusterReconciler{Client: c, Scheme: scheme}
+			clusterScope := &scope.ExternalClusterScope{
+				Cluster: &clusterv1.Cluster{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "prod"},
+					Spec: clusterv1.ClusterSpec{
+						ControlPlaneRef: &corev1.ObjectReference{Kind: "ExternalControlPlane", Name: "prod-control-plane"},
+					},
+				},
+			}
+
+			g.Expect(r.reconcileControlPlaneStatus(ctx, clusterScope, tt.nodes, tt.apiServerVersion)).To(Succeed())
+			g.Expect(c.Get(ctx, client.ObjectKeyFromObject(externalControlPlane), externalControlPlane)).To(Succeed())
+			status := externalControlPlane.Status
+			g.Expect(status.Replicas).To(Equal(tt.wantReplicas))
+			g.Expect(status.ReadyReplicas).To(Equal(tt.wantReadyReplicas))
+			g.Expect(status.ProviderManaged).To(Equal(tt.wantProviderManaged))
+			g.Expect(status.Version).To(Equal(tt.wantVersion))
+			g.Expect(status.Selector).To(Equal("cluster.x-k8s.io/cluster-name=prod,cluster.x-k8s.io/control-plane="))
+			if tt.wantVersionMatched == "" {
+				g.Expect(conditions.Has(externalControlPlane, VersionMatchedCondition)).To(BeFalse())
+			} else {
+				g.Expect(conditions.Get(externalControlPlane, VersionMatchedCondition).Status).To(Equal(tt.wantVersionMatched))
+			}
+			// The conditions set by the ExternalControlPlane reconciler in
+			// the meantime are kept.
+			g.Expect(conditions.IsTrue(externalControlPlane, clusterv1.ReadyCondition)).To(BeTrue())
+		})
+	}
+}
+
+func TestReconcileControlPlaneStatusWithoutExternalControlPlane(t *testing.T) {
+	g := NewWithT(t)
+	scheme := runtime.NewScheme()
+	g.Expect(externalcontrolplanev1.AddToScheme(scheme)).To(Succeed())
+	r := &ExternalClusterReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).Build(), Scheme: scheme}
+
+	// Clusters with another control plane, or whose ExternalControlPlane
+	// is gone, are ignored.
+	for _, controlPlaneRef := range []*corev1.ObjectReference{nil, {Kind: "KubeadmControlPlane", Name: "prod"}, {Kind: "ExternalControlPlane", Name: "deleted"}} {
+		clusterScope := &scope.ExternalClusterScope{
+			Cluster: &clusterv1.Cluster{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "prod"},
+				Spec:       clusterv1.ClusterSpec{ControlPlaneRef: controlPlaneRef},
+			},
+		}
+		g.Expect(r.reconcileControlPlaneStatus(context.Background(), clusterScope, nil, "v1.23.5")).To(Succeed())
+	}
+}
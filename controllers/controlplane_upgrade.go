@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/upgrade"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// UpgradeReadyCondition reports whether the external cluster uses APIs
+	// that are removed in the next minor Kubernetes version, see the
+	// UpgradeReadiness in the status of the ExternalControlPlane.
+	UpgradeReadyCondition    clusterv1.ConditionType = "UpgradeReady"
+	RemovedAPIsInUseReason                           = "RemovedAPIsInUse"
+	UpgradeCheckFailedReason                         = "UpgradeCheckFailed"
+
+	// upgradeCheckInterval is the interval at which the usage of removed APIs
+	// is checked.
+	upgradeCheckInterval = time.Hour
+)
+
+// reconcileUpgradeReadiness checks the usage of the APIs that are removed in
+// the next minor version of the external cluster, and reports it in the
+// status of the ExternalControlPlane. Failures are reported in the
+// UpgradeReady condition, but do not fail the reconcile.
+func (r *ExternalControlPlaneReconciler) reconcileUpgradeReadiness(ctx context.Context, clusterScope *scope.ControlPlaneScope, externalCluster *externalinfrav1.ExternalCluster) {
+	log := ctrl.LoggerFrom(ctx)
+	externalControlPlane := clusterScope.ExternalControlPlane
+	clusterKey := types.NamespacedName{Namespace: clusterScope.Namespace(), Name: clusterScope.Name()}
+
+	var report *externalcontrolplanev1.UpgradeReadiness
+	clusterConfig, err := r.clusterConfig(ctx, clusterKey, externalCluster)
+	if err == nil {
+		report, err = upgrade.Check(ctx, clusterConfig)
+	}
+	if err != nil {
+		log.Error(err, "Failed to check the usage of removed APIs")
+		conditions.MarkUnknown(externalControlPlane, UpgradeReadyCondition, UpgradeCheckFailedReason, err.Error())
+		return
+	}
+	externalControlPlane.Status.UpgradeReadiness = report
+
+	if report.Ready {
+		conditions.MarkTrue(externalControlPlane, UpgradeReadyCondition)
+		return
+	}
+	message := fmt.Sprintf("Kubernetes %s removes APIs in use: %s", report.TargetVersion, strings.Join(upgrade.Blockers(report), ", "))
+	if conditions.IsTrue(externalControlPlane, UpgradeReadyCondition) || !conditions.Has(externalControlPlane, UpgradeReadyCondition) {
+		r.Recorder.Event(externalControlPlane, corev1.EventTypeWarning, RemovedAPIsInUseReason, message)
+	}
+	conditions.MarkFalse(externalControlPlane, UpgradeReadyCondition, RemovedAPIsInUseReason, clusterv1.ConditionSeverityWarning, message)
+}
@@ -2,20 +2,37 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/audit"
+	importer "github.com/platform9-incubator/cluster-api-provider-external/pkg/cape"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/inventory"
+	capekubeconfig "github.com/platform9-incubator/cluster-api-provider-external/pkg/kubeconfig"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/metrics"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/remote"
 	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tracing"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tunnel"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/pointer"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	addonsv1 "sigs.k8s.io/cluster-api/exp/addons/api/v1beta1"
 	"sigs.k8s.io/cluster-api/util"
 	"sigs.k8s.io/cluster-api/util/annotations"
 	"sigs.k8s.io/cluster-api/util/conditions"
@@ -25,6 +42,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 )
@@ -38,12 +56,57 @@ const (
 	KubeconfigInvalidReason        = "KubeconfigInvalid"
 	ClusterAccessFailedReason      = "ClusterAccessFailed"
 	NodesListFailedReason          = "NodesListFailed"
+	UnsupportedAuthMethodReason    = "UnsupportedAuthMethod"
+	ProxyConfigInvalidReason       = "ProxyConfigInvalid"
+
+	// KubeconfigHashAnnotation holds a hash of the last seen kubeconfig of
+	// the cluster, used to detect credential rotations.
+	KubeconfigHashAnnotation = "externalcluster.infrastructure.cluster.x-k8s.io/kubeconfig-hash"
+
+	InventoryCollectedCondition     clusterv1.ConditionType = "InventoryCollected"
+	InventoryCollectionFailedReason                         = "InventoryCollectionFailed"
+
+	TunnelConnectedCondition   clusterv1.ConditionType = "TunnelConnected"
+	TunnelServerDisabledReason                         = "TunnelServerDisabled"
+	TunnelDisconnectedReason                           = "TunnelDisconnected"
+
+	// tunnelRetryInterval is the interval at which clusters are requeued
+	// while waiting for their agent to connect.
+	tunnelRetryInterval = 30 * time.Second
 )
 
 // ExternalClusterReconciler reconciles a ExternalCluster object
 type ExternalClusterReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// InventoryInterval is the interval at which the inventory of the external
+	// clusters is refreshed. Inventory collection is disabled if it is zero.
+	InventoryInterval time.Duration
+
+	// Tunnel is the server that `cape agent` connects to. Requests to clusters
+	// with Spec.Tunnel set are routed through it. It is nil if the tunnel
+	// server is disabled.
+	Tunnel *tunnel.Server
+
+	// Audit records the mutating requests to the external clusters. Auditing
+	// is disabled if it is nil.
+	Audit audit.Sink
+
+	// Transports caches the transports of the clusters with a tunnel or an
+	// egress proxy. It can be shared with the other reconcilers.
+	Transports *remote.Transports
+
+	// KubeconfigProjectionNamespaces are the namespaces that kubeconfigs may
+	// be projected into, or AllNamespaces. Projection is disabled if it is
+	// empty.
+	KubeconfigProjectionNamespaces []string
+
+	// clusterKeys maps the ExternalClusters to their Clusters, whose names
+	// label the metrics and key the Transports, so that both can be removed
+	// after the ExternalCluster and the Cluster are gone.
+	clusterKeys sync.Map
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -65,6 +128,24 @@ func (r *ExternalClusterReconciler) SetupWithManager(ctx context.Context, mgr ct
 		return errors.Wrapf(err, "failed adding a watch for ready clusters")
 	}
 
+	// Add a watch on kubeconfig Secrets to keep projected kubeconfigs in sync.
+	if err = c.Watch(
+		&source.Kind{Type: &corev1.Secret{}},
+		handler.EnqueueRequestsFromMapFunc(r.kubeconfigSecretToExternalCluster),
+		predicate.NewPredicateFuncs(isKubeconfigSecret),
+	); err != nil {
+		return errors.Wrapf(err, "failed adding a watch for kubeconfig secrets")
+	}
+
+	// Add a watch on ClusterResourceSets to adopt their existing resources
+	// as soon as they select a cluster.
+	if err = c.Watch(
+		&source.Kind{Type: &addonsv1.ClusterResourceSet{}},
+		handler.EnqueueRequestsFromMapFunc(r.clusterResourceSetToExternalClusters),
+	); err != nil {
+		return errors.Wrapf(err, "failed adding a watch for cluster resource sets")
+	}
+
 	return nil
 }
 
@@ -73,14 +154,18 @@ func (r *ExternalClusterReconciler) SetupWithManager(ctx context.Context, mgr ct
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=externalclusters;externalmachines,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=externalclusters/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;update;patch;create;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 func (r *ExternalClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, reterr error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ExternalClusterReconciler.Reconcile", trace.WithAttributes(tracing.ObjectAttributes("ExternalCluster", req.Namespace, req.Name)...))
+	defer func() { tracing.EndSpan(span, reterr) }()
 	log := ctrl.LoggerFrom(ctx)
 
 	log.Info("Fetching ExternalCluster from storage")
 	var externalCluster externalv1.ExternalCluster
 	if err := r.Get(ctx, req.NamespacedName, &externalCluster); err != nil {
 		if apierrors.IsNotFound(err) {
+			r.forgetCluster(req.NamespacedName)
 			return reconcile.Result{}, nil
 		}
 		return reconcile.Result{}, err
@@ -88,10 +173,18 @@ func (r *ExternalClusterReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 
 	// Fetch the Cluster.
 	cluster, err := util.GetOwnerCluster(ctx, r.Client, externalCluster.ObjectMeta)
+	if apierrors.IsNotFound(err) && !externalCluster.DeletionTimestamp.IsZero() {
+		// The ExternalCluster is garbage collected after its Cluster.
+		cluster, err = nil, nil
+	}
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 	if cluster == nil {
+		if !externalCluster.DeletionTimestamp.IsZero() {
+			// The Cluster is already gone, so only clean up the resources it does not own.
+			return ctrl.Result{}, r.reconcileOrphanDelete(ctx, &externalCluster)
+		}
 		log.Info("OwnerCluster is not set yet. Requeuing...")
 		return ctrl.Result{}, nil
 	}
@@ -111,8 +204,12 @@ func (r *ExternalClusterReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 	if err != nil {
 		return ctrl.Result{}, errors.Errorf("failed to create scope: %+v", err)
 	}
+	r.clusterKeys.Store(req.NamespacedName, clusterScope.NamespacedName())
 
+	wasReady := externalCluster.Status.Ready
+	previousReadyCondition := conditions.Get(&externalCluster, ReadyCondition).DeepCopy()
 	defer func() {
+		r.recordReadyTransition(clusterScope.ExternalCluster, wasReady, previousReadyCondition)
 		if err := clusterScope.Close(); err != nil && reterr == nil {
 			reterr = err
 		}
@@ -120,7 +217,7 @@ func (r *ExternalClusterReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 	}()
 
 	// Handle deleted clusters
-	if !cluster.DeletionTimestamp.IsZero() {
+	if !cluster.DeletionTimestamp.IsZero() || !externalCluster.DeletionTimestamp.IsZero() {
 		return r.reconcileDelete(ctx, clusterScope)
 	}
 	return r.reconcileNormal(ctx, clusterScope)
@@ -130,45 +227,46 @@ func (r *ExternalClusterReconciler) reconcileNormal(ctx context.Context, cluster
 	log := ctrl.LoggerFrom(ctx)
 	// externalCluster := clusterScope.ExternalCluster
 	// controllerutil.AddFinalizer(externalCluster, ClusterFinalizer)
+	ready := false
+	defer func() {
+		metrics.SetClusterReady(clusterScope.NamespacedName(), ready)
+	}()
 
-	// Reconcile the kubeconfig secret
-	log.V(4).Info("Fetching the external cluster kubeconfig from the associated")
-	kubeconfigSecret := &corev1.Secret{}
-	err := r.Client.Get(ctx, types.NamespacedName{
-		Namespace: clusterScope.Namespace(),
-		Name:      fmt.Sprintf("%s-kubeconfig", clusterScope.Name()),
-	}, kubeconfigSecret)
+	rawKubeconfig, err := r.fetchKubeconfig(ctx, clusterScope)
 	if err != nil {
-		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, KubeconfigSecretNotFoundReason, clusterv1.ConditionSeverityInfo, err.Error())
 		return ctrl.Result{}, err
 	}
-	if kubeconfigSecret.Data == nil || kubeconfigSecret.Data["value"] == nil {
-		return ctrl.Result{}, errors.New("kubeconfig does not contain secret")
-	}
-
-	if len(kubeconfigSecret.ObjectMeta.OwnerReferences) == 0 {
-		log.V(4).Info("Updating the controller reference on the kubeconfig secret")
-		err = controllerutil.SetControllerReference(clusterScope.Cluster, kubeconfigSecret, r.Scheme)
-		if err != nil {
-			return ctrl.Result{}, err
-		}
-
-		err = r.Client.Update(ctx, kubeconfigSecret)
-		if err != nil {
-			return ctrl.Result{}, err
-		}
+	r.recordKubeconfigRotation(clusterScope.ExternalCluster, rawKubeconfig)
+	if err := capekubeconfig.CheckAuthMethod(rawKubeconfig); errors.Is(err, capekubeconfig.ErrUnsupportedAuthMethod) {
+		// The kubeconfig Secret is watched, so there is no need to requeue
+		// until it is replaced.
+		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, UnsupportedAuthMethodReason, clusterv1.ConditionSeverityError,
+			"%s; replace the kubeconfig with one that has a token or client certificate, e.g. with cape import --resolve-auth", err.Error())
+		return ctrl.Result{}, nil
 	}
 
-	rawKubeconfig, err := kubeconfig.FromSecret(ctx, r.Client, clusterScope.NamespacedName())
+	clusterConfig, err := clientcmd.RESTConfigFromKubeConfig(rawKubeconfig)
 	if err != nil {
-		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, KubeconfigSecretNotFoundReason, clusterv1.ConditionSeverityInfo, err.Error())
+		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, KubeconfigInvalidReason, clusterv1.ConditionSeverityInfo, err.Error())
 		return ctrl.Result{}, err
 	}
-	clusterConfig, err := clientcmd.RESTConfigFromKubeConfig(rawKubeconfig)
-	if err != nil {
+	if err := r.reconcileControlPlaneEndpoint(clusterScope, clusterConfig); err != nil {
 		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, KubeconfigInvalidReason, clusterv1.ConditionSeverityInfo, err.Error())
 		return ctrl.Result{}, err
 	}
+	if err := r.adoptTunnelToken(ctx, clusterScope); err != nil {
+		return ctrl.Result{}, err
+	}
+	if !r.reconcileTunnel(clusterScope) {
+		return ctrl.Result{RequeueAfter: tunnelRetryInterval}, nil
+	}
+	// The client certificate is moved into the cached transport by Configure.
+	metrics.SetCredentialExpiry(clusterScope.NamespacedName(), clusterConfig)
+	remoteOpts := remote.Options{Tunnel: r.Tunnel, Audit: r.Audit, Tracer: clusterScope.Tracer, Transports: r.Transports}
+	if err := remote.Configure(ctx, r.Client, clusterScope.NamespacedName(), clusterScope.ExternalCluster, clusterConfig, remoteOpts); err != nil {
+		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, ProxyConfigInvalidReason, clusterv1.ConditionSeverityError, err.Error())
+		return ctrl.Result{}, err
+	}
 	clusterClient, err := kubernetes.NewForConfig(clusterConfig)
 	if err != nil {
 		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, KubeconfigInvalidReason, clusterv1.ConditionSeverityInfo, err.Error())
@@ -176,11 +274,18 @@ func (r *ExternalClusterReconciler) reconcileNormal(ctx context.Context, cluster
 	}
 
 	log.V(4).Info("Checking if the cluster is accessible")
+	probeStart := time.Now()
 	_, err = clusterClient.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
 	if err != nil {
 		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, ClusterAccessFailedReason, clusterv1.ConditionSeverityInfo, err.Error())
 		return ctrl.Result{}, err
 	}
+	metrics.ClusterAPILatency.WithLabelValues(clusterScope.Namespace(), clusterScope.Name()).Set(time.Since(probeStart).Seconds())
+	serverVersion, err := clusterClient.Discovery().ServerVersion()
+	if err != nil {
+		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, ClusterAccessFailedReason, clusterv1.ConditionSeverityInfo, err.Error())
+		return ctrl.Result{}, err
+	}
 
 	log.V(4).Info("Retrieving nodes from external cluster")
 	nodes, err := clusterClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
@@ -188,38 +293,435 @@ func (r *ExternalClusterReconciler) reconcileNormal(ctx context.Context, cluster
 		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, NodesListFailedReason, clusterv1.ConditionSeverityInfo, err.Error())
 		return ctrl.Result{}, err
 	}
+	readyNodes := 0
+	for _, node := range nodes.Items {
+		if isNodeReady(&node) {
+			readyNodes++
+		}
+	}
+	metrics.ClusterNodes.WithLabelValues(clusterScope.Namespace(), clusterScope.Name()).Set(float64(len(nodes.Items)))
+	metrics.ClusterReadyNodes.WithLabelValues(clusterScope.Namespace(), clusterScope.Name()).Set(float64(readyNodes))
 
 	log.V(4).Info("Syncing external machines with the nodes in the external cluster")
-	for _, node := range nodes.Items {
-		machine, externalMachine := convertNodeToExternalMachine(clusterScope.Cluster, &node)
+	if err := r.syncMachines(ctx, clusterScope, nodes.Items); err != nil {
+		return ctrl.Result{}, err
+	}
+	reconcileVersionSkew(clusterScope, nodes.Items, serverVersion.GitVersion)
+	if err := r.reconcileControlPlaneStatus(ctx, clusterScope, nodes.Items, serverVersion.GitVersion); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.reconcileClusterResourceSetAdoption(ctx, clusterScope, clusterConfig)
+
+	result := ctrl.Result{}
+	if r.InventoryInterval > 0 {
+		r.reconcileInventory(ctx, clusterScope, clusterClient, nodes.Items)
+		result.RequeueAfter = r.InventoryInterval
+	}
+
+	// TODO calculate the ready from the conditions (one condition is false -> ready = false)
+	clusterScope.ExternalCluster.Status.Ready = true
+	conditions.MarkTrue(clusterScope.ExternalCluster, ReadyCondition)
+	ready = true
 
-		// TODO update if already created (with controllerutil.CreateOrUpdate)
+	r.reconcileKubeconfigProjection(ctx, clusterScope, rawKubeconfig)
+	return result, nil
+}
+
+// reconcileControlPlaneEndpoint sets the ControlPlaneEndpoint to the server of
+// the kubeconfig if it is empty, as for ExternalClusters created from an
+// ExternalClusterTemplate by the topology controller.
+func (r *ExternalClusterReconciler) reconcileControlPlaneEndpoint(clusterScope *scope.ExternalClusterScope, clusterConfig *rest.Config) error {
+	endpoint := &clusterScope.ExternalCluster.Spec.ControlPlaneEndpoint
+	if !endpoint.IsZero() {
+		return nil
+	}
+	host, port, err := importer.SplitServerURL(clusterConfig.Host)
+	if err != nil {
+		return errors.Wrapf(err, "invalid server %q in kubeconfig", clusterConfig.Host)
+	}
+	endpoint.Host, endpoint.Port = host, int32(port)
+	return nil
+}
+
+// reconcileTunnel reports whether the tunnel agent of the cluster is
+// connected, if the cluster is configured to use a tunnel. It returns false if
+// the cluster should be accessed through a tunnel but no agent is connected.
+func (r *ExternalClusterReconciler) reconcileTunnel(clusterScope *scope.ExternalClusterScope) bool {
+	externalCluster := clusterScope.ExternalCluster
+	if !externalCluster.Spec.Tunnel {
+		conditions.Delete(externalCluster, TunnelConnectedCondition)
+		return true
+	}
+
+	if r.Tunnel == nil {
+		msg := "the tunnel server is disabled; start cape run with --tunnel-bind-addr"
+		conditions.MarkFalse(externalCluster, TunnelConnectedCondition, TunnelServerDisabledReason, clusterv1.ConditionSeverityError, msg)
+		conditions.MarkFalse(externalCluster, ReadyCondition, ClusterAccessFailedReason, clusterv1.ConditionSeverityInfo, msg)
+		return false
+	}
+	cluster := clusterScope.NamespacedName()
+	if connected, _ := r.Tunnel.Connected(cluster); !connected {
+		msg := fmt.Sprintf("waiting for the tunnel agent of cluster %s to connect", cluster)
+		conditions.MarkFalse(externalCluster, TunnelConnectedCondition, TunnelDisconnectedReason, clusterv1.ConditionSeverityWarning, msg)
+		conditions.MarkFalse(externalCluster, ReadyCondition, ClusterAccessFailedReason, clusterv1.ConditionSeverityInfo, msg)
+		return false
+	}
+	conditions.MarkTrue(externalCluster, TunnelConnectedCondition)
+	return true
+}
+
+// adoptTunnelToken sets the Cluster as the owner of the tunnel token Secret,
+// so that `clusterctl move` moves the Secret with the cluster. Unlike the
+// kubeconfig Secret, its name does not follow the naming convention that
+// clusterctl uses to find the Secrets of a cluster.
+func (r *ExternalClusterReconciler) adoptTunnelToken(ctx context.Context, clusterScope *scope.ExternalClusterScope) error {
+	if !clusterScope.ExternalCluster.Spec.Tunnel {
+		return nil
+	}
+	secret := &corev1.Secret{}
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: clusterScope.Namespace(), Name: tunnel.TokenSecretName(clusterScope.Name())}, secret)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to get the tunnel token secret")
+	}
+	if util.IsOwnedByObject(secret, clusterScope.Cluster) {
+		return nil
+	}
+	patchBase := client.MergeFrom(secret.DeepCopy())
+	if err := controllerutil.SetOwnerReference(clusterScope.Cluster, secret, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Client.Patch(ctx, secret, patchBase); err != nil {
+		return errors.Wrap(err, "failed to set the owner of the tunnel token secret")
+	}
+	return nil
+}
+
+// syncMachines creates a Machine and ExternalMachine for each node of the
+// external cluster. If MachinePools are enabled, nodes in a node pool are synced into the
+// MachinePool of the pool instead. The Machines of nodes that no longer exist,
+// or that are now synced into a MachinePool, are deleted.
+func (r *ExternalClusterReconciler) syncMachines(ctx context.Context, clusterScope *scope.ExternalClusterScope, nodes []corev1.Node) (reterr error) {
+	ctx, span := clusterScope.StartSpan(ctx, "sync machines")
+	defer func() { tracing.EndSpan(span, reterr) }()
+
+	// Nodes in a node pool are represented by the MachinePool of the pool.
+	standalone, pools := nodes, map[string][]corev1.Node(nil)
+	if spec := clusterScope.ExternalCluster.Spec.MachinePools; spec != nil {
+		standalone, pools = groupNodesByPool(nodes, nodePoolLabels(spec))
+	}
+
+	labelAllowlist := nodeLabelAllowlist(clusterScope.ExternalCluster)
+	var discovered []string
+	defer func() { r.recordNodesDiscovered(clusterScope.ExternalCluster, discovered) }()
+	for _, node := range standalone {
+		machine, externalMachine := convertNodeToExternalMachine(clusterScope.Cluster, &node, labelAllowlist)
+
+		var machineUpdated bool
 		err := r.Client.Create(ctx, machine)
-		if err != nil && !apierrors.IsAlreadyExists(err) {
-			return ctrl.Result{}, err
+		if apierrors.IsAlreadyExists(err) {
+			machine, machineUpdated, err = r.syncMachine(ctx, clusterScope, machine)
+		} else if err == nil {
+			metrics.NodeSyncOperations.WithLabelValues(clusterScope.Namespace(), clusterScope.Name(), metrics.OperationCreate).Inc()
+			discovered = append(discovered, node.Name)
+		}
+		if err != nil {
+			return err
+		}
+		externalMachineUpdated, err := r.syncExternalMachine(ctx, machine, externalMachine)
+		if err != nil {
+			return err
 		}
-		err = r.Client.Create(ctx, externalMachine)
-		if err != nil && !apierrors.IsAlreadyExists(err) {
-			return ctrl.Result{}, err
+		if machineUpdated || externalMachineUpdated {
+			metrics.NodeSyncOperations.WithLabelValues(clusterScope.Namespace(), clusterScope.Name(), metrics.OperationUpdate).Inc()
 		}
 	}
-	// TODO remove machines not found in the nodes. The problem is that the node within the k8s cluster will be preempted/deleted.
+	if err := r.deleteRemovedMachines(ctx, clusterScope, standalone); err != nil {
+		return err
+	}
+	return r.syncMachinePools(ctx, clusterScope, pools)
+}
 
-	// TODO calculate the ready from the conditions (one condition is false -> ready = false)
-	clusterScope.ExternalCluster.Status.Ready = true
-	return ctrl.Result{}, nil
+// deleteRemovedMachines deletes the Machines and ExternalMachines of the
+// cluster whose nodes are not among the standalone nodes, because the nodes
+// were removed from the external cluster or are synced into a MachinePool.
+// Only the Machines created by the node sync, which refer to an
+// ExternalMachine, are deleted.
+func (r *ExternalClusterReconciler) deleteRemovedMachines(ctx context.Context, clusterScope *scope.ExternalClusterScope, standalone []corev1.Node) error {
+	// The Machines are not labeled with the cluster name until Cluster API
+	// adopts them, so they are filtered by their spec instead.
+	machines := &clusterv1.MachineList{}
+	if err := r.Client.List(ctx, machines, client.InNamespace(clusterScope.Namespace())); err != nil {
+		return errors.Wrap(err, "failed to list machines")
+	}
+	nodeNames := make(map[string]struct{}, len(standalone))
+	for _, node := range standalone {
+		nodeNames[node.Name] = struct{}{}
+	}
+	var removed []string
+	defer func() { r.recordNodesRemoved(clusterScope.ExternalCluster, removed) }()
+	for i := range machines.Items {
+		machine := &machines.Items[i]
+		if machine.Spec.ClusterName != clusterScope.Name() || machine.Spec.InfrastructureRef.Kind != "ExternalMachine" || !machine.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if _, ok := nodeNames[machine.Name]; ok {
+			continue
+		}
+		ctrl.LoggerFrom(ctx).Info("Deleting Machine of removed node", "machine", machine.Name)
+		if err := r.Client.Delete(ctx, machine); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete machine %s", machine.Name)
+		}
+		externalMachine := &externalv1.ExternalMachine{ObjectMeta: metav1.ObjectMeta{Name: machine.Spec.InfrastructureRef.Name, Namespace: machine.Namespace}}
+		if err := r.Client.Delete(ctx, externalMachine); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete external machine %s", externalMachine.Name)
+		}
+		metrics.NodeSyncOperations.WithLabelValues(clusterScope.Namespace(), clusterScope.Name(), metrics.OperationDelete).Inc()
+		removed = append(removed, machine.Name)
+	}
+	return nil
+}
+
+// syncMachine updates the control plane label and the owner reference of an
+// existing Machine, and returns the Machine and whether it was updated. The
+// owner reference is updated after the cluster was moved with `clusterctl move`.
+func (r *ExternalClusterReconciler) syncMachine(ctx context.Context, clusterScope *scope.ExternalClusterScope, desired *clusterv1.Machine) (*clusterv1.Machine, bool, error) {
+	machine := &clusterv1.Machine{}
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(desired), machine); err != nil {
+		return nil, false, errors.Wrapf(err, "failed to get machine %s", desired.Name)
+	}
+	original := machine.DeepCopy()
+	if _, ok := desired.Labels[clusterv1.MachineControlPlaneLabelName]; ok {
+		if machine.Labels == nil {
+			machine.Labels = map[string]string{}
+		}
+		machine.Labels[clusterv1.MachineControlPlaneLabelName] = ""
+	} else {
+		delete(machine.Labels, clusterv1.MachineControlPlaneLabelName)
+	}
+	if err := controllerutil.SetOwnerReference(clusterScope.Cluster, machine, r.Scheme); err != nil {
+		return nil, false, err
+	}
+	if equality.Semantic.DeepEqual(original.ObjectMeta, machine.ObjectMeta) {
+		return machine, false, nil
+	}
+	if err := r.Client.Patch(ctx, machine, client.MergeFrom(original)); err != nil {
+		return nil, false, errors.Wrapf(err, "failed to update machine %s", machine.Name)
+	}
+	return machine, true, nil
+}
+
+// recordNodesDiscovered emits a single Event for the nodes for which Machines
+// were created in a sync, so that importing a large cluster does not flood
+// the Events.
+func (r *ExternalClusterReconciler) recordNodesDiscovered(externalCluster *externalv1.ExternalCluster, nodes []string) {
+	if len(nodes) == 0 {
+		return
+	}
+	r.Recorder.Eventf(externalCluster, corev1.EventTypeNormal, "NodesDiscovered", "Created Machines for %d nodes: %s", len(nodes), listNodes(nodes))
+}
+
+// recordNodesRemoved emits a single Event for the nodes whose Machines were
+// deleted in a sync.
+func (r *ExternalClusterReconciler) recordNodesRemoved(externalCluster *externalv1.ExternalCluster, nodes []string) {
+	if len(nodes) == 0 {
+		return
+	}
+	r.Recorder.Eventf(externalCluster, corev1.EventTypeNormal, "NodesRemoved", "Deleted Machines of %d nodes: %s", len(nodes), listNodes(nodes))
+}
+
+// listNodes joins the names of the nodes for an Event. Only the first ten
+// are listed, so that the message stays readable for large clusters.
+func listNodes(nodes []string) string {
+	const maxListed = 10
+	if len(nodes) <= maxListed {
+		return strings.Join(nodes, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(nodes[:maxListed], ", "), len(nodes)-maxListed)
+}
+
+// recordReadyTransition emits an Event when the Ready condition of the
+// ExternalCluster changes. Only transitions are recorded, so that a cluster
+// that is unreachable for a long time does not flood the Events.
+func (r *ExternalClusterReconciler) recordReadyTransition(externalCluster *externalv1.ExternalCluster, wasReady bool, previous *clusterv1.Condition) {
+	current := conditions.Get(externalCluster, ReadyCondition)
+	if current != nil && current.Status == corev1.ConditionFalse {
+		if previous == nil || previous.Status != current.Status || previous.Reason != current.Reason {
+			r.Recorder.Event(externalCluster, corev1.EventTypeWarning, current.Reason, current.Message)
+		}
+		return
+	}
+	wasReady = wasReady && (previous == nil || previous.Status == corev1.ConditionTrue)
+	if externalCluster.Status.Ready && !wasReady {
+		r.Recorder.Event(externalCluster, corev1.EventTypeNormal, "ClusterReady", "External cluster is accessible")
+	}
+}
+
+// recordKubeconfigRotation emits an Event when the kubeconfig of the cluster
+// changes. A hash of the last seen kubeconfig is kept in an annotation.
+func (r *ExternalClusterReconciler) recordKubeconfigRotation(externalCluster *externalv1.ExternalCluster, rawKubeconfig []byte) {
+	hash := fmt.Sprintf("%x", sha256.Sum256(rawKubeconfig))[:16]
+	previousHash, seen := externalCluster.Annotations[KubeconfigHashAnnotation]
+	if previousHash == hash {
+		return
+	}
+	if seen {
+		r.Recorder.Event(externalCluster, corev1.EventTypeNormal, "KubeconfigRotated", "The kubeconfig of the external cluster changed")
+	}
+	if externalCluster.Annotations == nil {
+		externalCluster.Annotations = map[string]string{}
+	}
+	externalCluster.Annotations[KubeconfigHashAnnotation] = hash
+}
+
+// fetchKubeconfig retrieves the kubeconfig of the external cluster from the
+// <cluster-name>-kubeconfig Secret in the management cluster.
+func (r *ExternalClusterReconciler) fetchKubeconfig(ctx context.Context, clusterScope *scope.ExternalClusterScope) (rawKubeconfig []byte, err error) {
+	ctx, span := clusterScope.StartSpan(ctx, "fetch kubeconfig")
+	defer func() { tracing.EndSpan(span, err) }()
+	log := ctrl.LoggerFrom(ctx)
+
+	// Reconcile the kubeconfig secret
+	log.V(4).Info("Fetching the external cluster kubeconfig from the associated")
+	kubeconfigSecret := &corev1.Secret{}
+	err = r.Client.Get(ctx, types.NamespacedName{
+		Namespace: clusterScope.Namespace(),
+		Name:      fmt.Sprintf("%s-kubeconfig", clusterScope.Name()),
+	}, kubeconfigSecret)
+	if err != nil {
+		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, KubeconfigSecretNotFoundReason, clusterv1.ConditionSeverityInfo, err.Error())
+		return nil, err
+	}
+	if kubeconfigSecret.Data == nil || kubeconfigSecret.Data["value"] == nil {
+		err = errors.New("kubeconfig does not contain secret")
+		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, KubeconfigInvalidReason, clusterv1.ConditionSeverityInfo, err.Error())
+		return nil, err
+	}
+
+	// The ClusterResourceSet controller and the ClusterCacheTracker expect
+	// the kubeconfig secret to be labelled and owned like the ones created
+	// by the Cluster API.
+	missingLabel := kubeconfigSecret.Labels[clusterv1.ClusterLabelName] != clusterScope.Cluster.Name
+	if len(kubeconfigSecret.ObjectMeta.OwnerReferences) == 0 || missingLabel {
+		log.V(4).Info("Updating the controller reference and labels on the kubeconfig secret")
+		if len(kubeconfigSecret.ObjectMeta.OwnerReferences) == 0 {
+			err = controllerutil.SetControllerReference(clusterScope.Cluster, kubeconfigSecret, r.Scheme)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if kubeconfigSecret.Labels == nil {
+			kubeconfigSecret.Labels = map[string]string{}
+		}
+		kubeconfigSecret.Labels[clusterv1.ClusterLabelName] = clusterScope.Cluster.Name
+
+		err = r.Client.Update(ctx, kubeconfigSecret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rawKubeconfig, err = kubeconfig.FromSecret(ctx, r.Client, clusterScope.NamespacedName())
+	if err != nil {
+		conditions.MarkFalse(clusterScope.ExternalCluster, ReadyCondition, KubeconfigSecretNotFoundReason, clusterv1.ConditionSeverityInfo, err.Error())
+		return nil, err
+	}
+	return rawKubeconfig, nil
+}
+
+// reconcileInventory refreshes the inventory in the ExternalCluster status if
+// it is older than the InventoryInterval. Failures are reported in the
+// InventoryCollected condition, but do not fail the reconcile.
+func (r *ExternalClusterReconciler) reconcileInventory(ctx context.Context, clusterScope *scope.ExternalClusterScope, clusterClient kubernetes.Interface, nodes []corev1.Node) {
+	log := ctrl.LoggerFrom(ctx)
+	current := clusterScope.ExternalCluster.Status.Inventory
+	if current != nil && current.LastUpdated != nil && time.Since(current.LastUpdated.Time) < r.InventoryInterval {
+		return
+	}
+
+	log.V(4).Info("Collecting the inventory of the external cluster")
+	ctx, span := clusterScope.StartSpan(ctx, "collect inventory")
+	clusterInventory, err := inventory.Collect(ctx, clusterClient, nodes)
+	tracing.EndSpan(span, err)
+	if err != nil {
+		log.Error(err, "Failed to collect the inventory of the external cluster")
+		conditions.MarkFalse(clusterScope.ExternalCluster, InventoryCollectedCondition, InventoryCollectionFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
+		return
+	}
+	clusterScope.ExternalCluster.Status.Inventory = clusterInventory
+	conditions.MarkTrue(clusterScope.ExternalCluster, InventoryCollectedCondition)
 }
 
 func (r *ExternalClusterReconciler) reconcileDelete(ctx context.Context, clusterScope *scope.ExternalClusterScope) (ctrl.Result, error) {
+	if err := r.deleteProjectedKubeconfigs(ctx, clusterScope.ExternalCluster, nil); err != nil {
+		return ctrl.Result{}, err
+	}
+	controllerutil.RemoveFinalizer(clusterScope.ExternalCluster, ClusterFinalizer)
+	metrics.DeleteClusterMetrics(clusterScope.NamespacedName())
+	if r.Transports != nil {
+		r.Transports.Forget(clusterScope.NamespacedName())
+	}
 	return ctrl.Result{}, nil
 }
 
-func convertNodeToExternalMachine(cluster *clusterv1.Cluster, node *corev1.Node) (*clusterv1.Machine, *externalv1.ExternalMachine) {
+// reconcileOrphanDelete cleans up an ExternalCluster that is being deleted
+// after its Cluster has already been removed.
+func (r *ExternalClusterReconciler) reconcileOrphanDelete(ctx context.Context, externalCluster *externalv1.ExternalCluster) error {
+	r.forgetCluster(client.ObjectKeyFromObject(externalCluster))
+	if !controllerutil.ContainsFinalizer(externalCluster, ClusterFinalizer) {
+		return nil
+	}
+	if err := r.deleteProjectedKubeconfigs(ctx, externalCluster, nil); err != nil {
+		return err
+	}
+	controllerutil.RemoveFinalizer(externalCluster, ClusterFinalizer)
+	return r.Client.Update(ctx, externalCluster)
+}
+
+// forgetCluster removes the metrics and the cached transport of the Cluster
+// of a deleted ExternalCluster.
+func (r *ExternalClusterReconciler) forgetCluster(externalCluster types.NamespacedName) {
+	value, ok := r.clusterKeys.LoadAndDelete(externalCluster)
+	if !ok {
+		return
+	}
+	clusterKey := value.(types.NamespacedName)
+	metrics.DeleteClusterMetrics(clusterKey)
+	if r.Transports != nil {
+		r.Transports.Forget(clusterKey)
+	}
+}
+
+func isNodeReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func convertNodeToExternalMachine(cluster *clusterv1.Cluster, node *corev1.Node, labelAllowlist []string) (*clusterv1.Machine, *externalv1.ExternalMachine) {
 	machineName := node.Name
+	labels := map[string]string{}
+	if inventory.IsControlPlaneNode(node) {
+		labels[clusterv1.MachineControlPlaneLabelName] = ""
+	}
 	return &clusterv1.Machine{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      machineName,
 				Namespace: cluster.Namespace,
+				Labels:    labels,
+				// The owner reference lets `clusterctl move` discover the
+				// Machine before Cluster API adopts it.
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: clusterv1.GroupVersion.String(),
+					Kind:       "Cluster",
+					Name:       cluster.Name,
+					UID:        cluster.UID,
+				}},
 			},
 			Spec: clusterv1.MachineSpec{
 				ClusterName: cluster.Name,
@@ -244,7 +746,17 @@ func convertNodeToExternalMachine(cluster *clusterv1.Cluster, node *corev1.Node)
 				ProviderID: node.Spec.ProviderID,
 			},
 			Status: externalv1.ExternalMachineStatus{
-				Addresses: node.Status.Addresses,
+				Addresses:   node.Status.Addresses,
+				NodeLabels:  filterNodeLabels(node.Labels, labelAllowlist),
+				Taints:      node.Spec.Taints,
+				Capacity:    node.Status.Capacity,
+				Allocatable: node.Status.Allocatable,
+				NodeInfo: &externalv1.NodeInfo{
+					OSImage:                 node.Status.NodeInfo.OSImage,
+					ContainerRuntimeVersion: node.Status.NodeInfo.ContainerRuntimeVersion,
+					Architecture:            node.Status.NodeInfo.Architecture,
+					KernelVersion:           node.Status.NodeInfo.KernelVersion,
+				},
 			},
 		}
 }
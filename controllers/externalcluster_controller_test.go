@@ -0,0 +1,209 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/metrics"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/remote"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestReconcileDeletedExternalCluster(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	g.Expect(externalv1.AddToScheme(scheme)).To(Succeed())
+
+	// The metrics are labeled with the name of the Cluster, which is gone by
+	// the time the ExternalCluster is.
+	externalClusterKey := types.NamespacedName{Namespace: "default", Name: "prod-infra"}
+	clusterKey := types.NamespacedName{Namespace: "default", Name: "prod"}
+	r := &ExternalClusterReconciler{
+		Client:     fake.NewClientBuilder().WithScheme(scheme).WithObjects(kubeconfigSecret(clusterKey, "https://prod.example.com")).Build(),
+		Scheme:     scheme,
+		Transports: remote.NewTransports(),
+	}
+	externalCluster := &externalv1.ExternalCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: externalClusterKey.Namespace, Name: externalClusterKey.Name},
+		Spec:       externalv1.ExternalClusterSpec{Proxy: &externalv1.ProxySpec{URL: "http://proxy.example.com:3128"}},
+	}
+	// transport returns the cached transport of the Cluster, which is shared
+	// until the Cluster is forgotten.
+	transport := func() http.RoundTripper {
+		config, err := remote.Config(ctx, r.Client, clusterKey, externalCluster, remote.Options{Transports: r.Transports})
+		g.Expect(err).NotTo(HaveOccurred())
+		return config.Transport
+	}
+	cachedTransport := transport()
+	g.Expect(transport()).To(BeIdenticalTo(cachedTransport))
+
+	r.clusterKeys.Store(externalClusterKey, clusterKey)
+	metrics.SetClusterReady(clusterKey, true)
+	metrics.ClusterImports.WithLabelValues(clusterKey.Namespace, clusterKey.Name, metrics.ImportSuccess).Inc()
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: externalClusterKey})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(metrics.ClusterReady.DeleteLabelValues(clusterKey.Namespace, clusterKey.Name)).To(BeFalse())
+	g.Expect(metrics.ClusterImports.DeleteLabelValues(clusterKey.Namespace, clusterKey.Name, metrics.ImportSuccess)).To(BeFalse())
+	g.Expect(transport()).NotTo(BeIdenticalTo(cachedTransport))
+	_, ok := r.clusterKeys.Load(externalClusterKey)
+	g.Expect(ok).To(BeFalse())
+
+	// Orphaned ExternalClusters are cleaned up as well.
+	cachedTransport = transport()
+	r.clusterKeys.Store(externalClusterKey, clusterKey)
+	metrics.SetClusterReady(clusterKey, true)
+	g.Expect(r.reconcileOrphanDelete(ctx, externalCluster)).To(Succeed())
+	g.Expect(metrics.ClusterReady.DeleteLabelValues(clusterKey.Namespace, clusterKey.Name)).To(BeFalse())
+	g.Expect(transport()).NotTo(BeIdenticalTo(cachedTransport))
+}
+
+// recordedEvents drains the Events of the FakeRecorder.
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestRecordReadyTransition(t *testing.T) {
+	notReady := func(reason string) *clusterv1.Condition {
+		return conditions.FalseCondition(ReadyCondition, reason, clusterv1.ConditionSeverityWarning, "%s failed", reason)
+	}
+	tests := []struct {
+		name      string
+		wasReady  bool
+		previous  *clusterv1.Condition
+		current   *clusterv1.Condition
+		ready     bool
+		wantEvent []string
+	}{
+		{
+			name:      "first failure",
+			current:   notReady(ClusterAccessFailedReason),
+			wantEvent: []string{"Warning ClusterAccessFailed ClusterAccessFailed failed"},
+		},
+		{
+			name:     "same failure",
+			previous: notReady(ClusterAccessFailedReason),
+			current:  notReady(ClusterAccessFailedReason),
+		},
+		{
+			name:      "other failure",
+			previous:  notReady(ClusterAccessFailedReason),
+			current:   notReady(NodesListFailedReason),
+			wantEvent: []string{"Warning NodesListFailed NodesListFailed failed"},
+		},
+		{
+			name:      "became ready",
+			ready:     true,
+			wantEvent: []string{"Normal ClusterReady External cluster is accessible"},
+		},
+		{
+			name:     "stayed ready",
+			wasReady: true,
+			ready:    true,
+		},
+		{
+			// The Ready status is only updated after a successful sync, so
+			// it can still be set from before the failure.
+			name:      "recovered",
+			wasReady:  true,
+			previous:  notReady(ClusterAccessFailedReason),
+			ready:     true,
+			wantEvent: []string{"Normal ClusterReady External cluster is accessible"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			recorder := record.NewFakeRecorder(10)
+			r := &ExternalClusterReconciler{Recorder: recorder}
+			externalCluster := &externalv1.ExternalCluster{Status: externalv1.ExternalClusterStatus{Ready: tt.ready}}
+			if tt.current != nil {
+				conditions.Set(externalCluster, tt.current)
+			}
+			r.recordReadyTransition(externalCluster, tt.wasReady, tt.previous)
+			g.Expect(recordedEvents(recorder)).To(Equal(tt.wantEvent))
+		})
+	}
+}
+
+func TestRecordKubeconfigRotation(t *testing.T) {
+	g := NewWithT(t)
+	recorder := record.NewFakeRecorder(10)
+	r := &ExternalClusterReconciler{Recorder: recorder}
+	externalCluster := &externalv1.ExternalCluster{}
+
+	// The first kubeconfig is not a rotation.
+	r.recordKubeconfigRotation(externalCluster, []byte("first"))
+	g.Expect(recordedEvents(recorder)).To(BeEmpty())
+	g.Expect(externalCluster.Annotations).To(HaveKey(KubeconfigHashAnnotation))
+	r.recordKubeconfigRotation(externalCluster, []byte("first"))
+	g.Expect(recordedEvents(recorder)).To(BeEmpty())
+
+	r.recordKubeconfigRotation(externalCluster, []byte("second"))
+	g.Expect(recordedEvents(recorder)).To(Equal([]string{"Normal KubeconfigRotated The kubeconfig of the external cluster changed"}))
+	r.recordKubeconfigRotation(externalCluster, []byte("second"))
+	g.Expect(recordedEvents(recorder)).To(BeEmpty())
+}
+
+func TestRecordNodeEvents(t *testing.T) {
+	var manyNodes []string
+	for i := 1; i <= 12; i++ {
+		manyNodes = append(manyNodes, fmt.Sprintf("node-%02d", i))
+	}
+	tests := []struct {
+		name           string
+		nodes          []string
+		wantDiscovered []string
+		wantRemoved    []string
+	}{
+		{
+			name: "no nodes",
+		},
+		{
+			name:           "few nodes",
+			nodes:          []string{"node-a", "node-b"},
+			wantDiscovered: []string{"Normal NodesDiscovered Created Machines for 2 nodes: node-a, node-b"},
+			wantRemoved:    []string{"Normal NodesRemoved Deleted Machines of 2 nodes: node-a, node-b"},
+		},
+		{
+			// Only the first ten nodes are listed.
+			name:           "many nodes",
+			nodes:          manyNodes,
+			wantDiscovered: []string{"Normal NodesDiscovered Created Machines for 12 nodes: node-01, node-02, node-03, node-04, node-05, node-06, node-07, node-08, node-09, node-10 and 2 more"},
+			wantRemoved:    []string{"Normal NodesRemoved Deleted Machines of 12 nodes: node-01, node-02, node-03, node-04, node-05, node-06, node-07, node-08, node-09, node-10 and 2 more"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			recorder := record.NewFakeRecorder(10)
+			r := &ExternalClusterReconciler{Recorder: recorder}
+			r.recordNodesDiscovered(&externalv1.ExternalCluster{}, tt.nodes)
+			g.Expect(recordedEvents(recorder)).To(Equal(tt.wantDiscovered))
+			r.recordNodesRemoved(&externalv1.ExternalCluster{}, tt.nodes)
+			g.Expect(recordedEvents(recorder)).To(Equal(tt.wantRemoved))
+		})
+	}
+}
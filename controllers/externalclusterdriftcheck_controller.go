@@ -0,0 +1,475 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/audit"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/drift"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/metrics"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/remote"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tracing"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tunnel"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/annotations"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/cluster-api/util/predicates"
+	utilyaml "sigs.k8s.io/cluster-api/util/yaml"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+const (
+	DriftCheckInvalidSpecReason = "InvalidSpec"
+	DriftCheckFailedReason      = "CheckFailed"
+
+	// ObjectsInSyncCondition reports whether the objects of an
+	// ExternalClusterDriftCheck match their desired state in all clusters.
+	ObjectsInSyncCondition clusterv1.ConditionType = "ObjectsInSync"
+	DriftDetectedReason                            = "DriftDetected"
+
+	defaultDriftCheckInterval = 5 * time.Minute
+)
+
+// ExternalClusterDriftCheckReconciler periodically compares the objects of an
+// ExternalClusterDriftCheck with their live state in the selected clusters,
+// and optionally reapplies the drifted ones.
+type ExternalClusterDriftCheckReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Tunnel is the tunnel server of `cape agent`, see ExternalClusterReconciler.
+	Tunnel *tunnel.Server
+
+	// Audit records the objects reapplied to the external clusters. It is nil
+	// if auditing is disabled.
+	Audit audit.Sink
+
+	// Transports caches the transports of the clusters with a tunnel or an
+	// egress proxy.
+	Transports *remote.Transports
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ExternalClusterDriftCheckReconciler) SetupWithManager(ctx context.Context, mgr ctrl.Manager) error {
+	err := ctrl.NewControllerManagedBy(mgr).
+		// Only spec changes trigger a check; the status is updated by every
+		// check.
+		For(&externalv1.ExternalClusterDriftCheck{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		WithEventFilter(predicates.ResourceNotPaused(ctrl.LoggerFrom(ctx))). // don't queue reconcile if resource is paused
+		Complete(r)
+	if err != nil {
+		return errors.Wrapf(err, "error creating controller")
+	}
+	return nil
+}
+
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=externalclusterdriftchecks,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=externalclusterdriftchecks/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=externalclusters,verbs=get;list;watch
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+func (r *ExternalClusterDriftCheckReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, reterr error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ExternalClusterDriftCheckReconciler.Reconcile", trace.WithAttributes(tracing.ObjectAttributes("ExternalClusterDriftCheck", req.Namespace, req.Name)...))
+	defer func() { tracing.EndSpan(span, reterr) }()
+	log := ctrl.LoggerFrom(ctx)
+
+	driftCheck := &externalv1.ExternalClusterDriftCheck{}
+	if err := r.Get(ctx, req.NamespacedName, driftCheck); err != nil {
+		if apierrors.IsNotFound(err) {
+			metrics.DeleteDriftMetrics(req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if !driftCheck.DeletionTimestamp.IsZero() {
+		metrics.DeleteDriftMetrics(req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+	if annotations.HasPaused(driftCheck) {
+		log.Info("ExternalClusterDriftCheck is marked as paused. Won't reconcile")
+		return ctrl.Result{}, nil
+	}
+
+	patchHelper, err := patch.NewHelper(driftCheck, r.Client)
+	if err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "failed to init patch helper")
+	}
+	defer func() {
+		if err := patchHelper.Patch(ctx, driftCheck); err != nil && reterr == nil {
+			reterr = err
+		}
+	}()
+
+	objects, err := desiredObjects(driftCheck.Spec.Objects)
+	if err != nil {
+		// Wait for the spec to be fixed.
+		conditions.MarkFalse(driftCheck, clusterv1.ReadyCondition, DriftCheckInvalidSpecReason, clusterv1.ConditionSeverityError, err.Error())
+		return ctrl.Result{}, nil
+	}
+	clusters, paused, err := r.selectedClusters(ctx, driftCheck)
+	if err != nil {
+		conditions.MarkFalse(driftCheck, clusterv1.ReadyCondition, DriftCheckFailedReason, clusterv1.ConditionSeverityError, err.Error())
+		return ctrl.Result{}, err
+	}
+	baselines, err := r.loadBaselines(ctx, driftCheck)
+	if err != nil {
+		conditions.MarkFalse(driftCheck, clusterv1.ReadyCondition, DriftCheckFailedReason, clusterv1.ConditionSeverityError, err.Error())
+		return ctrl.Result{}, err
+	}
+
+	previous := map[string]int{}
+	for _, status := range driftCheck.Status.Clusters {
+		previous[status.Name] = len(status.DriftedObjects)
+	}
+	var statuses []externalv1.DriftCheckClusterStatus
+	var drifted, failed []string
+	driftMetrics := map[string]metrics.ClusterDrift{}
+	for i := range clusters {
+		cluster := &clusters[i]
+		status := r.checkCluster(ctx, driftCheck, cluster, objects, baselines)
+		statuses = append(statuses, status)
+		if status.Message != "" {
+			failed = append(failed, cluster.Name)
+		}
+		clusterDrift := metrics.ClusterDrift{Objects: len(status.DriftedObjects)}
+		for _, obj := range status.DriftedObjects {
+			clusterDrift.Fields += len(obj.Fields)
+		}
+		driftMetrics[cluster.Name] = clusterDrift
+		if len(status.DriftedObjects) == 0 {
+			continue
+		}
+		drifted = append(drifted, cluster.Name)
+		if previous[cluster.Name] == 0 {
+			r.Recorder.Eventf(driftCheck, corev1.EventTypeWarning, "DriftDetected", "%d object(s) drifted in cluster %s", len(status.DriftedObjects), cluster.Name)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	metrics.SetDrift(req.NamespacedName, driftMetrics)
+	if err := r.saveBaselines(ctx, driftCheck, baselines, append(clusters, paused...), objects); err != nil {
+		conditions.MarkFalse(driftCheck, clusterv1.ReadyCondition, DriftCheckFailedReason, clusterv1.ConditionSeverityError, err.Error())
+		return ctrl.Result{}, err
+	}
+
+	driftCheck.Status.Clusters = statuses
+	now := metav1.Now()
+	driftCheck.Status.LastCheckTime = &now
+	if len(drifted) > 0 {
+		conditions.MarkFalse(driftCheck, ObjectsInSyncCondition, DriftDetectedReason, clusterv1.ConditionSeverityWarning,
+			"Objects drifted in %d cluster(s): %v", len(drifted), drifted)
+	} else {
+		conditions.MarkTrue(driftCheck, ObjectsInSyncCondition)
+	}
+	if len(failed) > 0 {
+		conditions.MarkFalse(driftCheck, clusterv1.ReadyCondition, DriftCheckFailedReason, clusterv1.ConditionSeverityWarning,
+			"Failed to check %d cluster(s): %v", len(failed), failed)
+	} else {
+		conditions.MarkTrue(driftCheck, clusterv1.ReadyCondition)
+	}
+
+	interval := defaultDriftCheckInterval
+	if driftCheck.Spec.Interval != nil && driftCheck.Spec.Interval.Duration > 0 {
+		interval = driftCheck.Spec.Interval.Duration
+	}
+	return ctrl.Result{RequeueAfter: interval}, nil
+}
+
+// desiredObject is an object to check. Desired is nil for objects given by
+// reference.
+type desiredObject struct {
+	ref     externalv1.DriftCheckObjectReference
+	desired *unstructured.Unstructured
+}
+
+// desiredObjects parses the objects of the spec. A manifest may contain
+// several objects.
+func desiredObjects(specObjects []externalv1.DriftCheckObject) ([]desiredObject, error) {
+	var objects []desiredObject
+	for i, specObject := range specObjects {
+		switch {
+		case specObject.Ref != nil && specObject.Manifest != "":
+			return nil, errors.Errorf("object %d has both a ref and a manifest", i)
+		case specObject.Ref != nil:
+			objects = append(objects, desiredObject{ref: *specObject.Ref})
+		case specObject.Manifest != "":
+			manifestObjects, err := utilyaml.ToUnstructured([]byte(specObject.Manifest))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid manifest of object %d", i)
+			}
+			for j := range manifestObjects {
+				obj := &manifestObjects[j]
+				if obj.GetAPIVersion() == "" || obj.GetKind() == "" || obj.GetName() == "" {
+					return nil, errors.Errorf("manifest of object %d should set apiVersion, kind and metadata.name", i)
+				}
+				objects = append(objects, desiredObject{
+					ref: externalv1.DriftCheckObjectReference{
+						APIVersion: obj.GetAPIVersion(),
+						Kind:       obj.GetKind(),
+						Namespace:  obj.GetNamespace(),
+						Name:       obj.GetName(),
+					},
+					desired: obj,
+				})
+			}
+		default:
+			return nil, errors.Errorf("object %d should have either a ref or a manifest", i)
+		}
+	}
+	return objects, nil
+}
+
+// selectedClusters returns the imported Clusters selected by the drift check.
+// Paused Clusters, for example while they are moved with `clusterctl move`,
+// are not checked, but are returned separately so that their baselines are
+// kept.
+func (r *ExternalClusterDriftCheckReconciler) selectedClusters(ctx context.Context, driftCheck *externalv1.ExternalClusterDriftCheck) (clusters, paused []clusterv1.Cluster, err error) {
+	selector, err := metav1.LabelSelectorAsSelector(&driftCheck.Spec.ClusterSelector)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid cluster selector")
+	}
+	clusterList := &clusterv1.ClusterList{}
+	if err := r.List(ctx, clusterList, client.InNamespace(driftCheck.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to list clusters")
+	}
+	for i := range clusterList.Items {
+		cluster := &clusterList.Items[i]
+		infraRef := cluster.Spec.InfrastructureRef
+		if infraRef == nil || infraRef.Kind != "ExternalCluster" || !cluster.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if annotations.IsPaused(cluster, cluster) {
+			paused = append(paused, *cluster)
+			continue
+		}
+		clusters = append(clusters, *cluster)
+	}
+	return clusters, paused, nil
+}
+
+// checkCluster compares the objects with their live state in the cluster.
+// The baselines of the objects checked by reference are looked up in, and
+// recorded into, baselines.
+func (r *ExternalClusterDriftCheckReconciler) checkCluster(ctx context.Context, driftCheck *externalv1.ExternalClusterDriftCheck, cluster *clusterv1.Cluster, objects []desiredObject, baselines map[string]string) externalv1.DriftCheckClusterStatus {
+	log := ctrl.LoggerFrom(ctx).WithValues("cluster", cluster.Name)
+	status := externalv1.DriftCheckClusterStatus{Name: cluster.Name}
+	clusterKey := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
+	clusterConfig, err := r.clusterConfig(ctx, cluster)
+	if err != nil {
+		status.Message = err.Error()
+		return status
+	}
+	remoteClient, err := client.New(clusterConfig, client.Options{})
+	if err != nil {
+		status.Message = errors.Wrap(err, "failed to create a client for the cluster").Error()
+		return status
+	}
+
+	for _, obj := range objects {
+		drifted, err := r.checkObject(ctx, driftCheck.Spec.Reapply, remoteClient, obj, baselines, baselineKey(cluster.Name, obj.ref))
+		if err != nil {
+			log.Error(err, "Failed to check object", "kind", obj.ref.Kind, "namespace", obj.ref.Namespace, "name", obj.ref.Name)
+			if status.Message == "" {
+				status.Message = err.Error()
+			}
+			continue
+		}
+		if drifted == nil {
+			continue
+		}
+		if drifted.Reapplied {
+			metrics.DriftReapplies.WithLabelValues(driftCheck.Namespace, driftCheck.Name, cluster.Name).Inc()
+			r.Recorder.Eventf(driftCheck, corev1.EventTypeNormal, "DriftReapplied", "Reapplied %s %s in cluster %s", drifted.Kind, objectName(drifted.Namespace, drifted.Name), clusterKey.Name)
+		}
+		status.DriftedObjects = append(status.DriftedObjects, *drifted)
+	}
+	return status
+}
+
+// checkObject compares an object with its live state, and reapplies it if it
+// drifted and reapply is set. It returns nil if the object did not drift.
+// The desired state of an object checked by reference is baselines[key]; it
+// is recorded there at the first check.
+func (r *ExternalClusterDriftCheckReconciler) checkObject(ctx context.Context, reapply bool, remoteClient client.Client, obj desiredObject, baselines map[string]string, key string) (*externalv1.DriftedObject, error) {
+	ref := obj.ref
+	live := &unstructured.Unstructured{}
+	live.SetAPIVersion(ref.APIVersion)
+	live.SetKind(ref.Kind)
+	mapping, err := remoteClient.RESTMapper().RESTMapping(live.GroupVersionKind().GroupKind(), live.GroupVersionKind().Version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unknown kind %s", ref.Kind)
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace && ref.Namespace == "" {
+		ref.Namespace = metav1.NamespaceDefault
+	}
+	drifted := &externalv1.DriftedObject{DriftCheckObjectReference: ref}
+
+	err = remoteClient.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, live)
+	if apierrors.IsNotFound(err) {
+		drifted.Missing = true
+		if reapply && obj.desired != nil {
+			create := obj.desired.DeepCopy()
+			create.SetNamespace(ref.Namespace)
+			if err := remoteClient.Create(ctx, create); err != nil {
+				return nil, errors.Wrapf(err, "failed to recreate %s %s", ref.Kind, objectName(ref.Namespace, ref.Name))
+			}
+			drifted.Reapplied = true
+		}
+		return drifted, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s %s", ref.Kind, objectName(ref.Namespace, ref.Name))
+	}
+
+	var desired map[string]interface{}
+	if obj.desired != nil {
+		desired = drift.Desired(obj.desired)
+	} else {
+		baseline, ok := baselines[key]
+		if !ok {
+			baseline, err := drift.Baseline(live)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to record the drift baseline of %s %s", ref.Kind, objectName(ref.Namespace, ref.Name))
+			}
+			baselines[key] = baseline
+			return nil, nil
+		}
+		desired, err = drift.ParseBaseline(baseline)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid drift baseline of %s %s", ref.Kind, objectName(ref.Namespace, ref.Name))
+		}
+	}
+	drifted.Fields = drift.Diff(desired, live)
+	if len(drifted.Fields) == 0 {
+		return nil, nil
+	}
+	if reapply {
+		data, err := json.Marshal(desired)
+		if err != nil {
+			return nil, err
+		}
+		if err := remoteClient.Patch(ctx, live, client.RawPatch(types.MergePatchType, data)); err != nil {
+			return nil, errors.Wrapf(err, "failed to reapply %s %s", ref.Kind, objectName(ref.Namespace, ref.Name))
+		}
+		drifted.Reapplied = true
+	}
+	return drifted, nil
+}
+
+// driftBaselinesName returns the name of the ConfigMap that holds the
+// baselines of the objects checked by reference. The baselines are kept in
+// the management cluster so that checking an object never modifies it.
+func driftBaselinesName(driftCheck *externalv1.ExternalClusterDriftCheck) string {
+	return driftCheck.Name + "-drift-baselines"
+}
+
+// baselineKey returns the key of the baseline of an object in a cluster, e.g.
+// prod_Deployment.apps.v1_kube-system_coredns. Underscores cannot occur in
+// the names, so the keys are unique. The reference is used as given in the
+// spec, so that the keys are known without accessing the cluster.
+func baselineKey(clusterName string, ref externalv1.DriftCheckObjectReference) string {
+	return strings.Join([]string{clusterName, ref.Kind + "." + strings.ReplaceAll(ref.APIVersion, "/", "."), ref.Namespace, ref.Name}, "_")
+}
+
+// loadBaselines returns the baselines recorded by earlier checks.
+func (r *ExternalClusterDriftCheckReconciler) loadBaselines(ctx context.Context, driftCheck *externalv1.ExternalClusterDriftCheck) (map[string]string, error) {
+	configMap := &corev1.ConfigMap{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: driftCheck.Namespace, Name: driftBaselinesName(driftCheck)}, configMap)
+	if apierrors.IsNotFound(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the drift baselines")
+	}
+	baselines := make(map[string]string, len(configMap.Data))
+	for key, baseline := range configMap.Data {
+		baselines[key] = baseline
+	}
+	return baselines, nil
+}
+
+// saveBaselines stores the baselines in the ConfigMap owned by the drift
+// check, dropping the ones of clusters and objects that are no longer
+// checked. The ConfigMap is deleted when there are no baselines.
+func (r *ExternalClusterDriftCheckReconciler) saveBaselines(ctx context.Context, driftCheck *externalv1.ExternalClusterDriftCheck, baselines map[string]string, clusters []clusterv1.Cluster, objects []desiredObject) error {
+	checked := map[string]bool{}
+	for _, cluster := range clusters {
+		for _, obj := range objects {
+			if obj.desired == nil {
+				checked[baselineKey(cluster.Name, obj.ref)] = true
+			}
+		}
+	}
+	for key := range baselines {
+		if !checked[key] {
+			delete(baselines, key)
+		}
+	}
+
+	configMap := &corev1.ConfigMap{}
+	configMap.Namespace = driftCheck.Namespace
+	configMap.Name = driftBaselinesName(driftCheck)
+	if len(baselines) == 0 {
+		err := r.Get(ctx, client.ObjectKeyFromObject(configMap), configMap)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err == nil {
+			err = r.Delete(ctx, configMap)
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "failed to delete the drift baselines")
+		}
+		return nil
+	}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, configMap, func() error {
+		configMap.Data = baselines
+		return controllerutil.SetControllerReference(driftCheck, configMap, r.Scheme)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to save the drift baselines")
+	}
+	return nil
+}
+
+// clusterConfig returns the rest.Config of the imported cluster, see
+// remote.Config.
+func (r *ExternalClusterDriftCheckReconciler) clusterConfig(ctx context.Context, cluster *clusterv1.Cluster) (*rest.Config, error) {
+	clusterKey := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
+	externalCluster := &externalv1.ExternalCluster{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: cluster.Spec.InfrastructureRef.Name}, externalCluster); err != nil {
+		return nil, errors.Wrap(err, "failed to get the ExternalCluster")
+	}
+	return remote.Config(ctx, r.Client, clusterKey, externalCluster, remote.Options{Tunnel: r.Tunnel, Audit: r.Audit, Transports: r.Transports})
+}
+
+func objectName(namespace string, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
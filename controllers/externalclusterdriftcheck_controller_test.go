@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDriftBaselines(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	g.Expect(externalv1.AddToScheme(scheme)).To(Succeed())
+	driftCheck := &externalv1.ExternalClusterDriftCheck{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "addons", UID: "uid"}}
+	r := &ExternalClusterDriftCheckReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(driftCheck).Build(),
+		Scheme: scheme,
+	}
+
+	live := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "coredns"},
+		Data:       map[string]string{"Corefile": ".:53"},
+	}
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+	remoteClient := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithRESTMapper(mapper).WithObjects(live).Build()
+	obj := desiredObject{ref: externalv1.DriftCheckObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: "kube-system", Name: "coredns"}}
+	key := baselineKey("workload", obj.ref)
+	g.Expect(key).To(Equal("workload_ConfigMap.v1_kube-system_coredns"))
+	clusters := []clusterv1.Cluster{{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "workload"}}}
+
+	// The first check records the baseline without modifying the object.
+	baselines, err := r.loadBaselines(ctx, driftCheck)
+	g.Expect(err).NotTo(HaveOccurred())
+	drifted, err := r.checkObject(ctx, false, remoteClient, obj, baselines, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(drifted).To(BeNil())
+	g.Expect(baselines).To(HaveKey(key))
+	g.Expect(r.saveBaselines(ctx, driftCheck, baselines, clusters, []desiredObject{obj})).To(Succeed())
+
+	got := &corev1.ConfigMap{}
+	g.Expect(remoteClient.Get(ctx, client.ObjectKeyFromObject(live), got)).To(Succeed())
+	g.Expect(got.Annotations).To(BeEmpty())
+	g.Expect(got.ResourceVersion).To(Equal(live.ResourceVersion))
+
+	configMap := &corev1.ConfigMap{}
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "addons-drift-baselines"}, configMap)).To(Succeed())
+	g.Expect(configMap.Data).To(HaveKey(key))
+	g.Expect(metav1.IsControlledBy(configMap, driftCheck)).To(BeTrue())
+
+	// Later checks compare with the stored baseline.
+	got.Data["Corefile"] = ".:5353"
+	g.Expect(remoteClient.Update(ctx, got)).To(Succeed())
+	baselines, err = r.loadBaselines(ctx, driftCheck)
+	g.Expect(err).NotTo(HaveOccurred())
+	drifted, err = r.checkObject(ctx, false, remoteClient, obj, baselines, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(drifted).NotTo(BeNil())
+	g.Expect(drifted.Fields).To(Equal([]string{".data.Corefile"}))
+	g.Expect(drifted.Reapplied).To(BeFalse())
+
+	// The baselines of clusters that are no longer checked are dropped.
+	g.Expect(r.saveBaselines(ctx, driftCheck, baselines, nil, []desiredObject{obj})).To(Succeed())
+	err = r.Get(ctx, client.ObjectKeyFromObject(configMap), configMap)
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestDriftCheckSelectedClusters(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	g.Expect(clusterv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(externalv1.AddToScheme(scheme)).To(Succeed())
+	cluster := func(name string, mutate func(*clusterv1.Cluster)) client.Object {
+		c := &clusterv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{"drift": "true"}},
+			Spec:       clusterv1.ClusterSpec{InfrastructureRef: &corev1.ObjectReference{Kind: "ExternalCluster", Name: name}},
+		}
+		if mutate != nil {
+			mutate(c)
+		}
+		return c
+	}
+	r := &ExternalClusterDriftCheckReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			cluster("selected", nil),
+			cluster("unlabeled", func(c *clusterv1.Cluster) { c.Labels = nil }),
+			cluster("other-namespace", func(c *clusterv1.Cluster) { c.Namespace = "other" }),
+			cluster("other-infrastructure", func(c *clusterv1.Cluster) { c.Spec.InfrastructureRef.Kind = "DockerCluster" }),
+			cluster("paused", func(c *clusterv1.Cluster) { c.Spec.Paused = true }),
+			cluster("paused-annotation", func(c *clusterv1.Cluster) {
+				c.Annotations = map[string]string{clusterv1.PausedAnnotation: ""}
+			}),
+		).Build(),
+		Scheme: scheme,
+	}
+	driftCheck := &externalv1.ExternalClusterDriftCheck{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "addons"},
+		Spec: externalv1.ExternalClusterDriftCheckSpec{
+			ClusterSelector: metav1.LabelSelector{MatchLabels: map[string]string{"drift": "true"}},
+		},
+	}
+
+	clusters, paused, err := r.selectedClusters(ctx, driftCheck)
+	g.Expect(err).NotTo(HaveOccurred())
+	names := func(clusters []clusterv1.Cluster) []string {
+		var names []string
+		for _, c := range clusters {
+			names = append(names, c.Name)
+		}
+		return names
+	}
+	g.Expect(names(clusters)).To(ConsistOf("selected"))
+	g.Expect(names(paused)).To(ConsistOf("paused", "paused-annotation"))
+}
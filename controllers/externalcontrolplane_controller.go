@@ -3,15 +3,28 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/pkg/errors"
 	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/audit"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/metrics"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/remote"
 	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tracing"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tunnel"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/cluster-api/util"
 	"sigs.k8s.io/cluster-api/util/annotations"
+	"sigs.k8s.io/cluster-api/util/conditions"
 	"sigs.k8s.io/cluster-api/util/predicates"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -29,7 +42,27 @@ const (
 // ExternalControlPlaneReconciler reconciles a ExternalControlPlane object
 type ExternalControlPlaneReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Tunnel is the tunnel server of `cape agent`, see ExternalClusterReconciler.
+	Tunnel *tunnel.Server
+
+	// Audit records the mutating requests to the external clusters. Auditing
+	// is disabled if it is nil.
+	Audit audit.Sink
+
+	// Transports caches the transports of the clusters with a tunnel or an
+	// egress proxy.
+	Transports *remote.Transports
+
+	// CertificateExpiryWarning and CertificateExpiryCritical are the
+	// thresholds before the expiry of a certificate of the control plane at
+	// which the CertificatesValid condition becomes false with severity
+	// Warning and Error. They default to DefaultCertificateExpiryWarning and
+	// DefaultCertificateExpiryCritical.
+	CertificateExpiryWarning  time.Duration
+	CertificateExpiryCritical time.Duration
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -55,21 +88,35 @@ func (r *ExternalControlPlaneReconciler) SetupWithManager(ctx context.Context, m
 		return errors.Wrap(err, "failed adding Watch for Clusters to controller manager")
 	}
 
+	// Add a watch on ExternalClusters, whose readiness is the readiness of
+	// the control plane.
+	err = c.Watch(
+		&source.Kind{Type: &externalinfrav1.ExternalCluster{}},
+		handler.EnqueueRequestsFromMapFunc(r.ExternalClusterToExternalControlPlane),
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed adding Watch for ExternalClusters to controller manager")
+	}
+
 	return nil
 }
 
 // +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters;clusters/status,verbs=get;list;watch
 // +kubebuilder:rbac:groups=controlplane.cluster.x-k8s.io,resources=externalcontrolplanes,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=controlplane.cluster.x-k8s.io,resources=externalcontrolplanes/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=externalclusters,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 func (r *ExternalControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, reterr error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ExternalControlPlaneReconciler.Reconcile", trace.WithAttributes(tracing.ObjectAttributes("ExternalControlPlane", req.Namespace, req.Name)...))
+	defer func() { tracing.EndSpan(span, reterr) }()
 	log := ctrl.LoggerFrom(ctx)
 
 	log.Info("Fetching ExternalControlPLane from storage")
 	var externalControlPlane externalv1.ExternalControlPlane
 	if err := r.Get(ctx, req.NamespacedName, &externalControlPlane); err != nil {
 		if apierrors.IsNotFound(err) {
-			return reconcile.Result{}, nil
+			return reconcile.Result{}, r.deleteControlPlaneMetrics(ctx, req.NamespacedName)
 		}
 		return reconcile.Result{}, err
 	}
@@ -100,7 +147,11 @@ func (r *ExternalControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl
 		return ctrl.Result{}, errors.Errorf("failed to create scope: %+v", err)
 	}
 
+	wasReady := externalControlPlane.Status.Ready
 	defer func() {
+		if !wasReady && clusterScope.ExternalControlPlane.Status.Ready {
+			r.Recorder.Event(clusterScope.ExternalControlPlane, corev1.EventTypeNormal, "ControlPlaneReady", "External control plane is ready")
+		}
 		if err := clusterScope.Close(); err != nil && reterr == nil {
 			reterr = err
 		}
@@ -108,7 +159,7 @@ func (r *ExternalControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl
 	}()
 
 	// Handle deleted clusters
-	if !cluster.DeletionTimestamp.IsZero() {
+	if !cluster.DeletionTimestamp.IsZero() || !externalControlPlane.DeletionTimestamp.IsZero() {
 		return r.reconcileDelete(ctx, clusterScope)
 	}
 	return r.reconcileNormal(ctx, clusterScope)
@@ -117,17 +168,86 @@ func (r *ExternalControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl
 func (r *ExternalControlPlaneReconciler) reconcileNormal(ctx context.Context, clusterScope *scope.ControlPlaneScope) (ctrl.Result, error) {
 	// externalControlPlane := clusterScope.ExternalControlPlane
 	// controllerutil.AddFinalizer(externalControlPlane, ControlPlaneFinalizer)
-	// TODO actually check if it is ready
-	clusterScope.ExternalControlPlane.Status.Ready = true
-	clusterScope.ExternalControlPlane.Status.Initialized = true
-	return ctrl.Result{}, nil
+	// The control plane of an external cluster is ready when the
+	// ExternalCluster can reach its API server. Initialized is never reset,
+	// as the Cluster API contract requires, so that the ClusterResourceSets
+	// and the Cluster conditions do not flap when the cluster is briefly
+	// unreachable.
+	externalControlPlane := clusterScope.ExternalControlPlane
+	externalCluster, err := r.getExternalCluster(ctx, clusterScope.Cluster)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if externalCluster == nil {
+		externalControlPlane.Status.Ready = false
+		conditions.MarkFalse(externalControlPlane, clusterv1.ReadyCondition, clusterv1.WaitingForInfrastructureFallbackReason, clusterv1.ConditionSeverityInfo, "")
+		return ctrl.Result{}, nil
+	}
+	externalControlPlane.Status.Ready = externalCluster.Status.Ready
+	if externalCluster.Status.Ready {
+		externalControlPlane.Status.Initialized = true
+	}
+	conditions.SetMirror(externalControlPlane, clusterv1.ReadyCondition, externalCluster)
+	if !externalCluster.Status.Ready {
+		return ctrl.Result{}, nil
+	}
+
+	if last := externalControlPlane.Status.LastCertificateCheckTime; last == nil || time.Since(last.Time) >= certificateCheckInterval {
+		r.reconcileCertificates(ctx, clusterScope, externalCluster)
+	}
+	if report := externalControlPlane.Status.UpgradeReadiness; report == nil || time.Since(report.LastCheckTime.Time) >= upgradeCheckInterval {
+		r.reconcileUpgradeReadiness(ctx, clusterScope, externalCluster)
+	}
+	return ctrl.Result{RequeueAfter: certificateCheckInterval}, nil
+}
+
+// clusterConfig returns the rest.Config of the external cluster, see
+// remote.Config.
+func (r *ExternalControlPlaneReconciler) clusterConfig(ctx context.Context, clusterKey types.NamespacedName, externalCluster *externalinfrav1.ExternalCluster) (*rest.Config, error) {
+	return remote.Config(ctx, r.Client, clusterKey, externalCluster, remote.Options{Tunnel: r.Tunnel, Audit: r.Audit, Transports: r.Transports})
+}
+
+// getExternalCluster returns the infrastructure of the Cluster, or nil if it
+// is not an ExternalCluster or does not exist yet.
+func (r *ExternalControlPlaneReconciler) getExternalCluster(ctx context.Context, cluster *clusterv1.Cluster) (*externalinfrav1.ExternalCluster, error) {
+	infraRef := cluster.Spec.InfrastructureRef
+	if infraRef == nil || infraRef.Kind != "ExternalCluster" {
+		return nil, nil
+	}
+	externalCluster := &externalinfrav1.ExternalCluster{}
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: infraRef.Name}, externalCluster)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the external cluster")
+	}
+	return externalCluster, nil
 }
 
 func (r *ExternalControlPlaneReconciler) reconcileDelete(ctx context.Context, clusterScope *scope.ControlPlaneScope) (ctrl.Result, error) {
 	// controllerutil.RemoveFinalizer(clusterScope.ExternalControlPlane, ControlPlaneFinalizer)
+	metrics.DeleteCertificateExpiry(types.NamespacedName{Namespace: clusterScope.Namespace(), Name: clusterScope.Name()})
 	return ctrl.Result{}, nil
 }
 
+// deleteControlPlaneMetrics removes the metrics of a deleted
+// ExternalControlPlane. They are labeled with the name of its Cluster, which
+// is found through the control plane reference of the Cluster.
+func (r *ExternalControlPlaneReconciler) deleteControlPlaneMetrics(ctx context.Context, externalControlPlane types.NamespacedName) error {
+	clusters := &clusterv1.ClusterList{}
+	if err := r.Client.List(ctx, clusters, client.InNamespace(externalControlPlane.Namespace)); err != nil {
+		return errors.Wrap(err, "failed to list clusters")
+	}
+	for _, cluster := range clusters.Items {
+		controlPlaneRef := cluster.Spec.ControlPlaneRef
+		if controlPlaneRef != nil && controlPlaneRef.Kind == "ExternalControlPlane" && controlPlaneRef.Name == externalControlPlane.Name {
+			metrics.DeleteCertificateExpiry(types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name})
+		}
+	}
+	return nil
+}
+
 // ClusterToExternalControlPlane is a handler.ToRequestsFunc to be used to enqueue requests for reconciliation
 // for ExternalControlPlane based on updates to a Cluster.
 func (r *ExternalControlPlaneReconciler) ClusterToExternalControlPlane(o client.Object) []ctrl.Request {
@@ -143,3 +263,18 @@ func (r *ExternalControlPlaneReconciler) ClusterToExternalControlPlane(o client.
 
 	return nil
 }
+
+// ExternalClusterToExternalControlPlane is a handler.ToRequestsFunc to be used to enqueue requests for reconciliation
+// for ExternalControlPlane based on updates to an ExternalCluster.
+func (r *ExternalControlPlaneReconciler) ExternalClusterToExternalControlPlane(o client.Object) []ctrl.Request {
+	c, ok := o.(*externalinfrav1.ExternalCluster)
+	if !ok {
+		panic(fmt.Sprintf("Expected an ExternalCluster but got a %T", o))
+	}
+
+	cluster, err := util.GetOwnerCluster(context.TODO(), r.Client, c.ObjectMeta)
+	if err != nil || cluster == nil {
+		return nil
+	}
+	return r.ClusterToExternalControlPlane(cluster)
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/cluster-api/util/secret"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// kubeconfigSecret returns the kubeconfig Secret of the cluster, with a
+// token user for the API server at host.
+func kubeconfigSecret(cluster types.NamespacedName, host string) *corev1.Secret {
+	config := clientcmdapi.NewConfig()
+	config.Clusters[cluster.Name] = &clientcmdapi.Cluster{Server: host}
+	config.AuthInfos[cluster.Name] = &clientcmdapi.AuthInfo{Token: "token"}
+	config.Contexts[cluster.Name] = &clientcmdapi.Context{Cluster: cluster.Name, AuthInfo: cluster.Name}
+	config.CurrentContext = cluster.Name
+	raw, err := clientcmd.Write(*config)
+	if err != nil {
+		panic(err)
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: cluster.Namespace, Name: secret.Name(cluster.Name, secret.Kubeconfig)},
+		Data:       map[string][]byte{secret.KubeconfigDataName: raw},
+	}
+}
+
+func TestExternalControlPlaneClusterConfigTraced(t *testing.T) {
+	g := NewWithT(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"major":"1","minor":"23","gitVersion":"v1.23.5"}`))
+	}))
+	defer server.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tracerProvider := tracing.NewTracerProvider(exporter, sdktrace.AlwaysSample())
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(tracerProvider)
+	defer otel.SetTracerProvider(previous)
+
+	cluster := types.NamespacedName{Namespace: "default", Name: "cluster"}
+	r := &ExternalControlPlaneReconciler{
+		Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(kubeconfigSecret(cluster, server.URL)).Build(),
+	}
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "ExternalControlPlaneReconciler.Reconcile")
+	config, err := r.clusterConfig(ctx, cluster, &externalinfrav1.ExternalCluster{})
+	g.Expect(err).NotTo(HaveOccurred())
+	clientset, err := kubernetes.NewForConfig(config)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = clientset.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Raw()
+	g.Expect(err).NotTo(HaveOccurred())
+	span.End()
+	g.Expect(tracerProvider.ForceFlush(context.Background())).To(Succeed())
+
+	spans := exporter.GetSpans()
+	g.Expect(spans).To(HaveLen(2))
+	g.Expect(spans[0].Name).To(Equal("remote GET"))
+	g.Expect(spans[0].Parent.SpanID()).To(Equal(spans[1].SpanContext.SpanID()))
+}
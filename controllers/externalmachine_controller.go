@@ -6,8 +6,12 @@ import (
 	"github.com/pkg/errors"
 	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
 	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/cluster-api/util"
 	"sigs.k8s.io/cluster-api/util/annotations"
@@ -22,7 +26,8 @@ import (
 // ExternalMachineReconciler reconciles a ExternalMachine object
 type ExternalMachineReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -51,8 +56,11 @@ func (r *ExternalMachineReconciler) SetupWithManager(ctx context.Context, mgr ct
 // +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines;machines/status,verbs=get;list;watch
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=externalmachines,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=externalmachines/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 func (r *ExternalMachineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, reterr error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ExternalMachineReconciler.Reconcile", trace.WithAttributes(tracing.ObjectAttributes("ExternalMachine", req.Namespace, req.Name)...))
+	defer func() { tracing.EndSpan(span, reterr) }()
 	log := ctrl.LoggerFrom(ctx)
 
 	log.Info("Fetching ExternalMachine from storage")
@@ -101,7 +109,11 @@ func (r *ExternalMachineReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		return ctrl.Result{}, errors.Errorf("failed to create scope: %+v", err)
 	}
 
+	wasReady := externalMachine.Status.Ready
 	defer func() {
+		if !wasReady && machineScope.ExternalMachine.Status.Ready {
+			r.Recorder.Event(machineScope.ExternalMachine, corev1.EventTypeNormal, "MachineReady", "External machine is ready")
+		}
 		if err := machineScope.Close(); err != nil && reterr == nil {
 			reterr = err
 		}
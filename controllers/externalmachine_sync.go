@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// syncExternalMachine creates or updates the ExternalMachine of a node, so
+// that its status mirrors the node, and returns whether an existing
+// ExternalMachine was updated. The ExternalMachine is owned by the Machine,
+// like Cluster API does for the infrastructure of a Machine.
+func (r *ExternalClusterReconciler) syncExternalMachine(ctx context.Context, machine *clusterv1.Machine, desired *externalv1.ExternalMachine) (bool, error) {
+	externalMachine := &externalv1.ExternalMachine{ObjectMeta: desired.ObjectMeta}
+	setStatus := func() {
+		status := &externalMachine.Status
+		status.Addresses = desired.Status.Addresses
+		status.NodeLabels = desired.Status.NodeLabels
+		status.Taints = desired.Status.Taints
+		status.Capacity = desired.Status.Capacity
+		status.Allocatable = desired.Status.Allocatable
+		status.NodeInfo = desired.Status.NodeInfo
+	}
+	result, err := controllerutil.CreateOrPatch(ctx, r.Client, externalMachine, func() error {
+		externalMachine.Spec.ProviderID = desired.Spec.ProviderID
+		setStatus()
+		return controllerutil.SetOwnerReference(machine, externalMachine, r.Scheme)
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to sync external machine %s", desired.Name)
+	}
+	switch result {
+	case controllerutil.OperationResultCreated:
+		// The status is not set on create.
+		setStatus()
+		if err := r.Client.Status().Update(ctx, externalMachine); err != nil {
+			return false, errors.Wrapf(err, "failed to update the status of external machine %s", desired.Name)
+		}
+	case controllerutil.OperationResultUpdated, controllerutil.OperationResultUpdatedStatus, controllerutil.OperationResultUpdatedStatusOnly:
+		return true, nil
+	}
+	return false, nil
+}
+
+// nodeLabelAllowlist returns the node labels that are mirrored into the
+// ExternalMachines of the cluster.
+func nodeLabelAllowlist(externalCluster *externalv1.ExternalCluster) []string {
+	if len(externalCluster.Spec.NodeLabelAllowlist) > 0 {
+		return externalCluster.Spec.NodeLabelAllowlist
+	}
+	return externalv1.DefaultNodeLabelAllowlist
+}
+
+// filterNodeLabels returns the labels that match the allowlist. An entry
+// ending with * matches all labels with that prefix.
+func filterNodeLabels(labels map[string]string, allowlist []string) map[string]string {
+	var filtered map[string]string
+	for key, value := range labels {
+		for _, allowed := range allowlist {
+			if key == allowed || (strings.HasSuffix(allowed, "*") && strings.HasPrefix(key, strings.TrimSuffix(allowed, "*"))) {
+				if filtered == nil {
+					filtered = map[string]string{}
+				}
+				filtered[key] = value
+				break
+			}
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+)
+
+func TestNodeLabelAllowlist(t *testing.T) {
+	g := NewWithT(t)
+
+	externalCluster := &externalv1.ExternalCluster{}
+	g.Expect(nodeLabelAllowlist(externalCluster)).To(Equal(externalv1.DefaultNodeLabelAllowlist))
+	externalCluster.Spec.NodeLabelAllowlist = []string{}
+	g.Expect(nodeLabelAllowlist(externalCluster)).To(Equal(externalv1.DefaultNodeLabelAllowlist))
+	externalCluster.Spec.NodeLabelAllowlist = []string{"example.com/*"}
+	g.Expect(nodeLabelAllowlist(externalCluster)).To(Equal([]string{"example.com/*"}))
+}
+
+func TestFilterNodeLabels(t *testing.T) {
+	labels := map[string]string{
+		"kubernetes.io/arch":            "amd64",
+		"kubernetes.io/hostname":        "worker-1",
+		"node-role.kubernetes.io/infra": "",
+		"example.com/team":              "payments",
+		"example.com/tier":              "gold",
+		"example.community/owner":       "ops",
+	}
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		allowlist []string
+		want      map[string]string
+	}{
+		{
+			name:      "exact keys",
+			labels:    labels,
+			allowlist: []string{"kubernetes.io/arch", "kubernetes.io/os"},
+			want:      map[string]string{"kubernetes.io/arch": "amd64"},
+		},
+		{
+			name:      "exact keys are not prefixes",
+			labels:    labels,
+			allowlist: []string{"kubernetes.io/", "example.com"},
+		},
+		{
+			name:      "prefix",
+			labels:    labels,
+			allowlist: []string{"example.com/*"},
+			want:      map[string]string{"example.com/team": "payments", "example.com/tier": "gold"},
+		},
+		{
+			name:      "prefix without a separator",
+			labels:    labels,
+			allowlist: []string{"example.com*"},
+			want:      map[string]string{"example.com/team": "payments", "example.com/tier": "gold", "example.community/owner": "ops"},
+		},
+		{
+			name:      "star matches all",
+			labels:    labels,
+			allowlist: []string{"*"},
+			want:      labels,
+		},
+		{
+			name:      "exact keys and prefixes",
+			labels:    labels,
+			allowlist: []string{"kubernetes.io/hostname", "node-role.kubernetes.io/*"},
+			want:      map[string]string{"kubernetes.io/hostname": "worker-1", "node-role.kubernetes.io/infra": ""},
+		},
+		{
+			name:      "empty allowlist",
+			labels:    labels,
+			allowlist: []string{},
+		},
+		{
+			name:      "nil labels",
+			allowlist: externalv1.DefaultNodeLabelAllowlist,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			got := filterNodeLabels(tt.labels, tt.allowlist)
+			if tt.want == nil {
+				// No matches leave the labels of the ExternalMachine unset.
+				g.Expect(got).To(BeNil())
+				return
+			}
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	capekubeconfig "github.com/platform9-incubator/cluster-api-provider-external/pkg/kubeconfig"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	KubeconfigProjectedCondition         clusterv1.ConditionType = "KubeconfigProjected"
+	KubeconfigProjectionFailedReason                             = "KubeconfigProjectionFailed"
+	KubeconfigProjectionNotAllowedReason                         = "KubeconfigProjectionNotAllowed"
+
+	// AllNamespaces in the KubeconfigProjectionNamespaces of the
+	// ExternalClusterReconciler allows projection into any namespace.
+	AllNamespaces = "*"
+
+	// ProjectedFromNameLabel and ProjectedFromNamespaceLabel identify the
+	// ExternalCluster that a projected kubeconfig Secret was copied from. Owner
+	// references cannot cross namespaces, so these labels are used to garbage
+	// collect the copies.
+	ProjectedFromNameLabel      = "externalcluster.infrastructure.cluster.x-k8s.io/projected-from-name"
+	ProjectedFromNamespaceLabel = "externalcluster.infrastructure.cluster.x-k8s.io/projected-from-namespace"
+)
+
+// kubeconfigProjectionNamespaces returns the namespaces that the kubeconfig of
+// the ExternalCluster should be projected into, merging the spec and the
+// KubeconfigProjectionAnnotation.
+func kubeconfigProjectionNamespaces(externalCluster *externalv1.ExternalCluster) []string {
+	namespaces := sets.NewString()
+	if externalCluster.Spec.KubeconfigProjection != nil {
+		namespaces.Insert(externalCluster.Spec.KubeconfigProjection.Namespaces...)
+	}
+	for _, namespace := range strings.Split(externalCluster.Annotations[externalv1.KubeconfigProjectionAnnotation], ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			namespaces.Insert(namespace)
+		}
+	}
+	return namespaces.List()
+}
+
+func kubeconfigProjectionSecretName(clusterName string, externalCluster *externalv1.ExternalCluster) string {
+	if externalCluster.Spec.KubeconfigProjection != nil && externalCluster.Spec.KubeconfigProjection.SecretName != "" {
+		return externalCluster.Spec.KubeconfigProjection.SecretName
+	}
+	return fmt.Sprintf("%s-kubeconfig", clusterName)
+}
+
+// reconcileKubeconfigProjection copies a sanitized version of the kubeconfig
+// into the configured namespaces that are allowed by the
+// KubeconfigProjectionNamespaces, and removes copies from other namespaces.
+// Failures are only reported in the KubeconfigProjected condition, so that
+// they do not block the reconcile of the cluster.
+func (r *ExternalClusterReconciler) reconcileKubeconfigProjection(ctx context.Context, clusterScope *scope.ExternalClusterScope, rawKubeconfig []byte) {
+	log := ctrl.LoggerFrom(ctx)
+	externalCluster := clusterScope.ExternalCluster
+
+	namespaces := kubeconfigProjectionNamespaces(externalCluster)
+	if len(namespaces) == 0 {
+		if err := r.deleteProjectedKubeconfigs(ctx, externalCluster, nil); err != nil {
+			log.Error(err, "Failed to delete the projected kubeconfigs")
+			conditions.MarkFalse(externalCluster, KubeconfigProjectedCondition, KubeconfigProjectionFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
+			return
+		}
+		// The finalizer is only needed to delete the copies.
+		conditions.Delete(externalCluster, KubeconfigProjectedCondition)
+		controllerutil.RemoveFinalizer(externalCluster, ClusterFinalizer)
+		return
+	}
+	controllerutil.AddFinalizer(externalCluster, ClusterFinalizer)
+
+	allowed, denied := r.allowedProjectionNamespaces(namespaces)
+	if err := r.projectKubeconfig(ctx, clusterScope, allowed, rawKubeconfig); err != nil {
+		log.Error(err, "Failed to project the kubeconfig")
+		conditions.MarkFalse(externalCluster, KubeconfigProjectedCondition, KubeconfigProjectionFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
+		return
+	}
+	if len(denied) > 0 {
+		conditions.MarkFalse(externalCluster, KubeconfigProjectedCondition, KubeconfigProjectionNotAllowedReason, clusterv1.ConditionSeverityWarning,
+			"projection into namespaces %s is not allowed by --kubeconfig-projection-namespaces", strings.Join(denied, ", "))
+		return
+	}
+	conditions.MarkTrue(externalCluster, KubeconfigProjectedCondition)
+}
+
+// allowedProjectionNamespaces splits the namespaces into the ones that the
+// KubeconfigProjectionNamespaces allow and the ones they deny.
+func (r *ExternalClusterReconciler) allowedProjectionNamespaces(namespaces []string) (allowed, denied []string) {
+	allowlist := sets.NewString(r.KubeconfigProjectionNamespaces...)
+	for _, namespace := range namespaces {
+		if allowlist.Has(AllNamespaces) || allowlist.Has(namespace) {
+			allowed = append(allowed, namespace)
+		} else {
+			denied = append(denied, namespace)
+		}
+	}
+	return allowed, denied
+}
+
+// projectKubeconfig copies the sanitized kubeconfig into the namespaces and
+// deletes the copies in all other namespaces.
+func (r *ExternalClusterReconciler) projectKubeconfig(ctx context.Context, clusterScope *scope.ExternalClusterScope, namespaces []string, rawKubeconfig []byte) error {
+	externalCluster := clusterScope.ExternalCluster
+	var desired []client.ObjectKey
+	if len(namespaces) > 0 {
+		sanitizedKubeconfig, err := capekubeconfig.Sanitize(rawKubeconfig)
+		if err != nil {
+			return err
+		}
+		secretName := kubeconfigProjectionSecretName(clusterScope.Name(), externalCluster)
+		for _, namespace := range namespaces {
+			key := client.ObjectKey{Namespace: namespace, Name: secretName}
+			secret := &corev1.Secret{}
+			secret.Namespace = namespace
+			secret.Name = secretName
+			_, err := controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+				// Never overwrite Secrets that were not created by the projection,
+				// such as the original kubeconfig Secret.
+				if !secret.CreationTimestamp.IsZero() &&
+					(secret.Labels[ProjectedFromNameLabel] != externalCluster.Name || secret.Labels[ProjectedFromNamespaceLabel] != externalCluster.Namespace) {
+					return errors.Errorf("secret %s already exists and is not a projection of this cluster", key)
+				}
+				if secret.Labels == nil {
+					secret.Labels = map[string]string{}
+				}
+				secret.Labels[clusterv1.ClusterLabelName] = clusterScope.Name()
+				secret.Labels[ProjectedFromNameLabel] = externalCluster.Name
+				secret.Labels[ProjectedFromNamespaceLabel] = externalCluster.Namespace
+				secret.Type = corev1.SecretTypeOpaque
+				secret.Data = map[string][]byte{
+					"value":      sanitizedKubeconfig,
+					"value.yaml": sanitizedKubeconfig,
+				}
+				return nil
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to project kubeconfig to %s", key)
+			}
+			desired = append(desired, key)
+		}
+	}
+	return r.deleteProjectedKubeconfigs(ctx, externalCluster, desired)
+}
+
+// deleteProjectedKubeconfigs deletes all kubeconfig copies of the
+// ExternalCluster, except for the ones listed in keep.
+func (r *ExternalClusterReconciler) deleteProjectedKubeconfigs(ctx context.Context, externalCluster *externalv1.ExternalCluster, keep []client.ObjectKey) error {
+	secrets := &corev1.SecretList{}
+	err := r.Client.List(ctx, secrets, client.MatchingLabels{
+		ProjectedFromNameLabel:      externalCluster.Name,
+		ProjectedFromNamespaceLabel: externalCluster.Namespace,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to list projected kubeconfigs")
+	}
+
+	keepSet := map[client.ObjectKey]struct{}{}
+	for _, key := range keep {
+		keepSet[key] = struct{}{}
+	}
+	var errs []error
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if _, ok := keepSet[client.ObjectKeyFromObject(secret)]; ok {
+			continue
+		}
+		ctrl.LoggerFrom(ctx).Info("Deleting projected kubeconfig", "secret", client.ObjectKeyFromObject(secret))
+		if err := r.Client.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, err)
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// isKubeconfigSecret filters the watch on Secrets to the <cluster-name>-kubeconfig
+// Secrets of Cluster API.
+func isKubeconfigSecret(o client.Object) bool {
+	secret, ok := o.(*corev1.Secret)
+	return ok && secret.Type == clusterv1.ClusterSecretType && strings.HasSuffix(secret.Name, "-kubeconfig")
+}
+
+// kubeconfigSecretToExternalCluster is a handler.MapFunc that enqueues the
+// ExternalCluster belonging to a <cluster-name>-kubeconfig Secret, so that
+// projected copies are updated when the kubeconfig is rotated.
+func (r *ExternalClusterReconciler) kubeconfigSecretToExternalCluster(o client.Object) []ctrl.Request {
+	secret, ok := o.(*corev1.Secret)
+	if !ok {
+		panic(fmt.Sprintf("Expected a Secret but got a %T", o))
+	}
+
+	cluster := &clusterv1.Cluster{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{
+		Namespace: secret.Namespace,
+		Name:      strings.TrimSuffix(secret.Name, "-kubeconfig"),
+	}, cluster)
+	if err != nil {
+		return nil
+	}
+
+	infraRef := cluster.Spec.InfrastructureRef
+	if infraRef == nil || infraRef.Kind != "ExternalCluster" {
+		return nil
+	}
+	return []ctrl.Request{{NamespacedName: client.ObjectKey{Namespace: cluster.Namespace, Name: infraRef.Name}}}
+}
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+func TestReconcileKubeconfigProjection(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	clusterKey := types.NamespacedName{Namespace: "default", Name: "workload"}
+	rawKubeconfig := kubeconfigSecret(clusterKey, "https://10.0.0.10:6443").Data["value"]
+	r := &ExternalClusterReconciler{
+		Client:                         fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build(),
+		KubeconfigProjectionNamespaces: []string{"flux-system"},
+	}
+	clusterScope := &scope.ExternalClusterScope{
+		Cluster: &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: clusterKey.Namespace, Name: clusterKey.Name}},
+		ExternalCluster: &externalv1.ExternalCluster{
+			ObjectMeta: metav1.ObjectMeta{Namespace: clusterKey.Namespace, Name: clusterKey.Name},
+			Spec: externalv1.ExternalClusterSpec{
+				KubeconfigProjection: &externalv1.KubeconfigProjection{Namespaces: []string{"flux-system", "team-a"}},
+			},
+		},
+	}
+	externalCluster := clusterScope.ExternalCluster
+	projected := func(namespace string) bool {
+		err := r.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload-kubeconfig"}, &corev1.Secret{})
+		g.Expect(client.IgnoreNotFound(err)).To(Succeed())
+		return !apierrors.IsNotFound(err)
+	}
+
+	// Only the allowed namespaces get a copy.
+	r.reconcileKubeconfigProjection(ctx, clusterScope, rawKubeconfig)
+	g.Expect(projected("flux-system")).To(BeTrue())
+	g.Expect(projected("team-a")).To(BeFalse())
+	g.Expect(conditions.GetReason(externalCluster, KubeconfigProjectedCondition)).To(Equal(KubeconfigProjectionNotAllowedReason))
+	g.Expect(conditions.GetMessage(externalCluster, KubeconfigProjectedCondition)).To(ContainSubstring("team-a"))
+	g.Expect(controllerutil.ContainsFinalizer(externalCluster, ClusterFinalizer)).To(BeTrue())
+
+	// Failures are reported in the condition only.
+	r.reconcileKubeconfigProjection(ctx, clusterScope, []byte("{"))
+	g.Expect(conditions.GetReason(externalCluster, KubeconfigProjectedCondition)).To(Equal(KubeconfigProjectionFailedReason))
+
+	// Disabling the projection deletes the copies and the finalizer.
+	externalCluster.Spec.KubeconfigProjection = nil
+	r.reconcileKubeconfigProjection(ctx, clusterScope, rawKubeconfig)
+	g.Expect(projected("flux-system")).To(BeFalse())
+	g.Expect(conditions.Has(externalCluster, KubeconfigProjectedCondition)).To(BeFalse())
+	g.Expect(controllerutil.ContainsFinalizer(externalCluster, ClusterFinalizer)).To(BeFalse())
+}
+
+func TestIsKubeconfigSecret(t *testing.T) {
+	g := NewWithT(t)
+	secret := func(name string, secretType corev1.SecretType) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name}, Type: secretType}
+	}
+	g.Expect(isKubeconfigSecret(secret("workload-kubeconfig", clusterv1.ClusterSecretType))).To(BeTrue())
+	g.Expect(isKubeconfigSecret(secret("workload-kubeconfig", corev1.SecretTypeOpaque))).To(BeFalse())
+	g.Expect(isKubeconfigSecret(secret("workload-tunnel-token", clusterv1.ClusterSecretType))).To(BeFalse())
+}
@@ -0,0 +1,214 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/inventory"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/metrics"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	expv1 "sigs.k8s.io/cluster-api/exp/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machinepools,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=externalmachinepools,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=externalmachinepools/status,verbs=get;update;patch
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// groupNodesByPool splits the nodes into node pools, by the first of the
+// labels that is set on a node. Nodes without any of the labels and control
+// plane nodes are returned separately.
+func groupNodesByPool(nodes []corev1.Node, labels []string) (standalone []corev1.Node, pools map[string][]corev1.Node) {
+	pools = map[string][]corev1.Node{}
+	for _, node := range nodes {
+		pool := ""
+		for _, label := range labels {
+			if pool = node.Labels[label]; pool != "" {
+				break
+			}
+		}
+		if inventory.IsControlPlaneNode(&node) {
+			pool = ""
+		}
+		if pool == "" {
+			standalone = append(standalone, node)
+			continue
+		}
+		pools[pool] = append(pools[pool], node)
+	}
+	return standalone, pools
+}
+
+// nodePoolLabels returns the node labels that identify the node pool of a
+// node.
+func nodePoolLabels(spec *externalv1.MachinePoolsSpec) []string {
+	if len(spec.NodePoolLabels) > 0 {
+		return spec.NodePoolLabels
+	}
+	return externalv1.DefaultNodePoolLabels
+}
+
+// machinePoolName returns the name of the MachinePool of a node pool. Node
+// pool names that are not valid object names are sanitized and suffixed with
+// a short hash of the original name, so that e.g. Pool_A and pool-a do not
+// map to the same MachinePool.
+func machinePoolName(clusterName string, pool string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(pool), "-"), "-.")
+	if name != pool {
+		hash := fmt.Sprintf("%x", sha256.Sum256([]byte(pool)))[:8]
+		if name == "" {
+			name = hash
+		} else {
+			name += "-" + hash
+		}
+	}
+	return fmt.Sprintf("%s-%s", clusterName, name)
+}
+
+// syncMachinePools creates or updates a read-only MachinePool and
+// ExternalMachinePool for each node pool, and deletes the MachinePools of node
+// pools that no longer exist.
+func (r *ExternalClusterReconciler) syncMachinePools(ctx context.Context, clusterScope *scope.ExternalClusterScope, pools map[string][]corev1.Node) error {
+	for pool, nodes := range pools {
+		if err := r.syncMachinePool(ctx, clusterScope, pool, nodes); err != nil {
+			return errors.Wrapf(err, "failed to sync node pool %s", pool)
+		}
+	}
+	return r.deleteRemovedMachinePools(ctx, clusterScope, pools)
+}
+
+func (r *ExternalClusterReconciler) syncMachinePool(ctx context.Context, clusterScope *scope.ExternalClusterScope, pool string, nodes []corev1.Node) error {
+	cluster := clusterScope.Cluster
+	name := machinePoolName(cluster.Name, pool)
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	var providerIDs []string
+	var readyReplicas int32
+	for i := range nodes {
+		if nodes[i].Spec.ProviderID != "" {
+			providerIDs = append(providerIDs, nodes[i].Spec.ProviderID)
+		}
+		if isNodeReady(&nodes[i]) {
+			readyReplicas++
+		}
+	}
+	labels := map[string]string{
+		clusterv1.ClusterLabelName: cluster.Name,
+		externalv1.NodePoolLabel:   pool,
+	}
+
+	machinePool := &expv1.MachinePool{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: cluster.Namespace}}
+	result, err := controllerutil.CreateOrPatch(ctx, r.Client, machinePool, func() error {
+		if machinePool.Labels == nil {
+			machinePool.Labels = map[string]string{}
+		}
+		for key, value := range labels {
+			machinePool.Labels[key] = value
+		}
+		machinePool.Spec.ClusterName = cluster.Name
+		machinePool.Spec.Replicas = pointer.Int32(int32(len(nodes)))
+		machinePool.Spec.ProviderIDList = providerIDs
+		machinePool.Spec.Template.Spec = clusterv1.MachineSpec{
+			ClusterName: cluster.Name,
+			Bootstrap: clusterv1.Bootstrap{
+				DataSecretName: pointer.String("non-existent-secret"),
+			},
+			InfrastructureRef: corev1.ObjectReference{
+				APIVersion: externalv1.GroupVersion.String(),
+				Kind:       "ExternalMachinePool",
+				Name:       name,
+			},
+			Version: pointer.String(nodes[0].Status.NodeInfo.KubeletVersion),
+		}
+		return controllerutil.SetOwnerReference(cluster, machinePool, r.Scheme)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to sync MachinePool")
+	}
+	switch result {
+	case controllerutil.OperationResultCreated:
+		metrics.NodeSyncOperations.WithLabelValues(cluster.Namespace, cluster.Name, metrics.OperationCreate).Inc()
+		r.Recorder.Eventf(clusterScope.ExternalCluster, corev1.EventTypeNormal, "NodePoolDiscovered", "Created MachinePool %s for node pool %s", name, pool)
+	case controllerutil.OperationResultUpdated:
+		metrics.NodeSyncOperations.WithLabelValues(cluster.Namespace, cluster.Name, metrics.OperationUpdate).Inc()
+	}
+
+	externalMachinePool := &externalv1.ExternalMachinePool{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: cluster.Namespace}}
+	setStatus := func() {
+		externalMachinePool.Status.Ready = true
+		externalMachinePool.Status.Replicas = int32(len(nodes))
+		externalMachinePool.Status.ReadyReplicas = readyReplicas
+	}
+	result, err = controllerutil.CreateOrPatch(ctx, r.Client, externalMachinePool, func() error {
+		if externalMachinePool.Labels == nil {
+			externalMachinePool.Labels = map[string]string{}
+		}
+		for key, value := range labels {
+			externalMachinePool.Labels[key] = value
+		}
+		externalMachinePool.Spec.NodePool = pool
+		externalMachinePool.Spec.ProviderIDList = providerIDs
+		setStatus()
+		return controllerutil.SetOwnerReference(machinePool, externalMachinePool, r.Scheme)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to sync ExternalMachinePool")
+	}
+	if result == controllerutil.OperationResultCreated {
+		// The status is not set on create.
+		setStatus()
+		if err := r.Client.Status().Update(ctx, externalMachinePool); err != nil {
+			return errors.Wrap(err, "failed to update ExternalMachinePool status")
+		}
+	}
+	return nil
+}
+
+// deleteRemovedMachinePools deletes the MachinePools of the cluster whose
+// node pools no longer exist, or all of them if node pools are disabled.
+func (r *ExternalClusterReconciler) deleteRemovedMachinePools(ctx context.Context, clusterScope *scope.ExternalClusterScope, pools map[string][]corev1.Node) error {
+	machinePools := &expv1.MachinePoolList{}
+	err := r.Client.List(ctx, machinePools, client.InNamespace(clusterScope.Namespace()), client.MatchingLabels{
+		clusterv1.ClusterLabelName: clusterScope.Name(),
+	}, client.HasLabels{externalv1.NodePoolLabel})
+	if meta.IsNoMatchError(err) && len(pools) == 0 {
+		// The MachinePool CRD is not installed, so there is nothing to delete.
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to list machine pools")
+	}
+	for i := range machinePools.Items {
+		machinePool := &machinePools.Items[i]
+		pool := machinePool.Labels[externalv1.NodePoolLabel]
+		if _, ok := pools[pool]; ok || !machinePool.DeletionTimestamp.IsZero() {
+			continue
+		}
+		ctrl.LoggerFrom(ctx).Info("Deleting MachinePool of removed node pool", "machinePool", machinePool.Name)
+		if err := r.Client.Delete(ctx, machinePool); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete machine pool %s", machinePool.Name)
+		}
+		externalMachinePool := &externalv1.ExternalMachinePool{ObjectMeta: metav1.ObjectMeta{Name: machinePool.Name, Namespace: machinePool.Namespace}}
+		if err := r.Client.Delete(ctx, externalMachinePool); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete external machine pool %s", machinePool.Name)
+		}
+		metrics.NodeSyncOperations.WithLabelValues(clusterScope.Namespace(), clusterScope.Name(), metrics.OperationDelete).Inc()
+		r.Recorder.Eventf(clusterScope.ExternalCluster, corev1.EventTypeNormal, "NodePoolRemoved", "Deleted MachinePool of removed node pool %s", pool)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/metrics"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tracing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	expv1 "sigs.k8s.io/cluster-api/exp/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestMachinePoolName(t *testing.T) {
+	tests := []struct {
+		pool string
+		want string
+	}{
+		{pool: "pool-a", want: "prod-pool-a"},
+		{pool: "ng.workers", want: "prod-ng.workers"},
+		{pool: "Pool_A", want: "prod-pool-a-4bd6aff3"},
+		{pool: "pool_a", want: "prod-pool-a-8dd74c37"},
+		{pool: "-pool-", want: "prod-pool-c458c6ca"},
+		{pool: "___", want: "prod-bda25155"},
+	}
+	names := map[string]string{}
+	for _, tt := range tests {
+		t.Run(tt.pool, func(t *testing.T) {
+			g := NewWithT(t)
+			name := machinePoolName("prod", tt.pool)
+			g.Expect(name).To(Equal(tt.want))
+			g.Expect(names).NotTo(HaveKey(name), "collides with node pool %q", names[name])
+			names[name] = tt.pool
+		})
+	}
+}
+
+// newMachinePoolTest returns a reconciler and the scope of a cluster with
+// MachinePools enabled.
+func newMachinePoolTest(g *WithT, objects ...client.Object) (*ExternalClusterReconciler, *scope.ExternalClusterScope, *record.FakeRecorder) {
+	scheme := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	g.Expect(clusterv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(expv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(externalv1.AddToScheme(scheme)).To(Succeed())
+	recorder := record.NewFakeRecorder(20)
+	r := &ExternalClusterReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		Scheme:   scheme,
+		Recorder: recorder,
+	}
+	clusterScope := &scope.ExternalClusterScope{
+		Cluster: &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "prod", UID: "prod-uid"}},
+		ExternalCluster: &externalv1.ExternalCluster{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "prod"},
+			Spec:       externalv1.ExternalClusterSpec{MachinePools: &externalv1.MachinePoolsSpec{}},
+		},
+		Tracer: tracing.Tracer(),
+	}
+	return r, clusterScope, recorder
+}
+
+// pooledNode returns a ready worker node of the EKS node group pool.
+func pooledNode(name, pool string) corev1.Node {
+	return corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"eks.amazonaws.com/nodegroup": pool}},
+		Spec:       corev1.NodeSpec{ProviderID: "aws:///" + name},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+			NodeInfo:   corev1.NodeSystemInfo{KubeletVersion: "v1.23.5"},
+		},
+	}
+}
+
+func TestSyncMachinePools(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	r, clusterScope, recorder := newMachinePoolTest(g)
+	clusterKey := clusterScope.NamespacedName()
+	defer metrics.DeleteClusterMetrics(clusterKey)
+	operations := func(operation string) float64 {
+		return testutil.ToFloat64(metrics.NodeSyncOperations.WithLabelValues(clusterKey.Namespace, clusterKey.Name, operation))
+	}
+
+	g.Expect(r.syncMachinePools(ctx, clusterScope, map[string][]corev1.Node{
+		"workers": {pooledNode("worker-1", "workers")},
+		"gpu":     {pooledNode("gpu-1", "gpu")},
+	})).To(Succeed())
+	g.Expect(operations(metrics.OperationCreate)).To(Equal(2.0))
+	g.Expect(recorder.Events).To(Receive(HavePrefix("Normal NodePoolDiscovered")))
+	g.Expect(recorder.Events).To(Receive(HavePrefix("Normal NodePoolDiscovered")))
+
+	// A resync without changes does not update anything.
+	pools := map[string][]corev1.Node{
+		"workers": {pooledNode("worker-1", "workers")},
+		"gpu":     {pooledNode("gpu-1", "gpu")},
+	}
+	g.Expect(r.syncMachinePools(ctx, clusterScope, pools)).To(Succeed())
+	g.Expect(operations(metrics.OperationUpdate)).To(BeZero())
+
+	pools["workers"] = append(pools["workers"], pooledNode("worker-2", "workers"))
+	g.Expect(r.syncMachinePools(ctx, clusterScope, pools)).To(Succeed())
+	g.Expect(operations(metrics.OperationUpdate)).To(Equal(1.0))
+	machinePool := &expv1.MachinePool{}
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod-workers"}, machinePool)).To(Succeed())
+	g.Expect(machinePool.Spec.Replicas).To(Equal(pointer.Int32(2)))
+	g.Expect(machinePool.Spec.ProviderIDList).To(Equal([]string{"aws:///worker-1", "aws:///worker-2"}))
+
+	// The MachinePools of removed node pools are deleted.
+	delete(pools, "gpu")
+	g.Expect(r.syncMachinePools(ctx, clusterScope, pools)).To(Succeed())
+	g.Expect(operations(metrics.OperationDelete)).To(Equal(1.0))
+	g.Expect(recorder.Events).To(Receive(Equal("Normal NodePoolRemoved Deleted MachinePool of removed node pool gpu")))
+	err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod-gpu"}, &expv1.MachinePool{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	err = r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod-gpu"}, &externalv1.ExternalMachinePool{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestSyncMachinesEnablingMachinePools(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	r, clusterScope, recorder := newMachinePoolTest(g)
+	defer metrics.DeleteClusterMetrics(clusterScope.NamespacedName())
+	controlPlane := pooledNode("control-plane-1", "")
+	delete(controlPlane.Labels, "eks.amazonaws.com/nodegroup")
+	nodes := []corev1.Node{controlPlane, pooledNode("worker-1", "workers"), pooledNode("worker-2", "workers")}
+
+	// The cluster was synced before MachinePools were enabled, so each node
+	// has a standalone Machine. A Machine of another cluster must be kept.
+	spec := clusterScope.ExternalCluster.Spec.MachinePools
+	clusterScope.ExternalCluster.Spec.MachinePools = nil
+	g.Expect(r.syncMachines(ctx, clusterScope, nodes)).To(Succeed())
+	otherMachine, otherExternalMachine := convertNodeToExternalMachine(
+		&clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "staging"}}, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "staging-1"}}, nil)
+	g.Expect(r.Create(ctx, otherMachine)).To(Succeed())
+	g.Expect(r.Create(ctx, otherExternalMachine)).To(Succeed())
+	machines := &clusterv1.MachineList{}
+	g.Expect(r.List(ctx, machines)).To(Succeed())
+	g.Expect(machines.Items).To(HaveLen(4))
+
+	clusterScope.ExternalCluster.Spec.MachinePools = spec
+	recordedEvents(recorder)
+	g.Expect(r.syncMachines(ctx, clusterScope, nodes)).To(Succeed())
+	g.Expect(recordedEvents(recorder)).To(ConsistOf(
+		"Normal NodesRemoved Deleted Machines of 2 nodes: worker-1, worker-2",
+		"Normal NodePoolDiscovered Created MachinePool prod-workers for node pool workers",
+	))
+	g.Expect(r.List(ctx, machines)).To(Succeed())
+	g.Expect(machineNames(machines)).To(ConsistOf("control-plane-1", "staging-1"))
+	externalMachines := &externalv1.ExternalMachineList{}
+	g.Expect(r.List(ctx, externalMachines)).To(Succeed())
+	g.Expect(externalMachines.Items).To(HaveLen(2))
+	for _, name := range []string{"worker-1", "worker-2"} {
+		err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, &externalv1.ExternalMachine{})
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue(), name)
+	}
+	machinePool := &expv1.MachinePool{}
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod-workers"}, machinePool)).To(Succeed())
+	g.Expect(machinePool.Spec.Replicas).To(Equal(pointer.Int32(2)))
+	g.Expect(testutil.ToFloat64(metrics.NodeSyncOperations.WithLabelValues("default", "prod", metrics.OperationDelete))).To(Equal(2.0))
+}
+
+func machineNames(machines *clusterv1.MachineList) []string {
+	var names []string
+	for _, machine := range machines.Items {
+		names = append(names, machine.Name)
+	}
+	return names
+}
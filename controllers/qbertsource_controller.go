@@ -0,0 +1,405 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/audit"
+	importer "github.com/platform9-incubator/cluster-api-provider-external/pkg/cape"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/metrics"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/qbert"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/tools/record"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/annotations"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/cluster-api/util/predicates"
+	"sigs.k8s.io/cluster-api/util/secret"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	QbertCredentialsUnavailableReason = "CredentialsUnavailable"
+	QbertAuthenticationFailedReason   = "AuthenticationFailed"
+	QbertListFailedReason             = "ListClustersFailed"
+	QbertInvalidSpecReason            = "InvalidSpec"
+
+	QbertClustersImportedCondition clusterv1.ConditionType = "ClustersImported"
+	QbertClusterImportFailedReason                         = "ClusterImportFailed"
+
+	defaultQbertSyncInterval = 10 * time.Minute
+)
+
+// QbertSourceReconciler periodically imports the clusters of a PMK deployment
+// unit, refreshes their kubeconfigs and marks the clusters that were deleted
+// in Qbert.
+type QbertSourceReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Audit records the mutating requests that the imports make to the
+	// external clusters. Auditing is disabled if it is nil.
+	Audit audit.Sink
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *QbertSourceReconciler) SetupWithManager(ctx context.Context, mgr ctrl.Manager) error {
+	err := ctrl.NewControllerManagedBy(mgr).
+		For(&externalv1.QbertSource{}).
+		WithEventFilter(predicates.ResourceNotPaused(ctrl.LoggerFrom(ctx))). // don't queue reconcile if resource is paused
+		Complete(r)
+	if err != nil {
+		return errors.Wrapf(err, "error creating controller")
+	}
+	return nil
+}
+
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=qbertsources,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=qbertsources/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups=controlplane.cluster.x-k8s.io,resources=externalcontrolplanes,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;update;patch;create;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+func (r *QbertSourceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, reterr error) {
+	ctx, span := tracing.Tracer().Start(ctx, "QbertSourceReconciler.Reconcile", trace.WithAttributes(tracing.ObjectAttributes("QbertSource", req.Namespace, req.Name)...))
+	defer func() { tracing.EndSpan(span, reterr) }()
+	log := ctrl.LoggerFrom(ctx)
+
+	qbertSource := &externalv1.QbertSource{}
+	if err := r.Get(ctx, req.NamespacedName, qbertSource); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	// The imported clusters are left untouched when the QbertSource is deleted.
+	if !qbertSource.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+	// A QbertSource is paused while it is moved with `clusterctl move`, so
+	// that it does not import clusters that are being moved.
+	if annotations.HasPaused(qbertSource) {
+		log.Info("QbertSource is marked as paused. Won't reconcile")
+		return ctrl.Result{}, nil
+	}
+
+	patchHelper, err := patch.NewHelper(qbertSource, r.Client)
+	if err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "failed to init patch helper")
+	}
+	defer func() {
+		if err := patchHelper.Patch(ctx, qbertSource); err != nil && reterr == nil {
+			reterr = err
+		}
+	}()
+
+	// A spec that cannot be imported does not get better with a requeue; the
+	// QbertSource is reconciled again when it is updated.
+	if qbertSource.Spec.ClusterClass != "" && qbertSource.Spec.Proxy != nil {
+		conditions.MarkFalse(qbertSource, clusterv1.ReadyCondition, QbertInvalidSpecReason, clusterv1.ConditionSeverityError, importer.ErrProxyWithClusterClass.Error())
+		return ctrl.Result{}, nil
+	}
+
+	config, err := r.qbertConfig(ctx, qbertSource)
+	if err != nil {
+		conditions.MarkFalse(qbertSource, clusterv1.ReadyCondition, QbertCredentialsUnavailableReason, clusterv1.ConditionSeverityError, err.Error())
+		return ctrl.Result{}, err
+	}
+	qbertClient, err := qbert.NewClient(ctx, config)
+	if err != nil {
+		conditions.MarkFalse(qbertSource, clusterv1.ReadyCondition, QbertAuthenticationFailedReason, clusterv1.ConditionSeverityError, err.Error())
+		return ctrl.Result{}, err
+	}
+	source := importer.NewQbertClusterSource(qbertClient)
+	qbertClusters, err := source.List(ctx)
+	if err != nil {
+		conditions.MarkFalse(qbertSource, clusterv1.ReadyCondition, QbertListFailedReason, clusterv1.ConditionSeverityError, err.Error())
+		return ctrl.Result{}, err
+	}
+
+	log.V(4).Info("Syncing qbert clusters", "count", len(qbertClusters))
+	clusterImporter := &importer.ClusterImporter{
+		MgmtClient:   r.Client,
+		Log:          zap.S().Named("qbertsource"),
+		ClusterClass: qbertSource.Spec.ClusterClass,
+		Proxy:        qbertSource.Spec.Proxy,
+		Audit:        r.Audit,
+	}
+	var statuses []externalv1.QbertClusterStatus
+	var failed []string
+	for _, qbertCluster := range qbertClusters {
+		status := r.syncCluster(ctx, qbertSource, source, clusterImporter, qbertCluster)
+		if status.State == externalv1.QbertClusterFailed {
+			failed = append(failed, status.Name)
+		}
+		statuses = append(statuses, status)
+	}
+	deleted, err := r.markDeletedClusters(ctx, qbertSource, qbertClusters)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	statuses = append(statuses, deleted...)
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	qbertSource.Status.Clusters = statuses
+	now := metav1.Now()
+	qbertSource.Status.LastSyncTime = &now
+	if len(failed) > 0 {
+		conditions.MarkFalse(qbertSource, QbertClustersImportedCondition, QbertClusterImportFailedReason, clusterv1.ConditionSeverityWarning,
+			"Failed to import %d cluster(s): %v", len(failed), failed)
+	} else {
+		conditions.MarkTrue(qbertSource, QbertClustersImportedCondition)
+	}
+	conditions.MarkTrue(qbertSource, clusterv1.ReadyCondition)
+
+	return ctrl.Result{RequeueAfter: qbertSyncInterval(qbertSource)}, nil
+}
+
+// qbertSyncInterval returns the interval between the syncs of the
+// QbertSource.
+func qbertSyncInterval(qbertSource *externalv1.QbertSource) time.Duration {
+	if qbertSource.Spec.SyncInterval != nil && qbertSource.Spec.SyncInterval.Duration > 0 {
+		return qbertSource.Spec.SyncInterval.Duration
+	}
+	return defaultQbertSyncInterval
+}
+
+// qbertConfig builds the qbert.Config from the spec and the credentials
+// Secret of the QbertSource.
+func (r *QbertSourceReconciler) qbertConfig(ctx context.Context, qbertSource *externalv1.QbertSource) (qbert.Config, error) {
+	secret := &corev1.Secret{}
+	key := client.ObjectKey{Namespace: qbertSource.Namespace, Name: qbertSource.Spec.CredentialsSecretRef.Name}
+	if err := r.Get(ctx, key, secret); err != nil {
+		return qbert.Config{}, errors.Wrapf(err, "failed to get credentials secret %s", key)
+	}
+	config := qbert.Config{
+		FQDN:     qbertSource.Spec.FQDN,
+		Region:   qbertSource.Spec.Region,
+		Project:  qbertSource.Spec.Project,
+		Username: string(secret.Data["username"]),
+		Password: string(secret.Data["password"]),
+		Token:    string(secret.Data["token"]),
+	}
+	if config.Project == "" {
+		config.Project = "service"
+	}
+	if config.Token == "" && (config.Username == "" || config.Password == "") {
+		return qbert.Config{}, errors.Errorf("credentials secret %s should contain either username and password, or token", key)
+	}
+	return config, nil
+}
+
+// syncCluster imports a Qbert cluster, or refreshes the kubeconfig of a
+// previously imported one.
+func (r *QbertSourceReconciler) syncCluster(ctx context.Context, qbertSource *externalv1.QbertSource, source *importer.QbertClusterSource, clusterImporter *importer.ClusterImporter, qbertCluster importer.SourceCluster) externalv1.QbertClusterStatus {
+	log := ctrl.LoggerFrom(ctx).WithValues("qbertCluster", qbertCluster.Name, "uuid", qbertCluster.ID)
+	status := externalv1.QbertClusterStatus{Name: qbertCluster.Name, UUID: qbertCluster.ID, State: externalv1.QbertClusterImported}
+	fail := func(err error) externalv1.QbertClusterStatus {
+		log.Error(err, "Failed to sync qbert cluster")
+		status.State = externalv1.QbertClusterFailed
+		status.Message = err.Error()
+		return status
+	}
+
+	metadata, err := source.Metadata(ctx, qbertCluster)
+	if err != nil {
+		return fail(err)
+	}
+	metadata.Labels[externalv1.QbertSourceLabel] = qbertSource.Name
+	kubeconfig, err := source.GetKubeconfig(ctx, qbertCluster)
+	if errors.Is(err, importer.ErrNoKubeconfig) {
+		log.V(4).Info("Skipping qbert cluster without kubeconfig")
+		status.State = externalv1.QbertClusterSkipped
+		status.Message = err.Error()
+		return status
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	cluster := &clusterv1.Cluster{}
+	err = r.Get(ctx, client.ObjectKey{Namespace: qbertSource.Namespace, Name: qbertCluster.Name}, cluster)
+	switch {
+	case apierrors.IsNotFound(err):
+		err := clusterImporter.ImportCluster(ctx, importer.ClusterToImport{
+			Name:       qbertCluster.Name,
+			Namespace:  qbertSource.Namespace,
+			Host:       metadata.Host,
+			Port:       metadata.Port,
+			Kubeconfig: kubeconfig,
+			Labels:     metadata.Labels,
+		})
+		result := metrics.ImportSuccess
+		if err != nil {
+			result = metrics.ImportFailure
+		}
+		metrics.ClusterImports.WithLabelValues(qbertSource.Namespace, qbertCluster.Name, result).Inc()
+		if err != nil {
+			return fail(errors.Wrap(err, "failed to import cluster"))
+		}
+		log.Info("Imported qbert cluster")
+		r.Recorder.Eventf(qbertSource, corev1.EventTypeNormal, "ClusterImported", "Imported cluster %s (%s)", qbertCluster.Name, qbertCluster.ID)
+		if err := r.setTokenExpiry(ctx, qbertSource.Namespace, qbertCluster.Name, source.Client.KubeconfigTokenExpiry()); err != nil {
+			return fail(err)
+		}
+		return status
+	case err != nil:
+		return fail(err)
+	case cluster.Labels[externalv1.QbertClusterUUIDLabel] != qbertCluster.ID:
+		return fail(errors.Errorf("a Cluster named %s that was not imported from this qbert cluster already exists", qbertCluster.Name))
+	}
+
+	refreshed, err := r.refreshKubeconfig(ctx, qbertSource, clusterImporter, qbertCluster.Name, kubeconfig, source.Client.KubeconfigTokenExpiry())
+	if err != nil {
+		return fail(errors.Wrap(err, "failed to refresh kubeconfig"))
+	}
+	if refreshed {
+		r.Recorder.Eventf(qbertSource, corev1.EventTypeNormal, "KubeconfigRefreshed", "Refreshed the kubeconfig of cluster %s", qbertCluster.Name)
+	}
+	if _, ok := cluster.Annotations[externalv1.QbertDeletedAnnotation]; ok || cluster.Labels[externalv1.QbertSourceLabel] != qbertSource.Name {
+		patchBase := client.MergeFrom(cluster.DeepCopy())
+		delete(cluster.Annotations, externalv1.QbertDeletedAnnotation)
+		for key, value := range metadata.Labels {
+			cluster.Labels[key] = value
+		}
+		if err := r.Patch(ctx, cluster, patchBase); err != nil {
+			return fail(errors.Wrap(err, "failed to update cluster labels"))
+		}
+	}
+	return status
+}
+
+// refreshKubeconfig replaces the kubeconfig Secret of an imported cluster if
+// its kubeconfig changed in Qbert. With token authentication, Qbert embeds
+// the Keystone token of every sync in the kubeconfigs, so the tokens are not
+// compared, and the Secret is only replaced for its token shortly before the
+// token expires.
+func (r *QbertSourceReconciler) refreshKubeconfig(ctx context.Context, qbertSource *externalv1.QbertSource, clusterImporter *importer.ClusterImporter, name string, kubeconfig []byte, tokenExpiry time.Time) (bool, error) {
+	if !tokenExpiry.IsZero() {
+		kubeconfigSecret := &corev1.Secret{}
+		err := r.Get(ctx, client.ObjectKey{Namespace: qbertSource.Namespace, Name: secret.Name(name, secret.Kubeconfig)}, kubeconfigSecret)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return false, errors.Wrap(err, "failed to get the kubeconfig secret")
+		}
+		if err == nil && !tokenExpiresSoon(kubeconfigSecret, qbertSyncInterval(qbertSource)) && sameKubeconfigExceptTokens(kubeconfigSecret.Data[secret.KubeconfigDataName], kubeconfig) {
+			return false, nil
+		}
+	}
+	refreshed, err := clusterImporter.RefreshKubeconfig(ctx, qbertSource.Namespace, name, kubeconfig)
+	if err != nil || !refreshed {
+		return refreshed, err
+	}
+	return true, r.setTokenExpiry(ctx, qbertSource.Namespace, name, tokenExpiry)
+}
+
+// setTokenExpiry annotates the kubeconfig Secret of an imported cluster with
+// the expiry of its token.
+func (r *QbertSourceReconciler) setTokenExpiry(ctx context.Context, namespace, name string, tokenExpiry time.Time) error {
+	if tokenExpiry.IsZero() {
+		return nil
+	}
+	kubeconfigSecret := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: secret.Name(name, secret.Kubeconfig)}, kubeconfigSecret); err != nil {
+		return errors.Wrap(err, "failed to get the kubeconfig secret")
+	}
+	patchBase := client.MergeFrom(kubeconfigSecret.DeepCopy())
+	if kubeconfigSecret.Annotations == nil {
+		kubeconfigSecret.Annotations = map[string]string{}
+	}
+	kubeconfigSecret.Annotations[externalv1.QbertTokenExpiryAnnotation] = tokenExpiry.UTC().Format(time.RFC3339)
+	if err := r.Patch(ctx, kubeconfigSecret, patchBase); err != nil {
+		return errors.Wrap(err, "failed to annotate the kubeconfig secret with the token expiry")
+	}
+	return nil
+}
+
+// tokenExpiresSoon reports whether the token in the kubeconfig Secret expires
+// within two sync intervals, so that it is replaced at least one sync before
+// it expires. Secrets without a valid expiry are treated as expiring.
+func tokenExpiresSoon(kubeconfigSecret *corev1.Secret, interval time.Duration) bool {
+	expiry, err := time.Parse(time.RFC3339, kubeconfigSecret.Annotations[externalv1.QbertTokenExpiryAnnotation])
+	return err != nil || time.Until(expiry) < 2*interval
+}
+
+// sameKubeconfigExceptTokens reports whether the kubeconfigs only differ in
+// the bearer tokens of their users.
+func sameKubeconfigExceptTokens(a, b []byte) bool {
+	withoutTokens := func(kubeconfig []byte) (*clientcmdapi.Config, error) {
+		config, err := clientcmd.Load(kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		for _, authInfo := range config.AuthInfos {
+			authInfo.Token = ""
+		}
+		return config, nil
+	}
+	configA, err := withoutTokens(a)
+	if err != nil {
+		return false
+	}
+	configB, err := withoutTokens(b)
+	if err != nil {
+		return false
+	}
+	return equality.Semantic.DeepEqual(configA, configB)
+}
+
+// markDeletedClusters annotates the Clusters imported by the qbertSource that no
+// longer exist in Qbert.
+func (r *QbertSourceReconciler) markDeletedClusters(ctx context.Context, qbertSource *externalv1.QbertSource, qbertClusters []importer.SourceCluster) ([]externalv1.QbertClusterStatus, error) {
+	existing := map[string]bool{}
+	for _, qbertCluster := range qbertClusters {
+		existing[qbertCluster.ID] = true
+	}
+
+	clusters := &clusterv1.ClusterList{}
+	err := r.List(ctx, clusters, client.InNamespace(qbertSource.Namespace), client.MatchingLabels{externalv1.QbertSourceLabel: qbertSource.Name})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list imported clusters")
+	}
+	var statuses []externalv1.QbertClusterStatus
+	for i := range clusters.Items {
+		cluster := &clusters.Items[i]
+		uuid := cluster.Labels[externalv1.QbertClusterUUIDLabel]
+		if existing[uuid] {
+			continue
+		}
+		statuses = append(statuses, externalv1.QbertClusterStatus{
+			Name:    cluster.Name,
+			UUID:    uuid,
+			State:   externalv1.QbertClusterDeleted,
+			Message: "The cluster no longer exists in qbert",
+		})
+		if _, ok := cluster.Annotations[externalv1.QbertDeletedAnnotation]; ok {
+			continue
+		}
+		patchBase := client.MergeFrom(cluster.DeepCopy())
+		if cluster.Annotations == nil {
+			cluster.Annotations = map[string]string{}
+		}
+		cluster.Annotations[externalv1.QbertDeletedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		if err := r.Patch(ctx, cluster, patchBase); err != nil {
+			return nil, errors.Wrapf(err, "failed to mark cluster %s as deleted", cluster.Name)
+		}
+		r.Recorder.Event(qbertSource, corev1.EventTypeWarning, "ClusterDeletedInQbert", fmt.Sprintf("Cluster %s no longer exists in qbert", cluster.Name))
+	}
+	return statuses, nil
+}
@@ -0,0 +1,373 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/metrics"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/qbert"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/qbert/qberttest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// qbertKubeconfig returns a kubeconfig of the API server at host with the
+// token placeholder of Qbert.
+func qbertKubeconfig(host string) []byte {
+	return []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: cluster
+  cluster:
+    server: ` + host + `
+users:
+- name: user
+  user:
+    token: __INSERT_BEARER_TOKEN_HERE__
+contexts:
+- name: default
+  context:
+    cluster: cluster
+    user: user
+current-context: default
+`)
+}
+
+type qbertSourceTest struct {
+	server     *qberttest.Server
+	reconciler *QbertSourceReconciler
+	recorder   *record.FakeRecorder
+	key        types.NamespacedName
+}
+
+// newQbertSourceTest returns a QbertSource of a fake qbert server, with the
+// credentials Secret containing data.
+func newQbertSourceTest(g *WithT, spec externalv1.QbertSourceSpec, data map[string][]byte) *qbertSourceTest {
+	scheme := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	g.Expect(clusterv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(externalv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(externalcontrolplanev1.AddToScheme(scheme)).To(Succeed())
+
+	server := qberttest.NewServer("admin@example.com", "secret", "service")
+	spec.FQDN = server.URL
+	spec.CredentialsSecretRef.Name = "pmk-credentials"
+	qbertSource := &externalv1.QbertSource{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pmk"}, Spec: spec}
+	credentials := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pmk-credentials"}, Data: data}
+	recorder := record.NewFakeRecorder(20)
+	return &qbertSourceTest{
+		server: server,
+		reconciler: &QbertSourceReconciler{
+			Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(qbertSource, credentials).Build(),
+			Scheme:   scheme,
+			Recorder: recorder,
+		},
+		recorder: recorder,
+		key:      client.ObjectKeyFromObject(qbertSource),
+	}
+}
+
+func (q *qbertSourceTest) reconcile(g *WithT) (*externalv1.QbertSource, error) {
+	_, err := q.reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: q.key})
+	qbertSource := &externalv1.QbertSource{}
+	g.Expect(q.reconciler.Get(context.Background(), q.key, qbertSource)).To(Succeed())
+	return qbertSource, err
+}
+
+func (q *qbertSourceTest) events() []string {
+	var events []string
+	for {
+		select {
+		case event := <-q.recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func (q *qbertSourceTest) kubeconfig(g *WithT, name string) string {
+	secret := &corev1.Secret{}
+	g.Expect(q.reconciler.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: name + "-kubeconfig"}, secret)).To(Succeed())
+	return string(secret.Data["value"])
+}
+
+func TestQbertSourceReconcile(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	q := newQbertSourceTest(g, externalv1.QbertSourceSpec{}, map[string][]byte{
+		"username": []byte("admin@example.com"),
+		"password": []byte("secret"),
+	})
+	defer q.server.Close()
+	q.server.AddCluster(qbert.Cluster{Name: "prod", UUID: "uuid-prod", ExternalDNSName: "prod.example.com", APIPort: "6443"}, qbertKubeconfig("https://prod.example.com:6443"))
+	q.server.AddCluster(qbert.Cluster{Name: "creating", UUID: "uuid-creating", MasterIP: "10.0.0.2"}, []byte{})
+	imports := metrics.ClusterImports.WithLabelValues("default", "prod", "success")
+	previousImports := testutil.ToFloat64(imports)
+
+	// New clusters are imported, clusters without a kubeconfig are skipped.
+	qbertSource, err := q.reconcile(g)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(conditions.IsTrue(qbertSource, clusterv1.ReadyCondition)).To(BeTrue())
+	g.Expect(conditions.IsTrue(qbertSource, QbertClustersImportedCondition)).To(BeTrue())
+	g.Expect(qbertSource.Status.LastSyncTime).NotTo(BeNil())
+	g.Expect(qbertSource.Status.Clusters).To(HaveLen(2))
+	g.Expect(qbertSource.Status.Clusters[0].Name).To(Equal("creating"))
+	g.Expect(qbertSource.Status.Clusters[0].State).To(Equal(externalv1.QbertClusterSkipped))
+	g.Expect(qbertSource.Status.Clusters[1]).To(Equal(externalv1.QbertClusterStatus{Name: "prod", UUID: "uuid-prod", State: externalv1.QbertClusterImported}))
+	g.Expect(q.events()).To(ConsistOf(HavePrefix("Normal ClusterImported Imported cluster prod")))
+	g.Expect(testutil.ToFloat64(imports)).To(Equal(previousImports + 1))
+
+	cluster := &clusterv1.Cluster{}
+	g.Expect(q.reconciler.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod"}, cluster)).To(Succeed())
+	g.Expect(cluster.Labels).To(HaveKeyWithValue(externalv1.QbertSourceLabel, "pmk"))
+	g.Expect(cluster.Labels).To(HaveKeyWithValue(externalv1.QbertClusterUUIDLabel, "uuid-prod"))
+	g.Expect(cluster.Labels).To(HaveKeyWithValue(externalv1.QbertProjectIDLabel, qberttest.ProjectID))
+	externalCluster := &externalv1.ExternalCluster{}
+	g.Expect(q.reconciler.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod"}, externalCluster)).To(Succeed())
+	g.Expect(externalCluster.Spec.ControlPlaneEndpoint).To(Equal(clusterv1.APIEndpoint{Host: "prod.example.com", Port: 6443}))
+	kubeconfig := q.kubeconfig(g, "prod")
+	g.Expect(kubeconfig).To(ContainSubstring("server: https://prod.example.com:6443"))
+	g.Expect(kubeconfig).NotTo(ContainSubstring("__INSERT_BEARER_TOKEN_HERE__"))
+
+	// An unchanged kubeconfig is left alone, a changed one is refreshed.
+	_, err = q.reconcile(g)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(q.events()).To(BeEmpty())
+	q.server.AddCluster(qbert.Cluster{Name: "prod", UUID: "uuid-prod", ExternalDNSName: "prod.example.com", APIPort: "6443"}, qbertKubeconfig("https://prod-2.example.com:6443"))
+	_, err = q.reconcile(g)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(q.events()).To(ConsistOf(HavePrefix("Normal KubeconfigRefreshed Refreshed the kubeconfig of cluster prod")))
+	g.Expect(q.kubeconfig(g, "prod")).To(ContainSubstring("server: https://prod-2.example.com:6443"))
+	g.Expect(testutil.ToFloat64(imports)).To(Equal(previousImports + 1))
+
+	// Clusters that disappear from qbert are marked, but not deleted.
+	q.server.DeleteCluster("uuid-prod")
+	qbertSource, err = q.reconcile(g)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(qbertSource.Status.Clusters).To(ContainElement(externalv1.QbertClusterStatus{
+		Name: "prod", UUID: "uuid-prod", State: externalv1.QbertClusterDeleted, Message: "The cluster no longer exists in qbert",
+	}))
+	g.Expect(q.events()).To(ConsistOf(HavePrefix("Warning ClusterDeletedInQbert Cluster prod no longer exists in qbert")))
+	g.Expect(q.reconciler.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod"}, cluster)).To(Succeed())
+	g.Expect(cluster.Annotations).To(HaveKey(externalv1.QbertDeletedAnnotation))
+
+	// The event is recorded once.
+	_, err = q.reconcile(g)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(q.events()).To(BeEmpty())
+
+	// The mark is removed if the cluster comes back.
+	q.server.AddCluster(qbert.Cluster{Name: "prod", UUID: "uuid-prod", ExternalDNSName: "prod.example.com", APIPort: "6443"}, qbertKubeconfig("https://prod-2.example.com:6443"))
+	qbertSource, err = q.reconcile(g)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(qbertSource.Status.Clusters).To(ContainElement(externalv1.QbertClusterStatus{Name: "prod", UUID: "uuid-prod", State: externalv1.QbertClusterImported}))
+	g.Expect(q.reconciler.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod"}, cluster)).To(Succeed())
+	g.Expect(cluster.Annotations).NotTo(HaveKey(externalv1.QbertDeletedAnnotation))
+}
+
+func TestQbertSourceReconcileTokenKubeconfig(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	q := newQbertSourceTest(g, externalv1.QbertSourceSpec{}, map[string][]byte{"token": []byte(qberttest.Token)})
+	defer q.server.Close()
+	q.server.AddCluster(qbert.Cluster{Name: "prod", UUID: "uuid-prod", MasterIP: "10.0.0.1"}, qbertKubeconfig("https://10.0.0.1"))
+	kubeconfigSecret := func() *corev1.Secret {
+		kubeconfigSecret := &corev1.Secret{}
+		g.Expect(q.reconciler.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod-kubeconfig"}, kubeconfigSecret)).To(Succeed())
+		return kubeconfigSecret
+	}
+	tokenExpiry := func() time.Time {
+		expiry, err := time.Parse(time.RFC3339, kubeconfigSecret().Annotations[externalv1.QbertTokenExpiryAnnotation])
+		g.Expect(err).NotTo(HaveOccurred())
+		return expiry
+	}
+	setTokenExpiry := func(expiry string) {
+		existing := kubeconfigSecret()
+		patchBase := client.MergeFrom(existing.DeepCopy())
+		existing.Annotations[externalv1.QbertTokenExpiryAnnotation] = expiry
+		g.Expect(q.reconciler.Patch(ctx, existing, patchBase)).To(Succeed())
+	}
+
+	_, err := q.reconcile(g)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(q.events()).To(ConsistOf(HavePrefix("Normal ClusterImported")))
+	imported := kubeconfigSecret()
+	g.Expect(string(imported.Data["value"])).To(ContainSubstring("token: " + q.server.LastToken() + "\n"))
+	g.Expect(tokenExpiry()).To(BeTemporally("~", time.Now().Add(qberttest.DefaultTokenTTL), time.Minute))
+
+	// Every sync is issued a new token, which does not replace the Secret.
+	_, err = q.reconcile(g)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(q.events()).To(BeEmpty())
+	g.Expect(kubeconfigSecret()).To(Equal(imported))
+	g.Expect(string(imported.Data["value"])).NotTo(ContainSubstring("token: " + q.server.LastToken() + "\n"))
+
+	// The Secret is replaced if the kubeconfig changed.
+	q.server.AddCluster(qbert.Cluster{Name: "prod", UUID: "uuid-prod", MasterIP: "10.0.0.1"}, qbertKubeconfig("https://10.0.0.2"))
+	_, err = q.reconcile(g)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(q.events()).To(ConsistOf(HavePrefix("Normal KubeconfigRefreshed")))
+	g.Expect(q.kubeconfig(g, "prod")).To(ContainSubstring("server: https://10.0.0.2\n"))
+	g.Expect(q.kubeconfig(g, "prod")).To(ContainSubstring("token: " + q.server.LastToken() + "\n"))
+	g.Expect(tokenExpiry()).To(BeTemporally("~", time.Now().Add(qberttest.DefaultTokenTTL), time.Minute))
+
+	// The Secret is replaced for its token before the token expires, or if
+	// its expiry is unknown.
+	for _, expiry := range []string{time.Now().Add(15 * time.Minute).UTC().Format(time.RFC3339), "invalid"} {
+		setTokenExpiry(expiry)
+		_, err = q.reconcile(g)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(q.events()).To(ConsistOf(HavePrefix("Normal KubeconfigRefreshed")))
+		g.Expect(q.kubeconfig(g, "prod")).To(ContainSubstring("token: " + q.server.LastToken() + "\n"))
+		g.Expect(tokenExpiry()).To(BeTemporally("~", time.Now().Add(qberttest.DefaultTokenTTL), time.Minute))
+	}
+}
+
+func TestSameKubeconfigExceptTokens(t *testing.T) {
+	g := NewWithT(t)
+	kubeconfig := func(host, token string) []byte {
+		return []byte(strings.ReplaceAll(string(qbertKubeconfig(host)), "__INSERT_BEARER_TOKEN_HERE__", token))
+	}
+	g.Expect(sameKubeconfigExceptTokens(kubeconfig("https://10.0.0.1", "a"), kubeconfig("https://10.0.0.1", "b"))).To(BeTrue())
+	g.Expect(sameKubeconfigExceptTokens(kubeconfig("https://10.0.0.1", "a"), kubeconfig("https://10.0.0.2", "a"))).To(BeFalse())
+	g.Expect(sameKubeconfigExceptTokens(kubeconfig("https://10.0.0.1", "a"), []byte("{"))).To(BeFalse())
+}
+
+func TestQbertSourceReconcileNameConflict(t *testing.T) {
+	g := NewWithT(t)
+	q := newQbertSourceTest(g, externalv1.QbertSourceSpec{}, map[string][]byte{"token": []byte(qberttest.Token)})
+	defer q.server.Close()
+	q.server.AddCluster(qbert.Cluster{Name: "prod", UUID: "uuid-prod", MasterIP: "10.0.0.1"}, qbertKubeconfig("https://10.0.0.1"))
+	existing := &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "prod"}}
+	g.Expect(q.reconciler.Create(context.Background(), existing)).To(Succeed())
+
+	qbertSource, err := q.reconcile(g)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(qbertSource.Status.Clusters).To(HaveLen(1))
+	g.Expect(qbertSource.Status.Clusters[0].State).To(Equal(externalv1.QbertClusterFailed))
+	g.Expect(qbertSource.Status.Clusters[0].Message).To(ContainSubstring("was not imported from this qbert cluster"))
+	g.Expect(conditions.IsFalse(qbertSource, QbertClustersImportedCondition)).To(BeTrue())
+	g.Expect(conditions.IsTrue(qbertSource, clusterv1.ReadyCondition)).To(BeTrue())
+}
+
+func TestQbertSourceReconcileLogin(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        externalv1.QbertSourceSpec
+		credentials map[string][]byte
+		wantReason  string
+		wantMessage string
+
+		// wantToken is the bearer token in the kubeconfig, or empty for the
+		// Keystone token that the reconcile was issued.
+		wantToken string
+	}{
+		{
+			name:        "password",
+			credentials: map[string][]byte{"username": []byte("admin@example.com"), "password": []byte("secret")},
+			// base64 of {"password":"secret","username":"admin@example.com"}
+			wantToken: "eyJwYXNzd29yZCI6InNlY3JldCIsInVzZXJuYW1lIjoiYWRtaW5AZXhhbXBsZS5jb20ifQ==",
+		},
+		{
+			name:        "token",
+			credentials: map[string][]byte{"token": []byte(qberttest.Token)},
+		},
+		{
+			name:        "region",
+			spec:        externalv1.QbertSourceSpec{Region: qberttest.Region},
+			credentials: map[string][]byte{"token": []byte(qberttest.Token)},
+		},
+		{
+			name:        "unknown region",
+			spec:        externalv1.QbertSourceSpec{Region: "RegionTwo"},
+			credentials: map[string][]byte{"token": []byte(qberttest.Token)},
+			wantReason:  QbertAuthenticationFailedReason,
+			wantMessage: `no qbert endpoint found in region "RegionTwo"`,
+		},
+		{
+			name:        "wrong password",
+			credentials: map[string][]byte{"username": []byte("admin@example.com"), "password": []byte("wrong")},
+			wantReason:  QbertAuthenticationFailedReason,
+			wantMessage: "401 Unauthorized",
+		},
+		{
+			name:        "wrong project",
+			spec:        externalv1.QbertSourceSpec{Project: "other"},
+			credentials: map[string][]byte{"token": []byte(qberttest.Token)},
+			wantReason:  QbertAuthenticationFailedReason,
+			wantMessage: "project not found",
+		},
+		{
+			name:        "incomplete credentials",
+			credentials: map[string][]byte{"username": []byte("admin@example.com")},
+			wantReason:  QbertCredentialsUnavailableReason,
+			wantMessage: "should contain either username and password, or token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			q := newQbertSourceTest(g, tt.spec, tt.credentials)
+			defer q.server.Close()
+			name := strings.ReplaceAll(tt.name, " ", "-")
+			q.server.AddCluster(qbert.Cluster{Name: name, UUID: "uuid-" + name, MasterIP: "10.0.0.1"}, qbertKubeconfig("https://10.0.0.1"))
+
+			qbertSource, err := q.reconcile(g)
+			if tt.wantReason != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantMessage)))
+				g.Expect(conditions.IsFalse(qbertSource, clusterv1.ReadyCondition)).To(BeTrue())
+				g.Expect(conditions.GetReason(qbertSource, clusterv1.ReadyCondition)).To(Equal(tt.wantReason))
+				g.Expect(conditions.GetMessage(qbertSource, clusterv1.ReadyCondition)).To(ContainSubstring(tt.wantMessage))
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(conditions.IsTrue(qbertSource, clusterv1.ReadyCondition)).To(BeTrue())
+			wantToken := tt.wantToken
+			if wantToken == "" {
+				wantToken = q.server.LastToken()
+			}
+			g.Expect(q.kubeconfig(g, name)).To(ContainSubstring("token: " + wantToken + "\n"))
+			if tt.spec.Region != "" {
+				g.Expect(q.server.RegionalRequests()).To(BeNumerically(">", 0))
+			} else {
+				g.Expect(q.server.RegionalRequests()).To(BeZero())
+			}
+		})
+	}
+}
+
+func TestQbertSourceReconcileProxyWithClusterClass(t *testing.T) {
+	g := NewWithT(t)
+	spec := externalv1.QbertSourceSpec{
+		ClusterClass: "external",
+		Proxy:        &externalv1.ProxySpec{URL: "http://proxy.example.com:3128"},
+	}
+	q := newQbertSourceTest(g, spec, map[string][]byte{"token": []byte(qberttest.Token)})
+	defer q.server.Close()
+	q.server.AddCluster(qbert.Cluster{Name: "prod", UUID: "uuid-prod", MasterIP: "10.0.0.1"}, qbertKubeconfig("https://10.0.0.1"))
+
+	qbertSource, err := q.reconcile(g)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(conditions.IsFalse(qbertSource, clusterv1.ReadyCondition)).To(BeTrue())
+	g.Expect(conditions.GetReason(qbertSource, clusterv1.ReadyCondition)).To(Equal(QbertInvalidSpecReason))
+	g.Expect(qbertSource.Status.Clusters).To(BeEmpty())
+	clusters := &clusterv1.ClusterList{}
+	g.Expect(q.reconciler.List(context.Background(), clusters)).To(Succeed())
+	g.Expect(clusters.Items).To(BeEmpty())
+}
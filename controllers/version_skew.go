@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/metrics"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+)
+
+const (
+	// VersionSkewSupportedCondition is false if the kubelet of a node
+	// violates the Kubernetes version skew policy with the API server: the
+	// kubelet must not be newer than the API server, and at most two minor
+	// versions older, or three as of Kubernetes 1.28. The nodes are listed in
+	// the VersionSkew of the ExternalCluster status.
+	VersionSkewSupportedCondition clusterv1.ConditionType = "VersionSkewSupported"
+	UnsupportedVersionSkewReason                          = "UnsupportedVersionSkew"
+
+	// maxVersionSkewMessageNodes bounds the number of nodes named in the
+	// message of the VersionSkewSupported condition.
+	maxVersionSkewMessageNodes = 10
+)
+
+// reconcileVersionSkew compares the kubelet version of each node with the
+// version of the API server, and reports the nodes that violate the version
+// skew policy. Nodes with an unparsable kubelet version are skipped.
+func reconcileVersionSkew(clusterScope *scope.ExternalClusterScope, nodes []corev1.Node, apiServerVersion string) {
+	externalCluster := clusterScope.ExternalCluster
+	apiServer, err := version.ParseGeneric(apiServerVersion)
+	if err != nil {
+		return
+	}
+
+	var skew []externalv1.NodeVersionSkew
+	for i := range nodes {
+		kubeletVersion := nodes[i].Status.NodeInfo.KubeletVersion
+		kubelet, err := version.ParseGeneric(kubeletVersion)
+		if err != nil {
+			continue
+		}
+		if reason := versionSkewViolation(kubelet, apiServer); reason != "" {
+			skew = append(skew, externalv1.NodeVersionSkew{
+				Node:             nodes[i].Name,
+				KubeletVersion:   kubeletVersion,
+				APIServerVersion: apiServerVersion,
+				Reason:           reason,
+			})
+		}
+	}
+	sort.Slice(skew, func(i, j int) bool { return skew[i].Node < skew[j].Node })
+	externalCluster.Status.VersionSkew = skew
+	metrics.ClusterVersionSkewNodes.WithLabelValues(clusterScope.Namespace(), clusterScope.Name()).Set(float64(len(skew)))
+
+	if len(skew) == 0 {
+		conditions.MarkTrue(externalCluster, VersionSkewSupportedCondition)
+		return
+	}
+	conditions.Set(externalCluster, &clusterv1.Condition{
+		Type:     VersionSkewSupportedCondition,
+		Status:   corev1.ConditionFalse,
+		Severity: clusterv1.ConditionSeverityWarning,
+		Reason:   UnsupportedVersionSkewReason,
+		Message:  versionSkewMessage(skew),
+	})
+}
+
+// versionSkewViolation returns the reason why the kubelet version violates
+// the version skew policy with the API server, or an empty string if it does
+// not.
+func versionSkewViolation(kubelet, apiServer *version.Version) string {
+	if kubelet.Major() != apiServer.Major() {
+		if kubelet.Major() > apiServer.Major() {
+			return externalv1.KubeletNewerThanAPIServer
+		}
+		return externalv1.KubeletTooOld
+	}
+	maxSkew := uint(2)
+	if apiServer.AtLeast(version.MustParseGeneric("1.28")) {
+		maxSkew = 3
+	}
+	switch {
+	case kubelet.Minor() > apiServer.Minor():
+		return externalv1.KubeletNewerThanAPIServer
+	case apiServer.Minor()-kubelet.Minor() > maxSkew:
+		return externalv1.KubeletTooOld
+	default:
+		return ""
+	}
+}
+
+// versionSkewMessage summarizes the nodes per reason, e.g. "kubelet newer
+// than the API server v1.22.4 on node-1, node-2".
+func versionSkewMessage(skew []externalv1.NodeVersionSkew) string {
+	nodes := map[string][]string{}
+	for _, node := range skew {
+		nodes[node.Reason] = append(nodes[node.Reason], node.Node)
+	}
+	var messages []string
+	for _, reason := range []string{externalv1.KubeletNewerThanAPIServer, externalv1.KubeletTooOld} {
+		if len(nodes[reason]) == 0 {
+			continue
+		}
+		description := "kubelet newer than"
+		if reason == externalv1.KubeletTooOld {
+			description = "kubelet too old for"
+		}
+		names := nodes[reason]
+		if len(names) > maxVersionSkewMessageNodes {
+			names = append(names[:maxVersionSkewMessageNodes:maxVersionSkewMessageNodes], fmt.Sprintf("and %d more", len(nodes[reason])-maxVersionSkewMessageNodes))
+		}
+		messages = append(messages, fmt.Sprintf("%s the API server %s on %s", description, skew[0].APIServerVersion, strings.Join(names, ", ")))
+	}
+	return strings.Join(messages, "; ")
+}
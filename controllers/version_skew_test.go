@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/scope"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+)
+
+func TestVersionSkewViolation(t *testing.T) {
+	tests := []struct {
+		kubelet   string
+		apiServer string
+		want      string
+	}{
+		{kubelet: "v1.23.5", apiServer: "v1.23.5"},
+		{kubelet: "v1.23.1", apiServer: "v1.23.5"},
+		{kubelet: "v1.23.5", apiServer: "v1.23.1"},
+		{kubelet: "v1.24.0", apiServer: "v1.23.5", want: externalv1.KubeletNewerThanAPIServer},
+		{kubelet: "v1.21.0", apiServer: "v1.23.5"},
+		{kubelet: "v1.20.9", apiServer: "v1.23.5", want: externalv1.KubeletTooOld},
+		// The supported skew grows from two to three minor versions in 1.28.
+		{kubelet: "v1.25.0", apiServer: "v1.27.9"},
+		{kubelet: "v1.24.0", apiServer: "v1.27.9", want: externalv1.KubeletTooOld},
+		{kubelet: "v1.25.0", apiServer: "v1.28.0"},
+		{kubelet: "v1.24.0", apiServer: "v1.28.0", want: externalv1.KubeletTooOld},
+		{kubelet: "v1.26.3", apiServer: "v1.29.1"},
+		// Major versions are never compatible.
+		{kubelet: "v2.0.0", apiServer: "v1.29.1", want: externalv1.KubeletNewerThanAPIServer},
+		{kubelet: "v1.29.1", apiServer: "v2.0.0", want: externalv1.KubeletTooOld},
+		{kubelet: "v1.0.0", apiServer: "v2.1.0", want: externalv1.KubeletTooOld},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("kubelet %s with API server %s", tt.kubelet, tt.apiServer), func(t *testing.T) {
+			g := NewWithT(t)
+			got := versionSkewViolation(version.MustParseGeneric(tt.kubelet), version.MustParseGeneric(tt.apiServer))
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestReconcileVersionSkew(t *testing.T) {
+	g := NewWithT(t)
+	clusterScope := &scope.ExternalClusterScope{
+		Cluster:         &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "version-skew"}},
+		ExternalCluster: &externalv1.ExternalCluster{},
+	}
+	node := func(name, kubeletVersion string) corev1.Node {
+		return corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{KubeletVersion: kubeletVersion}},
+		}
+	}
+	nodes := []corev1.Node{
+		node("node-c", "v1.24.0"),
+		node("node-b", "v1.30.0"),
+		node("node-a", "v1.24.2"),
+		node("node-d", "v1.29.0"),
+		node("node-e", "unknown"),
+	}
+
+	reconcileVersionSkew(clusterScope, nodes, "v1.28.3")
+	externalCluster := clusterScope.ExternalCluster
+	g.Expect(externalCluster.Status.VersionSkew).To(Equal([]externalv1.NodeVersionSkew{
+		{Node: "node-a", KubeletVersion: "v1.24.2", APIServerVersion: "v1.28.3", Reason: externalv1.KubeletTooOld},
+		{Node: "node-b", KubeletVersion: "v1.30.0", APIServerVersion: "v1.28.3", Reason: externalv1.KubeletNewerThanAPIServer},
+		{Node: "node-c", KubeletVersion: "v1.24.0", APIServerVersion: "v1.28.3", Reason: externalv1.KubeletTooOld},
+		{Node: "node-d", KubeletVersion: "v1.29.0", APIServerVersion: "v1.28.3", Reason: externalv1.KubeletNewerThanAPIServer},
+	}))
+	g.Expect(conditions.IsFalse(externalCluster, VersionSkewSupportedCondition)).To(BeTrue())
+	g.Expect(conditions.GetReason(externalCluster, VersionSkewSupportedCondition)).To(Equal(UnsupportedVersionSkewReason))
+	g.Expect(conditions.Get(externalCluster, VersionSkewSupportedCondition).Severity).To(Equal(clusterv1.ConditionSeverityWarning))
+	g.Expect(conditions.GetMessage(externalCluster, VersionSkewSupportedCondition)).To(Equal(
+		"kubelet newer than the API server v1.28.3 on node-b, node-d; kubelet too old for the API server v1.28.3 on node-a, node-c"))
+
+	reconcileVersionSkew(clusterScope, nodes[3:], "v1.29.0")
+	g.Expect(externalCluster.Status.VersionSkew).To(BeEmpty())
+	g.Expect(conditions.IsTrue(externalCluster, VersionSkewSupportedCondition)).To(BeTrue())
+}
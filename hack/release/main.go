@@ -0,0 +1,24 @@
+// Command release writes the clusterctl artifacts of a provider release:
+// infrastructure-components.yaml, metadata.yaml and cluster-template.yaml.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/release"
+)
+
+func main() {
+	opts := release.Options{}
+	flag.StringVar(&opts.RepoDir, "repo-dir", ".", "The root of the repository.")
+	flag.StringVar(&opts.OutputDir, "output-dir", "build/releases", "The directory to write the release artifacts to.")
+	flag.StringVar(&opts.Image, "image", "", "The controller image of the release. If unspecified, the image in config/default is used.")
+	flag.Parse()
+
+	if err := release.Generate(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to generate the release: %v\n", err)
+		os.Exit(1)
+	}
+}
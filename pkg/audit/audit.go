@@ -0,0 +1,218 @@
+// Package audit records the mutating operations that CAPE performs against
+// the external clusters.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+
+	// ActorController is the actor of the operations performed by the
+	// controllers of CAPE itself.
+	ActorController = "cape"
+)
+
+// Event is a single audited operation.
+type Event struct {
+	Time        time.Time `json:"time"`
+	Actor       string    `json:"actor"`
+	Cluster     string    `json:"cluster"`
+	Verb        string    `json:"verb"`
+	Group       string    `json:"group,omitempty"`
+	Version     string    `json:"version,omitempty"`
+	Resource    string    `json:"resource,omitempty"`
+	Subresource string    `json:"subresource,omitempty"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	Path        string    `json:"path"`
+	Outcome     string    `json:"outcome"`
+	StatusCode  int       `json:"statusCode,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Sink receives the audit events. Implementations must be safe for
+// concurrent use.
+type Sink interface {
+	Write(event Event) error
+}
+
+// JSONSink writes the events as JSON lines.
+type JSONSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewJSONSink returns a Sink that writes JSON lines to w.
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+// OpenFileSink returns a JSONSink that appends to the file at path, or that
+// writes to stdout if path is "-".
+func OpenFileSink(path string) (*JSONSink, error) {
+	if path == "-" {
+		return NewJSONSink(os.Stdout), nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open audit log")
+	}
+	return &JSONSink{w: f, closer: f}, nil
+}
+
+func (s *JSONSink) Write(event Event) error {
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(bs, '\n'))
+	return err
+}
+
+// Close closes the underlying file, if any.
+func (s *JSONSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// Read parses the JSON lines written by a JSONSink and calls fn for each
+// event.
+func Read(r io.Reader, fn func(Event) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return errors.Wrapf(err, "invalid audit event on line %d", line)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// InstrumentRESTConfig wraps the transport of the rest.Config to record every
+// mutating request to the cluster in the sink, on behalf of actor.
+func InstrumentRESTConfig(sink Sink, cluster types.NamespacedName, actor string, config *rest.Config) {
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return NewRoundTripper(sink, cluster, actor, rt)
+	})
+}
+
+// NewRoundTripper returns a RoundTripper that records every mutating request
+// to the cluster in the sink, on behalf of actor.
+func NewRoundTripper(sink Sink, cluster types.NamespacedName, actor string, delegate http.RoundTripper) http.RoundTripper {
+	return &auditRoundTripper{sink: sink, cluster: cluster.String(), actor: actor, delegate: delegate}
+}
+
+type auditRoundTripper struct {
+	sink     Sink
+	cluster  string
+	actor    string
+	delegate http.RoundTripper
+}
+
+func (rt *auditRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	verb, mutating := mutatingVerb(req.Method)
+	if !mutating {
+		return rt.delegate.RoundTrip(req)
+	}
+
+	resp, err := rt.delegate.RoundTrip(req)
+	event := Event{
+		Time:    time.Now().UTC(),
+		Actor:   rt.actor,
+		Cluster: rt.cluster,
+		Verb:    verb,
+		Path:    req.URL.Path,
+		Outcome: OutcomeSuccess,
+	}
+	event.Group, event.Version, event.Resource, event.Subresource, event.Namespace, event.Name = parseResourcePath(req.URL.Path)
+	switch {
+	case err != nil:
+		event.Outcome = OutcomeFailure
+		event.Error = err.Error()
+	case resp.StatusCode >= http.StatusBadRequest:
+		event.Outcome = OutcomeFailure
+		event.StatusCode = resp.StatusCode
+	default:
+		event.StatusCode = resp.StatusCode
+	}
+	// Failing to write the audit log must not break the operation itself.
+	_ = rt.sink.Write(event)
+	return resp, err
+}
+
+func mutatingVerb(method string) (string, bool) {
+	switch method {
+	case http.MethodPost:
+		return "create", true
+	case http.MethodPut:
+		return "update", true
+	case http.MethodPatch:
+		return "patch", true
+	case http.MethodDelete:
+		return "delete", true
+	default:
+		return "", false
+	}
+}
+
+// parseResourcePath extracts the resource from a Kubernetes API path, such
+// as /api/v1/namespaces/default/pods/foo/eviction or
+// /apis/rbac.authorization.k8s.io/v1/clusterrolebindings/bar.
+func parseResourcePath(path string) (group, version, resource, subresource, namespace, name string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		version, parts = parts[1], parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		group, version, parts = parts[1], parts[2], parts[3:]
+	default:
+		return "", "", "", "", "", ""
+	}
+	if len(parts) >= 2 && parts[0] == "namespaces" {
+		switch {
+		case len(parts) == 2:
+			// The namespace itself.
+			return group, version, "namespaces", "", "", parts[1]
+		case len(parts) == 3 && (parts[2] == "status" || parts[2] == "finalize"):
+			// A subresource of the namespace.
+			return group, version, "namespaces", parts[2], "", parts[1]
+		}
+		namespace, parts = parts[1], parts[2:]
+	}
+	if len(parts) > 0 {
+		resource = parts[0]
+	}
+	if len(parts) > 1 {
+		name = parts[1]
+	}
+	if len(parts) > 2 {
+		subresource = strings.Join(parts[2:], "/")
+	}
+	return group, version, resource, subresource, namespace, name
+}
@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestParseResourcePath(t *testing.T) {
+	tests := []struct {
+		path                                                   string
+		group, version, resource, subresource, namespace, name string
+	}{
+		// Core API.
+		{path: "/api/v1/nodes/worker-1", version: "v1", resource: "nodes", name: "worker-1"},
+		{path: "/api/v1/namespaces/default/pods", version: "v1", resource: "pods", namespace: "default"},
+		{path: "/api/v1/namespaces/default/pods/foo", version: "v1", resource: "pods", namespace: "default", name: "foo"},
+		{path: "/api/v1/namespaces/default/pods/foo/eviction", version: "v1", resource: "pods", subresource: "eviction", namespace: "default", name: "foo"},
+		{path: "/api/v1/namespaces/default/pods/foo/proxy/healthz", version: "v1", resource: "pods", subresource: "proxy/healthz", namespace: "default", name: "foo"},
+		// API groups.
+		{path: "/apis/rbac.authorization.k8s.io/v1/clusterrolebindings/bar", group: "rbac.authorization.k8s.io", version: "v1", resource: "clusterrolebindings", name: "bar"},
+		{path: "/apis/apps/v1/namespaces/kube-system/deployments/coredns/scale", group: "apps", version: "v1", resource: "deployments", subresource: "scale", namespace: "kube-system", name: "coredns"},
+		{path: "/apis/apps/v1/", group: "apps", version: "v1"},
+		// Namespaces themselves.
+		{path: "/api/v1/namespaces", version: "v1", resource: "namespaces"},
+		{path: "/api/v1/namespaces/team-a", version: "v1", resource: "namespaces", name: "team-a"},
+		{path: "/api/v1/namespaces/team-a/finalize", version: "v1", resource: "namespaces", subresource: "finalize", name: "team-a"},
+		{path: "/api/v1/namespaces/team-a/status", version: "v1", resource: "namespaces", subresource: "status", name: "team-a"},
+		// Not resource paths.
+		{path: "/version"},
+		{path: "/apis/apps"},
+		{path: "/healthz/ping"},
+		{path: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			g := NewWithT(t)
+			group, version, resource, subresource, namespace, name := parseResourcePath(tt.path)
+			g.Expect([]string{group, version, resource, subresource, namespace, name}).To(Equal(
+				[]string{tt.group, tt.version, tt.resource, tt.subresource, tt.namespace, tt.name}))
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	g := NewWithT(t)
+
+	buf := &bytes.Buffer{}
+	sink := NewJSONSink(buf)
+	want := []Event{
+		{Time: time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC), Actor: ActorController, Cluster: "default/prod", Verb: "create",
+			Version: "v1", Resource: "serviceaccounts", Namespace: "kube-system", Path: "/api/v1/namespaces/kube-system/serviceaccounts",
+			Outcome: OutcomeSuccess, StatusCode: 201},
+		{Time: time.Date(2022, 5, 1, 12, 1, 0, 0, time.UTC), Actor: "alice", Cluster: "default/prod", Verb: "delete",
+			Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterrolebindings", Name: "cape",
+			Path: "/apis/rbac.authorization.k8s.io/v1/clusterrolebindings/cape", Outcome: OutcomeFailure, Error: "connection refused"},
+	}
+	g.Expect(sink.Write(want[0])).To(Succeed())
+	// Blank lines, for example from a truncated write, are skipped.
+	buf.WriteString("\n  \n")
+	g.Expect(sink.Write(want[1])).To(Succeed())
+	g.Expect(sink.Close()).To(Succeed())
+
+	var got []Event
+	g.Expect(Read(buf, func(event Event) error {
+		got = append(got, event)
+		return nil
+	})).To(Succeed())
+	g.Expect(got).To(Equal(want))
+}
+
+func TestReadErrors(t *testing.T) {
+	g := NewWithT(t)
+	line := `{"time":"2022-05-01T12:00:00Z","actor":"cape","cluster":"default/prod","verb":"create","path":"/api/v1/namespaces","outcome":"success"}`
+
+	var events int
+	err := Read(strings.NewReader(line+"\n\n{not json\n"+line+"\n"), func(Event) error {
+		events++
+		return nil
+	})
+	g.Expect(err).To(MatchError(ContainSubstring("invalid audit event on line 3")))
+	g.Expect(events).To(Equal(1))
+
+	// An error of the callback stops the read.
+	stop := errors.New("stop")
+	events = 0
+	err = Read(strings.NewReader(line+"\n"+line+"\n"), func(Event) error {
+		events++
+		return stop
+	})
+	g.Expect(err).To(MatchError(stop))
+	g.Expect(events).To(Equal(1))
+}
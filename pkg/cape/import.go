@@ -1,19 +1,28 @@
 package cape
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"strconv"
+	"strings"
+	"time"
 
 	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
 	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
-	"github.com/platform9/pf9-sdk-go/pf9/du"
-	"github.com/platform9/pf9-sdk-go/pf9/keystone"
-	"github.com/platform9/pf9-sdk-go/pf9/qbert"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/audit"
+	capekubeconfig "github.com/platform9-incubator/cluster-api-provider-external/pkg/kubeconfig"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/remote"
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/utils/pointer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -21,104 +30,374 @@ import (
 type ClusterImporter struct {
 	MgmtClient client.Client
 	Log        *zap.SugaredLogger
+
+	// ClusterClass imports the clusters with a managed topology of this
+	// ClusterClass, which creates the ExternalCluster and ExternalControlPlane
+	// from its templates. The ControlPlaneEndpoint of the ExternalCluster is
+	// then taken from the kubeconfig.
+	ClusterClass string
+
+	// ResolveAuth replaces the exec and auth-provider plugins of the
+	// kubeconfigs, which the controller cannot run, with the token of a
+	// ServiceAccount in the cluster, see kubeconfig.ResolveAuthMethod.
+	// Without it, clusters with such kubeconfigs fail to import.
+	ResolveAuth bool
+
+	// ResolveAuthTokenTTL makes ResolveAuth request a token that expires
+	// after the duration, instead of the token of a token Secret, which does
+	// not expire. See kubeconfig.ResolveOptions.
+	ResolveAuthTokenTTL time.Duration
+
+	// Proxy is set on the ExternalClusters of the imported clusters, and
+	// routes the requests of the import itself, such as the detection of the
+	// version, through the proxy. Its credentials Secret must exist in the
+	// namespace of the clusters. It cannot be combined with a ClusterClass,
+	// whose ExternalClusterTemplate sets the proxy of the ExternalClusters
+	// instead; see ErrProxyWithClusterClass.
+	Proxy *externalinfrav1.ProxySpec
+
+	// Audit records the mutating requests of the import to the clusters,
+	// such as the creation of the ServiceAccount of ResolveAuth, on behalf of
+	// Actor. Auditing is disabled if it is nil.
+	Audit audit.Sink
+	Actor string
 }
 
-func (c *ClusterImporter) ImportClusterResources(ctx context.Context, ClusterName string, MgmtClusterNamespace string, host string, port int, workloadClusterKubeconfig string) error {
-	resources := []client.Object{
-		&clusterv1.Cluster{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      ClusterName,
-				Namespace: MgmtClusterNamespace,
+// ErrProxyWithClusterClass is returned by ImportCluster if the importer has
+// both a Proxy and a ClusterClass. The Cluster of a managed topology does not
+// carry the proxy, so the ExternalCluster created from the ClusterClass would
+// not use the proxy that the import reached the cluster through.
+var ErrProxyWithClusterClass = errors.New("a proxy cannot be combined with a ClusterClass; set the proxy in the ExternalClusterTemplate of the ClusterClass instead")
+
+// ClusterToImport describes an external cluster to import.
+type ClusterToImport struct {
+	Name       string
+	Namespace  string
+	Host       string
+	Port       int
+	Kubeconfig []byte
+
+	// Labels are added to the Cluster, for example to record where the
+	// cluster was imported from.
+	Labels map[string]string
+
+	// Version is the Kubernetes version of the managed topology of the
+	// Cluster if the importer has a ClusterClass. It is detected from the
+	// cluster if empty.
+	Version string
+}
+
+// ImportCluster creates the Cluster, ExternalCluster, ExternalControlPlane
+// and kubeconfig Secret of an external cluster. The Cluster is created last,
+// so that an import that failed halfway can be retried; an existing Cluster
+// with the same name is never touched. With a ClusterClass, only the Cluster
+// and the kubeconfig Secret are created.
+func (c *ClusterImporter) ImportCluster(ctx context.Context, cluster ClusterToImport) error {
+	if c.ClusterClass != "" && c.Proxy != nil {
+		return ErrProxyWithClusterClass
+	}
+	capiCluster := &clusterv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cluster.Name,
+			Namespace: cluster.Namespace,
+			Labels:    cluster.Labels,
+		},
+		Spec: clusterv1.ClusterSpec{
+			ControlPlaneRef: &corev1.ObjectReference{
+				APIVersion: externalcontrolplanev1.GroupVersion.String(),
+				Kind:       "ExternalControlPlane",
+				Name:       cluster.Name,
 			},
-			Spec: clusterv1.ClusterSpec{
-				ControlPlaneRef: &corev1.ObjectReference{
-					APIVersion: externalcontrolplanev1.GroupVersion.String(),
-					Kind:       "ExternalControlPlane",
-					Name:       ClusterName,
-				},
-				InfrastructureRef: &corev1.ObjectReference{
-					APIVersion: externalinfrav1.GroupVersion.String(),
-					Kind:       "ExternalCluster",
-					Name:       ClusterName,
-				},
+			InfrastructureRef: &corev1.ObjectReference{
+				APIVersion: externalinfrav1.GroupVersion.String(),
+				Kind:       "ExternalCluster",
+				Name:       cluster.Name,
 			},
 		},
+	}
+	err := c.MgmtClient.Get(ctx, client.ObjectKeyFromObject(capiCluster), &clusterv1.Cluster{})
+	if err == nil {
+		return apierrors.NewAlreadyExists(clusterv1.GroupVersion.WithResource("clusters").GroupResource(), cluster.Name)
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+	if cluster.Kubeconfig, err = c.checkAuthMethod(ctx, cluster.Namespace, cluster.Name, cluster.Kubeconfig); err != nil {
+		return err
+	}
+	if c.ClusterClass != "" {
+		if err := c.setTopology(ctx, capiCluster, cluster); err != nil {
+			return err
+		}
+		return c.createCluster(ctx, capiCluster, cluster.Kubeconfig)
+	}
+
+	resources := []client.Object{
 		&externalinfrav1.ExternalCluster{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      ClusterName,
-				Namespace: MgmtClusterNamespace,
+				Name:      cluster.Name,
+				Namespace: cluster.Namespace,
 			},
 			Spec: externalinfrav1.ExternalClusterSpec{
 				ControlPlaneEndpoint: clusterv1.APIEndpoint{
-					Host: host,
-					Port: int32(port),
+					Host: cluster.Host,
+					Port: int32(cluster.Port),
 				},
+				Proxy: c.Proxy,
 			},
 		},
 		&externalcontrolplanev1.ExternalControlPlane{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      ClusterName,
-				Namespace: MgmtClusterNamespace,
+				Name:      cluster.Name,
+				Namespace: cluster.Namespace,
 			},
 			Spec: externalcontrolplanev1.ExternalControlPlaneSpec{},
 		},
-		&corev1.Secret{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      fmt.Sprintf("%s-kubeconfig", ClusterName),
-				Namespace: MgmtClusterNamespace,
-			},
-			Immutable: pointer.Bool(true),
-			StringData: map[string]string{
-				"value": workloadClusterKubeconfig,
-			},
-			Type: clusterv1.ClusterSecretType,
-		},
 	}
 	for _, resource := range resources {
 		c.Log.Debugf("Creating resource %T: %s/%s", resource, resource.GetNamespace(), resource.GetName())
 		err := c.MgmtClient.Create(ctx, resource)
+		if apierrors.IsAlreadyExists(err) {
+			c.Log.Debugf("Resource %T: %s/%s already exists", resource, resource.GetNamespace(), resource.GetName())
+			continue
+		}
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return c.createCluster(ctx, capiCluster, cluster.Kubeconfig)
 }
 
-func (c *ClusterImporter) ImportClustersFromQbert(ctx context.Context, username string, password string, project string, region string, managementClusterNamespace string, fqdn string) error {
-	keystoneEndpoint := fmt.Sprintf("%s/keystone", fqdn)
-	creds := keystone.Credentials{
-		Username: username,
-		Password: password,
-		Tenant:   project,
-		Region:   region,
-	}
-	ksClient := keystone.NewClient(keystoneEndpoint)
-	basicAuth := keystone.NewBasicTokenGenerator(ksClient, creds)
-	qbertClient := qbert.NewQbert(qbert.Config{
-		DU: du.Info{
-			FQDN: fqdn,
+// checkAuthMethod returns the kubeconfig if the controller can use its
+// credentials. Exec and auth-provider plugins are resolved if ResolveAuth is
+// set, and rejected otherwise. Other problems of the kubeconfig are reported
+// by the controller, as before.
+func (c *ClusterImporter) checkAuthMethod(ctx context.Context, namespace, name string, kubeconfig []byte) ([]byte, error) {
+	err := capekubeconfig.CheckAuthMethod(kubeconfig)
+	if !errors.Is(err, capekubeconfig.ErrUnsupportedAuthMethod) {
+		return kubeconfig, nil
+	}
+	if !c.ResolveAuth {
+		return nil, fmt.Errorf("%w; the controller cannot run the plugin, so import the cluster with a token or client certificate, or with --resolve-auth", err)
+	}
+	c.Log.Debugf("Resolving the auth plugin of the kubeconfig: %v", err)
+	resolved, err := capekubeconfig.ResolveAuthMethod(ctx, kubeconfig, capekubeconfig.ResolveOptions{
+		Configure: func(config *rest.Config) error {
+			return c.configure(ctx, types.NamespacedName{Namespace: namespace, Name: name}, config)
 		},
-		Authenticator: basicAuth,
+		TokenTTL: c.ResolveAuthTokenTTL,
 	})
-	auth, err := basicAuth.Auth(ctx)
 	if err != nil {
-		panic(fmt.Sprintf("could not authenticate: %v", err))
+		return nil, fmt.Errorf("failed to resolve the auth plugin of the kubeconfig: %w", err)
 	}
-	qbertClusters, err := qbertClient.ListClusters()
-	if err != nil {
-		panic(fmt.Sprintf("could not list qbert clusters: %v", err))
+	return resolved, nil
+}
+
+// createCluster creates the kubeconfig Secret and then the Cluster.
+func (c *ClusterImporter) createCluster(ctx context.Context, capiCluster *clusterv1.Cluster, kubeconfig []byte) error {
+	if _, err := c.RefreshKubeconfig(ctx, capiCluster.Namespace, capiCluster.Name, kubeconfig); err != nil {
+		return err
 	}
-	for _, cluster := range qbertClusters {
-		// TODO: fix token 0-> base64 encoded username/password string
-		clusterKubeConfig, err := qbertClient.GetClusterKubeconfig(cluster.ProjectID, cluster.UUID, auth.Token)
-		if err != nil {
-			c.Log.Debugf("could not fetch kubeconfig for %s cluster. Not registering it.", cluster.Name)
+	c.Log.Debugf("Creating resource %T: %s/%s", capiCluster, capiCluster.Namespace, capiCluster.Name)
+	if err := c.MgmtClient.Create(ctx, capiCluster); err != nil {
+		return err
+	}
+	return c.adoptKubeconfig(ctx, capiCluster)
+}
+
+// setTopology replaces the references to the infrastructure and control plane
+// of the Cluster with a managed topology of the ClusterClass. The version of
+// the topology is detected from the cluster if it is not set.
+func (c *ClusterImporter) setTopology(ctx context.Context, capiCluster *clusterv1.Cluster, cluster ClusterToImport) error {
+	version := cluster.Version
+	if version == "" {
+		config, err := clientcmd.RESTConfigFromKubeConfig(cluster.Kubeconfig)
+		if err == nil {
+			err = c.configure(ctx, types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}, config)
+		}
+		if err == nil {
+			version, err = detectVersion(config)
 		}
-		apiPort, _ := strconv.Atoi(cluster.APIPort)
-		err = c.ImportClusterResources(ctx, cluster.Name, managementClusterNamespace, cluster.ExternalDNSName, apiPort, string(clusterKubeConfig))
 		if err != nil {
-			c.Log.Debugf("failed to register %s cluster: %v", cluster.Name, err)
+			return fmt.Errorf("failed to detect the Kubernetes version of cluster %s: %w", cluster.Name, err)
+		}
+	}
+	capiCluster.Spec.ControlPlaneRef = nil
+	capiCluster.Spec.InfrastructureRef = nil
+	capiCluster.Spec.Topology = &clusterv1.Topology{
+		Class:   c.ClusterClass,
+		Version: version,
+	}
+	return nil
+}
+
+// configure routes the rest.Config of a cluster to import through the proxy
+// of the importer, if any, and audits its requests.
+func (c *ClusterImporter) configure(ctx context.Context, cluster types.NamespacedName, config *rest.Config) error {
+	externalCluster := &externalinfrav1.ExternalCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: cluster.Namespace, Name: cluster.Name},
+		Spec:       externalinfrav1.ExternalClusterSpec{Proxy: c.Proxy},
+	}
+	return remote.Configure(ctx, c.MgmtClient, cluster, externalCluster, config, remote.Options{Audit: c.Audit, Actor: c.Actor})
+}
+
+// detectVersion returns the version of the API server of the cluster, as
+// v<major>.<minor>.<patch> without the distribution suffix.
+func detectVersion(config *rest.Config) (string, error) {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return "", err
+	}
+	serverVersion, err := discoveryClient.ServerVersion()
+	if err != nil {
+		return "", err
+	}
+	v, err := version.ParseGeneric(serverVersion.GitVersion)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("v%d.%d.%d", v.Major(), v.Minor(), v.Patch()), nil
+}
+
+// adoptKubeconfig sets the Cluster as the owner of its kubeconfig Secret, so
+// that `clusterctl move` finds the Secret even before the first reconcile.
+// The metadata of a Secret can be updated even if it is immutable.
+func (c *ClusterImporter) adoptKubeconfig(ctx context.Context, cluster *clusterv1.Cluster) error {
+	secret := &corev1.Secret{}
+	if err := c.MgmtClient.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: fmt.Sprintf("%s-kubeconfig", cluster.Name)}, secret); err != nil {
+		return err
+	}
+	patchBase := client.MergeFrom(secret.DeepCopy())
+	secret.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(cluster, clusterv1.GroupVersion.WithKind("Cluster"))}
+	return c.MgmtClient.Patch(ctx, secret, patchBase)
+}
+
+// RefreshKubeconfig creates the kubeconfig Secret of an imported cluster, or
+// updates it if the kubeconfig changed. It returns whether the Secret was
+// created or updated.
+func (c *ClusterImporter) RefreshKubeconfig(ctx context.Context, namespace string, name string, kubeconfig []byte) (bool, error) {
+	existing := &corev1.Secret{}
+	err := c.MgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: fmt.Sprintf("%s-kubeconfig", name)}, existing)
+	if apierrors.IsNotFound(err) {
+		return true, c.MgmtClient.Create(ctx, newKubeconfigSecret(namespace, name, kubeconfig))
+	}
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(existing.Data["value"], kubeconfig) {
+		return false, nil
+	}
+	if existing.Immutable == nil || !*existing.Immutable {
+		c.Log.Debugf("Updating kubeconfig secret %s/%s", existing.Namespace, existing.Name)
+		if existing.Data == nil {
+			existing.Data = map[string][]byte{}
 		}
+		existing.Data["value"] = kubeconfig
+		return true, c.MgmtClient.Update(ctx, existing)
+	}
+	return true, c.replaceImmutableKubeconfig(ctx, existing, kubeconfig)
+}
+
+// replaceImmutableKubeconfig replaces an immutable kubeconfig Secret, as
+// created by previous releases, with a mutable one. The cluster cannot be
+// accessed without its kubeconfig, so the create is retried.
+func (c *ClusterImporter) replaceImmutableKubeconfig(ctx context.Context, existing *corev1.Secret, kubeconfig []byte) error {
+	c.Log.Debugf("Replacing immutable kubeconfig secret %s/%s", existing.Namespace, existing.Name)
+	if err := c.MgmtClient.Delete(ctx, existing); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	secret := newKubeconfigSecret(existing.Namespace, strings.TrimSuffix(existing.Name, "-kubeconfig"), kubeconfig)
+	// Keep the metadata of the replaced Secret, so that it is not orphaned.
+	secret.Labels = existing.Labels
+	secret.Annotations = existing.Annotations
+	secret.OwnerReferences = existing.OwnerReferences
+	err := retry.OnError(retry.DefaultBackoff, func(err error) bool { return !apierrors.IsAlreadyExists(err) }, func() error {
+		return c.MgmtClient.Create(ctx, secret)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to recreate kubeconfig secret %s/%s: %w", secret.Namespace, secret.Name, err)
 	}
 	return nil
 }
+
+func newKubeconfigSecret(namespace string, clusterName string, kubeconfig []byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-kubeconfig", clusterName),
+			Namespace: namespace,
+			Labels: map[string]string{
+				clusterv1.ClusterLabelName: clusterName,
+			},
+		},
+		Data: map[string][]byte{
+			"value": kubeconfig,
+		},
+		Type: clusterv1.ClusterSecretType,
+	}
+}
+
+// Import states of an ImportResult.
+const (
+	ImportStateImported = "imported"
+	ImportStateSkipped  = "skipped"
+	ImportStateFailed   = "failed"
+)
+
+// ImportResult is the outcome of the import of a single cluster.
+type ImportResult struct {
+	Name  string
+	State string
+
+	// Reason explains why the cluster was skipped or failed to import.
+	Reason string
+}
+
+// ImportFromSource imports all clusters of the source into the namespace and
+// returns the result for each cluster. Clusters without a kubeconfig and
+// clusters that were already imported are skipped. A cluster that fails to
+// import does not stop the import of the others; only a failure to list the
+// clusters is returned as an error.
+func (c *ClusterImporter) ImportFromSource(ctx context.Context, source ClusterSource, namespace string) ([]ImportResult, error) {
+	clusters, err := source.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list clusters: %w", err)
+	}
+	results := make([]ImportResult, 0, len(clusters))
+	for _, cluster := range clusters {
+		result := ImportResult{Name: cluster.Name, State: ImportStateImported}
+		err := c.importFromSource(ctx, source, namespace, cluster)
+		switch {
+		case errors.Is(err, ErrNoKubeconfig):
+			result.State, result.Reason = ImportStateSkipped, "no kubeconfig available"
+		case apierrors.IsAlreadyExists(err):
+			result.State, result.Reason = ImportStateSkipped, "already imported"
+		case err != nil:
+			result.State, result.Reason = ImportStateFailed, err.Error()
+		}
+		c.Log.Debugf("Import of cluster %s: %s %s", cluster.Name, result.State, result.Reason)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (c *ClusterImporter) importFromSource(ctx context.Context, source ClusterSource, namespace string, cluster SourceCluster) error {
+	kubeconfig, err := source.GetKubeconfig(ctx, cluster)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(kubeconfig)) == 0 {
+		return ErrNoKubeconfig
+	}
+	metadata, err := source.Metadata(ctx, cluster)
+	if err != nil {
+		return err
+	}
+	return c.ImportCluster(ctx, ClusterToImport{
+		Name:       cluster.Name,
+		Namespace:  namespace,
+		Host:       metadata.Host,
+		Port:       metadata.Port,
+		Kubeconfig: kubeconfig,
+		Labels:     metadata.Labels,
+	})
+}
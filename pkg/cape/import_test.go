@@ -0,0 +1,253 @@
+package cape
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestImporter(g *WithT, objects ...client.Object) *ClusterImporter {
+	scheme := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	g.Expect(clusterv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(externalinfrav1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(externalcontrolplanev1.AddToScheme(scheme)).To(Succeed())
+	return &ClusterImporter{
+		MgmtClient: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		Log:        zap.NewNop().Sugar(),
+	}
+}
+
+// fakeSource is a ClusterSource of in-memory kubeconfigs. Clusters without a
+// kubeconfig fail with the error in getErrors, or ErrNoKubeconfig.
+type fakeSource struct {
+	clusters    []SourceCluster
+	kubeconfigs map[string][]byte
+	getErrors   map[string]error
+	listErr     error
+}
+
+func (s *fakeSource) List(context.Context) ([]SourceCluster, error) {
+	return s.clusters, s.listErr
+}
+
+func (s *fakeSource) GetKubeconfig(_ context.Context, cluster SourceCluster) ([]byte, error) {
+	if err, ok := s.getErrors[cluster.Name]; ok {
+		return nil, err
+	}
+	kubeconfig, ok := s.kubeconfigs[cluster.Name]
+	if !ok {
+		return nil, ErrNoKubeconfig
+	}
+	return kubeconfig, nil
+}
+
+func (s *fakeSource) Metadata(_ context.Context, cluster SourceCluster) (ClusterMetadata, error) {
+	host, port, err := SplitServerURL(fmt.Sprintf("https://%s.example.com", cluster.Name))
+	return ClusterMetadata{Host: host, Port: port, Labels: map[string]string{"source": "fake"}}, err
+}
+
+func TestImportFromSource(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	importer := newTestImporter(g, &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "existing"}})
+	source := &fakeSource{
+		clusters: []SourceCluster{{Name: "prod"}, {Name: "creating"}, {Name: "empty"}, {Name: "existing"}, {Name: "broken"}},
+		kubeconfigs: map[string][]byte{
+			"prod":     testKubeconfig("https://prod.example.com"),
+			"empty":    []byte("\n"),
+			"existing": testKubeconfig("https://existing.example.com"),
+		},
+		getErrors: map[string]error{"broken": errors.New("500 Internal Server Error")},
+	}
+
+	results, err := importer.ImportFromSource(ctx, source, "default")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(results).To(Equal([]ImportResult{
+		{Name: "prod", State: ImportStateImported},
+		{Name: "creating", State: ImportStateSkipped, Reason: "no kubeconfig available"},
+		{Name: "empty", State: ImportStateSkipped, Reason: "no kubeconfig available"},
+		{Name: "existing", State: ImportStateSkipped, Reason: "already imported"},
+		{Name: "broken", State: ImportStateFailed, Reason: "500 Internal Server Error"},
+	}))
+
+	cluster := &clusterv1.Cluster{}
+	g.Expect(importer.MgmtClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod"}, cluster)).To(Succeed())
+	g.Expect(cluster.Labels).To(HaveKeyWithValue("source", "fake"))
+	externalCluster := &externalinfrav1.ExternalCluster{}
+	g.Expect(importer.MgmtClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod"}, externalCluster)).To(Succeed())
+	g.Expect(externalCluster.Spec.ControlPlaneEndpoint).To(Equal(clusterv1.APIEndpoint{Host: "prod.example.com", Port: 443}))
+	g.Expect(importer.MgmtClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod"}, &externalcontrolplanev1.ExternalControlPlane{})).To(Succeed())
+	secret := &corev1.Secret{}
+	g.Expect(importer.MgmtClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod-kubeconfig"}, secret)).To(Succeed())
+	g.Expect(secret.Data["value"]).To(Equal(testKubeconfig("https://prod.example.com")))
+	g.Expect(secret.Immutable).To(BeNil())
+	g.Expect(secret.OwnerReferences).To(HaveLen(1))
+	g.Expect(secret.OwnerReferences[0].Name).To(Equal("prod"))
+
+	// Skipped and failed clusters are not imported, not even partially.
+	for _, name := range []string{"creating", "empty", "broken"} {
+		err := importer.MgmtClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, &externalinfrav1.ExternalCluster{})
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue(), name)
+	}
+	err = importer.MgmtClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "existing-kubeconfig"}, &corev1.Secret{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+	_, err = importer.ImportFromSource(ctx, &fakeSource{listErr: errors.New("403 Forbidden")}, "default")
+	g.Expect(err).To(MatchError("failed to list clusters: 403 Forbidden"))
+}
+
+// flakyCreateClient fails the first creates of the client, up to failures.
+type flakyCreateClient struct {
+	client.Client
+	failures int
+	creates  int
+}
+
+func (c *flakyCreateClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.creates++
+	if c.creates <= c.failures {
+		return apierrors.NewServiceUnavailable("etcd leader changed")
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestRefreshKubeconfig(t *testing.T) {
+	oldKubeconfig := testKubeconfig("https://old.example.com")
+	newKubeconfig := testKubeconfig("https://new.example.com")
+	ownerReferences := []metav1.OwnerReference{{APIVersion: clusterv1.GroupVersion.String(), Kind: "Cluster", Name: "prod", UID: "uid-prod"}}
+	existingSecret := func(immutable bool) *corev1.Secret {
+		secret := newKubeconfigSecret("default", "prod", oldKubeconfig)
+		secret.Annotations = map[string]string{"example.com/annotation": "value"}
+		secret.OwnerReferences = ownerReferences
+		if immutable {
+			secret.Immutable = pointer.Bool(true)
+		}
+		return secret
+	}
+
+	tests := []struct {
+		name       string
+		existing   *corev1.Secret
+		kubeconfig []byte
+
+		// createFailures is the number of creates that fail before one
+		// succeeds.
+		createFailures int
+		wantChanged    bool
+		wantErr        string
+	}{
+		{
+			name:        "create",
+			kubeconfig:  newKubeconfig,
+			wantChanged: true,
+		},
+		{
+			name:       "unchanged",
+			existing:   existingSecret(false),
+			kubeconfig: oldKubeconfig,
+		},
+		{
+			name:        "update",
+			existing:    existingSecret(false),
+			kubeconfig:  newKubeconfig,
+			wantChanged: true,
+		},
+		{
+			name:        "unchanged immutable",
+			existing:    existingSecret(true),
+			kubeconfig:  oldKubeconfig,
+			wantChanged: false,
+		},
+		{
+			name:           "replace immutable",
+			existing:       existingSecret(true),
+			kubeconfig:     newKubeconfig,
+			createFailures: 2,
+			wantChanged:    true,
+		},
+		{
+			name:           "replace immutable fails",
+			existing:       existingSecret(true),
+			kubeconfig:     newKubeconfig,
+			createFailures: 100,
+			wantChanged:    true,
+			wantErr:        "failed to recreate kubeconfig secret default/prod-kubeconfig",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.Background()
+			var objects []client.Object
+			if tt.existing != nil {
+				objects = append(objects, tt.existing)
+			}
+			importer := newTestImporter(g, objects...)
+			flakyClient := &flakyCreateClient{Client: importer.MgmtClient, failures: tt.createFailures}
+			importer.MgmtClient = flakyClient
+
+			changed, err := importer.RefreshKubeconfig(ctx, "default", "prod", tt.kubeconfig)
+			g.Expect(changed).To(Equal(tt.wantChanged))
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			if tt.createFailures > 0 {
+				g.Expect(flakyClient.creates).To(Equal(tt.createFailures + 1))
+			}
+
+			secret := &corev1.Secret{}
+			g.Expect(importer.MgmtClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "prod-kubeconfig"}, secret)).To(Succeed())
+			g.Expect(secret.Data["value"]).To(Equal(tt.kubeconfig))
+			g.Expect(secret.Labels).To(HaveKeyWithValue(clusterv1.ClusterLabelName, "prod"))
+			if tt.existing == nil {
+				return
+			}
+			// Updated and replaced Secrets keep their metadata. Only
+			// Secrets that did not change stay immutable.
+			g.Expect(secret.Annotations).To(Equal(tt.existing.Annotations))
+			g.Expect(secret.OwnerReferences).To(Equal(ownerReferences))
+			if tt.wantChanged {
+				g.Expect(secret.Immutable).To(BeNil())
+			} else {
+				g.Expect(secret.Immutable).To(Equal(tt.existing.Immutable))
+			}
+		})
+	}
+}
+
+func TestImportClusterProxyWithClusterClass(t *testing.T) {
+	g := NewWithT(t)
+	importer := newTestImporter(g)
+	importer.ClusterClass = "external"
+	importer.Proxy = &externalinfrav1.ProxySpec{URL: "http://proxy.example.com:3128"}
+
+	err := importer.ImportCluster(context.Background(), ClusterToImport{
+		Name:       "workload",
+		Namespace:  "default",
+		Kubeconfig: testKubeconfig("https://10.0.0.1:6443"),
+		Version:    "v1.23.5",
+	})
+	g.Expect(err).To(MatchError(ErrProxyWithClusterClass))
+	clusters := &clusterv1.ClusterList{}
+	g.Expect(importer.MgmtClient.List(context.Background(), clusters)).To(Succeed())
+	g.Expect(clusters.Items).To(BeEmpty())
+	g.Expect(importer.MgmtClient.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "workload-kubeconfig"}, &corev1.Secret{})).To(Satisfy(apierrors.IsNotFound))
+}
@@ -0,0 +1,204 @@
+package cape
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/qbert"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// ErrNoKubeconfig is returned by ClusterSource.GetKubeconfig if there is no
+// kubeconfig for the cluster (yet). Such clusters are skipped on import.
+var ErrNoKubeconfig = errors.New("no kubeconfig available")
+
+// ClusterSource provides external clusters to import. Implement it to import
+// clusters from other inventories, and pass it to ImportFromSource.
+type ClusterSource interface {
+	// List returns the clusters that are available in the source.
+	List(ctx context.Context) ([]SourceCluster, error)
+
+	// GetKubeconfig returns the kubeconfig to access the cluster with.
+	GetKubeconfig(ctx context.Context, cluster SourceCluster) ([]byte, error)
+
+	// Metadata returns the API endpoint of the cluster and the labels to set
+	// on the imported Cluster.
+	Metadata(ctx context.Context, cluster SourceCluster) (ClusterMetadata, error)
+}
+
+// SourceCluster is a cluster listed by a ClusterSource.
+type SourceCluster struct {
+	// Name is the name to import the cluster as.
+	Name string
+
+	// ID identifies the cluster within the source.
+	ID string
+}
+
+// ClusterMetadata describes a cluster listed by a ClusterSource.
+type ClusterMetadata struct {
+	Host   string
+	Port   int
+	Labels map[string]string
+}
+
+// KubeconfigFileSource provides a single cluster from a kubeconfig file.
+type KubeconfigFileSource struct {
+	// Name is the name to import the cluster as.
+	Name string
+	Path string
+}
+
+func (s *KubeconfigFileSource) List(ctx context.Context) ([]SourceCluster, error) {
+	return []SourceCluster{{Name: s.Name, ID: s.Path}}, nil
+}
+
+func (s *KubeconfigFileSource) GetKubeconfig(ctx context.Context, cluster SourceCluster) ([]byte, error) {
+	return os.ReadFile(cluster.ID)
+}
+
+func (s *KubeconfigFileSource) Metadata(ctx context.Context, cluster SourceCluster) (ClusterMetadata, error) {
+	return kubeconfigFileMetadata(cluster.ID)
+}
+
+// KubeconfigDirSource provides a cluster for each kubeconfig file in a
+// directory. The clusters are named after the files, without extension.
+// Hidden files and subdirectories are ignored.
+type KubeconfigDirSource struct {
+	Dir string
+}
+
+func (s *KubeconfigDirSource) List(ctx context.Context) ([]SourceCluster, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var clusters []SourceCluster
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		clusters = append(clusters, SourceCluster{
+			Name: strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())),
+			ID:   filepath.Join(s.Dir, entry.Name()),
+		})
+	}
+	return clusters, nil
+}
+
+func (s *KubeconfigDirSource) GetKubeconfig(ctx context.Context, cluster SourceCluster) ([]byte, error) {
+	return os.ReadFile(cluster.ID)
+}
+
+func (s *KubeconfigDirSource) Metadata(ctx context.Context, cluster SourceCluster) (ClusterMetadata, error) {
+	return kubeconfigFileMetadata(cluster.ID)
+}
+
+// kubeconfigFileMetadata returns the API endpoint of the current context of a
+// kubeconfig file.
+func kubeconfigFileMetadata(path string) (ClusterMetadata, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", path)
+	if err != nil {
+		return ClusterMetadata{}, err
+	}
+	host, port, err := SplitServerURL(config.Host)
+	if err != nil {
+		return ClusterMetadata{}, fmt.Errorf("invalid server %q in %s: %w", config.Host, path, err)
+	}
+	return ClusterMetadata{Host: host, Port: port}, nil
+}
+
+// SplitServerURL splits the server URL of a kubeconfig into host and port.
+// The port defaults to 443.
+func SplitServerURL(server string) (string, int, error) {
+	if !strings.Contains(server, "://") {
+		server = "https://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", 0, err
+	}
+	if u.Port() == "" {
+		return u.Hostname(), 443, nil
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return "", 0, err
+	}
+	return u.Hostname(), port, nil
+}
+
+// QbertClusterSource provides the clusters of a PMK project.
+type QbertClusterSource struct {
+	Client qbert.Client
+
+	clusters map[string]qbert.Cluster
+}
+
+// NewQbertClusterSource returns a source for the clusters that are visible
+// to the client.
+func NewQbertClusterSource(client qbert.Client) *QbertClusterSource {
+	return &QbertClusterSource{Client: client, clusters: map[string]qbert.Cluster{}}
+}
+
+func (s *QbertClusterSource) List(ctx context.Context) ([]SourceCluster, error) {
+	qbertClusters, err := s.Client.ListClusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	clusters := make([]SourceCluster, 0, len(qbertClusters))
+	for _, qbertCluster := range qbertClusters {
+		s.clusters[qbertCluster.UUID] = qbertCluster
+		clusters = append(clusters, SourceCluster{Name: qbertCluster.Name, ID: qbertCluster.UUID})
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Name < clusters[j].Name })
+	return clusters, nil
+}
+
+func (s *QbertClusterSource) GetKubeconfig(ctx context.Context, cluster SourceCluster) ([]byte, error) {
+	kubeconfig, err := s.Client.GetKubeconfig(ctx, qbert.Cluster{Name: cluster.Name, UUID: cluster.ID})
+	if errors.Is(err, qbert.ErrNoKubeconfig) {
+		return nil, fmt.Errorf("%w: %v", ErrNoKubeconfig, err)
+	}
+	return kubeconfig, err
+}
+
+// Metadata returns the API endpoint of the cluster, preferring the external
+// DNS name over the IP of the master, and labels the cluster with its Qbert
+// UUID and project.
+func (s *QbertClusterSource) Metadata(ctx context.Context, cluster SourceCluster) (ClusterMetadata, error) {
+	qbertCluster, ok := s.clusters[cluster.ID]
+	if !ok {
+		return ClusterMetadata{}, fmt.Errorf("qbert cluster %s was not listed", cluster.ID)
+	}
+	host := qbertCluster.ExternalDNSName
+	if host == "" {
+		host = qbertCluster.MasterIP
+	}
+	if host == "" {
+		return ClusterMetadata{}, fmt.Errorf("qbert cluster %s has neither an external DNS name nor a master IP", cluster.Name)
+	}
+	port := 443
+	if qbertCluster.APIPort != "" {
+		var err error
+		if port, err = strconv.Atoi(qbertCluster.APIPort); err != nil {
+			return ClusterMetadata{}, fmt.Errorf("qbert cluster %s has an invalid API port %q", cluster.Name, qbertCluster.APIPort)
+		}
+	}
+	return ClusterMetadata{
+		Host: host,
+		Port: port,
+		Labels: map[string]string{
+			externalinfrav1.QbertClusterUUIDLabel: qbertCluster.UUID,
+			externalinfrav1.QbertProjectIDLabel:   qbertCluster.ProjectID,
+		},
+	}, nil
+}
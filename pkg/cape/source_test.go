@@ -0,0 +1,189 @@
+package cape
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/qbert"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/qbert/qberttest"
+)
+
+// testKubeconfig returns a kubeconfig of the API server at server that
+// authenticates with a token.
+func testKubeconfig(server string) []byte {
+	return []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: cluster
+  cluster:
+    server: ` + server + `
+users:
+- name: user
+  user:
+    token: __INSERT_BEARER_TOKEN_HERE__
+contexts:
+- name: default
+  context:
+    cluster: cluster
+    user: user
+current-context: default
+`)
+}
+
+func TestKubeconfigFileSource(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "prod.yaml")
+	g.Expect(os.WriteFile(path, testKubeconfig("https://10.0.0.1:6443"), 0o600)).To(Succeed())
+
+	source := &KubeconfigFileSource{Name: "prod", Path: path}
+	clusters, err := source.List(ctx)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(clusters).To(Equal([]SourceCluster{{Name: "prod", ID: path}}))
+	kubeconfig, err := source.GetKubeconfig(ctx, clusters[0])
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(kubeconfig).To(Equal(testKubeconfig("https://10.0.0.1:6443")))
+	metadata, err := source.Metadata(ctx, clusters[0])
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(metadata).To(Equal(ClusterMetadata{Host: "10.0.0.1", Port: 6443}))
+
+	_, err = source.Metadata(ctx, SourceCluster{Name: "missing", ID: filepath.Join(t.TempDir(), "missing.yaml")})
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestKubeconfigDirSource(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	g.Expect(os.WriteFile(filepath.Join(dir, "prod.yaml"), testKubeconfig("https://prod.example.com"), 0o600)).To(Succeed())
+	g.Expect(os.WriteFile(filepath.Join(dir, "staging.kubeconfig"), testKubeconfig("https://staging.example.com:8443"), 0o600)).To(Succeed())
+	g.Expect(os.WriteFile(filepath.Join(dir, ".hidden.yaml"), testKubeconfig("https://hidden.example.com"), 0o600)).To(Succeed())
+	g.Expect(os.Mkdir(filepath.Join(dir, "subdir"), 0o700)).To(Succeed())
+
+	source := &KubeconfigDirSource{Dir: dir}
+	clusters, err := source.List(ctx)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(clusters).To(Equal([]SourceCluster{
+		{Name: "prod", ID: filepath.Join(dir, "prod.yaml")},
+		{Name: "staging", ID: filepath.Join(dir, "staging.kubeconfig")},
+	}))
+	metadata, err := source.Metadata(ctx, clusters[0])
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(metadata).To(Equal(ClusterMetadata{Host: "prod.example.com", Port: 443}))
+	metadata, err = source.Metadata(ctx, clusters[1])
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(metadata).To(Equal(ClusterMetadata{Host: "staging.example.com", Port: 8443}))
+	kubeconfig, err := source.GetKubeconfig(ctx, clusters[1])
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(kubeconfig).To(Equal(testKubeconfig("https://staging.example.com:8443")))
+
+	_, err = (&KubeconfigDirSource{Dir: filepath.Join(dir, "missing")}).List(ctx)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestQbertClusterSource(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	server := qberttest.NewServer("admin@example.com", "secret", "service")
+	defer server.Close()
+	server.AddCluster(qbert.Cluster{Name: "prod", UUID: "uuid-prod", ExternalDNSName: "prod.example.com", MasterIP: "10.0.0.1", APIPort: "6443"}, testKubeconfig("https://prod.example.com:6443"))
+	server.AddCluster(qbert.Cluster{Name: "edge", UUID: "uuid-edge", MasterIP: "10.0.0.2"}, testKubeconfig("https://10.0.0.2"))
+	server.AddCluster(qbert.Cluster{Name: "creating", UUID: "uuid-creating"}, []byte{})
+	server.AddCluster(qbert.Cluster{Name: "invalid-port", UUID: "uuid-invalid-port", MasterIP: "10.0.0.3", APIPort: "https"}, testKubeconfig("https://10.0.0.3"))
+	qbertClient, err := qbert.NewClient(ctx, qbert.Config{FQDN: server.URL, Project: "service", Token: qberttest.Token})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	source := NewQbertClusterSource(qbertClient)
+	clusters, err := source.List(ctx)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(clusters).To(Equal([]SourceCluster{
+		{Name: "creating", ID: "uuid-creating"},
+		{Name: "edge", ID: "uuid-edge"},
+		{Name: "invalid-port", ID: "uuid-invalid-port"},
+		{Name: "prod", ID: "uuid-prod"},
+	}))
+
+	tests := []struct {
+		cluster      SourceCluster
+		wantMetadata ClusterMetadata
+		wantErr      string
+	}{
+		{
+			// The external DNS name is preferred over the IP of the master.
+			cluster:      SourceCluster{Name: "prod", ID: "uuid-prod"},
+			wantMetadata: ClusterMetadata{Host: "prod.example.com", Port: 6443},
+		},
+		{
+			cluster:      SourceCluster{Name: "edge", ID: "uuid-edge"},
+			wantMetadata: ClusterMetadata{Host: "10.0.0.2", Port: 443},
+		},
+		{
+			cluster: SourceCluster{Name: "creating", ID: "uuid-creating"},
+			wantErr: "neither an external DNS name nor a master IP",
+		},
+		{
+			cluster: SourceCluster{Name: "invalid-port", ID: "uuid-invalid-port"},
+			wantErr: `invalid API port "https"`,
+		},
+		{
+			cluster: SourceCluster{Name: "unlisted", ID: "uuid-unlisted"},
+			wantErr: "was not listed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cluster.Name, func(t *testing.T) {
+			g := NewWithT(t)
+			metadata, err := source.Metadata(ctx, tt.cluster)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(metadata.Host).To(Equal(tt.wantMetadata.Host))
+			g.Expect(metadata.Port).To(Equal(tt.wantMetadata.Port))
+			g.Expect(metadata.Labels).To(Equal(map[string]string{
+				externalinfrav1.QbertClusterUUIDLabel: tt.cluster.ID,
+				externalinfrav1.QbertProjectIDLabel:   qberttest.ProjectID,
+			}))
+		})
+	}
+
+	kubeconfig, err := source.GetKubeconfig(ctx, SourceCluster{Name: "edge", ID: "uuid-edge"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(kubeconfig)).To(ContainSubstring("token: " + server.LastToken() + "\n"))
+	_, err = source.GetKubeconfig(ctx, SourceCluster{Name: "creating", ID: "uuid-creating"})
+	g.Expect(errors.Is(err, ErrNoKubeconfig)).To(BeTrue())
+}
+
+func TestSplitServerURL(t *testing.T) {
+	tests := []struct {
+		server   string
+		wantHost string
+		wantPort int
+		wantErr  bool
+	}{
+		{server: "https://10.0.0.1:6443", wantHost: "10.0.0.1", wantPort: 6443},
+		{server: "https://api.example.com", wantHost: "api.example.com", wantPort: 443},
+		{server: "api.example.com:8443", wantHost: "api.example.com", wantPort: 8443},
+		{server: "https://[fd00::1]:6443", wantHost: "fd00::1", wantPort: 6443},
+		{server: "https://api.example.com:https", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			g := NewWithT(t)
+			host, port, err := SplitServerURL(tt.server)
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(host).To(Equal(tt.wantHost))
+			g.Expect(port).To(Equal(tt.wantPort))
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/erwinvaneyk/cobras"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tunnel"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+type AgentOptions struct {
+	*RootOptions
+	ServerAddress         string
+	Cluster               string
+	TokenFile             string
+	CAFile                string
+	InsecureSkipTLSVerify bool
+	Target                string
+}
+
+func NewCmdAgent(rootOptions *RootOptions) *cobra.Command {
+	opts := &AgentOptions{
+		RootOptions: rootOptions,
+		Cluster:     os.Getenv("CAPE_CLUSTER"),
+	}
+	if host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"); host != "" && port != "" {
+		opts.Target = net.JoinHostPort(host, port)
+	}
+
+	cmd := &cobra.Command{
+		Use:   "agent",
+		Short: "Open a reverse tunnel from an external cluster to the CAPE tunnel server.",
+		Long: `Open a reverse tunnel from an external cluster to the tunnel server of 'cape run'.
+
+The agent runs in the external cluster and allows CAPE to reach its API server
+when the cluster is not reachable from the management cluster, for example
+because it is behind NAT or a firewall. The ExternalCluster must have
+spec.tunnel set to true, and the token must match the token in the
+<cluster-name>-tunnel-token Secret in the management cluster.`,
+		Run: cobras.Run(opts),
+	}
+
+	cmd.Flags().StringVar(&opts.ServerAddress, "server", opts.ServerAddress, "host:port of the CAPE tunnel server.")
+	cmd.Flags().StringVar(&opts.Cluster, "cluster", opts.Cluster, "<namespace>/<name> of the Cluster in the management cluster. [CAPE_CLUSTER]")
+	cmd.Flags().StringVar(&opts.TokenFile, "token-file", opts.TokenFile, "File containing the token to authenticate with the tunnel server. Defaults to the CAPE_TUNNEL_TOKEN environment variable.")
+	cmd.Flags().StringVar(&opts.CAFile, "ca-file", opts.CAFile, "CA bundle to verify the certificate of the tunnel server. Defaults to the system roots.")
+	cmd.Flags().BoolVar(&opts.InsecureSkipTLSVerify, "insecure-skip-tls-verify", opts.InsecureSkipTLSVerify, "Do not verify the certificate of the tunnel server.")
+	cmd.Flags().StringVar(&opts.Target, "target", opts.Target, "host:port of the API server to forward the tunnel to. Defaults to the in-cluster API server.")
+
+	return cmd
+}
+
+func (o *AgentOptions) Complete(cmd *cobra.Command, args []string) error {
+	return o.RootOptions.Complete(cmd, args)
+}
+
+func (o *AgentOptions) Validate() error {
+	if len(o.ServerAddress) == 0 {
+		return errors.New("address of the tunnel server is required")
+	}
+	if _, _, ok := strings.Cut(o.Cluster, "/"); !ok {
+		return errors.New("cluster should be of the form <namespace>/<name>")
+	}
+	if len(o.Target) == 0 {
+		return errors.New("target is required when not running in a cluster")
+	}
+	if len(o.TokenFile) == 0 && os.Getenv("CAPE_TUNNEL_TOKEN") == "" {
+		return errors.New("token file or CAPE_TUNNEL_TOKEN is required")
+	}
+	return o.RootOptions.Validate()
+}
+
+func (o *AgentOptions) Run(ctx context.Context) error {
+	ctrl.SetLogger(zap.New(zap.UseDevMode(o.Debug)))
+
+	token := os.Getenv("CAPE_TUNNEL_TOKEN")
+	if len(o.TokenFile) > 0 {
+		bs, err := ioutil.ReadFile(o.TokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read token file: %w", err)
+		}
+		token = strings.TrimSpace(string(bs))
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: o.InsecureSkipTLSVerify,
+	}
+	if len(o.CAFile) > 0 {
+		bs, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(bs) {
+			return fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+	}
+
+	namespace, name, _ := strings.Cut(o.Cluster, "/")
+	agent := &tunnel.Agent{
+		Cluster: types.NamespacedName{Namespace: namespace, Name: name},
+		Token:   token,
+		Target:  o.Target,
+		Log:     ctrl.Log.WithName("agent"),
+	}
+	return agent.Run(ctx, o.ServerAddress, tlsConfig)
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/erwinvaneyk/cobras"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/audit"
+	"github.com/spf13/cobra"
+)
+
+type AuditOptions struct {
+	*RootOptions
+	File     string
+	Cluster  string
+	Actor    string
+	Verb     string
+	Resource string
+	Since    time.Duration
+	Failed   bool
+	Output   string
+}
+
+func NewCmdAudit(rootOptions *RootOptions) *cobra.Command {
+	opts := &AuditOptions{
+		RootOptions: rootOptions,
+		Output:      "table",
+	}
+
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Query the audit log written by 'cape run --audit-log'.",
+		Run:   cobras.Run(opts),
+	}
+
+	cmd.Flags().StringVarP(&opts.File, "file", "f", opts.File, "The audit log file to query.")
+	cmd.Flags().StringVar(&opts.Cluster, "cluster", opts.Cluster, "Only show operations on this cluster (<namespace>/<name>).")
+	cmd.Flags().StringVar(&opts.Actor, "actor", opts.Actor, "Only show operations by this actor.")
+	cmd.Flags().StringVar(&opts.Verb, "verb", opts.Verb, "Only show operations with this verb (create, update, patch or delete).")
+	cmd.Flags().StringVar(&opts.Resource, "resource", opts.Resource, "Only show operations on this resource (e.g. pods or clusterrolebindings).")
+	cmd.Flags().DurationVar(&opts.Since, "since", opts.Since, "Only show operations newer than this duration (e.g. 24h).")
+	cmd.Flags().BoolVar(&opts.Failed, "failed", opts.Failed, "Only show failed operations.")
+	cmd.Flags().StringVarP(&opts.Output, "output", "o", opts.Output, "Output format: table or json.")
+
+	return cmd
+}
+
+func (o *AuditOptions) Complete(cmd *cobra.Command, args []string) error {
+	return o.RootOptions.Complete(cmd, args)
+}
+
+func (o *AuditOptions) Validate() error {
+	if len(o.File) == 0 {
+		return errors.New("audit log file is required")
+	}
+	if o.Output != "table" && o.Output != "json" {
+		return fmt.Errorf("unsupported output format %q", o.Output)
+	}
+	return o.RootOptions.Validate()
+}
+
+func (o *AuditOptions) Run(ctx context.Context) error {
+	f, err := os.Open(o.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var since time.Time
+	if o.Since > 0 {
+		since = time.Now().Add(-o.Since)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	encoder := json.NewEncoder(os.Stdout)
+	if o.Output == "table" {
+		fmt.Fprintln(w, "TIME\tACTOR\tCLUSTER\tVERB\tRESOURCE\tOUTCOME")
+	}
+	err = audit.Read(f, func(event audit.Event) error {
+		if !o.matches(event, since) {
+			return nil
+		}
+		if o.Output == "json" {
+			return encoder.Encode(event)
+		}
+		_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", event.Time.Local().Format(time.RFC3339),
+			event.Actor, event.Cluster, event.Verb, formatResource(event), formatOutcome(event))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (o *AuditOptions) matches(event audit.Event, since time.Time) bool {
+	return (o.Cluster == "" || event.Cluster == o.Cluster) &&
+		(o.Actor == "" || event.Actor == o.Actor) &&
+		(o.Verb == "" || event.Verb == o.Verb) &&
+		(o.Resource == "" || event.Resource == o.Resource) &&
+		(!o.Failed || event.Outcome == audit.OutcomeFailure) &&
+		!event.Time.Before(since)
+}
+
+// formatResource formats the resource like kubectl does, e.g.
+// clusterrolebindings.rbac.authorization.k8s.io/foo or
+// pods/bar/eviction -n default.
+func formatResource(event audit.Event) string {
+	if event.Resource == "" {
+		return event.Path
+	}
+	resource := event.Resource
+	if event.Group != "" {
+		resource += "." + event.Group
+	}
+	resource = strings.TrimSuffix(path.Join(resource, event.Name, event.Subresource), "/")
+	if event.Namespace != "" {
+		resource += " -n " + event.Namespace
+	}
+	return resource
+}
+
+func formatOutcome(event audit.Event) string {
+	switch {
+	case event.Error != "":
+		return fmt.Sprintf("%s (%s)", event.Outcome, event.Error)
+	case event.StatusCode != 0:
+		return fmt.Sprintf("%s (%d)", event.Outcome, event.StatusCode)
+	default:
+		return event.Outcome
+	}
+}
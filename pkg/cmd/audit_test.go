@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/audit"
+)
+
+func TestAuditMatches(t *testing.T) {
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	event := audit.Event{
+		Time:     now,
+		Actor:    "alice",
+		Cluster:  "default/prod",
+		Verb:     "delete",
+		Resource: "pods",
+		Outcome:  audit.OutcomeFailure,
+	}
+	tests := []struct {
+		name  string
+		opts  AuditOptions
+		since time.Time
+		want  bool
+	}{
+		{name: "no filters", want: true},
+		{name: "cluster", opts: AuditOptions{Cluster: "default/prod"}, want: true},
+		{name: "other cluster", opts: AuditOptions{Cluster: "default/staging"}},
+		{name: "cluster name without namespace", opts: AuditOptions{Cluster: "prod"}},
+		{name: "actor", opts: AuditOptions{Actor: "alice"}, want: true},
+		{name: "other actor", opts: AuditOptions{Actor: audit.ActorController}},
+		{name: "verb", opts: AuditOptions{Verb: "delete"}, want: true},
+		{name: "other verb", opts: AuditOptions{Verb: "create"}},
+		{name: "resource", opts: AuditOptions{Resource: "pods"}, want: true},
+		{name: "other resource", opts: AuditOptions{Resource: "pods/eviction"}},
+		{name: "failed", opts: AuditOptions{Failed: true}, want: true},
+		{name: "since", since: now, want: true},
+		{name: "before since", since: now.Add(time.Second)},
+		{
+			name: "all filters",
+			opts: AuditOptions{Cluster: "default/prod", Actor: "alice", Verb: "delete", Resource: "pods", Failed: true},
+			want: true,
+		},
+		{
+			name: "all filters but one",
+			opts: AuditOptions{Cluster: "default/prod", Actor: "alice", Verb: "patch", Resource: "pods", Failed: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(tt.opts.matches(event, tt.since)).To(Equal(tt.want))
+		})
+	}
+
+	succeeded := event
+	succeeded.Outcome = audit.OutcomeSuccess
+	g := NewWithT(t)
+	g.Expect((&AuditOptions{Failed: true}).matches(succeeded, time.Time{})).To(BeFalse())
+}
+
+func TestFormatResource(t *testing.T) {
+	tests := []struct {
+		event audit.Event
+		want  string
+	}{
+		{
+			event: audit.Event{Version: "v1", Resource: "pods", Subresource: "eviction", Namespace: "default", Name: "bar"},
+			want:  "pods/bar/eviction -n default",
+		},
+		{
+			event: audit.Event{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterrolebindings", Name: "foo"},
+			want:  "clusterrolebindings.rbac.authorization.k8s.io/foo",
+		},
+		{
+			// A create has no name.
+			event: audit.Event{Version: "v1", Resource: "serviceaccounts", Namespace: "kube-system"},
+			want:  "serviceaccounts -n kube-system",
+		},
+		{
+			event: audit.Event{Version: "v1", Resource: "namespaces", Subresource: "finalize", Name: "team-a"},
+			want:  "namespaces/team-a/finalize",
+		},
+		{
+			// Requests outside of the resource API are shown by path.
+			event: audit.Event{Path: "/version"},
+			want:  "/version",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(formatResource(tt.event)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestFormatOutcome(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(formatOutcome(audit.Event{Outcome: audit.OutcomeSuccess, StatusCode: 201})).To(Equal("success (201)"))
+	g.Expect(formatOutcome(audit.Event{Outcome: audit.OutcomeFailure, StatusCode: 403})).To(Equal("failure (403)"))
+	g.Expect(formatOutcome(audit.Event{Outcome: audit.OutcomeFailure, Error: "connection refused"})).To(Equal("failure (connection refused)"))
+	g.Expect(formatOutcome(audit.Event{Outcome: audit.OutcomeSuccess})).To(Equal("success"))
+}
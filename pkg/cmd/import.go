@@ -4,16 +4,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"strconv"
+	"io"
+	"os"
+	"os/user"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/erwinvaneyk/cobras"
 	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
 	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/audit"
 	importer "github.com/platform9-incubator/cluster-api-provider-external/pkg/cape"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/qbert"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -29,17 +35,28 @@ type ConfigOptions struct {
 	MgmtClusterNamespace  string
 	ClusterName           string
 	ClusterKubeconfigPath string
+	Source                string
+	KubeconfigDir         string
 	ImportFromQbert       bool
 	Username              string
 	Password              string
+	Token                 string
 	Project               string
+	Region                string
 	FQDN                  string
+	ClusterClass          string
+	ResolveAuth           bool
+	ResolveAuthTokenTTL   time.Duration
+	ProxyURL              string
+	ProxyCredentials      string
+	AuditLogPath          string
 }
 
 func NewCmdImport(rootOptions *RootOptions) *cobra.Command {
 	opts := &ConfigOptions{
 		RootOptions:          rootOptions,
 		MgmtClusterNamespace: metav1.NamespaceDefault,
+		Source:               sourceKubeconfig,
 	}
 
 	cmd := &cobra.Command{
@@ -52,28 +69,76 @@ func NewCmdImport(rootOptions *RootOptions) *cobra.Command {
 	cmd.Flags().StringVar(&opts.ClusterKubeconfigPath, "kubeconfig", opts.ClusterKubeconfigPath, "Kubeconfig of the cluster to import.")
 	cmd.Flags().StringVar(&opts.MgmtKubeconfigPath, "mgmt-kubeconfig", opts.MgmtKubeconfigPath, "Kubeconfig of the management cluster to import the cluster into.")
 	cmd.Flags().StringVar(&opts.ClusterName, "name", opts.ClusterName, "Name of the cluster to import.")
+	cmd.Flags().StringVar(&opts.Source, "source", opts.Source, "Source of the clusters to import: kubeconfig (a single cluster), directory (a cluster per kubeconfig file) or qbert (all clusters of a PF9 project).")
+	cmd.Flags().StringVar(&opts.KubeconfigDir, "kubeconfig-dir", opts.KubeconfigDir, "Directory with the kubeconfigs of the clusters to import, named <cluster-name>.yaml. Used with --source=directory.")
 	cmd.Flags().BoolVar(&opts.ImportFromQbert, "qbert", false, "import all clusters from qbert")
+	_ = cmd.Flags().MarkDeprecated("qbert", "use --source=qbert instead")
 	cmd.Flags().StringVar(&opts.Username, "username", "", "username to connect to the PF9 control plane")
 	cmd.Flags().StringVar(&opts.Password, "password", "", "password to connect to the PF9 control plane")
+	cmd.Flags().StringVar(&opts.Token, "token", "", "keystone token to connect to the PF9 control plane, instead of a username and password")
 	cmd.Flags().StringVar(&opts.Project, "project", "service", "project to authenticate as when connecting to the PF9 control plane")
+	cmd.Flags().StringVar(&opts.Region, "region", "", "region of the PF9 control plane to import the clusters of; defaults to the region of the control plane URL")
 	cmd.Flags().StringVar(&opts.FQDN, "fqdn", "", "PF9 control plane URL")
+	cmd.Flags().BoolVar(&opts.ResolveAuth, "resolve-auth", false, "Replace the exec and auth-provider plugins of the kubeconfigs, which the controller cannot run, with the token of a ServiceAccount with cluster-admin access that is created in kube-system of each cluster.")
+	cmd.Flags().DurationVar(&opts.ResolveAuthTokenTTL, "resolve-auth-token-ttl", 0, "With --resolve-auth, use a token that expires after this duration instead of a ServiceAccount token Secret, which does not expire. The clusters must then be imported again before the token expires.")
+	cmd.Flags().StringVar(&opts.ClusterClass, "cluster-class", "", "ClusterClass to import the clusters with a managed topology of. The version of the topology is detected from the cluster.")
+	cmd.Flags().StringVar(&opts.ProxyURL, "proxy-url", "", "HTTP, HTTPS or SOCKS5 proxy to reach the clusters through, e.g. http://proxy.example.com:3128. It is set on the imported ExternalClusters.")
+	cmd.Flags().StringVar(&opts.ProxyCredentials, "proxy-credentials-secret", "", "Name of the Secret in the namespace of the clusters with the username, password and optional ca.crt of the proxy.")
+	cmd.Flags().StringVar(&opts.AuditLogPath, "audit-log", "", "File to append the audit log of the mutating requests to the imported clusters to, such as those of --resolve-auth, as JSON lines. Use - for stdout. The actor is the local user.")
 
 	return cmd
 }
 
+const (
+	sourceKubeconfig = "kubeconfig"
+	sourceDirectory  = "directory"
+	sourceQbert      = "qbert"
+)
+
 func (o *ConfigOptions) Complete(cmd *cobra.Command, args []string) error {
+	if o.ImportFromQbert {
+		o.Source = sourceQbert
+	}
+	if o.MgmtClusterNamespace == "" {
+		o.MgmtClusterNamespace = metav1.NamespaceDefault
+	}
 	return o.RootOptions.Complete(cmd, args)
 }
 
 func (o *ConfigOptions) Validate() error {
-	if len(o.ClusterName) == 0 && !o.ImportFromQbert {
-		return errors.New("name of the target cluster is required")
-	}
 	if len(o.MgmtKubeconfigPath) == 0 {
 		return errors.New("kubeconfig for the management cluster is required")
 	}
-	if len(o.ClusterKubeconfigPath) == 0 && !o.ImportFromQbert {
-		return errors.New("kubeconfig for the target cluster is required")
+	switch o.Source {
+	case sourceKubeconfig:
+		if len(o.ClusterName) == 0 {
+			return errors.New("name of the target cluster is required")
+		}
+		if len(o.ClusterKubeconfigPath) == 0 {
+			return errors.New("kubeconfig for the target cluster is required")
+		}
+	case sourceDirectory:
+		if len(o.KubeconfigDir) == 0 {
+			return errors.New("directory with the kubeconfigs of the target clusters is required")
+		}
+	case sourceQbert:
+		if len(o.FQDN) == 0 {
+			return errors.New("PF9 control plane URL is required")
+		}
+		if len(o.Token) == 0 && (len(o.Username) == 0 || len(o.Password) == 0) {
+			return errors.New("either a token or a username and password are required to connect to the PF9 control plane")
+		}
+	default:
+		return fmt.Errorf("unsupported source %q", o.Source)
+	}
+	if len(o.ProxyURL) > 0 && !strings.HasPrefix(o.ProxyURL, "http://") && !strings.HasPrefix(o.ProxyURL, "https://") && !strings.HasPrefix(o.ProxyURL, "socks5://") {
+		return fmt.Errorf("unsupported proxy URL %q: the scheme must be http, https or socks5", o.ProxyURL)
+	}
+	if len(o.ProxyCredentials) > 0 && len(o.ProxyURL) == 0 {
+		return errors.New("--proxy-credentials-secret requires --proxy-url")
+	}
+	if len(o.ProxyURL) > 0 && len(o.ClusterClass) > 0 {
+		return errors.New("--proxy-url cannot be combined with --cluster-class; set the proxy in the ExternalClusterTemplate of the ClusterClass instead")
 	}
 	return o.RootOptions.Validate()
 }
@@ -99,43 +164,92 @@ func (o *ConfigOptions) Run(ctx context.Context) error {
 		return err
 	}
 
-	log.Debugf("Loading workload cluster client")
-	workloadCfg, err := clientcmd.BuildConfigFromFlags("", o.ClusterKubeconfigPath)
-	if err != nil {
-		return err
+	clsImporter := importer.ClusterImporter{
+		MgmtClient:          mgmtClient,
+		Log:                 log,
+		ClusterClass:        o.ClusterClass,
+		ResolveAuth:         o.ResolveAuth,
+		ResolveAuthTokenTTL: o.ResolveAuthTokenTTL,
 	}
-
-	hostParts := strings.Split(strings.TrimPrefix(workloadCfg.Host, "https://"), ":")
-	port := 6443
-	host := hostParts[0]
-	if len(hostParts) > 2 {
-		port, err = strconv.Atoi(hostParts[1])
+	if len(o.AuditLogPath) > 0 {
+		auditSink, err := audit.OpenFileSink(o.AuditLogPath)
 		if err != nil {
 			return err
 		}
+		defer auditSink.Close()
+		clsImporter.Audit = auditSink
+		clsImporter.Actor = localActor()
 	}
-	bs, err := ioutil.ReadFile(o.ClusterKubeconfigPath)
+	if len(o.ProxyURL) > 0 {
+		clsImporter.Proxy = &externalinfrav1.ProxySpec{URL: o.ProxyURL}
+		if len(o.ProxyCredentials) > 0 {
+			clsImporter.Proxy.CredentialsSecretRef = &corev1.LocalObjectReference{Name: o.ProxyCredentials}
+		}
+	}
+
+	source, err := o.clusterSource(ctx)
 	if err != nil {
 		return err
 	}
+	log.Debugf("Creating ExternalClusters for the clusters of source %s", o.Source)
+	results, err := clsImporter.ImportFromSource(ctx, source, o.MgmtClusterNamespace)
+	if err != nil {
+		return fmt.Errorf("cluster import failed: %w", err)
+	}
+	return printImportResults(os.Stdout, o.MgmtClusterNamespace, results)
+}
 
-	clsImporter := importer.ClusterImporter{
-		MgmtClient: mgmtClient,
-		Log:        log,
+// localActor returns the actor of the audit events of the import: the local
+// user, or the controller actor if it is unknown.
+func localActor() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
 	}
+	return audit.ActorController
+}
 
-	if o.ImportFromQbert {
-		if o.MgmtClusterNamespace == "" {
-			o.MgmtClusterNamespace = "default"
-		}
-		return clsImporter.ImportClustersFromQbert(ctx, o.Username, o.Password, o.Project, "RegionOne", o.MgmtClusterNamespace, o.FQDN)
+// printImportResults prints the result of each cluster and a summary. It
+// returns an error if any cluster failed to import.
+func printImportResults(out io.Writer, namespace string, results []importer.ImportResult) error {
+	counts := map[string]int{}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CLUSTER\tRESULT\tREASON")
+	for _, result := range results {
+		counts[result.State]++
+		fmt.Fprintf(w, "%s/%s\t%s\t%s\n", namespace, result.Name, result.State, result.Reason)
 	}
-	log.Debugf("Creating an ExternalCluster for cluster")
-	err = clsImporter.ImportClusterResources(ctx, o.ClusterName, o.MgmtClusterNamespace, host, port, string(bs))
-	if err != nil {
-		panic(fmt.Sprintf("cluster import failed: %v", err))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\n%d imported, %d skipped, %d failed.\n", counts[importer.ImportStateImported],
+		counts[importer.ImportStateSkipped], counts[importer.ImportStateFailed])
+	if counts[importer.ImportStateFailed] > 0 {
+		return fmt.Errorf("%d cluster(s) failed to import", counts[importer.ImportStateFailed])
 	}
-
-	fmt.Printf("cluster imported as %s/%s.\n", o.MgmtClusterNamespace, o.ClusterName)
 	return nil
 }
+
+// clusterSource returns the ClusterSource selected with --source.
+func (o *ConfigOptions) clusterSource(ctx context.Context) (importer.ClusterSource, error) {
+	switch o.Source {
+	case sourceKubeconfig:
+		return &importer.KubeconfigFileSource{Name: o.ClusterName, Path: o.ClusterKubeconfigPath}, nil
+	case sourceDirectory:
+		return &importer.KubeconfigDirSource{Dir: o.KubeconfigDir}, nil
+	case sourceQbert:
+		qbertClient, err := qbert.NewClient(ctx, qbert.Config{
+			FQDN:     o.FQDN,
+			Region:   o.Region,
+			Project:  o.Project,
+			Username: o.Username,
+			Password: o.Password,
+			Token:    o.Token,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return importer.NewQbertClusterSource(qbertClient), nil
+	default:
+		return nil, fmt.Errorf("unsupported source %q", o.Source)
+	}
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	importer "github.com/platform9-incubator/cluster-api-provider-external/pkg/cape"
+)
+
+func TestPrintImportResults(t *testing.T) {
+	tests := []struct {
+		name       string
+		results    []importer.ImportResult
+		wantOutput string
+		wantErr    string
+	}{
+		{
+			name:    "no clusters",
+			results: nil,
+			wantOutput: `CLUSTER  RESULT  REASON
+
+0 imported, 0 skipped, 0 failed.
+`,
+		},
+		{
+			name: "imported and skipped",
+			results: []importer.ImportResult{
+				{Name: "prod", State: importer.ImportStateImported},
+				{Name: "creating", State: importer.ImportStateSkipped, Reason: "no kubeconfig available"},
+			},
+			wantOutput: `CLUSTER           RESULT    REASON
+default/prod      imported  
+default/creating  skipped   no kubeconfig available
+
+1 imported, 1 skipped, 0 failed.
+`,
+		},
+		{
+			name: "failed",
+			results: []importer.ImportResult{
+				{Name: "prod", State: importer.ImportStateImported},
+				{Name: "broken", State: importer.ImportStateFailed, Reason: "500 Internal Server Error"},
+				{Name: "edge", State: importer.ImportStateFailed, Reason: "neither an external DNS name nor a master IP"},
+			},
+			wantOutput: `CLUSTER         RESULT    REASON
+default/prod    imported  
+default/broken  failed    500 Internal Server Error
+default/edge    failed    neither an external DNS name nor a master IP
+
+1 imported, 0 skipped, 2 failed.
+`,
+			wantErr: "2 cluster(s) failed to import",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			out := &bytes.Buffer{}
+			err := printImportResults(out, "default", tt.results)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(tt.wantErr))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+			g.Expect(out.String()).To(Equal(tt.wantOutput))
+		})
+	}
+}
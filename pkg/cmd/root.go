@@ -29,6 +29,9 @@ func NewCmdRoot() *cobra.Command {
 
 	cmd.AddCommand(NewCmdImport(opts))
 	cmd.AddCommand(NewCmdRun(opts))
+	cmd.AddCommand(NewCmdAgent(opts))
+	cmd.AddCommand(NewCmdAudit(opts))
+	cmd.AddCommand(NewCmdStatus(opts))
 	cmd.AddCommand(extensions.NewCobraCmdWithDefaults())
 
 	return cmd
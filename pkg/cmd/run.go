@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
@@ -11,17 +13,27 @@ import (
 	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
 	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
 	"github.com/platform9-incubator/cluster-api-provider-external/controllers"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/audit"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/proxy"
+	caperemote "github.com/platform9-incubator/cluster-api-provider-external/pkg/remote"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tracing"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tunnel"
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/cluster-api/controllers/remote"
+	addonsv1 "sigs.k8s.io/cluster-api/exp/addons/api/v1beta1"
+	expv1 "sigs.k8s.io/cluster-api/exp/api/v1beta1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
 type RunOptions struct {
@@ -39,6 +51,18 @@ type RunOptions struct {
 	healthAddr                  string
 	profilerAddress             string
 	watchFilterValue            string
+	inventoryInterval           time.Duration
+	certExpiryWarning           time.Duration
+	certExpiryCritical          time.Duration
+	tracingOpts                 tracing.Options
+	tunnelBindAddr              string
+	tunnelCertFile              string
+	tunnelKeyFile               string
+	proxyBindAddr               string
+	proxyCertFile               string
+	proxyKeyFile                string
+	auditLogPath                string
+	projectionNamespaces        []string
 	zapOpts                     zap.Options
 }
 
@@ -53,6 +77,10 @@ func NewCmdRun(rootOptions *RootOptions) *cobra.Command {
 		webhookPort:                 9443,
 		webhookCertDir:              "/tmp/k8s-webhook-server/serving-certs/",
 		healthAddr:                  ":9440",
+		inventoryInterval:           1 * time.Hour,
+		certExpiryWarning:           controllers.DefaultCertificateExpiryWarning,
+		certExpiryCritical:          controllers.DefaultCertificateExpiryCritical,
+		tracingOpts:                 tracing.Options{SampleRatio: 1},
 		zapOpts:                     zap.Options{Development: true},
 	}
 
@@ -86,6 +114,34 @@ func NewCmdRun(rootOptions *RootOptions) *cobra.Command {
 		"Webhook cert dir, only used when webhook-port is specified.")
 	cmd.Flags().StringVar(&opts.healthAddr, "health-addr", opts.healthAddr,
 		"The address the health endpoint binds to.")
+	cmd.Flags().DurationVar(&opts.inventoryInterval, "inventory-interval", opts.inventoryInterval,
+		"The interval at which the inventory of the external clusters is refreshed. Set to 0 to disable inventory collection.")
+	cmd.Flags().DurationVar(&opts.certExpiryWarning, "cert-expiry-warning", opts.certExpiryWarning,
+		"Set the CertificatesValid condition of an ExternalControlPlane to false with severity Warning when a certificate of the control plane expires within this duration.")
+	cmd.Flags().DurationVar(&opts.certExpiryCritical, "cert-expiry-critical", opts.certExpiryCritical,
+		"Set the CertificatesValid condition of an ExternalControlPlane to false with severity Error when a certificate of the control plane expires within this duration.")
+	cmd.Flags().StringVar(&opts.tracingOpts.Endpoint, "tracing-endpoint", opts.tracingOpts.Endpoint,
+		"The host:port of the OTLP/HTTP collector to send traces to. If unspecified, tracing is disabled.")
+	cmd.Flags().BoolVar(&opts.tracingOpts.Insecure, "tracing-insecure", opts.tracingOpts.Insecure,
+		"Disable TLS for the connection to the OTLP collector.")
+	cmd.Flags().Float64Var(&opts.tracingOpts.SampleRatio, "tracing-sample-ratio", opts.tracingOpts.SampleRatio,
+		"The fraction of reconciles to trace, between 0 and 1.")
+	cmd.Flags().StringVar(&opts.tunnelBindAddr, "tunnel-bind-addr", opts.tunnelBindAddr,
+		"The address the tunnel server for 'cape agent' binds to (e.g. :8443). If unspecified, the tunnel server is disabled.")
+	cmd.Flags().StringVar(&opts.tunnelCertFile, "tunnel-cert-file", opts.tunnelCertFile,
+		"The TLS certificate of the tunnel server.")
+	cmd.Flags().StringVar(&opts.tunnelKeyFile, "tunnel-key-file", opts.tunnelKeyFile,
+		"The TLS private key of the tunnel server.")
+	cmd.Flags().StringVar(&opts.proxyBindAddr, "proxy-bind-addr", opts.proxyBindAddr,
+		"The address the API proxy for user access to the imported clusters binds to (e.g. :9443). If unspecified, the proxy is disabled.")
+	cmd.Flags().StringVar(&opts.proxyCertFile, "proxy-cert-file", opts.proxyCertFile,
+		"The TLS certificate of the API proxy.")
+	cmd.Flags().StringVar(&opts.proxyKeyFile, "proxy-key-file", opts.proxyKeyFile,
+		"The TLS private key of the API proxy.")
+	cmd.Flags().StringVar(&opts.auditLogPath, "audit-log", opts.auditLogPath,
+		"File to append the audit log of all mutating requests to the external clusters to, as JSON lines. Use - for stdout. If unspecified, auditing is disabled.")
+	cmd.Flags().StringSliceVar(&opts.projectionNamespaces, "kubeconfig-projection-namespaces", opts.projectionNamespaces,
+		"The namespaces that the kubeconfigs of ExternalClusters may be projected into, or * for all namespaces. If unspecified, kubeconfig projection is disabled.")
 	cmd.Flags().StringVar(&opts.KubeconfigPath, "kubeconfig", opts.KubeconfigPath, "")
 
 	zapFs := flag.NewFlagSet("", flag.ExitOnError)
@@ -101,6 +157,18 @@ func (o *RunOptions) Complete(cmd *cobra.Command, args []string) error {
 }
 
 func (o *RunOptions) Validate() error {
+	if o.tracingOpts.SampleRatio < 0 || o.tracingOpts.SampleRatio > 1 {
+		return errors.New("tracing sample ratio should be between 0 and 1")
+	}
+	if o.certExpiryCritical > o.certExpiryWarning {
+		return errors.New("the critical certificate expiry threshold should not exceed the warning threshold")
+	}
+	if o.tunnelBindAddr != "" && (o.tunnelCertFile == "" || o.tunnelKeyFile == "") {
+		return errors.New("the tunnel server requires a TLS certificate and key")
+	}
+	if o.proxyBindAddr != "" && (o.proxyCertFile == "" || o.proxyKeyFile == "") {
+		return errors.New("the API proxy requires a TLS certificate and key")
+	}
 	return o.RootOptions.Validate()
 }
 
@@ -118,6 +186,26 @@ func (o *RunOptions) Run(ctx context.Context) error {
 		}()
 	}
 
+	shutdownTracing, err := tracing.Setup(ctx, o.tracingOpts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Error(err, "failed to shut down tracing")
+		}
+	}()
+
+	var auditSink audit.Sink
+	if o.auditLogPath != "" {
+		fileSink, err := audit.OpenFileSink(o.auditLogPath)
+		if err != nil {
+			return err
+		}
+		defer fileSink.Close()
+		auditSink = fileSink
+	}
+
 	restConfig, err := clientcmd.BuildConfigFromFlags("", o.KubeconfigPath)
 	if err != nil {
 		return err
@@ -127,6 +215,8 @@ func (o *RunOptions) Run(ctx context.Context) error {
 	scheme := runtime.NewScheme()
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	utilruntime.Must(clusterv1.AddToScheme(scheme))
+	utilruntime.Must(expv1.AddToScheme(scheme))
+	utilruntime.Must(addonsv1.AddToScheme(scheme))
 	utilruntime.Must(externalinfrav1.AddToScheme(scheme))
 	utilruntime.Must(externalcontrolplanev1.AddToScheme(scheme))
 
@@ -148,30 +238,84 @@ func (o *RunOptions) Run(ctx context.Context) error {
 		return err
 	}
 
+	var tunnelServer *tunnel.Server
+	if o.tunnelBindAddr != "" {
+		tunnelServer, err = o.setupTunnelServer(mgr)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The transports of the clusters with a tunnel or an egress proxy are
+	// shared by the reconcilers and the API proxy.
+	transports := caperemote.NewTransports()
+
+	if o.proxyBindAddr != "" {
+		if err := o.setupProxy(mgr, restConfig, tunnelServer, auditSink, transports); err != nil {
+			return err
+		}
+	}
+
 	if err = (&controllers.ExternalClusterReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:            mgr.GetClient(),
+		Scheme:            mgr.GetScheme(),
+		Recorder:          mgr.GetEventRecorderFor("externalcluster-controller"),
+		InventoryInterval: o.inventoryInterval,
+		Tunnel:            tunnelServer,
+		Audit:             auditSink,
+		Transports:        transports,
+
+		KubeconfigProjectionNamespaces: o.projectionNamespaces,
 	}).SetupWithManager(ctx, mgr); err != nil {
 		return fmt.Errorf("unable to create controller %s: %w", "ExternalCluster", err)
 	}
 	log.Info("Started ExternalCluster reconciler")
 
 	if err = (&controllers.ExternalControlPlaneReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                    mgr.GetClient(),
+		Scheme:                    mgr.GetScheme(),
+		Recorder:                  mgr.GetEventRecorderFor("externalcontrolplane-controller"),
+		Tunnel:                    tunnelServer,
+		Audit:                     auditSink,
+		Transports:                transports,
+		CertificateExpiryWarning:  o.certExpiryWarning,
+		CertificateExpiryCritical: o.certExpiryCritical,
 	}).SetupWithManager(ctx, mgr); err != nil {
 		return fmt.Errorf("unable to create controller %s: %w", "ExternalControlPlane", err)
 	}
 	log.Info("Started ExternalControlPlane reconciler")
 
 	if err = (&controllers.ExternalMachineReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("externalmachine-controller"),
 	}).SetupWithManager(ctx, mgr); err != nil {
 		return fmt.Errorf("unable to create controller %s: %w", "ExternalMachine", err)
 	}
 	log.Info("Started ExternalMachine reconciler")
 
+	if err = (&controllers.QbertSourceReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("qbertsource-controller"),
+		Audit:    auditSink,
+	}).SetupWithManager(ctx, mgr); err != nil {
+		return fmt.Errorf("unable to create controller %s: %w", "QbertSource", err)
+	}
+	log.Info("Started QbertSource reconciler")
+
+	if err = (&controllers.ExternalClusterDriftCheckReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		Recorder:   mgr.GetEventRecorderFor("externalclusterdriftcheck-controller"),
+		Tunnel:     tunnelServer,
+		Audit:      auditSink,
+		Transports: transports,
+	}).SetupWithManager(ctx, mgr); err != nil {
+		return fmt.Errorf("unable to create controller %s: %w", "ExternalClusterDriftCheck", err)
+	}
+	log.Info("Started ExternalClusterDriftCheck reconciler")
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		return fmt.Errorf("unable to set up health check: %w", err)
 	}
@@ -186,3 +330,70 @@ func (o *RunOptions) Run(ctx context.Context) error {
 	}
 	return nil
 }
+
+// setupTunnelServer adds the tunnel server for `cape agent` to the manager.
+func (o *RunOptions) setupTunnelServer(mgr ctrl.Manager) (*tunnel.Server, error) {
+	cert, err := tls.LoadX509KeyPair(o.tunnelCertFile, o.tunnelKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load tunnel server certificate: %w", err)
+	}
+	server := tunnel.NewServer(&tunnel.SecretAuthenticator{Reader: mgr.GetAPIReader()}, ctrl.Log.WithName("tunnel"))
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		listener, err := tls.Listen("tcp", o.tunnelBindAddr, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to start tunnel server: %w", err)
+		}
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+		}()
+		ctrl.Log.WithName("setup").Info("Tunnel server listening", "address", o.tunnelBindAddr)
+		if err := server.Serve(listener); err != nil && ctx.Err() == nil {
+			return fmt.Errorf("tunnel server exited: %w", err)
+		}
+		return nil
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up tunnel server: %w", err)
+	}
+	return server, nil
+}
+
+// setupProxy adds the API proxy for user access to the imported clusters to
+// the manager.
+func (o *RunOptions) setupProxy(mgr ctrl.Manager, restConfig *rest.Config, tunnelServer *tunnel.Server, auditSink audit.Sink, transports *caperemote.Transports) error {
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("unable to set up API proxy: %w", err)
+	}
+	server := &http.Server{
+		Addr: o.proxyBindAddr,
+		Handler: &proxy.Proxy{
+			Client:     mgr.GetClient(),
+			Clientset:  clientset,
+			Tunnel:     tunnelServer,
+			Transports: transports,
+			Audit:      auditSink,
+			Log:        ctrl.Log.WithName("proxy"),
+		},
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		go func() {
+			<-ctx.Done()
+			_ = server.Close()
+		}()
+		ctrl.Log.WithName("setup").Info("API proxy listening", "address", o.proxyBindAddr)
+		if err := server.ListenAndServeTLS(o.proxyCertFile, o.proxyKeyFile); err != nil && err != http.ErrServerClosed {
+			return fmt.Errorf("API proxy exited: %w", err)
+		}
+		return nil
+	}))
+	if err != nil {
+		return fmt.Errorf("unable to set up API proxy: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/erwinvaneyk/cobras"
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/upgrade"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/clientcmd"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type StatusOptions struct {
+	*RootOptions
+	MgmtKubeconfigPath string
+	Namespace          string
+	AllNamespaces      bool
+	UpgradeCheck       bool
+	Output             string
+}
+
+func NewCmdStatus(rootOptions *RootOptions) *cobra.Command {
+	opts := &StatusOptions{
+		RootOptions: rootOptions,
+		Namespace:   metav1.NamespaceDefault,
+		Output:      "table",
+	}
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the status of the imported clusters.",
+		Run:   cobras.Run(opts),
+	}
+
+	cmd.Flags().StringVar(&opts.MgmtKubeconfigPath, "mgmt-kubeconfig", opts.MgmtKubeconfigPath, "Kubeconfig of the management cluster the clusters are imported into.")
+	cmd.Flags().StringVarP(&opts.Namespace, "namespace", "n", opts.Namespace, "Namespace of the imported clusters.")
+	cmd.Flags().BoolVarP(&opts.AllNamespaces, "all-namespaces", "A", opts.AllNamespaces, "Show the imported clusters in all namespaces.")
+	cmd.Flags().BoolVar(&opts.UpgradeCheck, "upgrade-check", opts.UpgradeCheck, "Show whether the clusters use APIs that are removed in their next minor Kubernetes version. Fails if any cluster does.")
+	cmd.Flags().StringVarP(&opts.Output, "output", "o", opts.Output, "Output format: table or json.")
+
+	return cmd
+}
+
+// clusterStatus is the status of an imported cluster in the json output.
+type clusterStatus struct {
+	Namespace        string                                   `json:"namespace"`
+	Cluster          string                                   `json:"cluster"`
+	Ready            bool                                     `json:"ready"`
+	Version          string                                   `json:"version,omitempty"`
+	UpgradeReadiness *externalcontrolplanev1.UpgradeReadiness `json:"upgradeReadiness,omitempty"`
+}
+
+func (o *StatusOptions) Complete(cmd *cobra.Command, args []string) error {
+	if o.Namespace == "" {
+		o.Namespace = metav1.NamespaceDefault
+	}
+	return o.RootOptions.Complete(cmd, args)
+}
+
+func (o *StatusOptions) Validate() error {
+	if len(o.MgmtKubeconfigPath) == 0 {
+		return errors.New("kubeconfig for the management cluster is required")
+	}
+	if o.Output != "table" && o.Output != "json" {
+		return fmt.Errorf("unsupported output format %q", o.Output)
+	}
+	return o.RootOptions.Validate()
+}
+
+func (o *StatusOptions) Run(ctx context.Context) error {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(externalcontrolplanev1.AddToScheme(scheme))
+
+	cfg, err := clientcmd.BuildConfigFromFlags("", o.MgmtKubeconfigPath)
+	if err != nil {
+		return err
+	}
+	mgmtClient, err := client.New(cfg, client.Options{
+		Scheme: scheme,
+	})
+	if err != nil {
+		return err
+	}
+
+	var listOpts []client.ListOption
+	if !o.AllNamespaces {
+		listOpts = append(listOpts, client.InNamespace(o.Namespace))
+	}
+	var controlPlanes externalcontrolplanev1.ExternalControlPlaneList
+	if err := mgmtClient.List(ctx, &controlPlanes, listOpts...); err != nil {
+		return fmt.Errorf("failed to list the external control planes: %w", err)
+	}
+
+	var statuses []clusterStatus
+	for _, controlPlane := range controlPlanes.Items {
+		status := clusterStatus{
+			Namespace: controlPlane.Namespace,
+			Cluster:   controlPlane.Name,
+			Ready:     controlPlane.Status.Ready,
+		}
+		if name, ok := controlPlane.Labels[clusterv1.ClusterLabelName]; ok {
+			status.Cluster = name
+		}
+		if controlPlane.Status.Version != nil {
+			status.Version = *controlPlane.Status.Version
+		}
+		if o.UpgradeCheck {
+			status.UpgradeReadiness = controlPlane.Status.UpgradeReadiness
+		}
+		statuses = append(statuses, status)
+	}
+
+	return printStatuses(os.Stdout, o.Output, o.UpgradeCheck, statuses)
+}
+
+// printStatuses prints the statuses of the clusters as a table or as json.
+// With upgradeCheck, the table shows the upgrade readiness of the clusters,
+// and an error is returned if any cluster is not ready for an upgrade or has
+// not been checked yet.
+func printStatuses(out io.Writer, output string, upgradeCheck bool, statuses []clusterStatus) error {
+	if output == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(statuses); err != nil {
+			return err
+		}
+	} else if err := printStatusTable(out, upgradeCheck, statuses); err != nil {
+		return err
+	}
+
+	if upgradeCheck {
+		var notReady int
+		for _, status := range statuses {
+			if status.UpgradeReadiness == nil || !status.UpgradeReadiness.Ready {
+				notReady++
+			}
+		}
+		if notReady > 0 {
+			return fmt.Errorf("%d cluster(s) are not ready for an upgrade", notReady)
+		}
+	}
+	return nil
+}
+
+func printStatusTable(out io.Writer, upgradeCheck bool, statuses []clusterStatus) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	if !upgradeCheck {
+		fmt.Fprintln(w, "NAMESPACE\tCLUSTER\tREADY\tVERSION")
+		for _, status := range statuses {
+			fmt.Fprintf(w, "%s\t%s\t%t\t%s\n", status.Namespace, status.Cluster, status.Ready, status.Version)
+		}
+		return w.Flush()
+	}
+
+	fmt.Fprintln(w, "NAMESPACE\tCLUSTER\tVERSION\tTARGET\tUPGRADE-READY\tBLOCKERS\tLAST-CHECK")
+	for _, status := range statuses {
+		report := status.UpgradeReadiness
+		if report == nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\tunknown\tnot checked yet\t-\n", status.Namespace, status.Cluster, status.Version)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\t%s\n", status.Namespace, status.Cluster, report.Version, report.TargetVersion,
+			report.Ready, upgradeBlockers(report), report.LastCheckTime.Local().Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// upgradeBlockers returns the APIs that block the upgrade of a cluster,
+// followed by the message of the check, or - if there are neither.
+func upgradeBlockers(report *externalcontrolplanev1.UpgradeReadiness) string {
+	blockers := strings.Join(upgrade.Blockers(report), ", ")
+	if report.Message != "" {
+		blockers = strings.TrimPrefix(blockers+"; "+report.Message, "; ")
+	}
+	if blockers == "" {
+		return "-"
+	}
+	return blockers
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPrintStatuses(t *testing.T) {
+	// The time of the last check is printed in the local time zone.
+	local := time.Local
+	time.Local = time.UTC
+	defer func() { time.Local = local }()
+	lastCheck := metav1.NewTime(time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC))
+
+	ready := clusterStatus{
+		Namespace: "default", Cluster: "prod", Ready: true, Version: "v1.24.3",
+		UpgradeReadiness: &externalcontrolplanev1.UpgradeReadiness{
+			Version: "v1.24.3", TargetVersion: "1.25", Ready: true, LastCheckTime: lastCheck,
+		},
+	}
+	blocked := clusterStatus{
+		Namespace: "default", Cluster: "staging", Ready: true, Version: "v1.24.1",
+		UpgradeReadiness: &externalcontrolplanev1.UpgradeReadiness{
+			Version: "v1.24.1", TargetVersion: "1.25", LastCheckTime: lastCheck,
+			RemovedAPIObjects: []externalcontrolplanev1.RemovedAPIObjects{
+				{Group: "policy", Version: "v1beta1", Resource: "podsecuritypolicies", RemovedRelease: "1.25", Count: 3},
+			},
+			DeprecatedAPIRequests: []externalcontrolplanev1.DeprecatedAPIRequest{
+				{Group: "batch", Version: "v1beta1", Resource: "cronjobs", Subresource: "status", RemovedRelease: "1.25"},
+				// Removed in a later version, so it does not block the upgrade.
+				{Group: "autoscaling", Version: "v2beta2", Resource: "horizontalpodautoscalers", RemovedRelease: "1.26"},
+			},
+			Message: "failed to list namespace kube-system",
+		},
+	}
+	failed := clusterStatus{
+		Namespace: "edge", Cluster: "store-1", Version: "v1.23.5",
+		UpgradeReadiness: &externalcontrolplanev1.UpgradeReadiness{
+			Version: "v1.23.5", TargetVersion: "1.24", LastCheckTime: lastCheck,
+			Message: "failed to read the metrics",
+		},
+	}
+	notChecked := clusterStatus{Namespace: "edge", Cluster: "store-2", Version: "v1.23.5"}
+
+	tests := []struct {
+		name         string
+		output       string
+		upgradeCheck bool
+		statuses     []clusterStatus
+		wantOutput   string
+		wantErr      string
+	}{
+		{
+			name:     "table",
+			output:   "table",
+			statuses: []clusterStatus{{Namespace: "default", Cluster: "prod", Ready: true, Version: "v1.24.3"}, notChecked},
+			wantOutput: `NAMESPACE  CLUSTER  READY  VERSION
+default    prod     true   v1.24.3
+edge       store-2  false  v1.23.5
+`,
+		},
+		{
+			name:         "upgrade check ready",
+			output:       "table",
+			upgradeCheck: true,
+			statuses:     []clusterStatus{ready},
+			wantOutput: `NAMESPACE  CLUSTER  VERSION  TARGET  UPGRADE-READY  BLOCKERS  LAST-CHECK
+default    prod     v1.24.3  1.25    true           -         2022-05-01T12:00:00Z
+`,
+		},
+		{
+			name:         "upgrade check not ready",
+			output:       "table",
+			upgradeCheck: true,
+			statuses:     []clusterStatus{ready, blocked, failed, notChecked},
+			wantOutput: `NAMESPACE  CLUSTER  VERSION  TARGET  UPGRADE-READY  BLOCKERS                                                                                                                         LAST-CHECK
+default    prod     v1.24.3  1.25    true           -                                                                                                                                2022-05-01T12:00:00Z
+default    staging  v1.24.1  1.25    false          policy/v1beta1 podsecuritypolicies (3 objects), batch/v1beta1 cronjobs/status (requested); failed to list namespace kube-system  2022-05-01T12:00:00Z
+edge       store-1  v1.23.5  1.24    false          failed to read the metrics                                                                                                       2022-05-01T12:00:00Z
+edge       store-2  v1.23.5  -       unknown        not checked yet                                                                                                                  -
+`,
+			wantErr: "3 cluster(s) are not ready for an upgrade",
+		},
+		{
+			name:         "upgrade check json",
+			output:       "json",
+			upgradeCheck: true,
+			statuses:     []clusterStatus{notChecked},
+			wantOutput: `[
+  {
+    "namespace": "edge",
+    "cluster": "store-2",
+    "ready": false,
+    "version": "v1.23.5"
+  }
+]
+`,
+			wantErr: "1 cluster(s) are not ready for an upgrade",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			out := &bytes.Buffer{}
+			err := printStatuses(out, tt.output, tt.upgradeCheck, tt.statuses)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(tt.wantErr))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+			g.Expect(out.String()).To(Equal(tt.wantOutput))
+		})
+	}
+}
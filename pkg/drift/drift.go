@@ -0,0 +1,136 @@
+// Package drift compares objects in external clusters with their desired
+// state.
+package drift
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// lastAppliedAnnotation is updated by `kubectl edit`, so it is not part of
+// the desired state.
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// Desired returns the part of the object that is compared: everything but
+// the status and the metadata, except for the labels and annotations.
+func Desired(obj *unstructured.Unstructured) map[string]interface{} {
+	desired := map[string]interface{}{}
+	for key, value := range obj.DeepCopy().Object {
+		switch key {
+		case "apiVersion", "kind", "metadata", "status":
+		default:
+			desired[key] = value
+		}
+	}
+	metadata := map[string]interface{}{}
+	if labels := obj.GetLabels(); len(labels) > 0 {
+		metadata["labels"] = toInterfaceMap(labels)
+	}
+	annotations := obj.GetAnnotations()
+	delete(annotations, lastAppliedAnnotation)
+	if len(annotations) > 0 {
+		metadata["annotations"] = toInterfaceMap(annotations)
+	}
+	if len(metadata) > 0 {
+		desired["metadata"] = metadata
+	}
+	return desired
+}
+
+// Baseline returns the desired state of the object as JSON, to be stored as
+// its baseline.
+func Baseline(obj *unstructured.Unstructured) (string, error) {
+	data, err := json.Marshal(Desired(obj))
+	return string(data), err
+}
+
+// ParseBaseline returns the desired state stored in a baseline.
+func ParseBaseline(baseline string) (map[string]interface{}, error) {
+	desired := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(baseline), &desired); err != nil {
+		return nil, err
+	}
+	return desired, nil
+}
+
+// Diff returns the sorted paths of the fields of desired that differ in the
+// live object. Fields that are only set in the live object, like defaults,
+// are ignored. Lists are compared element by element, and reported as a
+// whole if their length differs.
+func Diff(desired map[string]interface{}, live *unstructured.Unstructured) []string {
+	var fields []string
+	for key, value := range desired {
+		diff("."+key, value, live.Object[key], &fields)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func diff(path string, desired interface{}, live interface{}, fields *[]string) {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			if len(d) > 0 || live != nil {
+				*fields = append(*fields, path)
+			}
+			return
+		}
+		for key, value := range d {
+			diff(path+"."+key, value, l[key], fields)
+		}
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			if len(d) > 0 || live != nil {
+				*fields = append(*fields, path)
+			}
+			return
+		}
+		for i := range d {
+			diff(fmt.Sprintf("%s[%d]", path, i), d[i], l[i], fields)
+		}
+	default:
+		if !equalValues(desired, live) {
+			*fields = append(*fields, path)
+		}
+	}
+}
+
+// equalValues compares two scalars. Numbers are compared by value, since
+// the decoders disagree on int64 and float64.
+func equalValues(a interface{}, b interface{}) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func toInterfaceMap(m map[string]string) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		out[key] = value
+	}
+	return out
+}
@@ -0,0 +1,174 @@
+package drift
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestDesired(t *testing.T) {
+	g := NewWithT(t)
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":            "config",
+			"namespace":       "default",
+			"resourceVersion": "42",
+			"labels":          map[string]interface{}{"app": "addon"},
+			"annotations": map[string]interface{}{
+				"note":                "kept",
+				lastAppliedAnnotation: "{}",
+			},
+		},
+		"data":   map[string]interface{}{"key": "value"},
+		"status": map[string]interface{}{"phase": "Active"},
+	}}
+	g.Expect(Desired(obj)).To(Equal(map[string]interface{}{
+		"data": map[string]interface{}{"key": "value"},
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{"app": "addon"},
+			"annotations": map[string]interface{}{"note": "kept"},
+		},
+	}))
+
+	// Without labels and annotations, the metadata is left out.
+	obj = &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "config"},
+	}}
+	g.Expect(Desired(obj)).To(BeEmpty())
+}
+
+func TestBaseline(t *testing.T) {
+	g := NewWithT(t)
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "addon"},
+		"spec":       map[string]interface{}{"replicas": int64(2)},
+	}}
+	baseline, err := Baseline(obj)
+	g.Expect(err).NotTo(HaveOccurred())
+	desired, err := ParseBaseline(baseline)
+	g.Expect(err).NotTo(HaveOccurred())
+	// The replicas are decoded as a float64, but still match.
+	g.Expect(Diff(desired, obj)).To(BeEmpty())
+
+	_, err = ParseBaseline("{")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		desired map[string]interface{}
+		live    map[string]interface{}
+		want    []string
+	}{
+		{
+			name:    "equal",
+			desired: map[string]interface{}{"spec": map[string]interface{}{"image": "nginx"}},
+			live:    map[string]interface{}{"spec": map[string]interface{}{"image": "nginx"}},
+		},
+		{
+			name:    "changed scalar",
+			desired: map[string]interface{}{"spec": map[string]interface{}{"image": "nginx", "paused": false}},
+			live:    map[string]interface{}{"spec": map[string]interface{}{"image": "httpd", "paused": true}},
+			want:    []string{".spec.image", ".spec.paused"},
+		},
+		{
+			name:    "int64 and float64",
+			desired: map[string]interface{}{"spec": map[string]interface{}{"replicas": float64(3)}},
+			live:    map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(3)}},
+		},
+		{
+			name:    "json.Number",
+			desired: map[string]interface{}{"spec": map[string]interface{}{"replicas": json.Number("3")}},
+			live:    map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(3)}},
+		},
+		{
+			name:    "changed number",
+			desired: map[string]interface{}{"spec": map[string]interface{}{"replicas": float64(3)}},
+			live:    map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(1)}},
+			want:    []string{".spec.replicas"},
+		},
+		{
+			name:    "number and string",
+			desired: map[string]interface{}{"spec": map[string]interface{}{"port": int64(80)}},
+			live:    map[string]interface{}{"spec": map[string]interface{}{"port": "80"}},
+			want:    []string{".spec.port"},
+		},
+		{
+			name:    "fields only set in the live object",
+			desired: map[string]interface{}{"spec": map[string]interface{}{"image": "nginx"}},
+			live: map[string]interface{}{
+				"spec":   map[string]interface{}{"image": "nginx", "imagePullPolicy": "Always"},
+				"status": map[string]interface{}{"ready": true},
+			},
+		},
+		{
+			name:    "missing field",
+			desired: map[string]interface{}{"spec": map[string]interface{}{"image": "nginx"}},
+			live:    map[string]interface{}{"spec": map[string]interface{}{}},
+			want:    []string{".spec.image"},
+		},
+		{
+			name:    "missing map",
+			desired: map[string]interface{}{"data": map[string]interface{}{"key": "value"}},
+			live:    map[string]interface{}{},
+			want:    []string{".data"},
+		},
+		{
+			name:    "empty map matches a missing one",
+			desired: map[string]interface{}{"data": map[string]interface{}{}},
+			live:    map[string]interface{}{},
+		},
+		{
+			name:    "map replaced by a scalar",
+			desired: map[string]interface{}{"data": map[string]interface{}{}},
+			live:    map[string]interface{}{"data": "value"},
+			want:    []string{".data"},
+		},
+		{
+			name: "list elements",
+			desired: map[string]interface{}{"spec": map[string]interface{}{"containers": []interface{}{
+				map[string]interface{}{"name": "a", "image": "nginx"},
+				map[string]interface{}{"name": "b", "args": []interface{}{"--v", int64(2)}},
+			}}},
+			live: map[string]interface{}{"spec": map[string]interface{}{"containers": []interface{}{
+				map[string]interface{}{"name": "a", "image": "httpd"},
+				map[string]interface{}{"name": "b", "args": []interface{}{"--v", int64(4)}},
+			}}},
+			want: []string{".spec.containers[0].image", ".spec.containers[1].args[1]"},
+		},
+		{
+			name:    "list length",
+			desired: map[string]interface{}{"spec": map[string]interface{}{"args": []interface{}{"a"}}},
+			live:    map[string]interface{}{"spec": map[string]interface{}{"args": []interface{}{"a", "b"}}},
+			want:    []string{".spec.args"},
+		},
+		{
+			name:    "missing list",
+			desired: map[string]interface{}{"spec": map[string]interface{}{"args": []interface{}{"a"}}},
+			live:    map[string]interface{}{"spec": map[string]interface{}{}},
+			want:    []string{".spec.args"},
+		},
+		{
+			name:    "empty list matches a missing one",
+			desired: map[string]interface{}{"spec": map[string]interface{}{"args": []interface{}{}}},
+			live:    map[string]interface{}{"spec": map[string]interface{}{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(Diff(tt.desired, &unstructured.Unstructured{Object: tt.live})).To(Equal(tt.want))
+		})
+	}
+}
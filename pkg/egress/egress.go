@@ -0,0 +1,226 @@
+// Package egress routes the connections to external clusters through HTTP,
+// HTTPS or SOCKS5 proxies, such as corporate egress proxies.
+package egress
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"golang.org/x/net/proxy"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Keys of the credentials Secret of a proxy.
+const (
+	UsernameKey = "username"
+	PasswordKey = "password"
+	CAKey       = "ca.crt"
+)
+
+// DialFunc is the signature of rest.Config.Dial.
+type DialFunc = func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Proxy is the proxy of an external cluster.
+type Proxy struct {
+	// URL of the proxy. Its user info holds the credentials to authenticate
+	// to the proxy with.
+	URL *url.URL
+
+	// CAData is the PEM-encoded CA to verify an HTTPS proxy with. The system
+	// CAs are used if it is empty.
+	CAData []byte
+}
+
+// ForCluster returns the proxy of the ExternalCluster with the credentials of
+// its Secret, or nil if it has no proxy.
+func ForCluster(ctx context.Context, c client.Reader, externalCluster *externalv1.ExternalCluster) (*Proxy, error) {
+	spec := externalCluster.Spec.Proxy
+	if spec == nil {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(spec.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy URL")
+	}
+	p := &Proxy{URL: proxyURL}
+	if spec.CredentialsSecretRef != nil {
+		secret := &corev1.Secret{}
+		key := client.ObjectKey{Namespace: externalCluster.Namespace, Name: spec.CredentialsSecretRef.Name}
+		if err := c.Get(ctx, key, secret); err != nil {
+			return nil, errors.Wrapf(err, "failed to get the proxy credentials Secret %s", key)
+		}
+		if username := secret.Data[UsernameKey]; len(username) > 0 {
+			p.URL.User = url.UserPassword(string(username), string(secret.Data[PasswordKey]))
+		}
+		p.CAData = secret.Data[CAKey]
+	}
+	return p, nil
+}
+
+// ConfigureRESTConfig routes the rest.Config through the proxy of the
+// ExternalCluster, if it has one. The connections to the proxy are made with
+// the Dial of the config, so that a proxy behind the tunnel of the cluster is
+// reached through the tunnel.
+func ConfigureRESTConfig(ctx context.Context, c client.Reader, externalCluster *externalv1.ExternalCluster, config *rest.Config) error {
+	p, err := ForCluster(ctx, c, externalCluster)
+	if err != nil || p == nil {
+		return err
+	}
+	return p.ConfigureRESTConfig(config)
+}
+
+// ConfigureRESTConfig replaces the Dial of the rest.Config with one that
+// connects through the proxy, using the previous Dial to reach the proxy.
+func (p *Proxy) ConfigureRESTConfig(config *rest.Config) error {
+	dial, err := p.Dialer(config.Dial)
+	if err != nil {
+		return err
+	}
+	config.Dial = dial
+	return nil
+}
+
+// Hash identifies the proxy and its credentials, to detect changes.
+func (p *Proxy) Hash() string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(p.URL.String()+"/"+string(p.CAData))))
+}
+
+// Dialer returns a DialFunc that connects to addresses through the proxy.
+// Connections to the proxy itself are made with forward, or with a
+// net.Dialer if it is nil.
+func (p *Proxy) Dialer(forward DialFunc) (DialFunc, error) {
+	if forward == nil {
+		forward = (&net.Dialer{}).DialContext
+	}
+	switch p.URL.Scheme {
+	case "http", "https":
+		var caPool *x509.CertPool
+		if len(p.CAData) > 0 {
+			caPool = x509.NewCertPool()
+			if !caPool.AppendCertsFromPEM(p.CAData) {
+				return nil, errors.New("invalid CA of the proxy")
+			}
+		}
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			return p.dialConnect(ctx, forward, caPool, address)
+		}, nil
+	case "socks5":
+		var auth *proxy.Auth
+		if p.URL.User != nil {
+			password, _ := p.URL.User.Password()
+			auth = &proxy.Auth{User: p.URL.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", p.address(), auth, contextDialer(forward))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid SOCKS5 proxy")
+		}
+		return dialer.(proxy.ContextDialer).DialContext, nil
+	default:
+		return nil, errors.Errorf("unsupported proxy scheme %q", p.URL.Scheme)
+	}
+}
+
+// dialConnect opens a tunnel to the address with an HTTP CONNECT request to
+// the proxy.
+func (p *Proxy) dialConnect(ctx context.Context, forward DialFunc, caPool *x509.CertPool, address string) (_ net.Conn, reterr error) {
+	conn, err := forward(ctx, "tcp", p.address())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to proxy %s", p.URL.Host)
+	}
+	defer func() {
+		if reterr != nil {
+			conn.Close()
+		}
+	}()
+	if p.URL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: p.URL.Hostname(),
+			RootCAs:    caPool,
+			MinVersion: tls.VersionTLS12,
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, errors.Wrapf(err, "TLS handshake with proxy %s failed", p.URL.Host)
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if p.URL.User != nil {
+		password, _ := p.URL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.URL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, errors.Wrapf(err, "failed to send CONNECT to proxy %s", p.URL.Host)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the CONNECT response of proxy %s", p.URL.Host)
+	}
+	// The body of a successful response is the tunnel itself, so it must not
+	// be closed, which would drain it.
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("proxy %s refused to connect to %s: %s", p.URL.Host, address, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: br}, nil
+	}
+	return conn, nil
+}
+
+// address returns the host and port of the proxy, with the default port of
+// its scheme if the URL has none.
+func (p *Proxy) address() string {
+	if p.URL.Port() != "" {
+		return p.URL.Host
+	}
+	port := map[string]string{"http": "80", "https": "443", "socks5": "1080"}[p.URL.Scheme]
+	return net.JoinHostPort(p.URL.Hostname(), port)
+}
+
+// contextDialer adapts a DialFunc to the dialer interfaces of
+// golang.org/x/net/proxy.
+type contextDialer DialFunc
+
+func (d contextDialer) Dial(network, address string) (net.Conn, error) {
+	return d(context.Background(), network, address)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d(ctx, network, address)
+}
+
+// bufferedConn is a connection whose first bytes were read into a buffer
+// together with the CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,251 @@
+package inventory
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	DistributionEKS     = "EKS"
+	DistributionGKE     = "GKE"
+	DistributionAKS     = "AKS"
+	DistributionK3s     = "k3s"
+	DistributionRKE     = "RKE"
+	DistributionRKE2    = "RKE2"
+	DistributionPMK     = "PMK"
+	DistributionUnknown = "Unknown"
+
+	// MaxItems bounds the length of the lists in the inventory to keep the
+	// ExternalCluster object small.
+	MaxItems = 50
+
+	listPageSize = 500
+)
+
+// builtinGroups are the API groups served by Kubernetes itself. Other groups,
+// including the *.k8s.io groups of addons like metrics.k8s.io or
+// snapshot.storage.k8s.io, are served by CRDs or aggregated API servers.
+var builtinGroups = sets.NewString(
+	"",
+	"admissionregistration.k8s.io",
+	"apiextensions.k8s.io",
+	"apiregistration.k8s.io",
+	"apps",
+	"authentication.k8s.io",
+	"authorization.k8s.io",
+	"autoscaling",
+	"batch",
+	"certificates.k8s.io",
+	"coordination.k8s.io",
+	"discovery.k8s.io",
+	"events.k8s.io",
+	"extensions",
+	"flowcontrol.apiserver.k8s.io",
+	"internal.apiserver.k8s.io",
+	"networking.k8s.io",
+	"node.k8s.io",
+	"policy",
+	"rbac.authorization.k8s.io",
+	"resource.k8s.io",
+	"scheduling.k8s.io",
+	"storage.k8s.io",
+	"storagemigration.k8s.io",
+)
+
+// cniDaemonSets maps the name prefixes of well-known DaemonSets to the CNI
+// they belong to.
+var cniDaemonSets = []struct {
+	prefix string
+	cni    string
+}{
+	{"calico-node", "calico"},
+	{"canal", "canal"},
+	{"cilium", "cilium"},
+	{"kube-flannel", "flannel"},
+	{"weave-net", "weave"},
+	{"aws-node", "aws-vpc-cni"},
+	{"azure-cni", "azure-cni"},
+	{"antrea-agent", "antrea"},
+	{"kube-router", "kube-router"},
+}
+
+// Collect gathers the inventory of the cluster that clientset points to. The
+// nodes are passed in because the caller already lists them.
+func Collect(ctx context.Context, clientset kubernetes.Interface, nodes []corev1.Node) (*externalv1.ClusterInventory, error) {
+	inventory := &externalv1.ClusterInventory{
+		Distribution: DetectDistribution(nodes),
+		NodeCount:    int32(len(nodes)),
+		Allocatable:  allocatable(nodes),
+	}
+
+	opts := metav1.ListOptions{Limit: listPageSize}
+	for {
+		namespaces, err := clientset.CoreV1().Namespaces().List(ctx, opts)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list namespaces")
+		}
+		inventory.NamespaceCount += int32(len(namespaces.Items))
+		if namespaces.Continue == "" {
+			break
+		}
+		opts.Continue = namespaces.Continue
+	}
+
+	opts = metav1.ListOptions{Limit: listPageSize}
+	for inventory.CNI == "" {
+		daemonSets, err := clientset.AppsV1().DaemonSets(metav1.NamespaceAll).List(ctx, opts)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list daemonsets")
+		}
+		for _, ds := range daemonSets.Items {
+			if cni := detectCNI(ds.Name); cni != "" {
+				inventory.CNI = cni
+				break
+			}
+		}
+		if daemonSets.Continue == "" {
+			break
+		}
+		opts.Continue = daemonSets.Continue
+	}
+
+	csiDrivers, err := clientset.StorageV1().CSIDrivers().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list CSI drivers")
+	}
+	for _, driver := range csiDrivers.Items {
+		inventory.CSIDrivers = append(inventory.CSIDrivers, driver.Name)
+	}
+	inventory.CSIDrivers = bound(inventory.CSIDrivers)
+
+	groups, err := clientset.Discovery().ServerGroups()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to discover API groups")
+	}
+	for _, group := range groups.Groups {
+		if !isBuiltinGroup(group.Name) {
+			inventory.CRDGroups = append(inventory.CRDGroups, group.Name)
+		}
+	}
+	inventory.CRDGroups = bound(inventory.CRDGroups)
+
+	now := metav1.Now()
+	inventory.LastUpdated = &now
+	return inventory, nil
+}
+
+// DetectDistribution guesses the Kubernetes distribution based on the labels,
+// provider IDs and kubelet versions of the nodes.
+func DetectDistribution(nodes []corev1.Node) string {
+	for _, node := range nodes {
+		kubeletVersion := node.Status.NodeInfo.KubeletVersion
+		switch {
+		case hasKeyPrefix(node.Labels, "eks.amazonaws.com/"):
+			return DistributionEKS
+		case hasKeyPrefix(node.Labels, "cloud.google.com/gke-"):
+			return DistributionGKE
+		case hasKeyPrefix(node.Labels, "kubernetes.azure.com/"):
+			return DistributionAKS
+		case strings.Contains(kubeletVersion, "+k3s"):
+			return DistributionK3s
+		case strings.Contains(kubeletVersion, "+rke2"):
+			return DistributionRKE2
+		case hasKeyPrefix(node.Annotations, "rke.cattle.io/"):
+			return DistributionRKE
+		case hasKeyPrefix(node.Labels, "pf9.io/"):
+			return DistributionPMK
+		}
+	}
+	for _, node := range nodes {
+		switch {
+		case strings.HasPrefix(node.Spec.ProviderID, "aws://") && strings.Contains(node.Spec.ProviderID, "fargate"):
+			return DistributionEKS
+		case strings.HasPrefix(node.Spec.ProviderID, "k3s://"):
+			return DistributionK3s
+		}
+	}
+	return DistributionUnknown
+}
+
+// controlPlaneLabels are the node labels that mark control plane nodes. An
+// empty value matches any value of the label.
+var controlPlaneLabels = []struct {
+	key   string
+	value string
+}{
+	{"node-role.kubernetes.io/control-plane", ""},
+	{"node-role.kubernetes.io/master", ""},
+	{"node-role.kubernetes.io/controlplane", "true"}, // RKE
+	{"kubernetes.io/role", "master"},                 // kops
+}
+
+// IsControlPlaneNode returns true if the node runs the control plane, based
+// on its role labels and, for nodes without role labels, its taints.
+func IsControlPlaneNode(node *corev1.Node) bool {
+	for _, label := range controlPlaneLabels {
+		value, ok := node.Labels[label.key]
+		if ok && (label.value == "" || value == label.value) {
+			return true
+		}
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == "node-role.kubernetes.io/control-plane" || taint.Key == "node-role.kubernetes.io/master" {
+			return true
+		}
+	}
+	return false
+}
+
+func detectCNI(daemonSetName string) string {
+	for _, candidate := range cniDaemonSets {
+		if strings.HasPrefix(daemonSetName, candidate.prefix) {
+			return candidate.cni
+		}
+	}
+	return ""
+}
+
+func allocatable(nodes []corev1.Node) corev1.ResourceList {
+	cpu := resource.NewQuantity(0, resource.DecimalSI)
+	memory := resource.NewQuantity(0, resource.BinarySI)
+	for _, node := range nodes {
+		cpu.Add(node.Status.Allocatable[corev1.ResourceCPU])
+		memory.Add(node.Status.Allocatable[corev1.ResourceMemory])
+	}
+	return corev1.ResourceList{
+		corev1.ResourceCPU:    *cpu,
+		corev1.ResourceMemory: *memory,
+	}
+}
+
+// isBuiltinGroup returns true for the API groups that are served by
+// Kubernetes itself rather than by CRDs or aggregated API servers.
+func isBuiltinGroup(group string) bool {
+	return builtinGroups.Has(group)
+}
+
+func hasKeyPrefix(m map[string]string, prefix string) bool {
+	for key := range m {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func bound(items []string) []string {
+	sort.Strings(items)
+	if len(items) > MaxItems {
+		return items[:MaxItems]
+	}
+	return items
+}
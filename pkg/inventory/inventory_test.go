@@ -0,0 +1,110 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestIsBuiltinGroup(t *testing.T) {
+	tests := []struct {
+		group string
+		want  bool
+	}{
+		{group: "", want: true},
+		{group: "apps", want: true},
+		{group: "rbac.authorization.k8s.io", want: true},
+		{group: "flowcontrol.apiserver.k8s.io", want: true},
+		{group: "metrics.k8s.io", want: false},
+		{group: "snapshot.storage.k8s.io", want: false},
+		{group: "gateway.networking.k8s.io", want: false},
+		{group: "cluster.x-k8s.io", want: false},
+		{group: "cert-manager.io", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.group, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(isBuiltinGroup(tt.group)).To(Equal(tt.want))
+		})
+	}
+}
+
+// pagedList serves the items of a list in pages of pageSize by counting the
+// requests, since the fake clientset neither paginates nor passes the
+// continue token to its reactors.
+func pagedList(pageSize int, items int, page func(start, end int, continueToken string) runtime.Object) (clienttesting.ReactionFunc, *int) {
+	requests := 0
+	return func(action clienttesting.Action) (bool, runtime.Object, error) {
+		start := requests * pageSize
+		end := start + pageSize
+		requests++
+		continueToken := ""
+		if end < items {
+			continueToken = fmt.Sprint(requests)
+		} else {
+			end = items
+		}
+		return true, page(start, end, continueToken), nil
+	}, &requests
+}
+
+func TestCollect(t *testing.T) {
+	g := NewWithT(t)
+
+	clientset := fake.NewSimpleClientset(
+		&storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: "ebs.csi.aws.com"}},
+	)
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{GroupVersion: "v1"},
+		{GroupVersion: "apps/v1"},
+		{GroupVersion: "storage.k8s.io/v1"},
+		{GroupVersion: "snapshot.storage.k8s.io/v1"},
+		{GroupVersion: "metrics.k8s.io/v1beta1"},
+		{GroupVersion: "cert-manager.io/v1"},
+	}
+	namespaces, namespaceRequests := pagedList(2, 5, func(start, end int, continueToken string) runtime.Object {
+		list := &corev1.NamespaceList{ListMeta: metav1.ListMeta{Continue: continueToken}}
+		for i := start; i < end; i++ {
+			list.Items = append(list.Items, corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("ns-%d", i)}})
+		}
+		return list
+	})
+	clientset.PrependReactor("list", "namespaces", namespaces)
+	// The CNI DaemonSet is on the second of three pages.
+	daemonSets, daemonSetRequests := pagedList(2, 6, func(start, end int, continueToken string) runtime.Object {
+		list := &appsv1.DaemonSetList{ListMeta: metav1.ListMeta{Continue: continueToken}}
+		for i := start; i < end; i++ {
+			name := fmt.Sprintf("agent-%d", i)
+			if i == 3 {
+				name = "calico-node"
+			}
+			list.Items = append(list.Items, appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: name}})
+		}
+		return list
+	})
+	clientset.PrependReactor("list", "daemonsets", daemonSets)
+
+	nodes := []corev1.Node{{
+		ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: map[string]string{"eks.amazonaws.com/nodegroup": "default"}},
+	}}
+	inventory, err := Collect(context.Background(), clientset, nodes)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(inventory.Distribution).To(Equal(DistributionEKS))
+	g.Expect(inventory.NodeCount).To(BeEquivalentTo(1))
+	g.Expect(inventory.NamespaceCount).To(BeEquivalentTo(5))
+	g.Expect(*namespaceRequests).To(Equal(3))
+	g.Expect(inventory.CNI).To(Equal("calico"))
+	g.Expect(*daemonSetRequests).To(Equal(2))
+	g.Expect(inventory.CSIDrivers).To(Equal([]string{"ebs.csi.aws.com"}))
+	g.Expect(inventory.CRDGroups).To(Equal([]string{"cert-manager.io", "metrics.k8s.io", "snapshot.storage.k8s.io"}))
+}
@@ -0,0 +1,97 @@
+package kubeconfig
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// ErrUnsupportedAuthMethod is returned for kubeconfigs that rely on exec or
+// auth-provider plugins. These plugins depend on binaries and local state of
+// the machine the kubeconfig was created on, so they cannot be used by CAPE.
+var ErrUnsupportedAuthMethod = errors.New("kubeconfig uses an exec or auth-provider plugin")
+
+// CheckAuthMethod returns an error wrapping ErrUnsupportedAuthMethod if the
+// user of the current context of the kubeconfig relies on an exec or
+// auth-provider plugin.
+func CheckAuthMethod(raw []byte) error {
+	config, err := clientcmd.Load(raw)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse kubeconfig")
+	}
+	currentContext, ok := config.Contexts[config.CurrentContext]
+	if !ok || currentContext == nil {
+		return errors.Errorf("current context %q not found in kubeconfig", config.CurrentContext)
+	}
+	authInfo, ok := config.AuthInfos[currentContext.AuthInfo]
+	if !ok || authInfo == nil {
+		return errors.Errorf("user %q not found in kubeconfig", currentContext.AuthInfo)
+	}
+	return checkAuthInfo(currentContext.AuthInfo, authInfo)
+}
+
+func checkAuthInfo(name string, authInfo *clientcmdapi.AuthInfo) error {
+	switch {
+	case authInfo.Exec != nil:
+		return errors.Wrapf(ErrUnsupportedAuthMethod, "user %q runs %q", name, filepath.Base(authInfo.Exec.Command))
+	case authInfo.AuthProvider != nil:
+		return errors.Wrapf(ErrUnsupportedAuthMethod, "user %q uses the %s auth-provider", name, authInfo.AuthProvider.Name)
+	default:
+		return nil
+	}
+}
+
+// Sanitize returns a minimal kubeconfig containing only the current context of
+// the provided kubeconfig. Credentials that reference local files, exec or
+// auth-provider plugins are rejected, so that the result can be used as-is
+// from any namespace or machine.
+func Sanitize(raw []byte) ([]byte, error) {
+	config, err := clientcmd.Load(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse kubeconfig")
+	}
+
+	currentContext, ok := config.Contexts[config.CurrentContext]
+	if !ok {
+		return nil, errors.Errorf("current context %q not found in kubeconfig", config.CurrentContext)
+	}
+	cluster, ok := config.Clusters[currentContext.Cluster]
+	if !ok {
+		return nil, errors.Errorf("cluster %q not found in kubeconfig", currentContext.Cluster)
+	}
+	authInfo, ok := config.AuthInfos[currentContext.AuthInfo]
+	if !ok {
+		return nil, errors.Errorf("user %q not found in kubeconfig", currentContext.AuthInfo)
+	}
+	if err := checkAuthInfo(currentContext.AuthInfo, authInfo); err != nil {
+		return nil, err
+	}
+	if cluster.CertificateAuthority != "" || authInfo.ClientCertificate != "" || authInfo.ClientKey != "" || authInfo.TokenFile != "" {
+		return nil, errors.Errorf("kubeconfig references local files; only inline credentials are supported")
+	}
+
+	sanitized := clientcmdapi.NewConfig()
+	sanitized.Clusters[currentContext.Cluster] = &clientcmdapi.Cluster{
+		Server:                   cluster.Server,
+		TLSServerName:            cluster.TLSServerName,
+		InsecureSkipTLSVerify:    cluster.InsecureSkipTLSVerify,
+		CertificateAuthorityData: cluster.CertificateAuthorityData,
+		ProxyURL:                 cluster.ProxyURL,
+	}
+	sanitized.AuthInfos[currentContext.AuthInfo] = &clientcmdapi.AuthInfo{
+		ClientCertificateData: authInfo.ClientCertificateData,
+		ClientKeyData:         authInfo.ClientKeyData,
+		Token:                 authInfo.Token,
+		Username:              authInfo.Username,
+		Password:              authInfo.Password,
+	}
+	sanitized.Contexts[config.CurrentContext] = &clientcmdapi.Context{
+		Cluster:  currentContext.Cluster,
+		AuthInfo: currentContext.AuthInfo,
+	}
+	sanitized.CurrentContext = config.CurrentContext
+
+	return clientcmd.Write(*sanitized)
+}
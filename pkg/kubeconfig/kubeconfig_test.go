@@ -0,0 +1,92 @@
+package kubeconfig
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// testKubeconfig returns a kubeconfig with a single context whose user is
+// authInfo.
+func testKubeconfig(authInfo *clientcmdapi.AuthInfo) []byte {
+	config := clientcmdapi.NewConfig()
+	config.Clusters["cluster"] = &clientcmdapi.Cluster{Server: "https://10.0.0.10:6443", CertificateAuthorityData: []byte("ca")}
+	config.AuthInfos["user"] = authInfo
+	config.Contexts["context"] = &clientcmdapi.Context{Cluster: "cluster", AuthInfo: "user"}
+	config.CurrentContext = "context"
+	raw, err := clientcmd.Write(*config)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+func TestCheckAuthMethod(t *testing.T) {
+	tests := []struct {
+		name        string
+		kubeconfig  []byte
+		unsupported bool
+		invalid     bool
+	}{
+		{
+			name:       "token",
+			kubeconfig: testKubeconfig(&clientcmdapi.AuthInfo{Token: "token"}),
+		},
+		{
+			name:       "client certificate",
+			kubeconfig: testKubeconfig(&clientcmdapi.AuthInfo{ClientCertificateData: []byte("cert"), ClientKeyData: []byte("key")}),
+		},
+		{
+			name:        "exec plugin",
+			kubeconfig:  testKubeconfig(&clientcmdapi.AuthInfo{Exec: &clientcmdapi.ExecConfig{Command: "/usr/local/bin/aws-iam-authenticator"}}),
+			unsupported: true,
+		},
+		{
+			name:        "auth-provider",
+			kubeconfig:  testKubeconfig(&clientcmdapi.AuthInfo{AuthProvider: &clientcmdapi.AuthProviderConfig{Name: "gcp"}}),
+			unsupported: true,
+		},
+		{
+			name:       "missing current context",
+			kubeconfig: []byte("apiVersion: v1\nkind: Config\ncurrent-context: missing\n"),
+			invalid:    true,
+		},
+		{
+			name:       "invalid yaml",
+			kubeconfig: []byte("{"),
+			invalid:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := CheckAuthMethod(tt.kubeconfig)
+			switch {
+			case tt.unsupported:
+				g.Expect(err).To(MatchError(ErrUnsupportedAuthMethod))
+			case tt.invalid:
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).NotTo(MatchError(ErrUnsupportedAuthMethod))
+			default:
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	g := NewWithT(t)
+	sanitized, err := Sanitize(testKubeconfig(&clientcmdapi.AuthInfo{Token: "token"}))
+	g.Expect(err).NotTo(HaveOccurred())
+	config, err := clientcmd.Load(sanitized)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config.AuthInfos["user"].Token).To(Equal("token"))
+	g.Expect(config.Clusters["cluster"].CertificateAuthorityData).To(Equal([]byte("ca")))
+
+	_, err = Sanitize(testKubeconfig(&clientcmdapi.AuthInfo{TokenFile: "/var/run/token"}))
+	g.Expect(err).To(MatchError(ContainSubstring("local files")))
+	_, err = Sanitize(testKubeconfig(&clientcmdapi.AuthInfo{Exec: &clientcmdapi.ExecConfig{Command: "kubelogin"}}))
+	g.Expect(err).To(MatchError(ErrUnsupportedAuthMethod))
+}
@@ -0,0 +1,265 @@
+package kubeconfig
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+
+	// Register the OIDC auth-provider, the only one that does not depend on
+	// a cloud SDK. The gcp and azure auth-providers are deprecated in favor
+	// of exec plugins.
+	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
+)
+
+const (
+	// ServiceAccountName is the name of the ServiceAccount, and of its
+	// ClusterRoleBinding to cluster-admin, that ResolveAuthMethod creates in
+	// the kube-system namespace of the external cluster. Its token Secret is
+	// named <ServiceAccountName>-token.
+	ServiceAccountName = "cape"
+
+	// ManagedByLabel is set to ManagedByValue on the objects created by
+	// ResolveAuthMethod. Existing objects without it are never reused.
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedByValue = "cape"
+
+	tokenPollInterval = time.Second
+	tokenTimeout      = 30 * time.Second
+)
+
+// ResolveOptions configures ResolveAuthMethod.
+type ResolveOptions struct {
+	// Configure is called with the rest.Config of the kubeconfig before it is
+	// used, e.g. to set a proxy or to audit the requests.
+	Configure func(*rest.Config) error
+
+	// TokenTTL requests a token that expires after the duration from the
+	// TokenRequest API. By default, the token of a ServiceAccount token
+	// Secret is used, which does not expire until the Secret is deleted.
+	// The kubeconfig must be resolved again before an expiring token expires.
+	TokenTTL time.Duration
+}
+
+// ResolveAuthMethod replaces the credentials of a kubeconfig whose user relies
+// on an exec or auth-provider plugin with the token of a ServiceAccount with
+// cluster-admin access, see ServiceAccountName. The plugin is run to create
+// the ServiceAccount, so the kubeconfig must be resolved on the machine that
+// it was created for, e.g. by `cape import`. Kubeconfigs without plugins are
+// returned unchanged.
+func ResolveAuthMethod(ctx context.Context, raw []byte, opts ResolveOptions) ([]byte, error) {
+	if err := CheckAuthMethod(raw); err == nil {
+		return raw, nil
+	} else if !errors.Is(err, ErrUnsupportedAuthMethod) {
+		return nil, err
+	}
+	config, err := clientcmd.Load(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse kubeconfig")
+	}
+	currentContext, ok := config.Contexts[config.CurrentContext]
+	if !ok || currentContext == nil {
+		return nil, errors.Errorf("current context %q not found in kubeconfig", config.CurrentContext)
+	}
+	cluster, ok := config.Clusters[currentContext.Cluster]
+	if !ok || cluster == nil {
+		return nil, errors.Errorf("cluster %q not found in kubeconfig", currentContext.Cluster)
+	}
+	restConfig, err := clientcmd.NewDefaultClientConfig(*config, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load the auth plugin of the kubeconfig")
+	}
+	if opts.Configure != nil {
+		if err := opts.Configure(restConfig); err != nil {
+			return nil, err
+		}
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	token, caData, err := serviceAccountToken(ctx, clientset, opts.TokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := clientcmdapi.NewConfig()
+	resolved.Clusters[currentContext.Cluster] = &clientcmdapi.Cluster{
+		Server:                   cluster.Server,
+		TLSServerName:            cluster.TLSServerName,
+		InsecureSkipTLSVerify:    cluster.InsecureSkipTLSVerify,
+		CertificateAuthorityData: cluster.CertificateAuthorityData,
+		ProxyURL:                 cluster.ProxyURL,
+	}
+	if len(cluster.CertificateAuthorityData) == 0 && !cluster.InsecureSkipTLSVerify {
+		resolved.Clusters[currentContext.Cluster].CertificateAuthorityData = caData
+	}
+	resolved.AuthInfos[ServiceAccountName] = &clientcmdapi.AuthInfo{
+		Token: token,
+	}
+	resolved.Contexts[config.CurrentContext] = &clientcmdapi.Context{
+		Cluster:  currentContext.Cluster,
+		AuthInfo: ServiceAccountName,
+	}
+	resolved.CurrentContext = config.CurrentContext
+	return clientcmd.Write(*resolved)
+}
+
+// serviceAccountToken creates the ServiceAccount and its ClusterRoleBinding if
+// they do not exist, and returns a token of the ServiceAccount and the CA of
+// the cluster. Existing objects are only reused if they were created by
+// ResolveAuthMethod and grant cluster-admin to the ServiceAccount only.
+func serviceAccountToken(ctx context.Context, clientset kubernetes.Interface, ttl time.Duration) (string, []byte, error) {
+	serviceAccount := &corev1.ServiceAccount{
+		ObjectMeta: managedObjectMeta(ServiceAccountName, metav1.NamespaceSystem),
+	}
+	_, err := clientset.CoreV1().ServiceAccounts(metav1.NamespaceSystem).Create(ctx, serviceAccount, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		serviceAccount, err = clientset.CoreV1().ServiceAccounts(metav1.NamespaceSystem).Get(ctx, ServiceAccountName, metav1.GetOptions{})
+		if err == nil {
+			err = checkManaged(&serviceAccount.ObjectMeta)
+		}
+	}
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to create the service account")
+	}
+
+	clusterRoleBinding := &rbacv1.ClusterRoleBinding{
+		ObjectMeta: managedObjectMeta(ServiceAccountName, ""),
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     "cluster-admin",
+		},
+		Subjects: []rbacv1.Subject{{
+			Kind:      rbacv1.ServiceAccountKind,
+			Name:      ServiceAccountName,
+			Namespace: metav1.NamespaceSystem,
+		}},
+	}
+	_, err = clientset.RbacV1().ClusterRoleBindings().Create(ctx, clusterRoleBinding, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		var existing *rbacv1.ClusterRoleBinding
+		existing, err = clientset.RbacV1().ClusterRoleBindings().Get(ctx, ServiceAccountName, metav1.GetOptions{})
+		if err == nil {
+			err = checkClusterRoleBinding(existing, clusterRoleBinding)
+		}
+	}
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to create the cluster role binding")
+	}
+
+	if ttl > 0 {
+		return requestToken(ctx, clientset, ttl)
+	}
+	return secretToken(ctx, clientset)
+}
+
+// requestToken returns a token of the ServiceAccount that expires after the
+// ttl, and the CA of the cluster from the kube-root-ca.crt ConfigMap.
+func requestToken(ctx context.Context, clientset kubernetes.Interface, ttl time.Duration) (string, []byte, error) {
+	expirationSeconds := int64(ttl.Seconds())
+	tokenRequest := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{ExpirationSeconds: &expirationSeconds},
+	}
+	tokenRequest, err := clientset.CoreV1().ServiceAccounts(metav1.NamespaceSystem).CreateToken(ctx, ServiceAccountName, tokenRequest, metav1.CreateOptions{})
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to request a service account token")
+	}
+	var caData []byte
+	rootCA, err := clientset.CoreV1().ConfigMaps(metav1.NamespaceSystem).Get(ctx, "kube-root-ca.crt", metav1.GetOptions{})
+	if err == nil {
+		caData = []byte(rootCA.Data["ca.crt"])
+	} else if !apierrors.IsNotFound(err) {
+		return "", nil, errors.Wrap(err, "failed to get the CA of the cluster")
+	}
+	return tokenRequest.Status.Token, caData, nil
+}
+
+// secretToken creates the token Secret of the ServiceAccount if it does not
+// exist, and returns the token and the CA of the cluster once the token
+// controller populated the Secret.
+func secretToken(ctx context.Context, clientset kubernetes.Interface) (string, []byte, error) {
+	secret := &corev1.Secret{
+		ObjectMeta: managedObjectMeta(ServiceAccountName+"-token", metav1.NamespaceSystem),
+		Type:       corev1.SecretTypeServiceAccountToken,
+	}
+	secret.Annotations = map[string]string{corev1.ServiceAccountNameKey: ServiceAccountName}
+	_, err := clientset.CoreV1().Secrets(metav1.NamespaceSystem).Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		var existing *corev1.Secret
+		existing, err = clientset.CoreV1().Secrets(metav1.NamespaceSystem).Get(ctx, secret.Name, metav1.GetOptions{})
+		if err == nil {
+			err = checkManaged(&existing.ObjectMeta)
+		}
+		if err == nil && (existing.Type != corev1.SecretTypeServiceAccountToken || existing.Annotations[corev1.ServiceAccountNameKey] != ServiceAccountName) {
+			err = errors.Errorf("secret %s/%s is not a token of service account %s", existing.Namespace, existing.Name, ServiceAccountName)
+		}
+	}
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to create the service account token")
+	}
+
+	err = wait.PollImmediate(tokenPollInterval, tokenTimeout, func() (bool, error) {
+		secret, err = clientset.CoreV1().Secrets(metav1.NamespaceSystem).Get(ctx, secret.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return len(secret.Data[corev1.ServiceAccountTokenKey]) > 0, nil
+	})
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to wait for the service account token")
+	}
+	return string(secret.Data[corev1.ServiceAccountTokenKey]), secret.Data[corev1.ServiceAccountRootCAKey], nil
+}
+
+func managedObjectMeta(name, namespace string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: namespace,
+		Labels:    map[string]string{ManagedByLabel: ManagedByValue},
+	}
+}
+
+// checkManaged returns an error if the object was not created by
+// ResolveAuthMethod.
+func checkManaged(meta *metav1.ObjectMeta) error {
+	if meta.Labels[ManagedByLabel] != ManagedByValue {
+		return errors.Errorf("%s already exists, but was not created by cape: it lacks the label %s=%s", objectName(meta), ManagedByLabel, ManagedByValue)
+	}
+	return nil
+}
+
+// checkClusterRoleBinding returns an error if the existing ClusterRoleBinding
+// was not created by ResolveAuthMethod, or if it grants a different role or
+// to other subjects than the desired one.
+func checkClusterRoleBinding(existing, desired *rbacv1.ClusterRoleBinding) error {
+	if err := checkManaged(&existing.ObjectMeta); err != nil {
+		return err
+	}
+	if existing.RoleRef != desired.RoleRef {
+		return errors.Errorf("cluster role binding %s binds %s %s instead of %s %s", existing.Name,
+			existing.RoleRef.Kind, existing.RoleRef.Name, desired.RoleRef.Kind, desired.RoleRef.Name)
+	}
+	if len(existing.Subjects) != 1 || existing.Subjects[0] != desired.Subjects[0] {
+		return errors.Errorf("cluster role binding %s has other subjects than service account %s/%s", existing.Name, metav1.NamespaceSystem, ServiceAccountName)
+	}
+	return nil
+}
+
+func objectName(meta *metav1.ObjectMeta) string {
+	if meta.Namespace == "" {
+		return meta.Name
+	}
+	return meta.Namespace + "/" + meta.Name
+}
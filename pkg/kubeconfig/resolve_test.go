@@ -0,0 +1,162 @@
+package kubeconfig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// newFakeClientset returns a clientset whose token controller populates the
+// ServiceAccount token Secrets on creation.
+func newFakeClientset(objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	clientset.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		secret := action.(k8stesting.CreateAction).GetObject().(*corev1.Secret)
+		if secret.Type == corev1.SecretTypeServiceAccountToken {
+			secret.Data = map[string][]byte{
+				corev1.ServiceAccountTokenKey:  []byte("secret-token"),
+				corev1.ServiceAccountRootCAKey: []byte("ca"),
+			}
+		}
+		return false, nil, nil
+	})
+	return clientset
+}
+
+func TestServiceAccountToken(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	clientset := newFakeClientset()
+
+	token, caData, err := serviceAccountToken(ctx, clientset, 0)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(token).To(Equal("secret-token"))
+	g.Expect(caData).To(Equal([]byte("ca")))
+
+	clusterRoleBinding, err := clientset.RbacV1().ClusterRoleBindings().Get(ctx, ServiceAccountName, metav1.GetOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(clusterRoleBinding.RoleRef.Name).To(Equal("cluster-admin"))
+	g.Expect(clusterRoleBinding.Labels).To(HaveKeyWithValue(ManagedByLabel, ManagedByValue))
+
+	// Resolving again reuses the objects.
+	token, _, err = serviceAccountToken(ctx, clientset, 0)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(token).To(Equal("secret-token"))
+}
+
+func TestServiceAccountTokenRequest(t *testing.T) {
+	g := NewWithT(t)
+	clientset := newFakeClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-root-ca.crt", Namespace: metav1.NamespaceSystem},
+		Data:       map[string]string{"ca.crt": "root-ca"},
+	})
+	var expirationSeconds int64
+	clientset.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		tokenRequest := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenRequest)
+		expirationSeconds = *tokenRequest.Spec.ExpirationSeconds
+		return true, &authenticationv1.TokenRequest{Status: authenticationv1.TokenRequestStatus{Token: "requested-token"}}, nil
+	})
+
+	token, caData, err := serviceAccountToken(context.Background(), clientset, 24*time.Hour)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(token).To(Equal("requested-token"))
+	g.Expect(caData).To(Equal([]byte("root-ca")))
+	g.Expect(expirationSeconds).To(Equal(int64(24 * 60 * 60)))
+
+	_, err = clientset.CoreV1().Secrets(metav1.NamespaceSystem).Get(context.Background(), ServiceAccountName+"-token", metav1.GetOptions{})
+	g.Expect(err).To(HaveOccurred(), "no token Secret should be created")
+}
+
+func TestServiceAccountTokenExistingObjects(t *testing.T) {
+	managed := map[string]string{ManagedByLabel: ManagedByValue}
+	serviceAccountSubject := rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: ServiceAccountName, Namespace: metav1.NamespaceSystem}
+	clusterAdmin := rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "cluster-admin"}
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		err     string
+	}{
+		{
+			name: "foreign service account",
+			objects: []runtime.Object{
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: ServiceAccountName, Namespace: metav1.NamespaceSystem}},
+			},
+			err: "was not created by cape",
+		},
+		{
+			name: "foreign cluster role binding",
+			objects: []runtime.Object{
+				&rbacv1.ClusterRoleBinding{
+					ObjectMeta: metav1.ObjectMeta{Name: ServiceAccountName},
+					RoleRef:    clusterAdmin,
+					Subjects:   []rbacv1.Subject{serviceAccountSubject},
+				},
+			},
+			err: "was not created by cape",
+		},
+		{
+			name: "cluster role binding with other subjects",
+			objects: []runtime.Object{
+				&rbacv1.ClusterRoleBinding{
+					ObjectMeta: metav1.ObjectMeta{Name: ServiceAccountName, Labels: managed},
+					RoleRef:    clusterAdmin,
+					Subjects:   []rbacv1.Subject{serviceAccountSubject, {Kind: rbacv1.UserKind, Name: "mallory"}},
+				},
+			},
+			err: "other subjects",
+		},
+		{
+			name: "cluster role binding with another role",
+			objects: []runtime.Object{
+				&rbacv1.ClusterRoleBinding{
+					ObjectMeta: metav1.ObjectMeta{Name: ServiceAccountName, Labels: managed},
+					RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "view"},
+					Subjects:   []rbacv1.Subject{serviceAccountSubject},
+				},
+			},
+			err: "instead of ClusterRole cluster-admin",
+		},
+		{
+			name: "foreign token secret",
+			objects: []runtime.Object{
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: ServiceAccountName + "-token", Namespace: metav1.NamespaceSystem},
+					Type:       corev1.SecretTypeOpaque,
+					Data:       map[string][]byte{corev1.ServiceAccountTokenKey: []byte("stolen")},
+				},
+			},
+			err: "was not created by cape",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			_, _, err := serviceAccountToken(context.Background(), newFakeClientset(tt.objects...), 0)
+			g.Expect(err).To(MatchError(ContainSubstring(tt.err)))
+		})
+	}
+}
+
+func TestResolveAuthMethodWithoutPlugin(t *testing.T) {
+	g := NewWithT(t)
+	raw := testKubeconfig(&clientcmdapi.AuthInfo{Token: "token"})
+	resolved, err := ResolveAuthMethod(context.Background(), raw, ResolveOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(resolved).To(Equal(raw))
+
+	_, err = ResolveAuthMethod(context.Background(), []byte("apiVersion: v1\nkind: Config\ncurrent-context: missing\n"), ResolveOptions{})
+	g.Expect(err).To(MatchError(ContainSubstring("not found")))
+}
@@ -0,0 +1,306 @@
+// Package metrics contains the CAPE-specific Prometheus metrics. All metrics
+// are registered on the controller-runtime registry, so they are exposed on
+// the metrics endpoint of `cape run`.
+package metrics
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	namespace = "cape"
+
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+
+	ImportSuccess = "success"
+	ImportFailure = "failure"
+)
+
+var clusterLabels = []string{"namespace", "name"}
+
+// driftCheckLabels identify an ExternalClusterDriftCheck and one of the
+// clusters it checks.
+var driftCheckLabels = []string{"namespace", "name", "cluster"}
+
+// certificateSources lists the values of the source label of
+// ClusterCertificateExpiry, which are the sources of the certificates in the
+// ExternalControlPlane status.
+var certificateSources = []string{"APIServer", "Kubeconfig"}
+
+// operations lists the values of the operation label of NodeSyncOperations.
+var operations = []string{OperationCreate, OperationUpdate, OperationDelete}
+
+// importResults lists the values of the result label of ClusterImports.
+var importResults = []string{ImportSuccess, ImportFailure}
+
+// verbs lists the values of the verb label of RemoteRequestDuration.
+var verbs = []string{"get", "watch", "create", "update", "patch", "delete", "other"}
+
+var (
+	ClusterReady = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_ready",
+		Help:      "Whether the imported cluster is reachable and ready (1) or not (0).",
+	}, clusterLabels)
+
+	ClusterAPILatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_api_latency_seconds",
+		Help:      "Latency of the last readiness probe against the API server of the imported cluster.",
+	}, clusterLabels)
+
+	ClusterNodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_nodes",
+		Help:      "Number of nodes in the imported cluster.",
+	}, clusterLabels)
+
+	ClusterReadyNodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_ready_nodes",
+		Help:      "Number of ready nodes in the imported cluster.",
+	}, clusterLabels)
+
+	ClusterCredentialExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_credential_expiry_seconds",
+		Help:      "Seconds until the client certificate in the kubeconfig of the imported cluster expires.",
+	}, clusterLabels)
+
+	ClusterCertificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_certificate_expiry_seconds",
+		Help:      "Seconds until the first certificate of the control plane of the imported cluster expires, by source (APIServer or Kubeconfig).",
+	}, append(clusterLabels, "source"))
+
+	ClusterVersionSkewNodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_version_skew_nodes",
+		Help:      "Number of nodes of the imported cluster whose kubelet version violates the version skew policy with the API server.",
+	}, clusterLabels)
+
+	NodeSyncOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "node_sync_operations_total",
+		Help:      "Number of Machines and MachinePools created, updated or deleted while syncing the nodes of the imported cluster, by operation.",
+	}, append(clusterLabels, "operation"))
+
+	RemoteRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "remote_request_duration_seconds",
+		Help:      "Duration of the requests made to the API server of the imported cluster, by verb.",
+		Buckets:   prometheus.DefBuckets,
+	}, append(clusterLabels, "verb"))
+
+	// ClusterImports only counts the imports of the manager. `cape import`
+	// runs in its own process, which does not export metrics.
+	ClusterImports = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cluster_imports_total",
+		Help:      "Number of cluster imports by QbertSources, by result.",
+	}, append(clusterLabels, "result"))
+
+	DriftedObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "drift_check_drifted_objects",
+		Help:      "Number of objects of the drift check that differ from their desired state in the imported cluster.",
+	}, driftCheckLabels)
+
+	DriftedFields = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "drift_check_drifted_fields",
+		Help:      "Number of fields of the objects of the drift check that differ from their desired state in the imported cluster.",
+	}, driftCheckLabels)
+
+	DriftReapplies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "drift_check_reapplies_total",
+		Help:      "Number of drifted objects of the drift check that were reapplied to the imported cluster.",
+	}, driftCheckLabels)
+)
+
+// driftCheckClusters tracks the clusters that each drift check reported
+// metrics for, so that their series can be removed.
+var (
+	driftCheckClustersMu sync.Mutex
+	driftCheckClusters   = map[types.NamespacedName][]string{}
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		ClusterReady,
+		ClusterAPILatency,
+		ClusterNodes,
+		ClusterReadyNodes,
+		ClusterCredentialExpiry,
+		ClusterCertificateExpiry,
+		ClusterVersionSkewNodes,
+		NodeSyncOperations,
+		RemoteRequestDuration,
+		ClusterImports,
+		DriftedObjects,
+		DriftedFields,
+		DriftReapplies,
+	)
+}
+
+// DeleteClusterMetrics removes all series of the cluster, so that deleted
+// clusters do not linger in the metrics.
+func DeleteClusterMetrics(cluster types.NamespacedName) {
+	labels := prometheus.Labels{"namespace": cluster.Namespace, "name": cluster.Name}
+	ClusterReady.Delete(labels)
+	ClusterAPILatency.Delete(labels)
+	ClusterNodes.Delete(labels)
+	ClusterReadyNodes.Delete(labels)
+	ClusterCredentialExpiry.Delete(labels)
+	ClusterVersionSkewNodes.Delete(labels)
+	DeleteCertificateExpiry(cluster)
+	for _, operation := range operations {
+		NodeSyncOperations.DeleteLabelValues(cluster.Namespace, cluster.Name, operation)
+	}
+	for _, result := range importResults {
+		ClusterImports.DeleteLabelValues(cluster.Namespace, cluster.Name, result)
+	}
+	for _, verb := range verbs {
+		RemoteRequestDuration.DeleteLabelValues(cluster.Namespace, cluster.Name, verb)
+	}
+}
+
+// SetClusterReady updates the ClusterReady metric.
+func SetClusterReady(cluster types.NamespacedName, ready bool) {
+	value := 0.0
+	if ready {
+		value = 1.0
+	}
+	ClusterReady.WithLabelValues(cluster.Namespace, cluster.Name).Set(value)
+}
+
+// SetCredentialExpiry updates the ClusterCredentialExpiry metric based on the
+// client certificate in the rest.Config. Configs without client certificates
+// are ignored.
+func SetCredentialExpiry(cluster types.NamespacedName, config *rest.Config) {
+	block, _ := pem.Decode(config.CertData)
+	if block == nil {
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return
+	}
+	ClusterCredentialExpiry.WithLabelValues(cluster.Namespace, cluster.Name).Set(time.Until(cert.NotAfter).Seconds())
+}
+
+// SetCertificateExpiry updates the ClusterCertificateExpiry metric to the
+// time until the first certificate of each source expires, and removes the
+// series of the sources without certificates.
+func SetCertificateExpiry(cluster types.NamespacedName, firstBySource map[string]time.Time) {
+	for _, source := range certificateSources {
+		if notAfter, ok := firstBySource[source]; ok {
+			ClusterCertificateExpiry.WithLabelValues(cluster.Namespace, cluster.Name, source).Set(time.Until(notAfter).Seconds())
+		} else {
+			ClusterCertificateExpiry.DeleteLabelValues(cluster.Namespace, cluster.Name, source)
+		}
+	}
+}
+
+// DeleteCertificateExpiry removes the ClusterCertificateExpiry series of the
+// cluster.
+func DeleteCertificateExpiry(cluster types.NamespacedName) {
+	for _, source := range certificateSources {
+		ClusterCertificateExpiry.DeleteLabelValues(cluster.Namespace, cluster.Name, source)
+	}
+}
+
+// InstrumentRESTConfig wraps the transport of the rest.Config to record the
+// duration of each request in the RemoteRequestDuration metric.
+func InstrumentRESTConfig(cluster types.NamespacedName, config *rest.Config) {
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &instrumentedRoundTripper{cluster: cluster, delegate: rt}
+	})
+}
+
+type instrumentedRoundTripper struct {
+	cluster  types.NamespacedName
+	delegate http.RoundTripper
+}
+
+func (rt *instrumentedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := rt.delegate.RoundTrip(req)
+	RemoteRequestDuration.WithLabelValues(rt.cluster.Namespace, rt.cluster.Name, verb(req)).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// verb approximates the Kubernetes API verb of the request based on its HTTP
+// method, since the request info is not available on the client side.
+func verb(req *http.Request) string {
+	switch req.Method {
+	case http.MethodGet:
+		if req.URL.Query().Get("watch") == "true" {
+			return "watch"
+		}
+		return "get"
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut:
+		return "update"
+	case http.MethodPatch:
+		return "patch"
+	case http.MethodDelete:
+		return "delete"
+	default:
+		return "other"
+	}
+}
+
+// ClusterDrift is the drift of the objects of a drift check in a cluster.
+type ClusterDrift struct {
+	Objects int
+	Fields  int
+}
+
+// SetDrift updates the drift metrics of the drift check, and removes the
+// series of the clusters that it no longer checks.
+func SetDrift(check types.NamespacedName, clusters map[string]ClusterDrift) {
+	driftCheckClustersMu.Lock()
+	defer driftCheckClustersMu.Unlock()
+	for _, cluster := range driftCheckClusters[check] {
+		if _, ok := clusters[cluster]; !ok {
+			deleteDriftSeries(check, cluster)
+		}
+	}
+	names := make([]string, 0, len(clusters))
+	for cluster, drift := range clusters {
+		DriftedObjects.WithLabelValues(check.Namespace, check.Name, cluster).Set(float64(drift.Objects))
+		DriftedFields.WithLabelValues(check.Namespace, check.Name, cluster).Set(float64(drift.Fields))
+		names = append(names, cluster)
+	}
+	driftCheckClusters[check] = names
+}
+
+// DeleteDriftMetrics removes all series of the drift check.
+func DeleteDriftMetrics(check types.NamespacedName) {
+	driftCheckClustersMu.Lock()
+	defer driftCheckClustersMu.Unlock()
+	for _, cluster := range driftCheckClusters[check] {
+		deleteDriftSeries(check, cluster)
+	}
+	delete(driftCheckClusters, check)
+}
+
+func deleteDriftSeries(check types.NamespacedName, cluster string) {
+	DriftedObjects.DeleteLabelValues(check.Namespace, check.Name, cluster)
+	DriftedFields.DeleteLabelValues(check.Namespace, check.Name, cluster)
+	DriftReapplies.DeleteLabelValues(check.Namespace, check.Name, cluster)
+}
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+// seriesOf returns the number of series of the collector that are labeled
+// with the cluster.
+func seriesOf(g *WithT, collector prometheus.Collector, cluster types.NamespacedName) int {
+	ch := make(chan prometheus.Metric, 100)
+	collector.Collect(ch)
+	close(ch)
+	count := 0
+	for metric := range ch {
+		labels := map[string]string{}
+		for _, label := range readMetric(g, metric).GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["namespace"] == cluster.Namespace && labels["name"] == cluster.Name {
+			count++
+		}
+	}
+	return count
+}
+
+func readMetric(g *WithT, metric prometheus.Metric) *dto.Metric {
+	out := &dto.Metric{}
+	g.Expect(metric.Write(out)).To(Succeed())
+	return out
+}
+
+func TestDeleteClusterMetrics(t *testing.T) {
+	g := NewWithT(t)
+	deleted := types.NamespacedName{Namespace: "default", Name: "deleted"}
+	kept := types.NamespacedName{Namespace: "default", Name: "kept"}
+	defer DeleteClusterMetrics(kept)
+
+	for _, cluster := range []types.NamespacedName{deleted, kept} {
+		SetClusterReady(cluster, true)
+		ClusterAPILatency.WithLabelValues(cluster.Namespace, cluster.Name).Set(0.1)
+		ClusterNodes.WithLabelValues(cluster.Namespace, cluster.Name).Set(3)
+		ClusterReadyNodes.WithLabelValues(cluster.Namespace, cluster.Name).Set(2)
+		ClusterCredentialExpiry.WithLabelValues(cluster.Namespace, cluster.Name).Set(3600)
+		ClusterVersionSkewNodes.WithLabelValues(cluster.Namespace, cluster.Name).Set(1)
+		SetCertificateExpiry(cluster, map[string]time.Time{"APIServer": time.Now(), "Kubeconfig": time.Now()})
+		for _, operation := range operations {
+			NodeSyncOperations.WithLabelValues(cluster.Namespace, cluster.Name, operation).Inc()
+		}
+		for _, result := range importResults {
+			ClusterImports.WithLabelValues(cluster.Namespace, cluster.Name, result).Inc()
+		}
+		RemoteRequestDuration.WithLabelValues(cluster.Namespace, cluster.Name, "get").Observe(0.1)
+	}
+
+	DeleteClusterMetrics(deleted)
+	collectors := map[string]prometheus.Collector{
+		"ClusterReady":             ClusterReady,
+		"ClusterAPILatency":        ClusterAPILatency,
+		"ClusterNodes":             ClusterNodes,
+		"ClusterReadyNodes":        ClusterReadyNodes,
+		"ClusterCredentialExpiry":  ClusterCredentialExpiry,
+		"ClusterCertificateExpiry": ClusterCertificateExpiry,
+		"ClusterVersionSkewNodes":  ClusterVersionSkewNodes,
+		"NodeSyncOperations":       NodeSyncOperations,
+		"RemoteRequestDuration":    RemoteRequestDuration,
+		"ClusterImports":           ClusterImports,
+	}
+	for name, collector := range collectors {
+		g.Expect(seriesOf(g, collector, deleted)).To(BeZero(), name)
+		g.Expect(seriesOf(g, collector, kept)).NotTo(BeZero(), name)
+	}
+}
+
+func TestNodeSyncOperations(t *testing.T) {
+	g := NewWithT(t)
+	cluster := types.NamespacedName{Namespace: "default", Name: "node-sync"}
+	defer DeleteClusterMetrics(cluster)
+
+	NodeSyncOperations.WithLabelValues(cluster.Namespace, cluster.Name, OperationCreate).Add(3)
+	NodeSyncOperations.WithLabelValues(cluster.Namespace, cluster.Name, OperationUpdate).Inc()
+	NodeSyncOperations.WithLabelValues(cluster.Namespace, cluster.Name, OperationDelete).Inc()
+	g.Expect(testutil.ToFloat64(NodeSyncOperations.WithLabelValues(cluster.Namespace, cluster.Name, OperationCreate))).To(Equal(3.0))
+	g.Expect(testutil.ToFloat64(NodeSyncOperations.WithLabelValues(cluster.Namespace, cluster.Name, OperationUpdate))).To(Equal(1.0))
+	g.Expect(testutil.ToFloat64(NodeSyncOperations.WithLabelValues(cluster.Namespace, cluster.Name, OperationDelete))).To(Equal(1.0))
+	g.Expect(seriesOf(g, NodeSyncOperations, cluster)).To(Equal(3))
+}
+
+func TestSetClusterReady(t *testing.T) {
+	g := NewWithT(t)
+	cluster := types.NamespacedName{Namespace: "default", Name: "ready"}
+	defer DeleteClusterMetrics(cluster)
+
+	SetClusterReady(cluster, true)
+	g.Expect(testutil.ToFloat64(ClusterReady.WithLabelValues(cluster.Namespace, cluster.Name))).To(Equal(1.0))
+	SetClusterReady(cluster, false)
+	g.Expect(testutil.ToFloat64(ClusterReady.WithLabelValues(cluster.Namespace, cluster.Name))).To(Equal(0.0))
+}
+
+func TestInstrumentRESTConfig(t *testing.T) {
+	g := NewWithT(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	cluster := types.NamespacedName{Namespace: "default", Name: "instrumented"}
+	defer DeleteClusterMetrics(cluster)
+
+	config := &rest.Config{Host: server.URL}
+	InstrumentRESTConfig(cluster, config)
+	client, err := rest.HTTPClientFor(config)
+	g.Expect(err).NotTo(HaveOccurred())
+	for _, request := range []struct{ method, query string }{
+		{http.MethodGet, ""},
+		{http.MethodGet, "watch=true"},
+		{http.MethodPost, ""},
+		{http.MethodPatch, ""},
+		{http.MethodPatch, ""},
+		{http.MethodOptions, ""},
+	} {
+		req, err := http.NewRequest(request.method, server.URL+"/api?"+request.query, nil)
+		g.Expect(err).NotTo(HaveOccurred())
+		resp, err := client.Do(req)
+		g.Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+	}
+
+	counts := map[string]uint64{}
+	for _, verb := range verbs {
+		observer := RemoteRequestDuration.WithLabelValues(cluster.Namespace, cluster.Name, verb)
+		counts[verb] = readMetric(g, observer.(prometheus.Metric)).GetHistogram().GetSampleCount()
+	}
+	g.Expect(counts).To(Equal(map[string]uint64{
+		"get": 1, "watch": 1, "create": 1, "update": 0, "patch": 2, "delete": 0, "other": 1,
+	}))
+}
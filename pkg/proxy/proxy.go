@@ -0,0 +1,288 @@
+// Package proxy implements an authenticating HTTPS proxy that gives users of
+// the management cluster access to the imported clusters. Callers
+// authenticate with their management cluster credentials; requests are
+// forwarded with the kubeconfig of the cluster, impersonating the caller.
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/audit"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/remote"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tunnel"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/transport"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/secret"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PathPrefix is the prefix of the proxied paths. The API of a cluster is
+// served under /clusters/<namespace>/<name>/.
+const PathPrefix = "/clusters/"
+
+// +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+// Proxy is an http.Handler that forwards requests to the imported clusters.
+//
+// Callers are authenticated with a TokenReview and must be allowed to use the
+// proxy subresource of the Cluster, with the verb derived from the HTTP
+// method, for example:
+//
+//	rules:
+//	- apiGroups: ["cluster.x-k8s.io"]
+//	  resources: ["clusters/proxy"]
+//	  verbs: ["get", "create", "update", "patch", "delete"]
+//
+// The credentials in the kubeconfig of the cluster must be allowed to
+// impersonate users and groups in the imported cluster.
+type Proxy struct {
+	// Client reads the Clusters, ExternalClusters and kubeconfig Secrets.
+	Client client.Reader
+
+	// Clientset creates the TokenReviews and SubjectAccessReviews.
+	Clientset kubernetes.Interface
+
+	// Tunnel is used for clusters that are accessed through a tunnel. It can
+	// be nil if the tunnel server is disabled.
+	Tunnel *tunnel.Server
+
+	// Transports caches the transports of the clusters with a tunnel or an
+	// egress proxy. It is shared with the ExternalCluster reconciler, which
+	// forgets the transports of deleted clusters. Without it, the connections
+	// to these clusters are not reused.
+	Transports *remote.Transports
+
+	// Audit records the mutating requests made through the proxy, with the
+	// caller as the actor. Auditing is disabled if it is nil.
+	Audit audit.Sink
+
+	Log logr.Logger
+}
+
+// clusterTransport is the transport of a cluster and the URL of its API
+// server.
+type clusterTransport struct {
+	host      *url.URL
+	transport http.RoundTripper
+}
+
+// ServeHTTP authenticates and authorizes the caller and forwards the request
+// to the cluster.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	cluster, path, ok := parsePath(req.URL.Path)
+	if !ok {
+		http.Error(w, "expected a path of the form /clusters/<namespace>/<name>/...", http.StatusNotFound)
+		return
+	}
+	ctx := req.Context()
+	log := p.Log.WithValues("cluster", cluster.String())
+
+	user, err := p.authenticate(ctx, req)
+	if err != nil {
+		log.V(2).Info("Unauthenticated proxy request", "reason", err.Error())
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	log = log.WithValues("user", user.Username)
+
+	if err := p.authorize(ctx, user, cluster, req.Method); err != nil {
+		log.V(2).Info("Forbidden proxy request", "reason", err.Error())
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	ct, err := p.clusterTransport(ctx, cluster)
+	if err != nil {
+		// The error can contain details of the management cluster, such as
+		// the names of Secrets, which the caller may not be allowed to see.
+		if apierrors.IsNotFound(errors.Cause(err)) {
+			log.V(2).Info("Proxy request for an unknown cluster", "reason", err.Error())
+			http.Error(w, "cluster not found", http.StatusNotFound)
+			return
+		}
+		log.Error(err, "Failed to set up the connection to the cluster")
+		http.Error(w, "failed to reach the cluster", http.StatusBadGateway)
+		return
+	}
+
+	extra := map[string][]string{}
+	for key, value := range user.Extra {
+		extra[key] = value
+	}
+	rt := ct.transport
+	if p.Audit != nil {
+		rt = audit.NewRoundTripper(p.Audit, cluster, user.Username, rt)
+	}
+	reverseProxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = ct.host.Scheme
+			out.URL.Host = ct.host.Host
+			out.URL.Path = strings.TrimSuffix(ct.host.Path, "/") + path
+			out.URL.RawPath = ""
+			out.Host = ct.host.Host
+			// Never forward the credentials of the caller, nor any attempt of
+			// the caller to impersonate someone else.
+			out.Header.Del("Authorization")
+			for header := range out.Header {
+				if strings.HasPrefix(header, "Impersonate-") {
+					out.Header.Del(header)
+				}
+			}
+		},
+		Transport: transport.NewImpersonatingRoundTripper(transport.ImpersonationConfig{
+			UserName: user.Username,
+			UID:      user.UID,
+			Groups:   user.Groups,
+			Extra:    extra,
+		}, rt),
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Error(err, "Failed to proxy request")
+			http.Error(w, "failed to reach the cluster", http.StatusBadGateway)
+		},
+	}
+	reverseProxy.ServeHTTP(w, req)
+}
+
+// parsePath splits /clusters/<namespace>/<name>/<path> into the cluster and
+// the path on the cluster.
+func parsePath(p string) (types.NamespacedName, string, bool) {
+	if !strings.HasPrefix(p, PathPrefix) {
+		return types.NamespacedName{}, "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(p, PathPrefix), "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return types.NamespacedName{}, "", false
+	}
+	path := "/"
+	if len(parts) == 3 {
+		path += parts[2]
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, path, true
+}
+
+func (p *Proxy) authenticate(ctx context.Context, req *http.Request) (*authenticationv1.UserInfo, error) {
+	token := strings.TrimSpace(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	if token == "" || token == req.Header.Get("Authorization") {
+		return nil, errors.New("no bearer token")
+	}
+	review, err := p.Clientset.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to review token")
+	}
+	if !review.Status.Authenticated {
+		return nil, errors.Errorf("token not authenticated: %s", review.Status.Error)
+	}
+	return &review.Status.User, nil
+}
+
+func (p *Proxy) authorize(ctx context.Context, user *authenticationv1.UserInfo, cluster types.NamespacedName, method string) error {
+	extra := map[string]authorizationv1.ExtraValue{}
+	for key, value := range user.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+	proxyVerb := verb(method)
+	review, err := p.Clientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   cluster.Namespace,
+				Name:        cluster.Name,
+				Verb:        proxyVerb,
+				Group:       clusterv1.GroupVersion.Group,
+				Resource:    "clusters",
+				Subresource: "proxy",
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to review access")
+	}
+	if !review.Status.Allowed {
+		return errors.Errorf("user %q cannot %s clusters/proxy %s", user.Username, proxyVerb, cluster)
+	}
+	return nil
+}
+
+// verb maps the HTTP method to the verb that is checked on clusters/proxy,
+// like the API server does for the proxy subresources of services and pods.
+func verb(method string) string {
+	switch method {
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut:
+		return "update"
+	case http.MethodPatch:
+		return "patch"
+	case http.MethodDelete:
+		return "delete"
+	default:
+		return "get"
+	}
+}
+
+// clusterTransport returns the transport to the imported cluster, built from
+// its kubeconfig Secret. It is built for every request, so that changes of
+// the kubeconfig take effect immediately; only the connections are reused,
+// through the Transports of clusters with a tunnel or an egress proxy and the
+// transport cache of client-go otherwise.
+func (p *Proxy) clusterTransport(ctx context.Context, cluster types.NamespacedName) (*clusterTransport, error) {
+	capiCluster := &clusterv1.Cluster{}
+	if err := p.Client.Get(ctx, cluster, capiCluster); err != nil {
+		return nil, errors.Wrapf(err, "failed to get cluster %s", cluster)
+	}
+	infraRef := capiCluster.Spec.InfrastructureRef
+	if infraRef == nil || infraRef.Kind != "ExternalCluster" {
+		return nil, apierrors.NewNotFound(externalv1.GroupVersion.WithResource("externalclusters").GroupResource(), cluster.Name)
+	}
+	externalCluster := &externalv1.ExternalCluster{}
+	if err := p.Client.Get(ctx, types.NamespacedName{Namespace: cluster.Namespace, Name: infraRef.Name}, externalCluster); err != nil {
+		return nil, errors.Wrapf(err, "failed to get ExternalCluster of cluster %s", cluster)
+	}
+
+	kubeconfigSecret, err := secret.GetFromNamespacedName(ctx, p.Client, cluster, secret.Kubeconfig)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get kubeconfig of cluster %s", cluster)
+	}
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfigSecret.Data[secret.KubeconfigDataName])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid kubeconfig of cluster %s", cluster)
+	}
+	// The requests are audited per user in ServeHTTP, rather than on behalf
+	// of the controller.
+	if err := remote.Configure(ctx, p.Client, cluster, externalCluster, config, remote.Options{Tunnel: p.Tunnel, Transports: p.Transports}); err != nil {
+		return nil, errors.Wrapf(err, "failed to configure access to cluster %s", cluster)
+	}
+
+	host, _, err := rest.DefaultServerURL(config.Host, "", schema.GroupVersion{}, true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid server of cluster %s", cluster)
+	}
+	rt, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create transport for cluster %s", cluster)
+	}
+	return &clusterTransport{host: host, transport: rt}, nil
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/remote"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// upstream is a fake API server of an imported cluster that records the
+// requests it receives.
+type upstream struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newUpstream() *upstream {
+	u := &upstream{}
+	u.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		u.requests = append(u.requests, r.Clone(r.Context()))
+		u.mu.Unlock()
+		_, _ = io.WriteString(w, `{"kind":"NamespaceList"}`)
+	}))
+	return u
+}
+
+func (u *upstream) count() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.requests)
+}
+
+func (u *upstream) lastRequest() *http.Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.requests) == 0 {
+		return nil
+	}
+	return u.requests[len(u.requests)-1]
+}
+
+// kubeconfig returns a kubeconfig of the upstream that authenticates with
+// the token.
+func (u *upstream) kubeconfig(g *WithT, token string) []byte {
+	config := clientcmdapi.NewConfig()
+	config.Clusters["prod"] = &clientcmdapi.Cluster{
+		Server:                   u.URL,
+		CertificateAuthorityData: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: u.Certificate().Raw}),
+	}
+	config.AuthInfos["prod"] = &clientcmdapi.AuthInfo{Token: token}
+	config.Contexts["prod"] = &clientcmdapi.Context{Cluster: "prod", AuthInfo: "prod"}
+	config.CurrentContext = "prod"
+	kubeconfig, err := clientcmd.Write(*config)
+	g.Expect(err).NotTo(HaveOccurred())
+	return kubeconfig
+}
+
+// newTestProxy returns a Proxy for the cluster default/prod of the upstream.
+// The TokenReviews authenticate the token "alice-token" as alice, and the
+// SubjectAccessReviews allow alice to get clusters/proxy. The reviews are
+// recorded in the returned clientset.
+func newTestProxy(g *WithT, u *upstream) (*Proxy, *kubefake.Clientset) {
+	scheme := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	g.Expect(clusterv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(externalv1.AddToScheme(scheme)).To(Succeed())
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&clusterv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "prod"},
+			Spec: clusterv1.ClusterSpec{
+				InfrastructureRef: &corev1.ObjectReference{Kind: "ExternalCluster", Name: "prod-infra"},
+			},
+		},
+		&externalv1.ExternalCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "prod-infra"}},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "prod-kubeconfig"},
+			Data:       map[string][]byte{"value": u.kubeconfig(g, "controller-token")},
+		},
+	).Build()
+
+	clientset := kubefake.NewSimpleClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "alice-token" {
+			review.Status = authenticationv1.TokenReviewStatus{
+				Authenticated: true,
+				User: authenticationv1.UserInfo{
+					Username: "alice",
+					UID:      "uid-alice",
+					Groups:   []string{"developers", "system:authenticated"},
+					Extra:    map[string]authenticationv1.ExtraValue{"scopes": {"read"}},
+				},
+			}
+		} else {
+			review.Status = authenticationv1.TokenReviewStatus{Error: "invalid bearer token"}
+		}
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		review.Status.Allowed = review.Spec.User == "alice" && review.Spec.ResourceAttributes.Verb == "get"
+		return true, review, nil
+	})
+	return &Proxy{Client: c, Clientset: clientset, Transports: remote.NewTransports(), Log: logr.Discard()}, clientset
+}
+
+func TestProxy(t *testing.T) {
+	u := newUpstream()
+	defer u.Close()
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+
+		wantStatus int
+		wantBody   string
+
+		// wantForwarded is true if the request should reach the upstream.
+		wantForwarded bool
+	}{
+		{
+			name:       "no token",
+			path:       "/clusters/default/prod/api/v1/namespaces",
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "Unauthorized\n",
+		},
+		{
+			name:       "token rejected",
+			path:       "/clusters/default/prod/api/v1/namespaces",
+			headers:    map[string]string{"Authorization": "Bearer mallory-token"},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "Unauthorized\n",
+		},
+		{
+			// The reason of the denial is logged, not returned.
+			name:       "access denied",
+			method:     http.MethodDelete,
+			path:       "/clusters/default/prod/api/v1/namespaces/kube-system",
+			headers:    map[string]string{"Authorization": "Bearer alice-token"},
+			wantStatus: http.StatusForbidden,
+			wantBody:   "Forbidden\n",
+		},
+		{
+			name:       "unknown cluster",
+			path:       "/clusters/default/staging/api/v1/namespaces",
+			headers:    map[string]string{"Authorization": "Bearer alice-token"},
+			wantStatus: http.StatusNotFound,
+			wantBody:   "cluster not found\n",
+		},
+		{
+			name:       "invalid path",
+			path:       "/clusters/default",
+			headers:    map[string]string{"Authorization": "Bearer alice-token"},
+			wantStatus: http.StatusNotFound,
+			wantBody:   "expected a path of the form /clusters/<namespace>/<name>/...\n",
+		},
+		{
+			name: "forwarded",
+			path: "/clusters/default/prod/api/v1/namespaces",
+			headers: map[string]string{
+				"Authorization":          "Bearer alice-token",
+				"Impersonate-User":       "admin",
+				"Impersonate-Group":      "system:masters",
+				"Impersonate-Extra-Team": "platform",
+			},
+			wantStatus:    http.StatusOK,
+			wantBody:      `{"kind":"NamespaceList"}`,
+			wantForwarded: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			p, _ := newTestProxy(g, u)
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tt.path, nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			forwarded := u.count()
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+			g.Expect(rec.Code).To(Equal(tt.wantStatus))
+			g.Expect(rec.Body.String()).To(Equal(tt.wantBody))
+			if tt.wantForwarded {
+				g.Expect(u.count()).To(Equal(forwarded + 1))
+			} else {
+				g.Expect(u.count()).To(Equal(forwarded))
+			}
+		})
+	}
+}
+
+func TestProxyImpersonation(t *testing.T) {
+	g := NewWithT(t)
+	u := newUpstream()
+	defer u.Close()
+	p, clientset := newTestProxy(g, u)
+
+	req := httptest.NewRequest(http.MethodGet, "/clusters/default/prod/api/v1/namespaces?limit=10", nil)
+	req.Header.Set("Authorization", "Bearer alice-token")
+	req.Header.Set("Impersonate-User", "admin")
+	req.Header.Set("Impersonate-Group", "system:masters")
+	req.Header.Set("Impersonate-Extra-Team", "platform")
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	g.Expect(rec.Code).To(Equal(http.StatusOK))
+
+	// The caller is authorized for the proxy subresource of the Cluster.
+	var sar *authorizationv1.SubjectAccessReview
+	for _, action := range clientset.Actions() {
+		if action.GetResource().Resource == "subjectaccessreviews" {
+			sar = action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		}
+	}
+	g.Expect(sar).NotTo(BeNil())
+	g.Expect(*sar.Spec.ResourceAttributes).To(Equal(authorizationv1.ResourceAttributes{
+		Namespace:   "default",
+		Name:        "prod",
+		Verb:        "get",
+		Group:       clusterv1.GroupVersion.Group,
+		Resource:    "clusters",
+		Subresource: "proxy",
+	}))
+
+	// The upstream sees the credentials of the kubeconfig impersonating the
+	// caller, and none of the headers of the caller that grant access.
+	upstreamReq := u.lastRequest()
+	g.Expect(upstreamReq).NotTo(BeNil())
+	g.Expect(upstreamReq.URL.Path).To(Equal("/api/v1/namespaces"))
+	g.Expect(upstreamReq.URL.RawQuery).To(Equal("limit=10"))
+	g.Expect(upstreamReq.Header.Get("Accept")).To(Equal("application/json"))
+	g.Expect(upstreamReq.Header.Values("Authorization")).To(Equal([]string{"Bearer controller-token"}))
+	g.Expect(upstreamReq.Header.Values("Impersonate-User")).To(Equal([]string{"alice"}))
+	g.Expect(upstreamReq.Header.Values("Impersonate-Uid")).To(Equal([]string{"uid-alice"}))
+	g.Expect(upstreamReq.Header.Values("Impersonate-Group")).To(ConsistOf("developers", "system:authenticated"))
+	g.Expect(upstreamReq.Header.Values("Impersonate-Extra-Scopes")).To(Equal([]string{"read"}))
+	g.Expect(upstreamReq.Header.Values("Impersonate-Extra-Team")).To(BeEmpty())
+
+	// Changes of the kubeconfig take effect on the next request.
+	secret := &corev1.Secret{}
+	g.Expect(p.Client.Get(req.Context(), client.ObjectKey{Namespace: "default", Name: "prod-kubeconfig"}, secret)).To(Succeed())
+	secret.Data["value"] = u.kubeconfig(g, "rotated-token")
+	g.Expect(p.Client.(client.Client).Update(req.Context(), secret)).To(Succeed())
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	g.Expect(rec.Code).To(Equal(http.StatusOK))
+	g.Expect(u.lastRequest().Header.Values("Authorization")).To(Equal([]string{"Bearer rotated-token"}))
+}
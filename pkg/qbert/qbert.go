@@ -0,0 +1,307 @@
+// Package qbert is a minimal client for Keystone and Qbert, the cluster
+// management service of Platform9 Managed Kubernetes (PMK).
+package qbert
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoKubeconfig is returned by GetKubeconfig if Qbert has no kubeconfig for
+// the cluster, for example because it is still being created.
+var ErrNoKubeconfig = errors.New("qbert has no kubeconfig for the cluster")
+
+// tokenPlaceholder is the placeholder for the credentials in the kubeconfigs
+// generated by Qbert.
+const tokenPlaceholder = "__INSERT_BEARER_TOKEN_HERE__"
+
+var errNotFound = errors.New("not found")
+
+// Config configures the connection to a PMK deployment unit (DU).
+type Config struct {
+	// FQDN is the URL of the DU, e.g. https://example.platform9.net.
+	FQDN string
+
+	// Region selects the Qbert endpoint from the Keystone service catalog. If
+	// empty, the Qbert endpoint of the DU itself is used.
+	Region string
+
+	// Project is the name of the Keystone project (tenant) to scope to.
+	Project string
+
+	// Username and Password authenticate with Keystone. Token can be used
+	// instead.
+	Username string
+	Password string
+	Token    string
+
+	// HTTPClient is used for all requests. Defaults to a client with a
+	// timeout.
+	HTTPClient *http.Client
+}
+
+// Cluster is a PMK cluster as returned by Qbert.
+type Cluster struct {
+	Name            string `json:"name"`
+	UUID            string `json:"uuid"`
+	ProjectID       string `json:"projectId"`
+	ExternalDNSName string `json:"externalDnsName"`
+	MasterIP        string `json:"masterIp"`
+	APIPort         string `json:"k8sApiPort"`
+	Status          string `json:"status"`
+}
+
+// Client lists the clusters of a project and fetches their kubeconfigs.
+type Client interface {
+	ListClusters(ctx context.Context) ([]Cluster, error)
+	GetKubeconfig(ctx context.Context, cluster Cluster) ([]byte, error)
+
+	// KubeconfigTokenExpiry returns when the bearer token in the kubeconfigs
+	// of GetKubeconfig expires, or the zero time if it does not expire.
+	KubeconfigTokenExpiry() time.Time
+}
+
+// NewClient authenticates with Keystone and returns a Client for the Qbert
+// endpoint of the DU.
+func NewClient(ctx context.Context, config Config) (Client, error) {
+	if config.FQDN == "" {
+		return nil, errors.New("the FQDN of the DU is required")
+	}
+	if config.Token == "" && (config.Username == "" || config.Password == "") {
+		return nil, errors.New("either a token or a username and password are required")
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	c := &client{config: config, fqdn: strings.TrimSuffix(config.FQDN, "/")}
+	if err := c.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type client struct {
+	config         Config
+	fqdn           string
+	token          string
+	tokenExpiresAt time.Time
+	projectID      string
+	qbertURL       string
+}
+
+type authRequest struct {
+	Auth struct {
+		Identity identity `json:"identity"`
+		Scope    struct {
+			Project project `json:"project"`
+		} `json:"scope"`
+	} `json:"auth"`
+}
+
+type identity struct {
+	Methods  []string          `json:"methods"`
+	Password *passwordIdentity `json:"password,omitempty"`
+	Token    *tokenIdentity    `json:"token,omitempty"`
+}
+
+type passwordIdentity struct {
+	User user `json:"user"`
+}
+
+type user struct {
+	Name     string `json:"name"`
+	Domain   domain `json:"domain"`
+	Password string `json:"password"`
+}
+
+type tokenIdentity struct {
+	ID string `json:"id"`
+}
+
+type project struct {
+	Name   string `json:"name"`
+	Domain domain `json:"domain"`
+}
+
+type domain struct {
+	ID string `json:"id"`
+}
+
+type authResponse struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+		Project   struct {
+			ID string `json:"id"`
+		} `json:"project"`
+		Catalog []struct {
+			Type      string `json:"type"`
+			Endpoints []struct {
+				Interface string `json:"interface"`
+				Region    string `json:"region"`
+				URL       string `json:"url"`
+			} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+// authenticate requests a project-scoped token from Keystone.
+func (c *client) authenticate(ctx context.Context) error {
+	req := authRequest{}
+	if c.config.Token != "" {
+		req.Auth.Identity = identity{
+			Methods: []string{"token"},
+			Token:   &tokenIdentity{ID: c.config.Token},
+		}
+	} else {
+		req.Auth.Identity = identity{
+			Methods: []string{"password"},
+			Password: &passwordIdentity{User: user{
+				Name:     c.config.Username,
+				Domain:   domain{ID: "default"},
+				Password: c.config.Password,
+			}},
+		}
+	}
+	req.Auth.Scope.Project = project{Name: c.config.Project, Domain: domain{ID: "default"}}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.fqdn+"/keystone/v3/auth/tokens", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := c.config.HTTPClient.Do(httpReq)
+	if err != nil {
+		return errors.Wrap(err, "failed to authenticate with keystone")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to authenticate with keystone: %s", readError(resp))
+	}
+
+	var auth authResponse
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return errors.Wrap(err, "failed to decode keystone token")
+	}
+	c.token = resp.Header.Get("X-Subject-Token")
+	c.tokenExpiresAt = auth.Token.ExpiresAt
+	c.projectID = auth.Token.Project.ID
+	if c.token == "" || c.projectID == "" {
+		return errors.New("keystone did not return a project-scoped token")
+	}
+
+	c.qbertURL = c.fqdn + "/qbert/v3"
+	if c.config.Region != "" {
+		url, ok := "", false
+		for _, service := range auth.Token.Catalog {
+			if service.Type != "qbert" {
+				continue
+			}
+			for _, endpoint := range service.Endpoints {
+				if endpoint.Interface == "public" && endpoint.Region == c.config.Region {
+					url, ok = endpoint.URL, true
+				}
+			}
+		}
+		if !ok {
+			return errors.Errorf("no qbert endpoint found in region %q", c.config.Region)
+		}
+		// The catalog URLs contain the project, e.g. https://du/qbert/v3/<project>.
+		c.qbertURL = strings.TrimSuffix(strings.TrimSuffix(url, "/"), "/"+c.projectID)
+	}
+	return nil
+}
+
+func (c *client) ListClusters(ctx context.Context) ([]Cluster, error) {
+	resp, err := c.get(ctx, fmt.Sprintf("%s/%s/clusters", c.qbertURL, c.projectID))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list qbert clusters")
+	}
+	defer resp.Body.Close()
+	var clusters []Cluster
+	if err := json.NewDecoder(resp.Body).Decode(&clusters); err != nil {
+		return nil, errors.Wrap(err, "failed to decode qbert clusters")
+	}
+	return clusters, nil
+}
+
+// GetKubeconfig returns the kubeconfig of the cluster, with the credentials
+// filled in. Qbert kubeconfigs authenticate with a bearer token that is the
+// base64-encoded credentials of the user, or a Keystone token.
+func (c *client) GetKubeconfig(ctx context.Context, cluster Cluster) ([]byte, error) {
+	resp, err := c.get(ctx, fmt.Sprintf("%s/%s/kubeconfig/cluster/%s", c.qbertURL, c.projectID, cluster.UUID))
+	if errors.Is(err, errNotFound) {
+		return nil, errors.Wrapf(ErrNoKubeconfig, "cluster %s", cluster.Name)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get kubeconfig of cluster %s", cluster.Name)
+	}
+	defer resp.Body.Close()
+	kubeconfig, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read kubeconfig of cluster %s", cluster.Name)
+	}
+	if len(bytes.TrimSpace(kubeconfig)) == 0 {
+		return nil, errors.Wrapf(ErrNoKubeconfig, "cluster %s", cluster.Name)
+	}
+
+	bearerToken := c.token
+	if c.config.Token == "" {
+		credentials, err := json.Marshal(map[string]string{"username": c.config.Username, "password": c.config.Password})
+		if err != nil {
+			return nil, err
+		}
+		bearerToken = base64.StdEncoding.EncodeToString(credentials)
+	}
+	return bytes.ReplaceAll(kubeconfig, []byte(tokenPlaceholder), []byte(bearerToken)), nil
+}
+
+// KubeconfigTokenExpiry returns the expiry of the Keystone token with token
+// authentication. With password authentication, the kubeconfigs contain the
+// credentials of the user, which do not expire.
+func (c *client) KubeconfigTokenExpiry() time.Time {
+	if c.config.Token == "" {
+		return time.Time{}
+	}
+	return c.tokenExpiresAt
+}
+
+func (c *client) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Auth-Token", c.token)
+	resp, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errors.Wrap(errNotFound, readError(resp))
+		}
+		return nil, errors.New(readError(resp))
+	}
+	return resp, nil
+}
+
+func readError(resp *http.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if msg := strings.TrimSpace(string(body)); msg != "" {
+		return fmt.Sprintf("%s: %s", resp.Status, msg)
+	}
+	return resp.Status
+}
@@ -0,0 +1,179 @@
+package qbert_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/qbert"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/qbert/qberttest"
+)
+
+const kubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example.com
+users:
+- name: prod
+  user:
+    token: __INSERT_BEARER_TOKEN_HERE__
+contexts:
+- name: prod
+  context:
+    cluster: prod
+    user: prod
+current-context: prod
+`
+
+func newServer() *qberttest.Server {
+	server := qberttest.NewServer("admin@example.com", "secret", "service")
+	server.AddCluster(qbert.Cluster{Name: "prod", UUID: "uuid-prod", ExternalDNSName: "prod.example.com"}, []byte(kubeconfig))
+	server.AddCluster(qbert.Cluster{Name: "creating", UUID: "uuid-creating"}, []byte{})
+	server.AddCluster(qbert.Cluster{Name: "broken", UUID: "uuid-broken"}, nil)
+	return server
+}
+
+func TestNewClient(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		config  qbert.Config
+		wantErr string
+
+		// wantRegional is true if the clusters should be listed through
+		// the Qbert endpoint of the region in the service catalog.
+		wantRegional bool
+	}{
+		{
+			name:   "password",
+			config: qbert.Config{FQDN: server.URL, Project: "service", Username: "admin@example.com", Password: "secret"},
+		},
+		{
+			name:   "token",
+			config: qbert.Config{FQDN: server.URL + "/", Project: "service", Token: qberttest.Token},
+		},
+		{
+			name:         "region",
+			config:       qbert.Config{FQDN: server.URL, Region: qberttest.Region, Project: "service", Token: qberttest.Token},
+			wantRegional: true,
+		},
+		{
+			name:    "unknown region",
+			config:  qbert.Config{FQDN: server.URL, Region: "RegionTwo", Project: "service", Token: qberttest.Token},
+			wantErr: `no qbert endpoint found in region "RegionTwo"`,
+		},
+		{
+			name:    "wrong password",
+			config:  qbert.Config{FQDN: server.URL, Project: "service", Username: "admin@example.com", Password: "wrong"},
+			wantErr: "401 Unauthorized",
+		},
+		{
+			name:    "wrong token",
+			config:  qbert.Config{FQDN: server.URL, Project: "service", Token: "wrong"},
+			wantErr: "401 Unauthorized",
+		},
+		{
+			name:    "wrong project",
+			config:  qbert.Config{FQDN: server.URL, Project: "other", Token: qberttest.Token},
+			wantErr: "project not found",
+		},
+		{
+			name:    "no FQDN",
+			config:  qbert.Config{Project: "service", Token: qberttest.Token},
+			wantErr: "the FQDN of the DU is required",
+		},
+		{
+			name:    "no credentials",
+			config:  qbert.Config{FQDN: server.URL, Project: "service", Username: "admin@example.com"},
+			wantErr: "either a token or a username and password are required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			client, err := qbert.NewClient(context.Background(), tt.config)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			regionalRequests := server.RegionalRequests()
+			clusters, err := client.ListClusters(context.Background())
+			g.Expect(err).NotTo(HaveOccurred())
+			if tt.wantRegional {
+				g.Expect(server.RegionalRequests()).To(Equal(regionalRequests + 1))
+			} else {
+				g.Expect(server.RegionalRequests()).To(Equal(regionalRequests))
+			}
+			g.Expect(clusters).To(HaveLen(3))
+			g.Expect(clusters[2]).To(Equal(qbert.Cluster{Name: "prod", UUID: "uuid-prod", ProjectID: qberttest.ProjectID, ExternalDNSName: "prod.example.com"}))
+		})
+	}
+}
+
+func TestGetKubeconfig(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+
+	credentials, err := json.Marshal(map[string]string{"username": "admin@example.com", "password": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		config qbert.Config
+
+		// wantToken is the bearer token in the kubeconfig, or empty for the
+		// Keystone token that the client was issued.
+		wantToken string
+	}{
+		{
+			// Qbert accepts the base64-encoded credentials of the user, which
+			// do not expire like a Keystone token.
+			name:      "password",
+			config:    qbert.Config{FQDN: server.URL, Project: "service", Username: "admin@example.com", Password: "secret"},
+			wantToken: base64.StdEncoding.EncodeToString(credentials),
+		},
+		{
+			name:   "token",
+			config: qbert.Config{FQDN: server.URL, Project: "service", Token: qberttest.Token},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.Background()
+			client, err := qbert.NewClient(ctx, tt.config)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			got, err := client.GetKubeconfig(ctx, qbert.Cluster{Name: "prod", UUID: "uuid-prod"})
+			g.Expect(err).NotTo(HaveOccurred())
+			if tt.wantToken == "" {
+				g.Expect(string(got)).To(ContainSubstring("token: " + server.LastToken() + "\n"))
+				g.Expect(client.KubeconfigTokenExpiry()).To(BeTemporally("~", time.Now().Add(qberttest.DefaultTokenTTL), time.Minute))
+			} else {
+				g.Expect(string(got)).To(ContainSubstring("token: " + tt.wantToken + "\n"))
+				g.Expect(client.KubeconfigTokenExpiry().IsZero()).To(BeTrue())
+			}
+			g.Expect(string(got)).NotTo(ContainSubstring("__INSERT_BEARER_TOKEN_HERE__"))
+
+			// Clusters that are being created or were deleted have no
+			// kubeconfig, other failures are returned as is.
+			_, err = client.GetKubeconfig(ctx, qbert.Cluster{Name: "creating", UUID: "uuid-creating"})
+			g.Expect(errors.Is(err, qbert.ErrNoKubeconfig)).To(BeTrue())
+			_, err = client.GetKubeconfig(ctx, qbert.Cluster{Name: "deleted", UUID: "uuid-deleted"})
+			g.Expect(errors.Is(err, qbert.ErrNoKubeconfig)).To(BeTrue())
+			_, err = client.GetKubeconfig(ctx, qbert.Cluster{Name: "broken", UUID: "uuid-broken"})
+			g.Expect(err).To(MatchError(ContainSubstring("500 Internal Server Error")))
+			g.Expect(errors.Is(err, qbert.ErrNoKubeconfig)).To(BeFalse())
+		})
+	}
+}
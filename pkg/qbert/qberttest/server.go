@@ -0,0 +1,234 @@
+// Package qberttest provides an in-memory Keystone and Qbert server for
+// testing the qbert client and the QbertSource controller without a PMK
+// deployment unit.
+package qberttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/qbert"
+)
+
+const (
+	// Token is the Keystone token that the fake server accepts for token
+	// authentication. Every authentication issues a new project-scoped
+	// token, like Keystone does.
+	Token = "fake-token"
+
+	// DefaultTokenTTL is the lifetime of the issued tokens, which is also the
+	// default of Keystone.
+	DefaultTokenTTL = 24 * time.Hour
+
+	// ProjectID is the ID of the only project of the fake server.
+	ProjectID = "fake-project-id"
+
+	// Region is the only region in the service catalog of the fake server.
+	// Its Qbert endpoint is served under /<region>/qbert, so that requests
+	// to it can be told apart from requests to the Qbert of the DU itself.
+	Region = "RegionOne"
+)
+
+var regionPrefix = "/" + strings.ToLower(Region)
+
+// Server is a fake Keystone and Qbert. Point qbert.Config.FQDN to URL.
+type Server struct {
+	*httptest.Server
+
+	// Username, Password and Project are the accepted credentials.
+	Username string
+	Password string
+	Project  string
+
+	// TokenTTL is the lifetime of the issued tokens.
+	TokenTTL time.Duration
+
+	mu               sync.Mutex
+	clusters         map[string]qbert.Cluster
+	kubeconfigs      map[string][]byte
+	issuedTokens     []string
+	regionalRequests int
+}
+
+// NewServer starts a fake server that accepts the provided credentials.
+// Close it when done.
+func NewServer(username, password, project string) *Server {
+	s := &Server{
+		Username:    username,
+		Password:    password,
+		Project:     project,
+		TokenTTL:    DefaultTokenTTL,
+		clusters:    map[string]qbert.Cluster{},
+		kubeconfigs: map[string][]byte{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keystone/v3/auth/tokens", s.handleAuth)
+	mux.HandleFunc("/qbert/v3/", s.handleQbert)
+	mux.Handle(regionPrefix+"/qbert/v3/", http.StripPrefix(regionPrefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.regionalRequests++
+		s.mu.Unlock()
+		s.handleQbert(w, r)
+	})))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// AddCluster adds or replaces a cluster. Its kubeconfig should contain the
+// __INSERT_BEARER_TOKEN_HERE__ placeholder like the kubeconfigs of Qbert. A
+// nil kubeconfig makes the kubeconfig endpoint of the cluster fail, an empty
+// one makes it return no kubeconfig like Qbert does for clusters that are
+// still being created.
+func (s *Server) AddCluster(cluster qbert.Cluster, kubeconfig []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cluster.ProjectID = ProjectID
+	s.clusters[cluster.UUID] = cluster
+	s.kubeconfigs[cluster.UUID] = kubeconfig
+}
+
+// RegionalRequests returns the number of requests to the Qbert endpoint of
+// Region.
+func (s *Server) RegionalRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.regionalRequests
+}
+
+// LastToken returns the last issued token, or an empty string if no token
+// was issued yet.
+func (s *Server) LastToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.issuedTokens) == 0 {
+		return ""
+	}
+	return s.issuedTokens[len(s.issuedTokens)-1]
+}
+
+// validToken reports whether the token was issued by the server. It must be
+// called with mu held.
+func (s *Server) validToken(token string) bool {
+	for _, issued := range s.issuedTokens {
+		if token == issued {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteCluster removes a cluster.
+func (s *Server) DeleteCluster(uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clusters, uuid)
+	delete(s.kubeconfigs, uuid)
+}
+
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Auth struct {
+			Identity struct {
+				Password struct {
+					User struct {
+						Name     string `json:"name"`
+						Password string `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+				Token struct {
+					ID string `json:"id"`
+				} `json:"token"`
+			} `json:"identity"`
+			Scope struct {
+				Project struct {
+					Name string `json:"name"`
+				} `json:"project"`
+			} `json:"scope"`
+		} `json:"auth"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	identity := req.Auth.Identity
+	validPassword := identity.Password.User.Name == s.Username && identity.Password.User.Password == s.Password
+	if !validPassword && identity.Token.ID != Token {
+		http.Error(w, "The request you have made requires authentication.", http.StatusUnauthorized)
+		return
+	}
+	if req.Auth.Scope.Project.Name != s.Project {
+		http.Error(w, "project not found", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	token := fmt.Sprintf("%s-%d", Token, len(s.issuedTokens)+1)
+	s.issuedTokens = append(s.issuedTokens, token)
+	s.mu.Unlock()
+	w.Header().Set("X-Subject-Token", token)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"token": map[string]interface{}{
+			"expires_at": time.Now().Add(s.TokenTTL).UTC().Format(time.RFC3339Nano),
+			"project":    map[string]string{"id": ProjectID, "name": s.Project},
+			"catalog": []interface{}{
+				map[string]interface{}{
+					"type": "qbert",
+					"endpoints": []interface{}{
+						map[string]string{"interface": "public", "region": Region, "url": s.URL + regionPrefix + "/qbert/v3/" + ProjectID},
+					},
+				},
+			},
+		},
+	})
+}
+
+func (s *Server) handleQbert(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.validToken(r.Header.Get("X-Auth-Token")) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// /qbert/v3/<project>/clusters or /qbert/v3/<project>/kubeconfig/cluster/<uuid>
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/qbert/v3/"), "/")
+	if len(parts) < 2 || parts[0] != ProjectID {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "clusters":
+		clusters := []qbert.Cluster{}
+		for _, cluster := range s.clusters {
+			clusters = append(clusters, cluster)
+		}
+		sort.Slice(clusters, func(i, j int) bool { return clusters[i].Name < clusters[j].Name })
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(clusters)
+	case len(parts) == 4 && parts[1] == "kubeconfig" && parts[2] == "cluster":
+		kubeconfig, ok := s.kubeconfigs[parts[3]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if kubeconfig == nil {
+			http.Error(w, "failed to generate kubeconfig", http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(kubeconfig)
+	default:
+		http.NotFound(w, r)
+	}
+}
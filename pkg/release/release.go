@@ -0,0 +1,107 @@
+// Package release generates the artifacts of a provider release in the
+// layout that clusterctl expects from a provider repository.
+package release
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	ComponentsFile      = "infrastructure-components.yaml"
+	MetadataFile        = "metadata.yaml"
+	ClusterTemplateFile = "cluster-template.yaml"
+
+	// ComponentsKustomization is the kustomization, relative to the root of
+	// the repository, that the components are built from.
+	ComponentsKustomization = "config/clusterctl"
+
+	// ManagerDeployment is the name of the controller Deployment in the
+	// components.
+	ManagerDeployment = "cape-controller-manager"
+	managerContainer  = "manager"
+)
+
+type Options struct {
+	// RepoDir is the root of the repository.
+	RepoDir string
+
+	// OutputDir is the directory the artifacts are written to. It is
+	// created if it does not exist.
+	OutputDir string
+
+	// Image is the controller image of the release. If empty, the image in
+	// config/default is kept.
+	Image string
+}
+
+// Generate writes the components, metadata and cluster template of a
+// release to the output directory. The components and the template keep the
+// ${VAR} references, which clusterctl substitutes on `clusterctl init` and
+// `clusterctl generate cluster`.
+func Generate(opts Options) error {
+	if err := os.MkdirAll(opts.OutputDir, 0o755); err != nil {
+		return errors.Wrap(err, "failed to create the output directory")
+	}
+
+	components, err := RenderComponents(opts.RepoDir, opts.Image)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(opts.OutputDir, ComponentsFile), components, 0o644); err != nil {
+		return errors.Wrapf(err, "failed to write %s", ComponentsFile)
+	}
+
+	for _, file := range []string{MetadataFile, filepath.Join("templates", ClusterTemplateFile)} {
+		data, err := os.ReadFile(filepath.Join(opts.RepoDir, file))
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", file)
+		}
+		if err := os.WriteFile(filepath.Join(opts.OutputDir, filepath.Base(file)), data, 0o644); err != nil {
+			return errors.Wrapf(err, "failed to write %s", filepath.Base(file))
+		}
+	}
+	return nil
+}
+
+// RenderComponents builds the components kustomization and returns it as a
+// multi-document YAML, with the image of the controller set to image if it
+// is not empty.
+func RenderComponents(repoDir string, image string) ([]byte, error) {
+	k := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	resources, err := k.Run(filesys.MakeFsOnDisk(), filepath.Join(repoDir, ComponentsKustomization))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build the components")
+	}
+
+	if image != "" {
+		found := false
+		for _, res := range resources.Resources() {
+			if res.GetKind() != "Deployment" || res.GetName() != ManagerDeployment {
+				continue
+			}
+			err := res.PipeE(
+				kyaml.Lookup("spec", "template", "spec", "containers", "[name="+managerContainer+"]"),
+				kyaml.SetField("image", kyaml.NewScalarRNode(image)),
+			)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to set the controller image")
+			}
+			found = true
+		}
+		if !found {
+			return nil, errors.Errorf("deployment %s not found in the components", ManagerDeployment)
+		}
+	}
+
+	out, err := resources.AsYaml()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode the components")
+	}
+	return out, nil
+}
@@ -0,0 +1,164 @@
+package release
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/version"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	clusterctlv1 "sigs.k8s.io/cluster-api/cmd/clusterctl/api/v1alpha3"
+	"sigs.k8s.io/cluster-api/cmd/clusterctl/client/config"
+	"sigs.k8s.io/cluster-api/cmd/clusterctl/client/repository"
+	"sigs.k8s.io/cluster-api/cmd/clusterctl/client/yamlprocessor"
+	"sigs.k8s.io/yaml"
+)
+
+const testImage = "example.com/cape:v0.3.0"
+
+// TestGenerate checks that clusterctl accepts the generated artifacts, the
+// same way `clusterctl init` and `clusterctl generate cluster` read them from
+// a provider repository.
+func TestGenerate(t *testing.T) {
+	g := NewWithT(t)
+	dir := t.TempDir()
+	g.Expect(Generate(Options{RepoDir: "../..", OutputDir: dir, Image: testImage})).To(Succeed())
+
+	t.Run("components", func(t *testing.T) {
+		g := NewWithT(t)
+		rawYaml, err := os.ReadFile(filepath.Join(dir, ComponentsFile))
+		g.Expect(err).NotTo(HaveOccurred())
+
+		components, err := repository.NewComponents(repository.ComponentsInput{
+			Provider:     config.NewProvider("external", "", clusterctlv1.InfrastructureProviderType),
+			ConfigClient: newConfigClient(g, map[string]string{"CAPE_INVENTORY_INTERVAL": "30m"}),
+			Processor:    yamlprocessor.NewSimpleProcessor(),
+			RawYaml:      rawYaml,
+			Options:      repository.ComponentsOptions{Version: "v0.3.0"},
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(components.TargetNamespace()).To(Equal("cape-system"))
+		g.Expect(components.Images()).To(ConsistOf(testImage))
+		g.Expect(components.Variables()).To(ContainElements("CAPE_INVENTORY_INTERVAL", "CAPE_LOG_LEVEL", "CAPE_SYNC_PERIOD"))
+
+		var deployment *appsv1.Deployment
+		crds := 0
+		for _, obj := range components.Objs() {
+			g.Expect(obj.GetLabels()).To(HaveKeyWithValue(clusterctlv1.ClusterctlLabelName, ""), "%s %s", obj.GetKind(), obj.GetName())
+			switch obj.GetKind() {
+			case "CustomResourceDefinition":
+				crds++
+			case "Deployment":
+				deployment = &appsv1.Deployment{}
+				g.Expect(runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, deployment)).To(Succeed())
+			}
+		}
+		g.Expect(crds).To(Equal(8))
+		g.Expect(deployment).NotTo(BeNil())
+		g.Expect(deployment.Name).To(Equal(ManagerDeployment))
+		g.Expect(deployment.Spec.Template.Spec.Containers[0].Args).To(ContainElements(
+			"--inventory-interval=30m",
+			"--zap-log-level=info",
+			"--sync-period=10m",
+		))
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		g := NewWithT(t)
+		data, err := os.ReadFile(filepath.Join(dir, MetadataFile))
+		g.Expect(err).NotTo(HaveOccurred())
+		metadata := &clusterctlv1.Metadata{}
+		g.Expect(yaml.UnmarshalStrict(data, metadata)).To(Succeed())
+
+		releaseSeries := metadata.GetReleaseSeriesForVersion(version.MustParseSemantic("v0.3.0"))
+		g.Expect(releaseSeries).NotTo(BeNil())
+		g.Expect(releaseSeries.Contract).To(Equal(clusterv1.GroupVersion.Version))
+	})
+
+	t.Run("cluster template", func(t *testing.T) {
+		g := NewWithT(t)
+		rawArtifact, err := os.ReadFile(filepath.Join(dir, ClusterTemplateFile))
+		g.Expect(err).NotTo(HaveOccurred())
+		kubeconfig := []byte("apiVersion: v1\nkind: Config\n")
+		variables := map[string]string{
+			"CLUSTER_NAME":                       "workload",
+			"CONTROL_PLANE_ENDPOINT_HOST":        "10.0.0.10",
+			"EXTERNAL_CLUSTER_KUBECONFIG_BASE64": base64.StdEncoding.EncodeToString(kubeconfig),
+		}
+
+		template, err := repository.NewTemplate(repository.TemplateInput{
+			RawArtifact:           rawArtifact,
+			ConfigVariablesClient: newConfigClient(g, variables).Variables(),
+			Processor:             yamlprocessor.NewSimpleProcessor(),
+			TargetNamespace:       "imported",
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(template.VariableMap()).To(HaveKey("CONTROL_PLANE_ENDPOINT_PORT"))
+		g.Expect(*template.VariableMap()["CONTROL_PLANE_ENDPOINT_PORT"]).To(Equal("6443"))
+
+		kinds := []string{}
+		for _, obj := range template.Objs() {
+			kinds = append(kinds, obj.GetKind())
+			g.Expect(obj.GetNamespace()).To(Equal("imported"))
+			switch obj.GetKind() {
+			case "ExternalCluster":
+				externalCluster := &externalinfrav1.ExternalCluster{}
+				g.Expect(runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, externalCluster)).To(Succeed())
+				g.Expect(externalCluster.Spec.ControlPlaneEndpoint).To(Equal(clusterv1.APIEndpoint{Host: "10.0.0.10", Port: 6443}))
+			case "Secret":
+				g.Expect(obj.GetName()).To(Equal("workload-kubeconfig"))
+				g.Expect(obj.GetLabels()).To(HaveKeyWithValue(clusterv1.ClusterLabelName, "workload"))
+				value, _, _ := unstructured.NestedString(obj.Object, "data", "value")
+				g.Expect(base64.StdEncoding.DecodeString(value)).To(Equal(kubeconfig))
+			}
+		}
+		g.Expect(kinds).To(ConsistOf("Cluster", "ExternalCluster", "ExternalControlPlane", "Secret"))
+
+		delete(variables, "CLUSTER_NAME")
+		_, err = repository.NewTemplate(repository.TemplateInput{
+			RawArtifact:           rawArtifact,
+			ConfigVariablesClient: newConfigClient(g, variables).Variables(),
+			Processor:             yamlprocessor.NewSimpleProcessor(),
+			TargetNamespace:       "imported",
+		})
+		g.Expect(err).To(MatchError(ContainSubstring("CLUSTER_NAME")))
+	})
+}
+
+func newConfigClient(g *WithT, variables map[string]string) config.Client {
+	configClient, err := config.New("", config.InjectReader(&mapReader{variables: variables}))
+	g.Expect(err).NotTo(HaveOccurred())
+	return configClient
+}
+
+// mapReader is a clusterctl config reader that only knows the given
+// variables, so that the tests do not depend on the environment or
+// ~/.cluster-api/clusterctl.yaml.
+type mapReader struct {
+	variables map[string]string
+}
+
+func (r *mapReader) Init(string) error {
+	return nil
+}
+
+func (r *mapReader) Get(key string) (string, error) {
+	if value, ok := r.variables[key]; ok {
+		return value, nil
+	}
+	return "", os.ErrNotExist
+}
+
+func (r *mapReader) Set(key string, value string) {
+	r.variables[key] = value
+}
+
+func (r *mapReader) UnmarshalKey(string, interface{}) error {
+	return nil
+}
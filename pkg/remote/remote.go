@@ -0,0 +1,114 @@
+// Package remote builds the rest.Configs that CAPE uses to access the external
+// clusters.
+package remote
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/audit"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/egress"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/metrics"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tracing"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tunnel"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/cluster-api/util/kubeconfig"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ErrTunnelDisabled is returned for clusters that are accessed through a
+// tunnel if the tunnel server is disabled.
+var ErrTunnelDisabled = errors.New("the cluster is accessed through a tunnel, but the tunnel server is disabled")
+
+// Options configures the rest.Config of an external cluster.
+type Options struct {
+	// Tunnel is the tunnel server of `cape agent`. Clusters with a tunnel
+	// cannot be accessed if it is nil.
+	Tunnel *tunnel.Server
+
+	// Audit records the mutating requests to the cluster. Auditing is
+	// disabled if it is nil.
+	Audit audit.Sink
+
+	// Actor is the actor of the audited requests. It defaults to
+	// audit.ActorController.
+	Actor string
+
+	// Tracer creates a span for each request. It defaults to the tracer of
+	// the global TracerProvider.
+	Tracer trace.Tracer
+
+	// Transports caches the transport of clusters with a tunnel or an egress
+	// proxy across calls. A new transport is built every time if it is nil.
+	Transports *Transports
+}
+
+// Config returns the rest.Config of the external cluster, built from the
+// kubeconfig Secret of the Cluster and configured with Configure.
+func Config(ctx context.Context, c client.Reader, cluster types.NamespacedName, externalCluster *externalv1.ExternalCluster, opts Options) (*rest.Config, error) {
+	rawKubeconfig, err := kubeconfig.FromSecret(ctx, c, cluster)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the kubeconfig")
+	}
+	config, err := clientcmd.RESTConfigFromKubeConfig(rawKubeconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid kubeconfig")
+	}
+	if err := Configure(ctx, c, cluster, externalCluster, config, opts); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Configure routes the rest.Config of the external cluster through its tunnel
+// and its egress proxy, if it has them, and instruments it with the metrics,
+// spans and audit events of the requests.
+func Configure(ctx context.Context, c client.Reader, cluster types.NamespacedName, externalCluster *externalv1.ExternalCluster, config *rest.Config, opts Options) error {
+	var dialHash string
+	if externalCluster.Spec.Tunnel {
+		if opts.Tunnel == nil {
+			return ErrTunnelDisabled
+		}
+		config.Dial = opts.Tunnel.Dialer(cluster)
+		dialHash = "tunnel"
+	}
+	egressProxy, err := egress.ForCluster(ctx, c, externalCluster)
+	if err != nil {
+		return err
+	}
+	if egressProxy != nil {
+		if err := egressProxy.ConfigureRESTConfig(config); err != nil {
+			return err
+		}
+		dialHash += "/" + egressProxy.Hash()
+	}
+	if config.Dial != nil && opts.Transports != nil {
+		if err := opts.Transports.apply(cluster, dialHash, config); err != nil {
+			return err
+		}
+	}
+	Instrument(cluster, config, opts)
+	return nil
+}
+
+// Instrument wraps the transport of the rest.Config to record the metrics,
+// spans and audit events of the requests to the cluster.
+func Instrument(cluster types.NamespacedName, config *rest.Config, opts Options) {
+	metrics.InstrumentRESTConfig(cluster, config)
+	tracer := opts.Tracer
+	if tracer == nil {
+		tracer = tracing.Tracer()
+	}
+	tracing.InstrumentRESTConfig(config, tracer)
+	if opts.Audit != nil {
+		actor := opts.Actor
+		if actor == "" {
+			actor = audit.ActorController
+		}
+		audit.InstrumentRESTConfig(opts.Audit, cluster, actor, config)
+	}
+}
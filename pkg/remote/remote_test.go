@@ -0,0 +1,96 @@
+package remote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/audit"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tunnel"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (s *recordingSink) Write(event audit.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestConfigureTunnelDisabled(t *testing.T) {
+	g := NewWithT(t)
+	c := fake.NewClientBuilder().WithScheme(runtime.NewScheme()).Build()
+	externalCluster := &externalv1.ExternalCluster{Spec: externalv1.ExternalClusterSpec{Tunnel: true}}
+
+	err := Configure(context.Background(), c, types.NamespacedName{Namespace: "default", Name: "cluster"}, externalCluster, &rest.Config{}, Options{})
+	g.Expect(err).To(MatchError(ErrTunnelDisabled))
+}
+
+func TestConfigureAudit(t *testing.T) {
+	g := NewWithT(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"apiVersion":"v1","kind":"ServiceAccount","metadata":{"name":"cape","namespace":"kube-system"}}`))
+	}))
+	defer server.Close()
+
+	c := fake.NewClientBuilder().WithScheme(runtime.NewScheme()).Build()
+	cluster := types.NamespacedName{Namespace: "default", Name: "cluster"}
+	sink := &recordingSink{}
+	config := &rest.Config{Host: server.URL}
+	g.Expect(Configure(context.Background(), c, cluster, &externalv1.ExternalCluster{}, config, Options{Audit: sink, Actor: "alice"})).To(Succeed())
+
+	clientset, err := kubernetes.NewForConfig(config)
+	g.Expect(err).NotTo(HaveOccurred())
+	serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "cape", Namespace: "kube-system"}}
+	_, err = clientset.CoreV1().ServiceAccounts("kube-system").Create(context.Background(), serviceAccount, metav1.CreateOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(sink.events).To(HaveLen(1))
+	g.Expect(sink.events[0].Actor).To(Equal("alice"))
+	g.Expect(sink.events[0].Cluster).To(Equal(cluster.String()))
+	g.Expect(sink.events[0].Verb).To(Equal("create"))
+	g.Expect(sink.events[0].Resource).To(Equal("serviceaccounts"))
+}
+
+func TestConfigureTransports(t *testing.T) {
+	g := NewWithT(t)
+	c := fake.NewClientBuilder().WithScheme(runtime.NewScheme()).Build()
+	cluster := types.NamespacedName{Namespace: "default", Name: "cluster"}
+	externalCluster := &externalv1.ExternalCluster{Spec: externalv1.ExternalClusterSpec{Tunnel: true}}
+	opts := Options{Tunnel: tunnel.NewServer(nil, logr.Discard()), Transports: NewTransports()}
+
+	configure := func(insecure bool) *rest.Config {
+		config := &rest.Config{Host: "https://10.0.0.10:6443", BearerToken: "token", TLSClientConfig: rest.TLSClientConfig{Insecure: insecure}}
+		g.Expect(Configure(context.Background(), c, cluster, externalCluster, config, opts)).To(Succeed())
+		g.Expect(config.Dial).To(BeNil())
+		g.Expect(config.Transport).NotTo(BeNil())
+		_, err := rest.TransportFor(config)
+		g.Expect(err).NotTo(HaveOccurred())
+		return config
+	}
+	first := configure(true)
+	g.Expect(configure(true).Transport).To(BeIdenticalTo(first.Transport), "the transport is reused")
+	changed := configure(false)
+	g.Expect(changed.Transport).NotTo(BeIdenticalTo(first.Transport), "the transport is rebuilt when the TLS settings change")
+
+	opts.Transports.Forget(cluster)
+	g.Expect(configure(false).Transport).NotTo(BeIdenticalTo(changed.Transport))
+}
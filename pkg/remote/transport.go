@@ -0,0 +1,77 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/rest"
+)
+
+// Transports caches the transports of the clusters that are accessed through
+// a tunnel or an egress proxy. client-go does not cache the transports of
+// rest.Configs with a Dial, so without it every reconcile would open new
+// connections to these clusters and leave the idle ones behind.
+type Transports struct {
+	mu         sync.Mutex
+	transports map[types.NamespacedName]*cachedTransport
+}
+
+type cachedTransport struct {
+	hash      string
+	transport http.RoundTripper
+}
+
+// NewTransports returns an empty transport cache.
+func NewTransports() *Transports {
+	return &Transports{transports: map[types.NamespacedName]*cachedTransport{}}
+}
+
+// apply replaces the TLS settings and the Dial of the rest.Config with the
+// cached transport of the cluster. The transport is rebuilt, and the idle
+// connections of the previous one closed, when the TLS settings or the dial
+// route, identified by dialHash, change.
+func (t *Transports) apply(cluster types.NamespacedName, dialHash string, config *rest.Config) error {
+	tlsConfig, err := json.Marshal(config.TLSClientConfig)
+	if err != nil {
+		return errors.Wrap(err, "failed to hash the TLS configuration")
+	}
+	hash := fmt.Sprintf("%x/%s", sha256.Sum256(tlsConfig), dialHash)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cached, ok := t.transports[cluster]
+	if !ok || cached.hash != hash {
+		// The authentication and the instrumentation stay on the config, so
+		// that they are applied on top of the shared transport.
+		rt, err := rest.TransportFor(&rest.Config{TLSClientConfig: config.TLSClientConfig, Dial: config.Dial})
+		if err != nil {
+			return errors.Wrap(err, "failed to create the transport")
+		}
+		if ok {
+			utilnet.CloseIdleConnectionsFor(cached.transport)
+		}
+		cached = &cachedTransport{hash: hash, transport: rt}
+		t.transports[cluster] = cached
+	}
+	config.Transport = cached.transport
+	config.TLSClientConfig = rest.TLSClientConfig{}
+	config.Dial = nil
+	return nil
+}
+
+// Forget closes the idle connections of the transport of the cluster and
+// removes it from the cache.
+func (t *Transports) Forget(cluster types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cached, ok := t.transports[cluster]; ok {
+		utilnet.CloseIdleConnectionsFor(cached.transport)
+		delete(t.transports, cluster)
+	}
+}
@@ -22,6 +22,8 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/types"
 
 	clusterv1beta1 "sigs.k8s.io/cluster-api/api/v1beta1"
@@ -35,6 +37,7 @@ type ClusterScopeParams struct {
 	Logger          logr.Logger
 	Cluster         *clusterv1beta1.Cluster
 	ExternalCluster *externalv1.ExternalCluster
+	Tracer          trace.Tracer
 }
 
 // NewClusterScope creates a new ClusterScope from the supplied parameters.
@@ -50,6 +53,10 @@ func NewClusterScope(params ClusterScopeParams) (*ExternalClusterScope, error) {
 	// 	params.Logger = klogr.New()
 	// }
 
+	if params.Tracer == nil {
+		params.Tracer = tracing.Tracer()
+	}
+
 	helper, err := patch.NewHelper(params.ExternalCluster, params.Client)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to init patch helper")
@@ -61,6 +68,7 @@ func NewClusterScope(params ClusterScopeParams) (*ExternalClusterScope, error) {
 		Cluster:         params.Cluster,
 		ExternalCluster: params.ExternalCluster,
 		patchHelper:     helper,
+		Tracer:          params.Tracer,
 	}, nil
 }
 
@@ -72,6 +80,7 @@ type ExternalClusterScope struct {
 
 	Cluster         *clusterv1beta1.Cluster
 	ExternalCluster *externalv1.ExternalCluster
+	Tracer          trace.Tracer
 }
 
 // Close closes the current scope persisting the cluster configuration and status.
@@ -100,3 +109,8 @@ func (s *ExternalClusterScope) NamespacedName() types.NamespacedName {
 func (s *ExternalClusterScope) SetReady() {
 	s.ExternalCluster.Status.Ready = true
 }
+
+// StartSpan starts a child span of the span in ctx, annotated with the ExternalCluster.
+func (s *ExternalClusterScope) StartSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return s.Tracer.Start(ctx, name, trace.WithAttributes(tracing.ObjectAttributes("ExternalCluster", s.ExternalCluster.Namespace, s.ExternalCluster.Name)...))
+}
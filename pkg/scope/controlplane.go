@@ -22,6 +22,8 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
 
 	clusterv1beta1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/cluster-api/util/patch"
@@ -34,6 +36,7 @@ type ControlPlaneScopeParams struct {
 	Logger               logr.Logger
 	Cluster              *clusterv1beta1.Cluster
 	ExternalControlPlane *externalv1.ExternalControlPlane
+	Tracer               trace.Tracer
 }
 
 // NewControlPlaneScope creates a new ControlPlaneScope from the supplied parameters.
@@ -49,6 +52,10 @@ func NewControlPlaneScope(params ControlPlaneScopeParams) (*ControlPlaneScope, e
 	// 	params.Logger = klogr.New()
 	// }
 
+	if params.Tracer == nil {
+		params.Tracer = tracing.Tracer()
+	}
+
 	helper, err := patch.NewHelper(params.ExternalControlPlane, params.Client)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to init patch helper")
@@ -60,6 +67,7 @@ func NewControlPlaneScope(params ControlPlaneScopeParams) (*ControlPlaneScope, e
 		Cluster:              params.Cluster,
 		ExternalControlPlane: params.ExternalControlPlane,
 		patchHelper:          helper,
+		Tracer:               params.Tracer,
 	}, nil
 }
 
@@ -71,6 +79,7 @@ type ControlPlaneScope struct {
 
 	Cluster              *clusterv1beta1.Cluster
 	ExternalControlPlane *externalv1.ExternalControlPlane
+	Tracer               trace.Tracer
 }
 
 // Close closes the current scope persisting the cluster configuration and status.
@@ -92,3 +101,8 @@ func (s *ControlPlaneScope) Namespace() string {
 func (s *ControlPlaneScope) SetReady() {
 	s.ExternalControlPlane.Status.Ready = true
 }
+
+// StartSpan starts a child span of the span in ctx, annotated with the ExternalControlPlane.
+func (s *ControlPlaneScope) StartSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return s.Tracer.Start(ctx, name, trace.WithAttributes(tracing.ObjectAttributes("ExternalControlPlane", s.ExternalControlPlane.Namespace, s.ExternalControlPlane.Name)...))
+}
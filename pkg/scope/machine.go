@@ -22,6 +22,8 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/types"
 
 	clusterv1beta1 "sigs.k8s.io/cluster-api/api/v1beta1"
@@ -36,6 +38,7 @@ type MachineScopeParams struct {
 	Cluster         *clusterv1beta1.Cluster
 	Machine         *clusterv1beta1.Machine
 	ExternalMachine *externalv1.ExternalMachine
+	Tracer          trace.Tracer
 }
 
 // NewMachineScope creates a new MachineScope from the supplied parameters.
@@ -51,6 +54,10 @@ func NewMachineScope(params MachineScopeParams) (*ExternalMachineScope, error) {
 	// 	params.Logger = klogr.New()
 	// }
 
+	if params.Tracer == nil {
+		params.Tracer = tracing.Tracer()
+	}
+
 	helper, err := patch.NewHelper(params.ExternalMachine, params.Client)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to init patch helper")
@@ -62,6 +69,7 @@ func NewMachineScope(params MachineScopeParams) (*ExternalMachineScope, error) {
 		Machine:         params.Machine,
 		ExternalMachine: params.ExternalMachine,
 		patchHelper:     helper,
+		Tracer:          params.Tracer,
 	}, nil
 }
 
@@ -74,6 +82,7 @@ type ExternalMachineScope struct {
 	Cluster         *clusterv1beta1.Cluster
 	Machine         *clusterv1beta1.Machine
 	ExternalMachine *externalv1.ExternalMachine
+	Tracer          trace.Tracer
 }
 
 // Close closes the current scope persisting the cluster configuration and status.
@@ -102,3 +111,8 @@ func (s *ExternalMachineScope) NamespacedName() types.NamespacedName {
 func (s *ExternalMachineScope) SetReady() {
 	s.ExternalMachine.Status.Ready = true
 }
+
+// StartSpan starts a child span of the span in ctx, annotated with the ExternalMachine.
+func (s *ExternalMachineScope) StartSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return s.Tracer.Start(ctx, name, trace.WithAttributes(tracing.ObjectAttributes("ExternalMachine", s.ExternalMachine.Namespace, s.ExternalMachine.Name)...))
+}
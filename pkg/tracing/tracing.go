@@ -0,0 +1,136 @@
+// Package tracing configures OpenTelemetry tracing for the controllers and
+// the requests they make to the external clusters.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/rest"
+)
+
+// TracerName is the name of the tracer used for all spans created by CAPE.
+const TracerName = "github.com/platform9-incubator/cluster-api-provider-external"
+
+// Options configures the OTLP exporter.
+type Options struct {
+	// Endpoint is the host:port of the OTLP/HTTP collector. Tracing is
+	// disabled if it is empty.
+	Endpoint string
+
+	// Insecure disables TLS for the connection to the collector.
+	Insecure bool
+
+	// SampleRatio is the fraction of reconciles that is traced.
+	SampleRatio float64
+}
+
+// Setup installs a global TracerProvider that exports spans to the OTLP
+// collector configured in the options. The returned function flushes and
+// stops the exporter. If no endpoint is configured, the default no-op
+// TracerProvider is kept.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporterOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.Endpoint)}
+	if opts.Insecure {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	tracerProvider := NewTracerProvider(exporter, sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio)))
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tracerProvider.Shutdown, nil
+}
+
+// NewTracerProvider returns a TracerProvider that batches spans to the
+// exporter. Tests can use it with an in-memory exporter from
+// go.opentelemetry.io/otel/sdk/trace/tracetest.
+func NewTracerProvider(exporter sdktrace.SpanExporter, sampler sdktrace.Sampler) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String("cape"),
+		)),
+	)
+}
+
+// Tracer returns the tracer of the global TracerProvider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// InstrumentRESTConfig wraps the transport of the rest.Config to create a
+// child span for each request to the external cluster. The parent span is
+// taken from the context of the request.
+func InstrumentRESTConfig(config *rest.Config, tracer trace.Tracer) {
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &tracingRoundTripper{tracer: tracer, delegate: rt}
+	})
+}
+
+type tracingRoundTripper struct {
+	tracer   trace.Tracer
+	delegate http.RoundTripper
+}
+
+func (rt *tracingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := rt.tracer.Start(req.Context(), "remote "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.HTTPTargetKey.String(req.URL.Path),
+			semconv.NetPeerNameKey.String(req.URL.Host),
+		),
+	)
+	defer span.End()
+
+	resp, err := rt.delegate.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
+
+// EndSpan records err, if any, on the span and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// ObjectAttributes returns the attributes that identify a Kubernetes object in
+// a span.
+func ObjectAttributes(kind, namespace, name string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("k8s.kind", kind),
+		attribute.String("k8s.namespace", namespace),
+		attribute.String("k8s.name", name),
+	}
+}
@@ -0,0 +1,63 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/rest"
+)
+
+func TestInstrumentRESTConfig(t *testing.T) {
+	g := NewWithT(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/version" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tracerProvider := NewTracerProvider(exporter, sdktrace.AlwaysSample())
+	tracer := tracerProvider.Tracer(TracerName)
+	config := &rest.Config{Host: server.URL}
+	InstrumentRESTConfig(config, tracer)
+	rt, err := rest.TransportFor(config)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ctx, span := tracer.Start(context.Background(), "ExternalClusterReconciler.Reconcile")
+	for _, path := range []string{"/version", "/missing"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+path, nil)
+		g.Expect(err).NotTo(HaveOccurred())
+		resp, err := rt.RoundTrip(req)
+		g.Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+	}
+	EndSpan(span, nil)
+	g.Expect(tracerProvider.ForceFlush(context.Background())).To(Succeed())
+
+	spans := exporter.GetSpans()
+	g.Expect(spans).To(HaveLen(3))
+	reconcile := spans[2]
+	g.Expect(reconcile.Name).To(Equal("ExternalClusterReconciler.Reconcile"))
+	for i, path := range []string{"/version", "/missing"} {
+		child := spans[i]
+		g.Expect(child.Name).To(Equal("remote GET"))
+		g.Expect(child.SpanKind).To(Equal(trace.SpanKindClient))
+		g.Expect(child.Parent.SpanID()).To(Equal(reconcile.SpanContext.SpanID()))
+		g.Expect(child.SpanContext.TraceID()).To(Equal(reconcile.SpanContext.TraceID()))
+		g.Expect(child.Attributes).To(ContainElement(semconv.HTTPTargetKey.String(path)))
+	}
+	g.Expect(spans[0].Status.Code).To(Equal(codes.Unset))
+	g.Expect(spans[1].Attributes).To(ContainElement(semconv.HTTPStatusCodeKey.Int(http.StatusNotFound)))
+	g.Expect(spans[1].Status.Code).To(Equal(codes.Error))
+}
@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Agent opens a tunnel to the tunnel server and forwards the streams opened
+// by the server to the API server of the cluster it runs in.
+type Agent struct {
+	// Cluster is the namespace and name of the Cluster object of this cluster
+	// in the management cluster.
+	Cluster types.NamespacedName
+
+	// Token authenticates the agent with the tunnel server.
+	Token string
+
+	// Target is the host:port of the API server that streams are forwarded
+	// to, typically kubernetes.default.svc:443.
+	Target string
+
+	// DialTarget dials the API server. Defaults to a net.Dialer.
+	DialTarget func(ctx context.Context, network, address string) (net.Conn, error)
+
+	Log logr.Logger
+}
+
+// Run connects to the tunnel server at address and serves the tunnel,
+// reconnecting with a backoff whenever the tunnel is lost, until ctx is done.
+// If tlsConfig is nil, the connection to the server is not encrypted.
+func (a *Agent) Run(ctx context.Context, address string, tlsConfig *tls.Config) error {
+	backoff := newBackoff()
+	for {
+		connectedAt := time.Now()
+		err := a.connect(ctx, address, tlsConfig)
+		if ctx.Err() != nil {
+			return nil
+		}
+		// Start over with a short delay if the tunnel was up for a while.
+		if time.Since(connectedAt) > backoff.Cap {
+			backoff = newBackoff()
+		}
+		delay := backoff.Step()
+		a.Log.Error(err, "Tunnel lost, reconnecting", "server", address, "delay", delay.String())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+func newBackoff() wait.Backoff {
+	return wait.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.1, Steps: 8, Cap: time.Minute}
+}
+
+func (a *Agent) connect(ctx context.Context, address string, tlsConfig *tls.Config) error {
+	dialer := &net.Dialer{Timeout: handshakeTimeout, KeepAlive: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to tunnel server %s", address)
+	}
+	a.Log.Info("Connected to tunnel server", "server", address)
+	return a.ServeConn(ctx, conn)
+}
+
+// ServeConn performs the handshake on conn, which must be connected to the
+// tunnel server, and serves the tunnel until the connection is closed or ctx
+// is done.
+func (a *Agent) ServeConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	req, err := http.NewRequest(http.MethodGet, "http://cape"+handshakePath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", Protocol)
+	req.Header.Set(ClusterHeader, a.Cluster.String())
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	if err := req.Write(conn); err != nil {
+		return errors.Wrap(err, "failed to send tunnel handshake")
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return errors.Wrap(err, "failed to read tunnel handshake response")
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return errors.Errorf("tunnel server rejected the handshake: %s: %s", resp.Status, body)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	server := &http2.Server{}
+	server.ServeConn(&bufferedConn{Conn: conn, r: reader}, &http2.ServeConnOpts{
+		Context: ctx,
+		Handler: a,
+	})
+	return errors.New("tunnel closed")
+}
+
+// ServeHTTP forwards a CONNECT stream to the API server.
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dial := a.DialTarget
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: handshakeTimeout}).DialContext
+	}
+	target, err := dial(r.Context(), "tcp", a.Target)
+	if err != nil {
+		a.Log.Error(err, "Failed to connect to the API server", "target", a.Target)
+		http.Error(w, "failed to connect to the API server", http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	w.WriteHeader(http.StatusOK)
+	flusher := w.(http.Flusher)
+	flusher.Flush()
+
+	go func() {
+		_, _ = io.Copy(target, r.Body)
+		if tcpConn, ok := target.(interface{ CloseWrite() error }); ok {
+			_ = tcpConn.CloseWrite()
+		}
+	}()
+	_, _ = io.Copy(&flushWriter{w: w, flusher: flusher}, target)
+}
+
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.flusher.Flush()
+	return n, err
+}
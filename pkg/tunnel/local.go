@@ -0,0 +1,18 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+)
+
+// ConnectLocal connects the agent to the server over an in-memory connection
+// instead of the network. It is a stand-in for an agent running in a remote
+// cluster, for tests and local development. The tunnel is served until ctx is
+// done; the returned error is only about the handshake.
+func ConnectLocal(ctx context.Context, server *Server, agent *Agent) error {
+	serverConn, agentConn := net.Pipe()
+	go func() {
+		_ = agent.ServeConn(ctx, agentConn)
+	}()
+	return server.ServeConn(serverConn)
+}
@@ -0,0 +1,247 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ErrNotConnected is returned when dialing a cluster without an agent
+// connected to the server.
+var ErrNotConnected = errors.New("no tunnel agent connected for cluster")
+
+// Authenticator verifies the token presented by an agent for a cluster.
+type Authenticator interface {
+	Authenticate(ctx context.Context, cluster types.NamespacedName, token string) error
+}
+
+// SecretAuthenticator authenticates agents with the token stored in the
+// <cluster-name>-tunnel-token Secret in the namespace of the cluster.
+type SecretAuthenticator struct {
+	Reader client.Reader
+}
+
+func (a *SecretAuthenticator) Authenticate(ctx context.Context, cluster types.NamespacedName, token string) error {
+	secret := &corev1.Secret{}
+	key := types.NamespacedName{Namespace: cluster.Namespace, Name: TokenSecretName(cluster.Name)}
+	if err := a.Reader.Get(ctx, key, secret); err != nil {
+		return errors.Wrapf(err, "failed to get tunnel token secret %s", key)
+	}
+	expected := secret.Data[TokenKey]
+	if len(expected) == 0 || subtle.ConstantTimeCompare(expected, []byte(token)) != 1 {
+		return errors.New("invalid tunnel token")
+	}
+	return nil
+}
+
+// Server accepts tunnels from agents and dials the external clusters through
+// them. At most one tunnel is kept per cluster; a new tunnel replaces the
+// previous one.
+type Server struct {
+	Authenticator Authenticator
+	Log           logr.Logger
+
+	mu       sync.Mutex
+	sessions map[types.NamespacedName]*session
+}
+
+type session struct {
+	conn        *http2.ClientConn
+	connectedAt time.Time
+}
+
+// NewServer returns a Server that authenticates agents with auth.
+func NewServer(auth Authenticator, log logr.Logger) *Server {
+	return &Server{
+		Authenticator: auth,
+		Log:           log,
+		sessions:      map[types.NamespacedName]*session{},
+	}
+}
+
+// Serve accepts agent connections on the listener until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				s.Log.Error(err, "Rejected tunnel", "remote", conn.RemoteAddr().String())
+			}
+		}()
+	}
+}
+
+// ServeConn performs the handshake with the agent on conn and registers the
+// tunnel for the cluster of the agent.
+func (s *Server) ServeConn(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "failed to read tunnel handshake")
+	}
+
+	cluster, err := s.authenticate(req)
+	if err != nil {
+		writeHandshakeError(conn, err)
+		conn.Close()
+		return err
+	}
+
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+Protocol+"\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "failed to complete tunnel handshake")
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	transport := &http2.Transport{
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     15 * time.Second,
+	}
+	clientConn, err := transport.NewClientConn(&bufferedConn{Conn: conn, r: reader})
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "failed to set up HTTP/2 over the tunnel")
+	}
+
+	s.mu.Lock()
+	previous := s.sessions[cluster]
+	s.sessions[cluster] = &session{conn: clientConn, connectedAt: time.Now()}
+	s.mu.Unlock()
+	if previous != nil {
+		previous.conn.Close()
+	}
+	s.Log.Info("Tunnel connected", "cluster", cluster.String(), "remote", conn.RemoteAddr().String())
+	return nil
+}
+
+func (s *Server) authenticate(req *http.Request) (types.NamespacedName, error) {
+	if req.URL.Path != handshakePath || !strings.EqualFold(req.Header.Get("Upgrade"), Protocol) {
+		return types.NamespacedName{}, errors.New("not a tunnel handshake")
+	}
+	cluster, ok := parseCluster(req.Header.Get(ClusterHeader))
+	if !ok {
+		return types.NamespacedName{}, errors.Errorf("invalid %s header %q", ClusterHeader, req.Header.Get(ClusterHeader))
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	ctx, cancel := context.WithTimeout(req.Context(), handshakeTimeout)
+	defer cancel()
+	if err := s.Authenticator.Authenticate(ctx, cluster, token); err != nil {
+		return cluster, errors.Wrapf(err, "failed to authenticate agent of cluster %s", cluster)
+	}
+	return cluster, nil
+}
+
+func writeHandshakeError(conn net.Conn, err error) {
+	body := err.Error()
+	fmt.Fprintf(conn, "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+}
+
+// Connected returns whether an agent of the cluster is connected and the
+// time at which it connected.
+func (s *Server) Connected(cluster types.NamespacedName) (bool, time.Time) {
+	sess := s.session(cluster)
+	if sess == nil {
+		return false, time.Time{}
+	}
+	return true, sess.connectedAt
+}
+
+func (s *Server) session(cluster types.NamespacedName) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[cluster]
+	if !ok {
+		return nil
+	}
+	if state := sess.conn.State(); state.Closed || state.Closing {
+		delete(s.sessions, cluster)
+		return nil
+	}
+	return sess
+}
+
+// Dialer returns a dial function for rest.Config.Dial that opens connections
+// to the cluster through its tunnel. The address is ignored: the agent always
+// connects to the API server of its own cluster.
+func (s *Server) Dialer(cluster types.NamespacedName) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return s.Dial(ctx, cluster)
+	}
+}
+
+// Dial opens a connection to the API server of the cluster through its
+// tunnel.
+func (s *Server) Dial(ctx context.Context, cluster types.NamespacedName) (net.Conn, error) {
+	sess := s.session(cluster)
+	if sess == nil {
+		return nil, errors.Wrapf(ErrNotConnected, "cluster %s", cluster)
+	}
+
+	bodyReader, bodyWriter := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: "apiserver"},
+		Host:   "apiserver",
+		Header: http.Header{},
+		Body:   bodyReader,
+	}
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	// The stream outlives the dial, so it must not be bound to ctx.
+	results := make(chan result, 1)
+	go func() {
+		resp, err := sess.conn.RoundTrip(req)
+		results <- result{resp, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		bodyWriter.CloseWithError(ctx.Err())
+		go func() {
+			if r := <-results; r.err == nil {
+				r.resp.Body.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case r := <-results:
+		if r.err != nil {
+			bodyWriter.Close()
+			return nil, errors.Wrapf(r.err, "failed to open stream through the tunnel of cluster %s", cluster)
+		}
+		if r.resp.StatusCode != http.StatusOK {
+			bodyWriter.Close()
+			r.resp.Body.Close()
+			return nil, errors.Errorf("tunnel agent of cluster %s refused the stream: %s", cluster, r.resp.Status)
+		}
+		return &streamConn{
+			Reader:      r.resp.Body,
+			WriteCloser: bodyWriter,
+			closeReader: r.resp.Body.Close,
+			remoteAddr:  tunnelAddr(cluster.String()),
+		}, nil
+	}
+}
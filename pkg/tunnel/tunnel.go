@@ -0,0 +1,98 @@
+// Package tunnel implements the reverse tunnel that allows CAPE to reach the
+// API server of clusters that are not reachable from the management cluster,
+// for example because they are behind NAT or a firewall.
+//
+// The agent, running in the external cluster, dials out to the tunnel server
+// embedded in `cape run` and authenticates with a token. Once the handshake
+// completes the roles are reversed: the server uses the connection as an
+// HTTP/2 client and opens a CONNECT stream for every connection the controllers
+// make to the external cluster. The agent pipes each stream to its API server,
+// so TLS and the credentials of the kubeconfig are used end-to-end.
+package tunnel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// Protocol is the value of the Upgrade header of the handshake.
+	Protocol = "cape-tunnel/1"
+
+	// ClusterHeader identifies the cluster, as <namespace>/<name> of the
+	// Cluster object, that the agent opens the tunnel for.
+	ClusterHeader = "X-Cape-Cluster"
+
+	// TokenKey is the key of the token in the tunnel token Secret.
+	TokenKey = "token"
+
+	handshakePath    = "/tunnel"
+	handshakeTimeout = 10 * time.Second
+)
+
+// TokenSecretName returns the name of the Secret that holds the token the
+// agent of the cluster authenticates with.
+func TokenSecretName(clusterName string) string {
+	return clusterName + "-tunnel-token"
+}
+
+// parseCluster parses a <namespace>/<name> string.
+func parseCluster(s string) (types.NamespacedName, bool) {
+	namespace, name, ok := strings.Cut(s, "/")
+	if !ok || namespace == "" || name == "" {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: namespace, Name: name}, true
+}
+
+// bufferedConn is a net.Conn that first drains the bufio.Reader used to read
+// the handshake, which may already contain the first bytes of the HTTP/2
+// connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// streamConn is a net.Conn on top of a CONNECT stream.
+type streamConn struct {
+	io.Reader
+	io.WriteCloser
+	closeReader func() error
+	remoteAddr  net.Addr
+	closeOnce   sync.Once
+}
+
+func (c *streamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.WriteCloser.Close()
+		if rerr := c.closeReader(); err == nil {
+			err = rerr
+		}
+	})
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return tunnelAddr("local") }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+// Deadlines are not supported on the streams; timeouts are handled by the
+// HTTP clients that use the connections.
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
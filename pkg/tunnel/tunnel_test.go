@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type staticAuthenticator string
+
+func (a staticAuthenticator) Authenticate(ctx context.Context, cluster types.NamespacedName, token string) error {
+	if token != string(a) {
+		return errors.New("invalid tunnel token")
+	}
+	return nil
+}
+
+func TestConnectLocal(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Method+" "+r.URL.Path)
+	}))
+	defer apiServer.Close()
+
+	cluster := types.NamespacedName{Namespace: "default", Name: "cluster"}
+	server := NewServer(staticAuthenticator("secret"), logr.Discard())
+	agent := &Agent{
+		Cluster: cluster,
+		Token:   "secret",
+		Target:  strings.TrimPrefix(apiServer.URL, "http://"),
+		Log:     logr.Discard(),
+	}
+	g.Expect(ConnectLocal(ctx, server, agent)).To(Succeed())
+	connected, _ := server.Connected(cluster)
+	g.Expect(connected).To(BeTrue())
+
+	// The address is ignored by the dialer: the agent connects to Target.
+	client := &http.Client{Transport: &http.Transport{DialContext: server.Dialer(cluster)}}
+	defer client.CloseIdleConnections()
+	for _, path := range []string{"/version", "/api/v1/nodes"} {
+		resp, err := client.Get("http://kubernetes.invalid" + path)
+		g.Expect(err).NotTo(HaveOccurred())
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(body)).To(Equal("GET " + path))
+	}
+
+	_, err := server.Dial(ctx, types.NamespacedName{Namespace: "default", Name: "other"})
+	g.Expect(errors.Cause(err)).To(Equal(ErrNotConnected))
+}
+
+func TestConnectLocalInvalidToken(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cluster := types.NamespacedName{Namespace: "default", Name: "cluster"}
+	server := NewServer(staticAuthenticator("secret"), logr.Discard())
+	agent := &Agent{Cluster: cluster, Token: "wrong", Target: "127.0.0.1:1", Log: logr.Discard()}
+	g.Expect(ConnectLocal(ctx, server, agent)).To(MatchError(ContainSubstring("invalid tunnel token")))
+	connected, _ := server.Connected(cluster)
+	g.Expect(connected).To(BeFalse())
+}
@@ -0,0 +1,345 @@
+// Package upgrade checks whether an external cluster uses APIs that are
+// removed in the next minor Kubernetes version, so that its upgrade can be
+// planned from the management cluster.
+package upgrade
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	"github.com/prometheus/common/expfmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// DeprecatedAPIsMetric is the metric of the API server that reports the
+	// deprecated APIs that were requested since it started.
+	DeprecatedAPIsMetric = "apiserver_requested_deprecated_apis"
+
+	// MaxObjects bounds the number of objects listed per resource in the
+	// report to keep the ExternalControlPlane object small.
+	MaxObjects = 20
+
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+	listPageSize          = 500
+)
+
+// RemovedAPI is a served API of a resource that is removed in a Kubernetes
+// release.
+type RemovedAPI struct {
+	Group    string
+	Version  string
+	Resource string
+
+	// RemovedRelease is the release that removes the API, e.g. 1.22.
+	RemovedRelease string
+
+	// Replacement is the API version that replaces it, or empty if the
+	// resource is removed altogether.
+	Replacement string
+}
+
+// GroupVersion returns the API version of the removed API, e.g.
+// extensions/v1beta1.
+func (a RemovedAPI) GroupVersion() schema.GroupVersion {
+	return schema.GroupVersion{Group: a.Group, Version: a.Version}
+}
+
+// RemovedAPIs are the removed APIs of the resources that are stored, taken
+// from the Kubernetes deprecated API migration guide. APIs of resources that
+// are never stored, like TokenReviews, are left out.
+var RemovedAPIs = []RemovedAPI{
+	{"extensions", "v1beta1", "daemonsets", "1.16", "apps/v1"},
+	{"extensions", "v1beta1", "deployments", "1.16", "apps/v1"},
+	{"extensions", "v1beta1", "replicasets", "1.16", "apps/v1"},
+	{"extensions", "v1beta1", "networkpolicies", "1.16", "networking.k8s.io/v1"},
+	{"extensions", "v1beta1", "podsecuritypolicies", "1.16", "policy/v1beta1"},
+	{"apps", "v1beta1", "deployments", "1.16", "apps/v1"},
+	{"apps", "v1beta1", "statefulsets", "1.16", "apps/v1"},
+	{"apps", "v1beta2", "daemonsets", "1.16", "apps/v1"},
+	{"apps", "v1beta2", "deployments", "1.16", "apps/v1"},
+	{"apps", "v1beta2", "replicasets", "1.16", "apps/v1"},
+	{"apps", "v1beta2", "statefulsets", "1.16", "apps/v1"},
+	{"admissionregistration.k8s.io", "v1beta1", "mutatingwebhookconfigurations", "1.22", "admissionregistration.k8s.io/v1"},
+	{"admissionregistration.k8s.io", "v1beta1", "validatingwebhookconfigurations", "1.22", "admissionregistration.k8s.io/v1"},
+	{"apiextensions.k8s.io", "v1beta1", "customresourcedefinitions", "1.22", "apiextensions.k8s.io/v1"},
+	{"apiregistration.k8s.io", "v1beta1", "apiservices", "1.22", "apiregistration.k8s.io/v1"},
+	{"certificates.k8s.io", "v1beta1", "certificatesigningrequests", "1.22", "certificates.k8s.io/v1"},
+	{"coordination.k8s.io", "v1beta1", "leases", "1.22", "coordination.k8s.io/v1"},
+	{"extensions", "v1beta1", "ingresses", "1.22", "networking.k8s.io/v1"},
+	{"networking.k8s.io", "v1beta1", "ingresses", "1.22", "networking.k8s.io/v1"},
+	{"networking.k8s.io", "v1beta1", "ingressclasses", "1.22", "networking.k8s.io/v1"},
+	{"rbac.authorization.k8s.io", "v1beta1", "clusterroles", "1.22", "rbac.authorization.k8s.io/v1"},
+	{"rbac.authorization.k8s.io", "v1beta1", "clusterrolebindings", "1.22", "rbac.authorization.k8s.io/v1"},
+	{"rbac.authorization.k8s.io", "v1beta1", "roles", "1.22", "rbac.authorization.k8s.io/v1"},
+	{"rbac.authorization.k8s.io", "v1beta1", "rolebindings", "1.22", "rbac.authorization.k8s.io/v1"},
+	{"scheduling.k8s.io", "v1beta1", "priorityclasses", "1.22", "scheduling.k8s.io/v1"},
+	{"storage.k8s.io", "v1beta1", "csidrivers", "1.22", "storage.k8s.io/v1"},
+	{"storage.k8s.io", "v1beta1", "csinodes", "1.22", "storage.k8s.io/v1"},
+	{"storage.k8s.io", "v1beta1", "storageclasses", "1.22", "storage.k8s.io/v1"},
+	{"storage.k8s.io", "v1beta1", "volumeattachments", "1.22", "storage.k8s.io/v1"},
+	{"batch", "v1beta1", "cronjobs", "1.25", "batch/v1"},
+	{"discovery.k8s.io", "v1beta1", "endpointslices", "1.25", "discovery.k8s.io/v1"},
+	{"events.k8s.io", "v1beta1", "events", "1.25", "events.k8s.io/v1"},
+	{"autoscaling", "v2beta1", "horizontalpodautoscalers", "1.25", "autoscaling/v2"},
+	{"policy", "v1beta1", "poddisruptionbudgets", "1.25", "policy/v1"},
+	{"policy", "v1beta1", "podsecuritypolicies", "1.25", ""},
+	{"node.k8s.io", "v1beta1", "runtimeclasses", "1.25", "node.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io", "v1beta1", "flowschemas", "1.26", "flowcontrol.apiserver.k8s.io/v1beta3"},
+	{"flowcontrol.apiserver.k8s.io", "v1beta1", "prioritylevelconfigurations", "1.26", "flowcontrol.apiserver.k8s.io/v1beta3"},
+	{"autoscaling", "v2beta2", "horizontalpodautoscalers", "1.26", "autoscaling/v2"},
+	{"storage.k8s.io", "v1beta1", "csistoragecapacities", "1.27", "storage.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io", "v1beta2", "flowschemas", "1.29", "flowcontrol.apiserver.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io", "v1beta2", "prioritylevelconfigurations", "1.29", "flowcontrol.apiserver.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io", "v1beta3", "flowschemas", "1.32", "flowcontrol.apiserver.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io", "v1beta3", "prioritylevelconfigurations", "1.32", "flowcontrol.apiserver.k8s.io/v1"},
+}
+
+// Check reports the usage of the APIs that are removed in the next minor
+// version of the cluster that config points to. A failure to read the
+// metrics of the API server, which requires access to /metrics, is reported
+// in the message of the report rather than failing the check, since the
+// stored objects are the main blockers of an upgrade.
+func Check(ctx context.Context, config *rest.Config) (*externalv1.UpgradeReadiness, error) {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the discovery client")
+	}
+	metadataClient, err := metadata.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the metadata client")
+	}
+	serverVersion, err := discoveryClient.ServerVersion()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the version of the API server")
+	}
+	current, err := version.ParseGeneric(serverVersion.GitVersion)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid version %q of the API server", serverVersion.GitVersion)
+	}
+	report := &externalv1.UpgradeReadiness{
+		Version:       serverVersion.GitVersion,
+		TargetVersion: fmt.Sprintf("%d.%d", current.Major(), current.Minor()+1),
+		LastCheckTime: metav1.Now(),
+	}
+
+	// The metrics are read first, because listing the resources that are
+	// removed without a replacement requests their deprecated API.
+	var messages []string
+	rawMetrics, err := discoveryClient.RESTClient().Get().AbsPath("/metrics").DoRaw(ctx)
+	if err == nil {
+		report.DeprecatedAPIRequests, err = ParseDeprecatedAPIRequests(rawMetrics)
+	}
+	if err != nil {
+		messages = append(messages, fmt.Sprintf("failed to read the deprecated API requests: %v", err))
+	}
+
+	served := servedResources{discovery: discoveryClient, resources: map[schema.GroupVersion][]string{}}
+	for _, api := range RemovedAPIs {
+		if !RemovedIn(api.RemovedRelease, report.TargetVersion) {
+			continue
+		}
+		objects, err := findObjects(ctx, served, metadataClient, api)
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("failed to list %s: %v", api.GroupVersion().WithResource(api.Resource), err))
+			continue
+		}
+		if objects != nil {
+			report.RemovedAPIObjects = append(report.RemovedAPIObjects, *objects)
+		}
+	}
+
+	report.Ready = len(report.RemovedAPIObjects) == 0
+	for _, request := range report.DeprecatedAPIRequests {
+		if RemovedIn(request.RemovedRelease, report.TargetVersion) {
+			report.Ready = false
+		}
+	}
+	report.Message = strings.Join(messages, "; ")
+	return report, nil
+}
+
+// Blockers lists the APIs in the report that are removed in its target
+// version, e.g. "batch/v1beta1 cronjobs (2 objects)" or "policy/v1beta1
+// podsecuritypolicies (requested)".
+func Blockers(report *externalv1.UpgradeReadiness) []string {
+	var blockers []string
+	for _, removed := range report.RemovedAPIObjects {
+		blockers = append(blockers, fmt.Sprintf("%s %s (%d objects)", apiVersion(removed.Group, removed.Version), removed.Resource, removed.Count))
+	}
+	for _, request := range report.DeprecatedAPIRequests {
+		if !RemovedIn(request.RemovedRelease, report.TargetVersion) {
+			continue
+		}
+		resource := request.Resource
+		if request.Subresource != "" {
+			resource += "/" + request.Subresource
+		}
+		blockers = append(blockers, fmt.Sprintf("%s %s (requested)", apiVersion(request.Group, request.Version), resource))
+	}
+	return blockers
+}
+
+// ParseDeprecatedAPIRequests returns the deprecated APIs that are reported
+// in the metrics of an API server, in the Prometheus text format.
+func ParseDeprecatedAPIRequests(rawMetrics []byte) ([]externalv1.DeprecatedAPIRequest, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(rawMetrics))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid metrics")
+	}
+	family, ok := families[DeprecatedAPIsMetric]
+	if !ok {
+		return nil, nil
+	}
+	var requests []externalv1.DeprecatedAPIRequest
+	for _, metric := range family.GetMetric() {
+		if metric.GetGauge().GetValue() == 0 {
+			continue
+		}
+		var request externalv1.DeprecatedAPIRequest
+		for _, label := range metric.GetLabel() {
+			switch label.GetName() {
+			case "group":
+				request.Group = label.GetValue()
+			case "version":
+				request.Version = label.GetValue()
+			case "resource":
+				request.Resource = label.GetValue()
+			case "subresource":
+				request.Subresource = label.GetValue()
+			case "removed_release":
+				request.RemovedRelease = label.GetValue()
+			}
+		}
+		requests = append(requests, request)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return fmt.Sprint(requests[i]) < fmt.Sprint(requests[j])
+	})
+	return requests, nil
+}
+
+// findObjects returns the objects of the resource that were written through
+// the removed API, or nil if there are none or the API is not served. The
+// objects are listed through the replacement, so that the check itself does
+// not request the deprecated API, and recognized by the API version of their
+// managed fields or of their last applied configuration. Resources without a
+// replacement are removed altogether, so all of their objects are returned.
+func findObjects(ctx context.Context, served servedResources, metadataClient metadata.Interface, api RemovedAPI) (*externalv1.RemovedAPIObjects, error) {
+	if ok, err := served.has(api.GroupVersion(), api.Resource); err != nil || !ok {
+		return nil, err
+	}
+	listVersion := api.GroupVersion()
+	if api.Replacement != "" {
+		replacement, err := schema.ParseGroupVersion(api.Replacement)
+		if err != nil {
+			return nil, err
+		}
+		if ok, err := served.has(replacement, api.Resource); err != nil {
+			return nil, err
+		} else if ok {
+			listVersion = replacement
+		}
+	}
+
+	result := &externalv1.RemovedAPIObjects{
+		Group:          api.Group,
+		Version:        api.Version,
+		Resource:       api.Resource,
+		RemovedRelease: api.RemovedRelease,
+		Replacement:    api.Replacement,
+	}
+	removedVersion := api.GroupVersion().String()
+	opts := metav1.ListOptions{Limit: listPageSize}
+	for {
+		list, err := metadataClient.Resource(listVersion.WithResource(api.Resource)).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			obj := &list.Items[i]
+			if api.Replacement != "" && !writtenThrough(obj, removedVersion) {
+				continue
+			}
+			result.Count++
+			if len(result.Objects) < MaxObjects {
+				result.Objects = append(result.Objects, strings.TrimPrefix(obj.Namespace+"/"+obj.Name, "/"))
+			}
+		}
+		if list.Continue == "" {
+			break
+		}
+		opts.Continue = list.Continue
+	}
+	if result.Count == 0 {
+		return nil, nil
+	}
+	return result, nil
+}
+
+// writtenThrough returns true if the object was last written through the API
+// version, by a field manager or by `kubectl apply`.
+func writtenThrough(obj *metav1.PartialObjectMetadata, apiVersion string) bool {
+	for _, entry := range obj.ManagedFields {
+		if entry.APIVersion == apiVersion {
+			return true
+		}
+	}
+	return strings.Contains(obj.Annotations[lastAppliedAnnotation], fmt.Sprintf(`"apiVersion":%q`, apiVersion))
+}
+
+// servedResources caches the resources that the API server serves per API
+// version.
+type servedResources struct {
+	discovery discovery.DiscoveryInterface
+	resources map[schema.GroupVersion][]string
+}
+
+func (s servedResources) has(gv schema.GroupVersion, resource string) (bool, error) {
+	resources, ok := s.resources[gv]
+	if !ok {
+		list, err := s.discovery.ServerResourcesForGroupVersion(gv.String())
+		if err != nil && !apierrors.IsNotFound(err) {
+			return false, err
+		}
+		if list != nil {
+			for _, r := range list.APIResources {
+				resources = append(resources, r.Name)
+			}
+		}
+		s.resources[gv] = resources
+	}
+	for _, r := range resources {
+		if r == resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RemovedIn returns true if the release, e.g. 1.22, is at or before the
+// target version.
+func RemovedIn(release string, targetVersion string) bool {
+	removed, err := version.ParseGeneric(release)
+	if err != nil {
+		return false
+	}
+	target, err := version.ParseGeneric(targetVersion)
+	return err == nil && !target.LessThan(removed)
+}
+
+func apiVersion(group, version string) string {
+	return schema.GroupVersion{Group: group, Version: version}.String()
+}
@@ -0,0 +1,273 @@
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalv1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakemetadata "k8s.io/client-go/metadata/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestParseDeprecatedAPIRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics string
+		want    []externalv1.DeprecatedAPIRequest
+		wantErr bool
+	}{
+		{
+			name:    "no metrics",
+			metrics: "",
+		},
+		{
+			name: "no deprecated APIs requested",
+			metrics: `# TYPE apiserver_request_total counter
+apiserver_request_total{code="200",resource="pods",verb="LIST",version="v1"} 3
+`,
+		},
+		{
+			name: "deprecated APIs",
+			metrics: `# HELP apiserver_requested_deprecated_apis [STABLE] Gauge of deprecated APIs that have been requested, broken out by API group, version, resource, subresource, and removed_release.
+# TYPE apiserver_requested_deprecated_apis gauge
+apiserver_requested_deprecated_apis{group="policy",removed_release="1.25",resource="podsecuritypolicies",subresource="",version="v1beta1"} 1
+apiserver_requested_deprecated_apis{group="batch",removed_release="1.25",resource="cronjobs",subresource="",version="v1beta1"} 1
+apiserver_requested_deprecated_apis{group="",removed_release="",resource="componentstatuses",subresource="",version="v1"} 1
+apiserver_requested_deprecated_apis{group="autoscaling",removed_release="1.26",resource="horizontalpodautoscalers",subresource="status",version="v2beta2"} 1
+`,
+			want: []externalv1.DeprecatedAPIRequest{
+				{Version: "v1", Resource: "componentstatuses"},
+				{Group: "autoscaling", Version: "v2beta2", Resource: "horizontalpodautoscalers", Subresource: "status", RemovedRelease: "1.26"},
+				{Group: "batch", Version: "v1beta1", Resource: "cronjobs", RemovedRelease: "1.25"},
+				{Group: "policy", Version: "v1beta1", Resource: "podsecuritypolicies", RemovedRelease: "1.25"},
+			},
+		},
+		{
+			name: "requests before a restart are ignored",
+			metrics: `# TYPE apiserver_requested_deprecated_apis gauge
+apiserver_requested_deprecated_apis{group="batch",removed_release="1.25",resource="cronjobs",subresource="",version="v1beta1"} 0
+`,
+		},
+		{
+			name:    "invalid metrics",
+			metrics: "apiserver_requested_deprecated_apis{group=\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			got, err := ParseDeprecatedAPIRequests([]byte(tt.metrics))
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestRemovedIn(t *testing.T) {
+	tests := []struct {
+		release       string
+		targetVersion string
+		want          bool
+	}{
+		{release: "1.25", targetVersion: "1.25", want: true},
+		{release: "1.22", targetVersion: "1.25", want: true},
+		{release: "1.26", targetVersion: "1.25", want: false},
+		{release: "1.16", targetVersion: "1.9", want: false},
+		{release: "1.25", targetVersion: "v1.25.3", want: true},
+		{release: "", targetVersion: "1.25", want: false},
+		{release: "1.25", targetVersion: "next", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s in %s", tt.release, tt.targetVersion), func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(RemovedIn(tt.release, tt.targetVersion)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestBlockers(t *testing.T) {
+	g := NewWithT(t)
+	report := &externalv1.UpgradeReadiness{
+		TargetVersion: "1.25",
+		RemovedAPIObjects: []externalv1.RemovedAPIObjects{
+			{Group: "batch", Version: "v1beta1", Resource: "cronjobs", RemovedRelease: "1.25", Count: 2},
+		},
+		DeprecatedAPIRequests: []externalv1.DeprecatedAPIRequest{
+			{Version: "v1", Resource: "componentstatuses"},
+			{Group: "autoscaling", Version: "v2beta2", Resource: "horizontalpodautoscalers", Subresource: "status", RemovedRelease: "1.26"},
+			{Group: "policy", Version: "v1beta1", Resource: "podsecuritypolicies", RemovedRelease: "1.25"},
+		},
+	}
+	g.Expect(Blockers(report)).To(Equal([]string{
+		"batch/v1beta1 cronjobs (2 objects)",
+		"policy/v1beta1 podsecuritypolicies (requested)",
+	}))
+}
+
+func partialObject(apiVersion, kind, namespace, name string) *metav1.PartialObjectMetadata {
+	return &metav1.PartialObjectMetadata{
+		TypeMeta:   metav1.TypeMeta{APIVersion: apiVersion, Kind: kind},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+	}
+}
+
+func newFakeMetadataClient(objects ...runtime.Object) *fakemetadata.FakeMetadataClient {
+	scheme := runtime.NewScheme()
+	metav1.AddMetaToScheme(scheme)
+	return fakemetadata.NewSimpleMetadataClient(scheme, objects...)
+}
+
+func TestFindObjects(t *testing.T) {
+	ctx := context.Background()
+	cronJobs := RemovedAPI{"batch", "v1beta1", "cronjobs", "1.25", "batch/v1"}
+	podSecurityPolicies := RemovedAPI{"policy", "v1beta1", "podsecuritypolicies", "1.25", ""}
+
+	// Objects are stored once, so they are listed through the replacement.
+	managed := partialObject("batch/v1", "CronJob", "default", "managed")
+	managed.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "helm", APIVersion: "batch/v1beta1"}}
+	applied := partialObject("batch/v1", "CronJob", "default", "applied")
+	applied.Annotations = map[string]string{lastAppliedAnnotation: `{"apiVersion":"batch/v1beta1","kind":"CronJob"}`}
+	// Without the replacement, objects are listed through the removed API.
+	managedBeta := managed.DeepCopy()
+	managedBeta.APIVersion = "batch/v1beta1"
+	migrated := partialObject("batch/v1", "CronJob", "default", "migrated")
+	migrated.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "helm", APIVersion: "batch/v1"}}
+	migrated.Annotations = map[string]string{lastAppliedAnnotation: `{"apiVersion":"batch/v1","kind":"CronJob"}`}
+
+	tests := []struct {
+		name      string
+		resources []*metav1.APIResourceList
+		objects   []runtime.Object
+		api       RemovedAPI
+		want      *externalv1.RemovedAPIObjects
+		wantList  schema.GroupVersionResource
+	}{
+		{
+			name: "objects written through the removed API",
+			resources: []*metav1.APIResourceList{
+				{GroupVersion: "batch/v1", APIResources: []metav1.APIResource{{Name: "cronjobs"}, {Name: "jobs"}}},
+				{GroupVersion: "batch/v1beta1", APIResources: []metav1.APIResource{{Name: "cronjobs"}}},
+			},
+			objects: []runtime.Object{managed, applied, migrated},
+			api:     cronJobs,
+			want: &externalv1.RemovedAPIObjects{
+				Group: "batch", Version: "v1beta1", Resource: "cronjobs", RemovedRelease: "1.25", Replacement: "batch/v1",
+				Count: 2, Objects: []string{"default/applied", "default/managed"},
+			},
+			wantList: schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"},
+		},
+		{
+			name: "no objects written through the removed API",
+			resources: []*metav1.APIResourceList{
+				{GroupVersion: "batch/v1", APIResources: []metav1.APIResource{{Name: "cronjobs"}}},
+				{GroupVersion: "batch/v1beta1", APIResources: []metav1.APIResource{{Name: "cronjobs"}}},
+			},
+			objects:  []runtime.Object{migrated},
+			api:      cronJobs,
+			wantList: schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"},
+		},
+		{
+			name: "removed API not served",
+			resources: []*metav1.APIResourceList{
+				{GroupVersion: "batch/v1", APIResources: []metav1.APIResource{{Name: "cronjobs"}}},
+			},
+			objects: []runtime.Object{managed},
+			api:     cronJobs,
+		},
+		{
+			name: "replacement not served",
+			resources: []*metav1.APIResourceList{
+				{GroupVersion: "batch/v1beta1", APIResources: []metav1.APIResource{{Name: "cronjobs"}}},
+			},
+			objects: []runtime.Object{managedBeta},
+			api:     cronJobs,
+			want: &externalv1.RemovedAPIObjects{
+				Group: "batch", Version: "v1beta1", Resource: "cronjobs", RemovedRelease: "1.25", Replacement: "batch/v1",
+				Count: 1, Objects: []string{"default/managed"},
+			},
+			wantList: schema.GroupVersionResource{Group: "batch", Version: "v1beta1", Resource: "cronjobs"},
+		},
+		{
+			name: "resource without a replacement",
+			resources: []*metav1.APIResourceList{
+				{GroupVersion: "policy/v1beta1", APIResources: []metav1.APIResource{{Name: "podsecuritypolicies"}}},
+			},
+			objects: []runtime.Object{
+				partialObject("policy/v1beta1", "PodSecurityPolicy", "", "privileged"),
+				partialObject("policy/v1beta1", "PodSecurityPolicy", "", "restricted"),
+			},
+			api: podSecurityPolicies,
+			want: &externalv1.RemovedAPIObjects{
+				Group: "policy", Version: "v1beta1", Resource: "podsecuritypolicies", RemovedRelease: "1.25",
+				Count: 2, Objects: []string{"privileged", "restricted"},
+			},
+			wantList: schema.GroupVersionResource{Group: "policy", Version: "v1beta1", Resource: "podsecuritypolicies"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			discoveryClient := &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{Resources: tt.resources}}
+			served := servedResources{discovery: discoveryClient, resources: map[schema.GroupVersion][]string{}}
+			metadataClient := newFakeMetadataClient(tt.objects...)
+
+			got, err := findObjects(ctx, served, metadataClient, tt.api)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+
+			var listed []schema.GroupVersionResource
+			for _, action := range metadataClient.Actions() {
+				listed = append(listed, action.GetResource())
+			}
+			if tt.wantList.Empty() {
+				g.Expect(listed).To(BeEmpty())
+			} else {
+				g.Expect(listed).To(ConsistOf(tt.wantList))
+			}
+		})
+	}
+}
+
+func TestFindObjectsPages(t *testing.T) {
+	g := NewWithT(t)
+	api := RemovedAPI{"policy", "v1beta1", "podsecuritypolicies", "1.25", ""}
+	discoveryClient := &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{Resources: []*metav1.APIResourceList{
+		{GroupVersion: "policy/v1beta1", APIResources: []metav1.APIResource{{Name: "podsecuritypolicies"}}},
+	}}}
+	served := servedResources{discovery: discoveryClient, resources: map[schema.GroupVersion][]string{}}
+
+	// The fake client neither paginates nor passes the continue token to
+	// its reactors, so serve MaxObjects+5 objects in pages of 10 by counting
+	// the requests.
+	metadataClient := newFakeMetadataClient()
+	page := 0
+	metadataClient.PrependReactor("list", "podsecuritypolicies", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		list := &metav1.List{}
+		for i := page * 10; i < (page+1)*10 && i < MaxObjects+5; i++ {
+			list.Items = append(list.Items, runtime.RawExtension{Object: partialObject("policy/v1beta1", "PodSecurityPolicy", "", fmt.Sprintf("psp-%02d", i))})
+		}
+		page++
+		if page*10 < MaxObjects+5 {
+			list.Continue = fmt.Sprint(page)
+		}
+		return true, list, nil
+	})
+
+	got, err := findObjects(context.Background(), served, metadataClient, api)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(page).To(Equal(3))
+	g.Expect(got.Count).To(BeEquivalentTo(MaxObjects + 5))
+	g.Expect(got.Objects).To(HaveLen(MaxObjects))
+	g.Expect(got.Objects[0]).To(Equal("psp-00"))
+}
@@ -0,0 +1,194 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/controllers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/remote"
+	addonsv1 "sigs.k8s.io/cluster-api/exp/addons/api/v1beta1"
+	addonscontrollers "sigs.k8s.io/cluster-api/exp/addons/controllers"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+)
+
+const (
+	// crsWatchFilter is the watch filter of the ClusterResourceSet
+	// controllers, so that they only apply a ClusterResourceSet once it is
+	// labelled with it.
+	crsWatchFilter = "cape-test-crs"
+
+	existingAddonManifest = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: addon-existing
+  namespace: default
+data:
+  version: v2
+`
+	newAddonManifest = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: addon-new
+  namespace: default
+data:
+  version: v1
+`
+)
+
+// TestClusterResourceSet applies a ClusterResourceSet to an imported cluster
+// that already runs one of its addons, with the ClusterResourceSet
+// controllers of Cluster API. The existing addon is adopted, and the missing
+// one is installed.
+func TestClusterResourceSet(t *testing.T) {
+	requireEnv(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	namespace := createNamespace(t, g)
+	startClusterResourceSetControllers(t, g)
+
+	existing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "addon-existing", Namespace: metav1.NamespaceDefault},
+		Data:       map[string]string{"version": "v1"},
+	}
+	_, err := workloadClient.CoreV1().ConfigMaps(metav1.NamespaceDefault).Create(ctx, existing, metav1.CreateOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	t.Cleanup(func() {
+		for _, name := range []string{"addon-existing", "addon-new"} {
+			_ = workloadClient.CoreV1().ConfigMaps(metav1.NamespaceDefault).Delete(context.Background(), name, metav1.DeleteOptions{})
+		}
+	})
+
+	importCluster(t, g, namespace, "workload")
+	adoptCluster(t, g, namespace, "workload")
+	cluster := &clusterv1.Cluster{}
+	g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, cluster)).To(Succeed())
+	patchBase := client.MergeFrom(cluster.DeepCopy())
+	cluster.Labels = map[string]string{"cni": "test"}
+	g.Expect(mgmtClient.Patch(ctx, cluster, patchBase)).To(Succeed())
+	externalCluster := &externalinfrav1.ExternalCluster{}
+	g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, externalCluster)).To(Succeed())
+	patchBase = client.MergeFrom(externalCluster.DeepCopy())
+	externalCluster.Spec.AdoptExistingResources = true
+	g.Expect(mgmtClient.Patch(ctx, externalCluster, patchBase)).To(Succeed())
+
+	// The control plane and the kubeconfig satisfy the contract of the
+	// ClusterResourceSet controller.
+	g.Eventually(func(g Gomega) {
+		externalControlPlane := &externalcontrolplanev1.ExternalControlPlane{}
+		g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, externalControlPlane)).To(Succeed())
+		g.Expect(externalControlPlane.Status.Initialized).To(BeTrue())
+		g.Expect(externalControlPlane.Status.Ready).To(BeTrue())
+		g.Expect(conditions.IsTrue(externalControlPlane, clusterv1.ReadyCondition)).To(BeTrue())
+
+		secret := &corev1.Secret{}
+		g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload-kubeconfig"}, secret)).To(Succeed())
+		g.Expect(secret.Labels).To(HaveKeyWithValue(clusterv1.ClusterLabelName, "workload"))
+		g.Expect(secret.Data).To(HaveKey("value"))
+		g.Expect(util.IsOwnedByObject(secret, cluster)).To(BeTrue())
+	}, timeout, interval).Should(Succeed())
+
+	for name, manifest := range map[string]string{"existing-addons": existingAddonManifest, "new-addons": newAddonManifest} {
+		resource := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Data:       map[string]string{"manifest.yaml": manifest},
+		}
+		g.Expect(mgmtClient.Create(ctx, resource)).To(Succeed())
+	}
+	clusterResourceSet := &addonsv1.ClusterResourceSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "addons", Namespace: namespace},
+		Spec: addonsv1.ClusterResourceSetSpec{
+			ClusterSelector: metav1.LabelSelector{MatchLabels: map[string]string{"cni": "test"}},
+			Resources: []addonsv1.ResourceRef{
+				{Name: "existing-addons", Kind: string(addonsv1.ConfigMapClusterResourceSetResourceKind)},
+				{Name: "new-addons", Kind: string(addonsv1.ConfigMapClusterResourceSetResourceKind)},
+			},
+		},
+	}
+	g.Expect(mgmtClient.Create(ctx, clusterResourceSet)).To(Succeed())
+
+	// CAPE adopts the existing addon before the ClusterResourceSet is
+	// applied, and records it as applied.
+	g.Eventually(func(g Gomega) {
+		addon, err := workloadClient.CoreV1().ConfigMaps(metav1.NamespaceDefault).Get(ctx, "addon-existing", metav1.GetOptions{})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(addon.Annotations).To(HaveKeyWithValue(externalinfrav1.AdoptedByAnnotation, namespace+"/addons"))
+
+		binding := &addonsv1.ClusterResourceSetBinding{}
+		g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, binding)).To(Succeed())
+		g.Expect(binding.GetOrCreateBinding(clusterResourceSet).IsApplied(clusterResourceSet.Spec.Resources[0])).To(BeTrue())
+		g.Expect(binding.GetOrCreateBinding(clusterResourceSet).IsApplied(clusterResourceSet.Spec.Resources[1])).To(BeFalse())
+	}, timeout, interval).Should(Succeed())
+	g.Eventually(func(g Gomega) {
+		g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, externalCluster)).To(Succeed())
+		g.Expect(conditions.IsTrue(externalCluster, controllers.ClusterResourceSetsAdoptedCondition)).To(BeTrue())
+	}, timeout, interval).Should(Succeed())
+
+	g.Expect(mgmtClient.Get(ctx, client.ObjectKeyFromObject(clusterResourceSet), clusterResourceSet)).To(Succeed())
+	patchBase = client.MergeFrom(clusterResourceSet.DeepCopy())
+	clusterResourceSet.Labels = map[string]string{clusterv1.WatchLabel: crsWatchFilter}
+	g.Expect(mgmtClient.Patch(ctx, clusterResourceSet, patchBase)).To(Succeed())
+
+	// The ClusterResourceSet installs the missing addon, and leaves the
+	// adopted one alone.
+	g.Eventually(func(g Gomega) {
+		binding := &addonsv1.ClusterResourceSetBinding{}
+		g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, binding)).To(Succeed())
+		for _, resource := range clusterResourceSet.Spec.Resources {
+			g.Expect(binding.GetOrCreateBinding(clusterResourceSet).IsApplied(resource)).To(BeTrue(), resource.Name)
+		}
+		_, err := workloadClient.CoreV1().ConfigMaps(metav1.NamespaceDefault).Get(ctx, "addon-new", metav1.GetOptions{})
+		g.Expect(err).NotTo(HaveOccurred())
+	}, timeout, interval).Should(Succeed())
+	addon, err := workloadClient.CoreV1().ConfigMaps(metav1.NamespaceDefault).Get(ctx, "addon-existing", metav1.GetOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(addon.Data).To(HaveKeyWithValue("version", "v1"))
+	g.Eventually(func(g Gomega) {
+		g.Expect(mgmtClient.Get(ctx, client.ObjectKeyFromObject(clusterResourceSet), clusterResourceSet)).To(Succeed())
+		g.Expect(conditions.IsTrue(clusterResourceSet, addonsv1.ResourcesAppliedCondition)).To(BeTrue())
+	}, timeout, interval).Should(Succeed())
+}
+
+// startClusterResourceSetControllers runs the ClusterResourceSet controllers
+// of Cluster API against the management cluster until the end of the test.
+// They only reconcile ClusterResourceSets labelled with crsWatchFilter.
+func startClusterResourceSetControllers(t *testing.T, g *WithT) {
+	t.Helper()
+	mgr, err := ctrl.NewManager(mgmtEnv.Config, ctrl.Options{
+		Scheme:             scheme,
+		MetricsBindAddress: "0",
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	tracker, err := remote.NewClusterCacheTracker(mgr, remote.ClusterCacheTrackerOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g.Expect((&addonscontrollers.ClusterResourceSetReconciler{
+		Client:           mgr.GetClient(),
+		Tracker:          tracker,
+		WatchFilterValue: crsWatchFilter,
+	}).SetupWithManager(ctx, mgr, controller.Options{})).To(Succeed())
+	g.Expect((&addonscontrollers.ClusterResourceSetBindingReconciler{
+		Client:           mgr.GetClient(),
+		WatchFilterValue: crsWatchFilter,
+	}).SetupWithManager(ctx, mgr, controller.Options{})).To(Succeed())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = mgr.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
@@ -0,0 +1,104 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/pkg/cmd"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// createNamespace creates a namespace in the management cluster that is
+// deleted at the end of the test.
+func createNamespace(t *testing.T, g *WithT) string {
+	t.Helper()
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "cape-test-"}}
+	g.Expect(mgmtClient.Create(context.Background(), namespace)).To(Succeed())
+	t.Cleanup(func() {
+		_ = mgmtClient.Delete(context.Background(), namespace)
+	})
+	return namespace.Name
+}
+
+// importCluster imports the workload cluster with `cape import`.
+func importCluster(t *testing.T, g *WithT, namespace string, name string) {
+	t.Helper()
+	opts := &cmd.ConfigOptions{
+		RootOptions:           &cmd.RootOptions{},
+		MgmtKubeconfigPath:    mgmtKubeconfigPath,
+		MgmtClusterNamespace:  namespace,
+		ClusterName:           name,
+		ClusterKubeconfigPath: workloadKubeconfigPath,
+		Source:                "kubeconfig",
+	}
+	g.Expect(opts.Complete(nil, nil)).To(Succeed())
+	g.Expect(opts.Validate()).To(Succeed())
+	g.Expect(opts.Run(context.Background())).To(Succeed())
+}
+
+// adoptCluster sets the owner references of the ExternalCluster and
+// ExternalControlPlane, like the Cluster controller of Cluster API does. The
+// Cluster API controllers do not run in the tests.
+func adoptCluster(t *testing.T, g *WithT, namespace string, name string) {
+	t.Helper()
+	ctx := context.Background()
+	cluster := &clusterv1.Cluster{}
+	g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, cluster)).To(Succeed())
+	ownerRef := metav1.OwnerReference{
+		APIVersion: clusterv1.GroupVersion.String(),
+		Kind:       "Cluster",
+		Name:       cluster.Name,
+		UID:        cluster.UID,
+	}
+
+	for _, obj := range []client.Object{&externalinfrav1.ExternalCluster{}, &externalcontrolplanev1.ExternalControlPlane{}} {
+		g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, obj)).To(Succeed())
+		patchBase := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+		obj.SetOwnerReferences([]metav1.OwnerReference{ownerRef})
+		g.Expect(mgmtClient.Patch(ctx, obj, patchBase)).To(Succeed())
+	}
+}
+
+// createNode creates a ready node in the workload cluster that is deleted at
+// the end of the test.
+func createNode(t *testing.T, g *WithT, name string) *corev1.Node {
+	t.Helper()
+	ctx := context.Background()
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{ProviderID: "external://" + name},
+	}
+	node, err := workloadClient.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	t.Cleanup(func() {
+		_ = workloadClient.CoreV1().Nodes().Delete(context.Background(), name, metav1.DeleteOptions{})
+	})
+
+	node.Status = corev1.NodeStatus{
+		Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		Addresses:  []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.1"}},
+		NodeInfo:   corev1.NodeSystemInfo{KubeletVersion: "v1.23.5"},
+	}
+	node, err = workloadClient.CoreV1().Nodes().UpdateStatus(ctx, node, metav1.UpdateOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	return node
+}
+
+// exists returns a function for Eventually that reports whether the object
+// exists in the management cluster.
+func exists(namespace string, name string, obj client.Object) func() (bool, error) {
+	return func() (bool, error) {
+		err := mgmtClient.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: name}, obj)
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+}
@@ -0,0 +1,116 @@
+package integration
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestImport(t *testing.T) {
+	requireEnv(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	namespace := createNamespace(t, g)
+
+	importCluster(t, g, namespace, "workload")
+
+	cluster := &clusterv1.Cluster{}
+	g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, cluster)).To(Succeed())
+	g.Expect(cluster.Spec.InfrastructureRef.Kind).To(Equal("ExternalCluster"))
+	g.Expect(cluster.Spec.ControlPlaneRef.Kind).To(Equal("ExternalControlPlane"))
+
+	externalCluster := &externalinfrav1.ExternalCluster{}
+	g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, externalCluster)).To(Succeed())
+	endpoint := externalCluster.Spec.ControlPlaneEndpoint
+	g.Expect(workloadEnv.Config.Host).To(ContainSubstring(net.JoinHostPort(endpoint.Host, strconv.Itoa(int(endpoint.Port)))))
+	g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, &externalcontrolplanev1.ExternalControlPlane{})).To(Succeed())
+	g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload-kubeconfig"}, &corev1.Secret{})).To(Succeed())
+
+	// Importing the same cluster again skips it.
+	importCluster(t, g, namespace, "workload")
+}
+
+func TestClusterReadiness(t *testing.T) {
+	requireEnv(t)
+	g := NewWithT(t)
+	namespace := createNamespace(t, g)
+	importCluster(t, g, namespace, "workload")
+	adoptCluster(t, g, namespace, "workload")
+
+	g.Eventually(func(g Gomega) {
+		externalCluster := &externalinfrav1.ExternalCluster{}
+		g.Expect(mgmtClient.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: "workload"}, externalCluster)).To(Succeed())
+		g.Expect(externalCluster.Status.Ready).To(BeTrue())
+		g.Expect(conditions.IsTrue(externalCluster, clusterv1.ReadyCondition)).To(BeTrue())
+	}, timeout, interval).Should(Succeed())
+
+	g.Eventually(func(g Gomega) {
+		externalControlPlane := &externalcontrolplanev1.ExternalControlPlane{}
+		g.Expect(mgmtClient.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: "workload"}, externalControlPlane)).To(Succeed())
+		g.Expect(externalControlPlane.Status.Ready).To(BeTrue())
+		g.Expect(externalControlPlane.Status.Initialized).To(BeTrue())
+	}, timeout, interval).Should(Succeed())
+}
+
+func TestNodeSync(t *testing.T) {
+	requireEnv(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	namespace := createNamespace(t, g)
+	importCluster(t, g, namespace, "workload")
+	adoptCluster(t, g, namespace, "workload")
+
+	node := createNode(t, g, "node-sync-1")
+
+	machine := &clusterv1.Machine{}
+	g.Eventually(exists(namespace, node.Name, machine), timeout, interval).Should(BeTrue())
+	g.Expect(machine.Spec.ClusterName).To(Equal("workload"))
+	g.Expect(machine.Spec.ProviderID).To(Equal(&node.Spec.ProviderID))
+	g.Expect(machine.Spec.InfrastructureRef.Kind).To(Equal("ExternalMachine"))
+	externalMachine := &externalinfrav1.ExternalMachine{}
+	g.Eventually(exists(namespace, node.Name, externalMachine), timeout, interval).Should(BeTrue())
+	g.Expect(externalMachine.Spec.ProviderID).To(Equal(node.Spec.ProviderID))
+
+	// The Machines of removed nodes are deleted.
+	g.Expect(workloadClient.CoreV1().Nodes().Delete(ctx, node.Name, metav1.DeleteOptions{})).To(Succeed())
+	g.Eventually(exists(namespace, node.Name, &clusterv1.Machine{}), timeout, interval).Should(BeFalse())
+	g.Eventually(exists(namespace, node.Name, &externalinfrav1.ExternalMachine{}), timeout, interval).Should(BeFalse())
+}
+
+func TestDeletion(t *testing.T) {
+	requireEnv(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	namespace := createNamespace(t, g)
+	projectionNamespace := createNamespace(t, g)
+	importCluster(t, g, namespace, "workload")
+	adoptCluster(t, g, namespace, "workload")
+
+	externalCluster := &externalinfrav1.ExternalCluster{}
+	g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, externalCluster)).To(Succeed())
+	patchBase := client.MergeFrom(externalCluster.DeepCopy())
+	externalCluster.Spec.KubeconfigProjection = &externalinfrav1.KubeconfigProjection{Namespaces: []string{projectionNamespace}}
+	g.Expect(mgmtClient.Patch(ctx, externalCluster, patchBase)).To(Succeed())
+	g.Eventually(exists(projectionNamespace, "workload-kubeconfig", &corev1.Secret{}), timeout, interval).Should(BeTrue())
+
+	// Delete the Cluster, and then the ExternalCluster like the garbage
+	// collector would.
+	cluster := &clusterv1.Cluster{}
+	g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, cluster)).To(Succeed())
+	g.Expect(mgmtClient.Delete(ctx, cluster)).To(Succeed())
+	g.Eventually(exists(namespace, "workload", &clusterv1.Cluster{}), timeout, interval).Should(BeFalse())
+	g.Expect(mgmtClient.Delete(ctx, externalCluster)).To(Succeed())
+
+	g.Eventually(exists(namespace, "workload", &externalinfrav1.ExternalCluster{}), timeout, interval).Should(BeFalse())
+	g.Eventually(exists(projectionNamespace, "workload-kubeconfig", &corev1.Secret{}), timeout, interval).Should(BeFalse())
+}
@@ -0,0 +1,158 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/client-go/rest"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	clusterctlv1 "sigs.k8s.io/cluster-api/cmd/clusterctl/api/v1alpha3"
+	clusterctlcluster "sigs.k8s.io/cluster-api/cmd/clusterctl/client/cluster"
+	clusterctlconfig "sigs.k8s.io/cluster-api/cmd/clusterctl/client/config"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+// TestMove moves an imported cluster to another management cluster with
+// `clusterctl move` and back, and checks that all objects are moved and that
+// the controllers do not recreate any of them.
+func TestMove(t *testing.T) {
+	requireEnv(t)
+	g := NewWithT(t)
+	ctx := context.Background()
+	namespace := createNamespace(t, g)
+	importCluster(t, g, namespace, "workload")
+	adoptCluster(t, g, namespace, "workload")
+	node := createNode(t, g, "node-move-1")
+	g.Eventually(exists(namespace, node.Name, &externalinfrav1.ExternalMachine{}), timeout, interval).Should(BeTrue())
+	markProvisioned(t, g, mgmtClient, namespace, "workload")
+
+	// The controllers do not run in the target cluster.
+	targetEnv := &envtest.Environment{
+		CRDDirectoryPaths:     mgmtEnv.CRDDirectoryPaths,
+		ErrorIfCRDPathMissing: true,
+		Scheme:                scheme,
+	}
+	targetConfig, err := targetEnv.Start()
+	g.Expect(err).NotTo(HaveOccurred())
+	t.Cleanup(func() { _ = targetEnv.Stop() })
+	targetClient, err := client.New(targetConfig, client.Options{Scheme: scheme})
+	g.Expect(err).NotTo(HaveOccurred())
+	targetKubeconfigPath, err := writeAdminKubeconfig(targetEnv, t.TempDir(), "target")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	source := newClusterctlClient(t, g, mgmtEnv.Config, mgmtKubeconfigPath)
+	target := newClusterctlClient(t, g, targetConfig, targetKubeconfigPath)
+
+	g.Expect(source.ObjectMover().Move(namespace, target, false)).To(Succeed())
+	expectMoved(t, g, mgmtClient, targetClient, namespace, node.Name)
+
+	markProvisioned(t, g, targetClient, namespace, "workload")
+	g.Expect(target.ObjectMover().Move(namespace, source, false)).To(Succeed())
+	expectMoved(t, g, targetClient, mgmtClient, namespace, node.Name)
+
+	// The controllers pick up the moved cluster again, without duplicating
+	// the Machines.
+	g.Eventually(func(g Gomega) {
+		externalCluster := &externalinfrav1.ExternalCluster{}
+		g.Expect(mgmtClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, externalCluster)).To(Succeed())
+		g.Expect(conditions.IsTrue(externalCluster, clusterv1.ReadyCondition)).To(BeTrue())
+	}, timeout, interval).Should(Succeed())
+	machines := &clusterv1.MachineList{}
+	g.Expect(mgmtClient.List(ctx, machines, client.InNamespace(namespace))).To(Succeed())
+	g.Expect(machines.Items).To(HaveLen(1))
+}
+
+// newClusterctlClient returns a clusterctl client for the cluster, with the
+// CRDs labelled like `clusterctl init` does.
+func newClusterctlClient(t *testing.T, g *WithT, config *rest.Config, kubeconfigPath string) clusterctlcluster.Client {
+	t.Helper()
+	ctx := context.Background()
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	g.Expect(err).NotTo(HaveOccurred())
+	crds := &apiextensionsv1.CustomResourceDefinitionList{}
+	g.Expect(c.List(ctx, crds)).To(Succeed())
+	for i := range crds.Items {
+		crd := &crds.Items[i]
+		patchBase := client.MergeFrom(crd.DeepCopy())
+		if crd.Labels == nil {
+			crd.Labels = map[string]string{}
+		}
+		crd.Labels[clusterctlv1.ClusterctlLabelName] = ""
+		if crd.Name == "qbertsources."+externalinfrav1.GroupVersion.Group {
+			crd.Labels[clusterctlv1.ClusterctlMoveHierarchyLabelName] = ""
+		}
+		g.Expect(c.Patch(ctx, crd, patchBase)).To(Succeed())
+	}
+
+	configClient, err := clusterctlconfig.New("")
+	g.Expect(err).NotTo(HaveOccurred())
+	clusterctlClient := clusterctlcluster.New(clusterctlcluster.Kubeconfig{Path: kubeconfigPath}, configClient)
+	g.Expect(clusterctlClient.ProviderInventory().EnsureCustomResourceDefinitions()).To(Succeed())
+	return clusterctlClient
+}
+
+// markProvisioned sets the status that `clusterctl move` requires before it
+// moves a cluster. It is set by the Cluster API controllers, which do not run
+// in the tests.
+func markProvisioned(t *testing.T, g *WithT, c client.Client, namespace string, name string) {
+	t.Helper()
+	ctx := context.Background()
+	cluster := &clusterv1.Cluster{}
+	g.Expect(c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, cluster)).To(Succeed())
+	cluster.Status.InfrastructureReady = true
+	cluster.Status.ControlPlaneReady = true
+	conditions.MarkTrue(cluster, clusterv1.ControlPlaneInitializedCondition)
+	g.Expect(c.Status().Update(ctx, cluster)).To(Succeed())
+
+	machines := &clusterv1.MachineList{}
+	g.Expect(c.List(ctx, machines, client.InNamespace(namespace))).To(Succeed())
+	for i := range machines.Items {
+		machine := &machines.Items[i]
+		if machine.Spec.ClusterName != name {
+			continue
+		}
+		machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: machine.Name}
+		g.Expect(c.Status().Update(ctx, machine)).To(Succeed())
+	}
+}
+
+// expectMoved checks that the objects of the imported cluster were moved
+// from one management cluster to the other, with their owner references.
+func expectMoved(t *testing.T, g *WithT, from client.Client, to client.Client, namespace string, nodeName string) {
+	t.Helper()
+	ctx := context.Background()
+	objects := []struct {
+		name string
+		obj  client.Object
+	}{
+		{"workload", &clusterv1.Cluster{}},
+		{"workload", &externalinfrav1.ExternalCluster{}},
+		{"workload", &externalcontrolplanev1.ExternalControlPlane{}},
+		{"workload-kubeconfig", &corev1.Secret{}},
+		{nodeName, &clusterv1.Machine{}},
+		{nodeName, &externalinfrav1.ExternalMachine{}},
+	}
+	for _, o := range objects {
+		key := client.ObjectKey{Namespace: namespace, Name: o.name}
+		g.Expect(to.Get(ctx, key, o.obj)).To(Succeed(), "%T %s was not moved", o.obj, key)
+		g.Expect(from.Get(ctx, key, o.obj.DeepCopyObject().(client.Object))).NotTo(Succeed(), "%T %s was not removed", o.obj, key)
+	}
+
+	cluster := &clusterv1.Cluster{}
+	g.Expect(to.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "workload"}, cluster)).To(Succeed())
+	g.Expect(cluster.Spec.Paused).To(BeFalse())
+	machine := &clusterv1.Machine{}
+	g.Expect(to.Get(ctx, client.ObjectKey{Namespace: namespace, Name: nodeName}, machine)).To(Succeed())
+	g.Expect(util.IsOwnedByObject(machine, cluster)).To(BeTrue())
+	externalMachine := &externalinfrav1.ExternalMachine{}
+	g.Expect(to.Get(ctx, client.ObjectKey{Namespace: namespace, Name: nodeName}, externalMachine)).To(Succeed())
+	g.Expect(util.IsOwnedByObject(externalMachine, machine)).To(BeTrue())
+}
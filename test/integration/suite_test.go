@@ -0,0 +1,234 @@
+// Package integration tests the controllers end-to-end against two envtest
+// API servers: one acting as the management cluster and one acting as the
+// external (workload) cluster that is imported.
+//
+// The tests are skipped unless KUBEBUILDER_ASSETS points to the envtest
+// binaries, which `make test` takes care of. If CAPE_REQUIRE_ENVTEST is set,
+// as in `make test` and CI, missing binaries fail the tests instead.
+package integration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	externalcontrolplanev1 "github.com/platform9-incubator/cluster-api-provider-external/api/controlplane/v1beta1"
+	externalinfrav1 "github.com/platform9-incubator/cluster-api-provider-external/api/infrastructure/v1beta1"
+	"github.com/platform9-incubator/cluster-api-provider-external/controllers"
+	"go.uber.org/zap"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	addonsv1 "sigs.k8s.io/cluster-api/exp/addons/api/v1beta1"
+	expv1 "sigs.k8s.io/cluster-api/exp/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	ctrlzap "sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+const (
+	timeout  = 30 * time.Second
+	interval = 250 * time.Millisecond
+
+	// requireEnvtestEnv is the environment variable that makes the tests
+	// fail if the envtest binaries are missing.
+	requireEnvtestEnv = "CAPE_REQUIRE_ENVTEST"
+)
+
+var (
+	scheme = runtime.NewScheme()
+
+	// mgmtEnv is the management cluster, running the controllers. It is nil
+	// if the envtest binaries are not available.
+	mgmtEnv    *envtest.Environment
+	mgmtClient client.Client
+
+	// mgmtKubeconfigPath is the kubeconfig of the management cluster, for
+	// `cape import`.
+	mgmtKubeconfigPath string
+
+	// workloadEnv is the external cluster that is imported.
+	workloadEnv            *envtest.Environment
+	workloadClient         kubernetes.Interface
+	workloadKubeconfigPath string
+)
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(apiextensionsv1.AddToScheme(scheme))
+	utilruntime.Must(clusterv1.AddToScheme(scheme))
+	utilruntime.Must(expv1.AddToScheme(scheme))
+	utilruntime.Must(addonsv1.AddToScheme(scheme))
+	utilruntime.Must(externalinfrav1.AddToScheme(scheme))
+	utilruntime.Must(externalcontrolplanev1.AddToScheme(scheme))
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		if os.Getenv(requireEnvtestEnv) != "" {
+			fmt.Fprintf(os.Stderr, "KUBEBUILDER_ASSETS is not set, but %s requires the integration tests to run\n", requireEnvtestEnv)
+			os.Exit(1)
+		}
+		fmt.Println("KUBEBUILDER_ASSETS is not set; skipping the integration tests")
+		os.Exit(m.Run())
+	}
+	ctrl.SetLogger(ctrlzap.New(ctrlzap.UseDevMode(true), ctrlzap.WriteTo(os.Stderr)))
+	logger, _ := zap.NewDevelopment()
+	zap.ReplaceGlobals(logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop, err := setup(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up the integration test environment: %v\n", err)
+		cancel()
+		stop()
+		os.Exit(1)
+	}
+	code := m.Run()
+	cancel()
+	stop()
+	os.Exit(code)
+}
+
+// setup starts the management and workload clusters and the controllers. The
+// returned function stops them, also if setup failed halfway.
+func setup(ctx context.Context) (stop func(), err error) {
+	tmpDir, err := os.MkdirTemp("", "cape-integration-")
+	if err != nil {
+		return func() {}, err
+	}
+	var stops []func()
+	stop = func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+		_ = os.RemoveAll(tmpDir)
+	}
+
+	capiCRDs, err := capiCRDPath()
+	if err != nil {
+		return stop, err
+	}
+	mgmtEnv = &envtest.Environment{
+		CRDDirectoryPaths: []string{
+			filepath.Join("..", "..", "config", "crd", "bases"),
+			capiCRDs,
+		},
+		ErrorIfCRDPathMissing: true,
+		Scheme:                scheme,
+	}
+	mgmtConfig, err := mgmtEnv.Start()
+	if err != nil {
+		return stop, fmt.Errorf("failed to start the management cluster: %w", err)
+	}
+	stops = append(stops, func() { _ = mgmtEnv.Stop() })
+	mgmtClient, err = client.New(mgmtConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return stop, err
+	}
+	if mgmtKubeconfigPath, err = writeAdminKubeconfig(mgmtEnv, tmpDir, "mgmt"); err != nil {
+		return stop, err
+	}
+
+	workloadEnv = &envtest.Environment{}
+	workloadConfig, err := workloadEnv.Start()
+	if err != nil {
+		return stop, fmt.Errorf("failed to start the workload cluster: %w", err)
+	}
+	stops = append(stops, func() { _ = workloadEnv.Stop() })
+	if workloadClient, err = kubernetes.NewForConfig(workloadConfig); err != nil {
+		return stop, err
+	}
+	if workloadKubeconfigPath, err = writeAdminKubeconfig(workloadEnv, tmpDir, "workload"); err != nil {
+		return stop, err
+	}
+
+	mgr, err := ctrl.NewManager(mgmtConfig, ctrl.Options{
+		Scheme:             scheme,
+		MetricsBindAddress: "0",
+	})
+	if err != nil {
+		return stop, err
+	}
+	if err := (&controllers.ExternalClusterReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("externalcluster-controller"),
+		// Requeue often, so that changes to the nodes are picked up quickly.
+		InventoryInterval: time.Second,
+
+		KubeconfigProjectionNamespaces: []string{controllers.AllNamespaces},
+	}).SetupWithManager(ctx, mgr); err != nil {
+		return stop, err
+	}
+	if err := (&controllers.ExternalControlPlaneReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("externalcontrolplane-controller"),
+	}).SetupWithManager(ctx, mgr); err != nil {
+		return stop, err
+	}
+	if err := (&controllers.ExternalMachineReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("externalmachine-controller"),
+	}).SetupWithManager(ctx, mgr); err != nil {
+		return stop, err
+	}
+
+	mgrCtx, cancelMgr := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := mgr.Start(mgrCtx); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to run the manager: %v\n", err)
+		}
+	}()
+	stops = append(stops, func() {
+		cancelMgr()
+		<-done
+	})
+	return stop, nil
+}
+
+// writeAdminKubeconfig writes a kubeconfig with cluster-admin access to the
+// envtest API server, and returns its path.
+func writeAdminKubeconfig(env *envtest.Environment, dir string, name string) (string, error) {
+	user, err := env.AddUser(envtest.User{Name: name + "-admin", Groups: []string{"system:masters"}}, nil)
+	if err != nil {
+		return "", err
+	}
+	kubeconfig, err := user.KubeConfig()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name+".kubeconfig")
+	return path, os.WriteFile(path, kubeconfig, 0600)
+}
+
+// capiCRDPath returns the directory with the CRDs of the Cluster API version
+// in go.mod.
+func capiCRDPath() (string, error) {
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "sigs.k8s.io/cluster-api").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate the cluster-api module: %w", err)
+	}
+	return filepath.Join(strings.TrimSpace(string(out)), "config", "crd", "bases"), nil
+}
+
+// requireEnv skips the test if the envtest binaries are not available.
+func requireEnv(t *testing.T) {
+	t.Helper()
+	if mgmtEnv == nil {
+		t.Skip("KUBEBUILDER_ASSETS is not set")
+	}
+}